@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Alert levels, from the value's position against its type's thresholds.
+const (
+	alertWarning  = "warning"
+	alertCritical = "critical"
+)
+
+// AlertThresholds are the limits beyond which a sensor type's readings
+// raise an alert: warning outside the warning band, critical outside the
+// critical band, which contains it.
+type AlertThresholds struct {
+	Warning  AlertBand `json:"warning"`
+	Critical AlertBand `json:"critical"`
+}
+
+// AlertBand is a range of acceptable values. A missing limit leaves that
+// side unbounded.
+type AlertBand struct {
+	Low  *float64 `json:"low,omitempty"`
+	High *float64 `json:"high,omitempty"`
+}
+
+// contains reports whether v is within the band.
+func (b AlertBand) contains(v float64) bool {
+	return (b.Low == nil || v >= *b.Low) && (b.High == nil || v <= *b.High)
+}
+
+func (b AlertBand) validate() error {
+	if b.Low != nil && b.High != nil && *b.Low > *b.High {
+		return fmt.Errorf("low %g is above high %g", *b.Low, *b.High)
+	}
+	return nil
+}
+
+// level returns the alert level of v, or "" for none. NaN raises no
+// alert: it is no measurement at all.
+func (t *AlertThresholds) level(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return ""
+	case !t.Critical.contains(v):
+		return alertCritical
+	case !t.Warning.contains(v):
+		return alertWarning
+	}
+	return ""
+}
+
+func (t *AlertThresholds) validate() error {
+	if err := t.Warning.validate(); err != nil {
+		return fmt.Errorf("warning: %w", err)
+	}
+	if err := t.Critical.validate(); err != nil {
+		return fmt.Errorf("critical: %w", err)
+	}
+	w, c := t.Warning, t.Critical
+	if c.Low != nil && (w.Low == nil || *w.Low < *c.Low) || c.High != nil && (w.High == nil || *w.High > *c.High) {
+		return fmt.Errorf("the warning band must lie within the critical band")
+	}
+	return nil
+}
+
+// limit returns a pointer to v, for band literals.
+func limit(v float64) *float64 { return &v }
+
+// defaultAlerts are the thresholds of types the configuration file does
+// not cover: critical beyond the instrument range, warning in the last
+// tenth of it. Only pressure, temperature and heating value alert on low
+// values, and a valve only alerts when it reports a position outside
+// 0-100%. Tank levels alert at the usual high and high-high heights over
+// the safe fill, and a floating roof warns when it has landed on its legs.
+// At a pump station, a stopped pump warns through its speed and discharge
+// pressure. A pipe-to-soil potential warns outside the usual protection
+// criteria: less negative than -850 mV or more negative than -1200 mV,
+// where coatings start to disbond.
+var defaultAlerts = map[string]AlertThresholds{
+	"pressure":            {AlertBand{limit(330), limit(1370)}, AlertBand{limit(200), limit(1500)}},
+	"temperature":         {AlertBand{limit(0), limit(160)}, AlertBand{limit(-20), limit(180)}},
+	"flow_rate":           {AlertBand{High: limit(45000)}, AlertBand{High: limit(50000)}},
+	"vibration":           {AlertBand{High: limit(22.5)}, AlertBand{High: limit(25)}},
+	"corrosion":           {AlertBand{High: limit(45)}, AlertBand{High: limit(50)}},
+	"humidity":            {AlertBand{High: limit(90)}, AlertBand{High: limit(100)}},
+	"gas_detector":        {AlertBand{High: limit(900)}, AlertBand{High: limit(1000)}},
+	"valve_position":      {AlertBand{limit(0), limit(100)}, AlertBand{limit(0), limit(100)}},
+	"chromatograph":       {AlertBand{limit(1010), limit(1090)}, AlertBand{limit(1000), limit(1100)}},
+	"tank_level":          {AlertBand{High: limit(45)}, AlertBand{High: limit(46.5)}},
+	"tank_temperature":    {AlertBand{High: limit(120)}, AlertBand{High: limit(130)}},
+	"roof_position":       {AlertBand{limit(roofLegs + 0.5), limit(45)}, AlertBand{High: limit(tankHeight)}},
+	"pipe_to_soil":        {AlertBand{limit(-1200), limit(-850)}, AlertBand{limit(-1500), limit(-700)}},
+	"rectifier_current":   {AlertBand{High: limit(45)}, AlertBand{High: limit(50)}},
+	"suction_pressure":    {AlertBand{limit(50), limit(540)}, AlertBand{limit(0), limit(600)}},
+	"discharge_pressure":  {AlertBand{limit(400), limit(1350)}, AlertBand{limit(0), limit(1500)}},
+	"pump_speed":          {AlertBand{limit(1800), limit(3600)}, AlertBand{limit(0), limit(3600)}},
+	"motor_current":       {AlertBand{High: limit(360)}, AlertBand{High: limit(400)}},
+	"bearing_temperature": {AlertBand{High: limit(200)}, AlertBand{High: limit(250)}},
+}
+
+// alertsByType resolves per-type thresholds, falling back to the "*" entry
+// and then the defaults, into a slice indexed like sensorTypes.
+func alertsByType(thresholds map[string]AlertThresholds) []AlertThresholds {
+	out := make([]AlertThresholds, len(sensorTypes))
+	for i, st := range sensorTypes {
+		t, ok := thresholds[st.Type]
+		if !ok {
+			t, ok = thresholds["*"]
+		}
+		if !ok {
+			t = defaultAlerts[st.Type]
+		}
+		out[i] = t
+	}
+	return out
+}
+
+// Rederive derives a reading's alert level again from its value, for a
+// reading given a new value after it was generated. The value is in the
+// run's output units.
+func (g *Generator) Rederive(r *SensorReading) {
+	typ := sensorTypeIndex(r.Type)
+	if typ < 0 {
+		return
+	}
+	v := r.Value
+	if c, ok := unitOf(typ, r.Unit); ok {
+		v = (v - c.offset) / c.scale
+	}
+	r.AlertLevel = g.alerts[typ].level(v)
+}
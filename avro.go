@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+)
+
+// avroBlockSize is the encoded size at which an Avro block is written.
+const avroBlockSize = 1 << 20
+
+// avroTable writes readings as an Avro object container file: a header
+// carrying the schema, then blocks of records, each deflated when
+// compressing and followed by the file's sync marker.
+type avroTable struct {
+	w        io.Writer
+	cols     []column
+	compress bool
+	sync     [16]byte
+	block    []byte
+	count    int
+	zbuf     bytes.Buffer
+	zw       *flate.Writer
+}
+
+func newAvroTable(w io.Writer, cols []column, compress bool) (*avroTable, error) {
+	t := &avroTable{w: w, cols: cols, compress: compress}
+	rand.Read(t.sync[:])
+	codec := "null"
+	if compress {
+		codec = "deflate"
+		t.zw, _ = flate.NewWriter(&t.zbuf, flate.DefaultCompression)
+	}
+	schema, err := avroSchema(cols)
+	if err != nil {
+		return nil, err
+	}
+	hdr := []byte("Obj\x01")
+	hdr = binary.AppendVarint(hdr, 2) // one block of two metadata entries
+	hdr = avroString(hdr, "avro.schema")
+	hdr = avroString(hdr, string(schema))
+	hdr = avroString(hdr, "avro.codec")
+	hdr = avroString(hdr, codec)
+	hdr = binary.AppendVarint(hdr, 0)
+	hdr = append(hdr, t.sync[:]...)
+	_, err = w.Write(hdr)
+	return t, err
+}
+
+// avroSchema returns the record schema for cols. Optional columns are
+// unions with null and timestamps are longs of microseconds.
+func avroSchema(cols []column) ([]byte, error) {
+	type field struct {
+		Name    string          `json:"name"`
+		Type    any             `json:"type"`
+		Default json.RawMessage `json:"default,omitempty"`
+	}
+	fields := make([]field, len(cols))
+	for i, c := range cols {
+		var typ any
+		switch c.kind {
+		case colString:
+			typ = "string"
+		case colDouble:
+			typ = "double"
+		case colInt64:
+			typ = "long"
+		case colBool:
+			typ = "boolean"
+		case colTimestamp:
+			typ = map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+		}
+		fields[i] = field{Name: c.name, Type: typ}
+		if c.optional {
+			fields[i].Type = []any{"null", typ}
+			fields[i].Default = json.RawMessage("null")
+		}
+	}
+	return json.Marshal(map[string]any{
+		"type":      "record",
+		"name":      "SensorReading",
+		"namespace": "sensorgen",
+		"fields":    fields,
+	})
+}
+
+func (t *avroTable) Write(r *convRow) error {
+	for _, c := range t.cols {
+		v := c.value(r)
+		if c.optional {
+			if v == nil {
+				t.block = binary.AppendVarint(t.block, 0)
+				continue
+			}
+			t.block = binary.AppendVarint(t.block, 1)
+		}
+		switch v := v.(type) {
+		case string:
+			t.block = avroString(t.block, v)
+		case float64:
+			t.block = binary.LittleEndian.AppendUint64(t.block, math.Float64bits(v))
+		case int64:
+			t.block = binary.AppendVarint(t.block, v)
+		case bool:
+			b := byte(0)
+			if v {
+				b = 1
+			}
+			t.block = append(t.block, b)
+		case time.Time:
+			t.block = binary.AppendVarint(t.block, v.UnixMicro())
+		}
+	}
+	t.count++
+	if len(t.block) >= avroBlockSize {
+		return t.flush()
+	}
+	return nil
+}
+
+// flush writes the records encoded so far as a block.
+func (t *avroTable) flush() error {
+	if t.count == 0 {
+		return nil
+	}
+	data := t.block
+	if t.compress {
+		t.zbuf.Reset()
+		t.zw.Reset(&t.zbuf)
+		t.zw.Write(data)
+		if err := t.zw.Close(); err != nil {
+			return err
+		}
+		data = t.zbuf.Bytes()
+	}
+	hdr := binary.AppendVarint(nil, int64(t.count))
+	hdr = binary.AppendVarint(hdr, int64(len(data)))
+	for _, b := range [][]byte{hdr, data, t.sync[:]} {
+		if _, err := t.w.Write(b); err != nil {
+			return err
+		}
+	}
+	t.block, t.count = t.block[:0], 0
+	return nil
+}
+
+func (t *avroTable) Close() error {
+	return t.flush()
+}
+
+// avroString appends s in Avro's encoding: its length as a zig-zag
+// varint, then its bytes. (encoding/binary's varints are zig-zag too.)
+func avroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
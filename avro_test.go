@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// avroReader decodes an Avro object container file written for cols,
+// following the specification rather than avroTable.
+type avroReader struct {
+	b    []byte
+	cols []column
+}
+
+func (d *avroReader) long() (int64, error) {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		return 0, errors.New("bad varint")
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *avroReader) bytes() ([]byte, error) {
+	n, err := d.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(len(d.b)) {
+		return nil, errors.New("bad length")
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// header reads the magic and metadata and returns the schema, codec and
+// sync marker.
+func (d *avroReader) header() (schema []byte, codec string, sync []byte, err error) {
+	if !bytes.HasPrefix(d.b, []byte("Obj\x01")) {
+		return nil, "", nil, errors.New("bad magic")
+	}
+	d.b = d.b[4:]
+	meta := make(map[string][]byte)
+	for {
+		n, err := d.long()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 { // a negative count is followed by the block's size
+			n = -n
+			if _, err := d.long(); err != nil {
+				return nil, "", nil, err
+			}
+		}
+		for range n {
+			k, err := d.bytes()
+			if err != nil {
+				return nil, "", nil, err
+			}
+			v, err := d.bytes()
+			if err != nil {
+				return nil, "", nil, err
+			}
+			meta[string(k)] = v
+		}
+	}
+	if len(d.b) < 16 {
+		return nil, "", nil, errors.New("short sync marker")
+	}
+	sync, d.b = d.b[:16], d.b[16:]
+	codec = string(meta["avro.codec"])
+	if codec == "" {
+		codec = "null"
+	}
+	return meta["avro.schema"], codec, sync, nil
+}
+
+func (d *avroReader) row() ([]any, error) {
+	row := make([]any, len(d.cols))
+	for i, c := range d.cols {
+		if c.optional {
+			branch, err := d.long()
+			if err != nil {
+				return nil, err
+			}
+			if branch == 0 {
+				continue
+			}
+		}
+		switch c.kind {
+		case colString:
+			v, err := d.bytes()
+			if err != nil {
+				return nil, err
+			}
+			row[i] = string(v)
+		case colDouble:
+			if len(d.b) < 8 {
+				return nil, errors.New("short double")
+			}
+			row[i] = math.Float64frombits(binary.LittleEndian.Uint64(d.b))
+			d.b = d.b[8:]
+		case colInt64, colTimestamp:
+			v, err := d.long()
+			if err != nil {
+				return nil, err
+			}
+			row[i] = v
+			if c.kind == colTimestamp {
+				row[i] = time.UnixMicro(v)
+			}
+		case colBool:
+			if len(d.b) < 1 || d.b[0] > 1 {
+				return nil, errors.New("bad boolean")
+			}
+			row[i] = d.b[0] == 1
+			d.b = d.b[1:]
+		}
+	}
+	return row, nil
+}
+
+// readAvro decodes every record of an Avro file written for cols.
+func readAvro(data []byte, cols []column) ([][]any, error) {
+	d := &avroReader{b: data, cols: cols}
+	schema, codec, sync, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+	var s struct {
+		Fields []struct{ Name string }
+	}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	if len(s.Fields) != len(cols) {
+		return nil, fmt.Errorf("schema has %d fields, want %d", len(s.Fields), len(cols))
+	}
+	for i, f := range s.Fields {
+		if f.Name != cols[i].name {
+			return nil, fmt.Errorf("schema field %d is %q, want %q", i, f.Name, cols[i].name)
+		}
+	}
+	var rows [][]any
+	for len(d.b) > 0 {
+		count, err := d.long()
+		if err != nil {
+			return nil, err
+		}
+		block, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(d.b) < 16 || !bytes.Equal(d.b[:16], sync) {
+			return nil, errors.New("bad sync marker after block")
+		}
+		d.b = d.b[16:]
+		switch codec {
+		case "deflate":
+			if block, err = io.ReadAll(flate.NewReader(bytes.NewReader(block))); err != nil {
+				return nil, err
+			}
+		case "null":
+		default:
+			return nil, fmt.Errorf("unknown codec %q", codec)
+		}
+		bd := &avroReader{b: block, cols: cols}
+		for range count {
+			row, err := bd.row()
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		}
+		if len(bd.b) != 0 {
+			return nil, fmt.Errorf("%d bytes left over in block", len(bd.b))
+		}
+	}
+	return rows, nil
+}
+
+func TestAvroWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		compress bool
+	}{
+		{"empty", 0, false},
+		{"plain", 2000, false},
+		{"deflate", 2000, true},
+		{"several blocks", 20000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings := testReadings(t, tt.n)
+			var buf bytes.Buffer
+			table, err := newAvroTable(&buf, readingColumns, tt.compress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTable(t, table, readings)
+			rows, err := readAvro(buf.Bytes(), readingColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRows(t, readingColumns, readings, rows)
+			got := make([]SensorReading, len(rows))
+			for i, row := range rows {
+				got[i] = *rowReading(readingColumns, row)
+			}
+			checkReadBack(t, readings, got)
+		})
+	}
+}
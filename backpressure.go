@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"unsafe"
+)
+
+// Backpressure policies: what generation does when a sink falls behind,
+// with both of its batch buffers queued or being written.
+const (
+	backpressureSlow   = "slow"   // wait for the sink, slowing generation to its pace
+	backpressureBuffer = "buffer" // queue further batches in memory up to a limit, then wait
+	backpressureDrop   = "drop"   // leave the sink out of the batch, counting its records as shed
+)
+
+// bufferBatches is the most batches a sink queues with backpressureBuffer,
+// whatever their size: at 10ms's worth of samples a batch, minutes of
+// generation.
+const bufferBatches = 16384
+
+// backpressure is how the writers keep up with sinks slower than
+// generation. The zero value slows generation.
+type backpressure struct {
+	policy string
+	limit  int64 // bytes each sink may queue with backpressureBuffer
+}
+
+// backpressureFlags defines the backpressure flags on fs. The returned
+// function builds and checks the policy once fs is parsed.
+func backpressureFlags(fs *flag.FlagSet) func() (backpressure, error) {
+	policy := fs.String("backpressure", backpressureSlow, "When a sink falls behind: slow (generation waits for it), buffer (queue batches in memory up to -buffer-size, then wait) or drop (shed batches it has no room for, counted in the final stats)")
+	limit := fs.String("buffer-size", "256MB", "Memory each sink may queue with -backpressure buffer, e.g. 1GB")
+
+	return func() (backpressure, error) {
+		b := backpressure{policy: *policy}
+		switch b.policy {
+		case backpressureSlow, backpressureDrop:
+		case backpressureBuffer:
+			var err error
+			if b.limit, err = parseBytes(*limit); err != nil {
+				return b, fmt.Errorf("-buffer-size: %w", err)
+			}
+			if b.limit <= 0 {
+				return b, errors.New("-buffer-size must be positive")
+			}
+		default:
+			return b, fmt.Errorf("-backpressure: unknown policy %q (want %s, %s or %s)", b.policy, backpressureSlow, backpressureBuffer, backpressureDrop)
+		}
+		return b, nil
+	}
+}
+
+// recordOverhead approximates the memory a queued record takes besides
+// its encoding: the record itself and the reading it points to.
+const recordOverhead = int64(unsafe.Sizeof(Record{}) + unsafe.Sizeof(SensorReading{}))
+
+// batchMemory estimates the memory a queued batch holds on to.
+func batchMemory(batch []Record) int64 {
+	n := int64(len(batch)) * recordOverhead
+	for i := range batch {
+		n += int64(len(batch[i].Data))
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateValue is the -rate flag: readings per second, or a bandwidth such
+// as 50MB/s that the run turns into a reading rate once it knows how large
+// its records are.
+type rateValue struct {
+	n         *int
+	bandwidth int64  // bytes per second, or 0 for a reading rate
+	spec      string // the bandwidth as given
+}
+
+func (v *rateValue) String() string {
+	if v.n == nil {
+		return ""
+	}
+	if v.bandwidth > 0 {
+		return v.spec
+	}
+	return strconv.Itoa(*v.n)
+}
+
+func (v *rateValue) Set(s string) error {
+	if size, ok := strings.CutSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"); ok {
+		b, err := parseBytes(size)
+		if err != nil || b <= 0 {
+			return fmt.Errorf("invalid bandwidth %q", s)
+		}
+		v.bandwidth, v.spec = b, s
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	*v.n, v.bandwidth = n, 0
+	return nil
+}
+
+// The run's encoding is measured on bandwidthProbe samples spread over
+// five minutes, long enough for gateways to transmit and report by
+// exception to settle.
+const (
+	bandwidthProbe     = 10000
+	bandwidthProbeRate = bandwidthProbe / 300
+)
+
+// sampleSize returns the average bytes per sample the run's records take
+// once encoded by enc, measured on a generator of its own built from cfg,
+// so the run's readings do not change. Samples suppressed by report by
+// exception count as nothing; late and duplicate readings add theirs.
+func sampleSize(cfg GeneratorConfig, start time.Time, enc func(readings []SensorReading) int64) float64 {
+	cfg.Clock = newNominalClock(start, bandwidthProbeRate).next
+	gen := NewGenerator(cfg)
+	total := enc(gen.GenerateBatch(bandwidthProbe))
+	return float64(total) / float64(gen.Samples())
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// benchStageTime is how long each -bench stage runs without -d.
+const benchStageTime = 5 * time.Second
+
+// benchConfig is what -bench measures: the run's generator and encoding,
+// and the sinks it would write to.
+type benchConfig struct {
+	gen        *Generator
+	batch      int              // samples per batch, as a live run at -rate takes them
+	stageTime  time.Duration    // how long each stage runs
+	malform    *malformer       // nil without -malformed
+	timestamps *timestampFormat // nil for RFC 3339 at full precision
+	fields     *fieldMapper     // nil without fields in -config
+	pad        *padder          // nil without -pad-to
+	ce         *ceWrapper       // nil without -cloudevents
+	sinks      []string         // -sink URLs; the -o file when empty
+	outputFile string
+	appendMode bool
+	layout     fileLayout
+}
+
+// benchStage is one measurement: generation alone, generation and an
+// encoder, or generation, JSONL encoding and a sink.
+type benchStage struct {
+	name   string
+	step   func(ctx context.Context) (int64, error) // takes and handles a batch, returning the records it made
+	finish func(ctx context.Context) error          // flushes and closes
+	bytes  func() int64                             // encoded bytes; nil when nothing is encoded
+	errs   *errorBudget                             // sink stages only
+}
+
+// runBench implements -bench: it generates as fast as it can through each
+// stage in turn, for the same time each, and reports the records and
+// megabytes per second each sustains. The slowest stage is the ceiling of
+// a live run with the same flags.
+func runBench(c benchConfig) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	none := func(context.Context) error { return nil }
+	stages := []benchStage{{
+		name:   "generate",
+		step:   func(context.Context) (int64, error) { return int64(len(c.gen.GenerateBatch(c.batch))), nil },
+		finish: none,
+	}}
+	jsonl := "jsonl"
+	if c.ce != nil {
+		jsonl += "+cloudevents"
+	}
+	var encoded int64
+	stages = append(stages, benchStage{
+		name: jsonl,
+		step: func(context.Context) (int64, error) {
+			records := c.encode(c.gen.GenerateBatch(c.batch))
+			for _, rec := range records {
+				encoded += int64(len(rec.Data) + 1)
+			}
+			return int64(len(records)), nil
+		},
+		finish: none,
+		bytes:  func() int64 { return encoded },
+	})
+	for _, format := range []string{formatCSV, formatAvro, formatParquet} {
+		stages = append(stages, c.tableStage(format))
+	}
+	sinks, names, err := openSinks(c.sinks, c.outputFile, c.appendMode, c.layout, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	stages = append(stages, c.sinkStage("null sink", nullSink{}))
+	for i, sink := range sinks {
+		stages = append(stages, c.sinkStage("sink "+names[i], sink))
+	}
+
+	fmt.Printf("Benchmarking %d stages for %v each, unthrottled, in batches of %d...\n\n", len(stages), c.stageTime, c.batch)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Stage\tRecords\tRecords/sec\tMB/sec\tErrors\t")
+	var slowest string
+	var slowestRate float64
+	failed := false
+	for i, s := range stages {
+		if ctx.Err() != nil {
+			s.finish(context.Background()) // closes the sinks of stages skipped
+			continue
+		}
+		records, elapsed, err := s.run(ctx, c.stageTime)
+		if err != nil {
+			tw.Flush()
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", s.name, err)
+			for _, rest := range stages[i+1:] {
+				rest.finish(context.Background())
+			}
+			return 1
+		}
+		rate := float64(records) / elapsed.Seconds()
+		mb, errCount := "-", "-"
+		if s.bytes != nil {
+			mb = fmt.Sprintf("%.1f", float64(s.bytes())/(1<<20)/elapsed.Seconds())
+		}
+		if s.errs != nil {
+			errCount = fmt.Sprint(s.errs.Total())
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%s\t%s\t\n", s.name, records, rate, mb, errCount)
+		if s.errs != nil && s.errs.Total() > 0 {
+			failed = true // a failing sink's rate says nothing about its ceiling
+			continue
+		}
+		if slowest == "" || rate < slowestRate {
+			slowest, slowestRate = s.name, rate
+		}
+	}
+	tw.Flush()
+	if ctx.Err() != nil {
+		fmt.Println("\nInterrupted; stages not yet run were skipped.")
+		return 0
+	}
+	fmt.Println()
+	fmt.Println("Encoder stages include generation; sink stages include generation and the run's encoding.")
+	if failed {
+		fmt.Println("Sinks with errors are left out of the comparison.")
+	}
+	fmt.Printf("Slowest stage: %s at %.0f records/sec.\n", slowest, slowestRate)
+	return 0
+}
+
+// run steps s until d has passed or ctx is done, then finishes it within
+// the default drain timeout, returning the records made and the time
+// taken including the finish.
+func (s benchStage) run(ctx context.Context, d time.Duration) (int64, time.Duration, error) {
+	var records int64
+	start := time.Now()
+	for time.Since(start) < d && ctx.Err() == nil {
+		n, err := s.step(ctx)
+		if err != nil {
+			return records, time.Since(start), err
+		}
+		records += n
+	}
+	finishCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.finish(finishCtx)
+	return records, time.Since(start), err
+}
+
+// encode encodes readings as a live run does: JSONL with
+// -ts-format timestamps, reshaped by the configured field mapping, padded
+// to -pad-to, corrupted with -malformed and wrapped with -cloudevents.
+func (c benchConfig) encode(readings []SensorReading) []Record {
+	records := make([]Record, 0, len(readings))
+	for i := range readings {
+		data, err := c.timestamps.marshal(&readings[i])
+		if err != nil {
+			continue
+		}
+		data = c.pad.apply(c.fields.apply(data, &readings[i]))
+		if c.malform != nil {
+			data = c.malform.apply(data, c.fields)
+		}
+		records = append(records, Record{Reading: &readings[i], Data: data})
+		if c.ce != nil {
+			c.ce.wrap(&records[len(records)-1])
+		}
+	}
+	return records
+}
+
+// tableStage measures generation with a convert encoder, writing to a
+// byte counter.
+func (c benchConfig) tableStage(format string) benchStage {
+	cw := &countingWriter{}
+	var table tableWriter
+	return benchStage{
+		name: format,
+		step: func(context.Context) (int64, error) {
+			if table == nil {
+				var err error
+				switch format {
+				case formatCSV:
+					table, err = newCSVTable(cw, readingColumns)
+				case formatAvro:
+					table, err = newAvroTable(cw, readingColumns, true)
+				case formatParquet:
+					table, err = newParquetTable(cw, readingColumns, true, 100000)
+				}
+				if err != nil {
+					return 0, err
+				}
+			}
+			var n int64
+			for _, r := range c.gen.GenerateBatch(c.batch) {
+				row, err := newConvRow(&r)
+				if err != nil {
+					continue
+				}
+				if err := table.Write(row); err != nil {
+					return n, err
+				}
+				n++
+			}
+			return n, nil
+		},
+		finish: func(context.Context) error {
+			if table == nil {
+				return nil
+			}
+			return table.Close()
+		},
+		bytes: func() int64 { return cw.n },
+	}
+}
+
+// sinkStage measures generation and encoding written to sink, through
+// the double-buffered writer of a live run. The sink is closed, with its
+// queue drained, when the stage ends.
+func (c benchConfig) sinkStage(name string, sink Sink) benchStage {
+	errs := newErrorBudget(-1)
+	var out *fanOut
+	var written int64
+	return benchStage{
+		name: name,
+		step: func(ctx context.Context) (int64, error) {
+			if out == nil {
+				out = newFanOut([]Sink{sink}, []string{name}, errs, sinkRetry{}, backpressure{})
+			}
+			records := c.encode(c.gen.GenerateBatch(c.batch))
+			if err := out.Write(ctx, records); err != nil && ctx.Err() == nil {
+				return 0, err
+			}
+			for _, rec := range records {
+				written += int64(len(rec.Data) + 1)
+			}
+			return int64(len(records)), nil
+		},
+		finish: func(ctx context.Context) error {
+			if out == nil {
+				return sink.Close(ctx)
+			}
+			out.Close(ctx) // failures are counted in errs
+			return nil
+		},
+		bytes: func() int64 { return written },
+		errs:  errs,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Sink health states, as /debug/vars, the dashboard and the final stats
+// report them.
+const (
+	sinkOK       = "ok"        // no write has failed for a window
+	sinkFailing  = "failing"   // writes failed within the window; the breaker, if any, is closed
+	sinkOpen     = "open"      // the breaker is open: batches are not attempted
+	sinkHalfOpen = "half-open" // the breaker lets one batch through to probe for recovery
+)
+
+// breaker is a sink's circuit breaker. Once threshold writes, retries
+// included, have failed within a window, it opens: the writer stops
+// sending the sink batches and settles them by the failure policy at
+// once, so a dead sink neither holds up generation nor fills the error
+// budget. Every probe interval it half-opens to let one batch through; if
+// that is written the breaker closes, otherwise it opens again. With a
+// threshold of 0 it never opens and only tracks the sink's health.
+//
+// Failures are counted over a window rather than in a row because sinks
+// that batch internally fail only on the writes that flush, and succeed on
+// those in between without having sent anything. For the same reason a
+// failing sink counts as ok again only once a write succeeds a window
+// after the last failure. It is safe for concurrent use.
+type breaker struct {
+	threshold int
+	window    time.Duration
+	probe     time.Duration
+
+	mu       sync.Mutex
+	state    string
+	since    time.Time   // of the state
+	next     time.Time   // of the next probe, while open
+	recent   []time.Time // of the latest failures, up to threshold
+	failures int         // failed writes since the sink was last ok
+	lastFail time.Time
+	lastErr  error
+	trips    int64
+}
+
+// Outcomes of a write, as breaker.record sees them.
+const (
+	breakerSteady    = iota
+	breakerFailing   // the sink started failing
+	breakerTripped   // the breaker opened
+	breakerRecovered // the sink is ok again
+)
+
+func newBreaker(threshold int, window, probe time.Duration) *breaker {
+	return &breaker{threshold: threshold, window: window, probe: probe, state: sinkOK, since: time.Now()}
+}
+
+// allow reports whether the next batch may be written, and whether it is a
+// probe, which must not be retried.
+func (b *breaker) allow(now time.Time) (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case sinkOpen:
+		if now.Before(b.next) {
+			return false, false
+		}
+		b.state, b.since = sinkHalfOpen, now
+		return true, true
+	case sinkHalfOpen:
+		return true, true
+	}
+	return true, false
+}
+
+// closed reports whether a failed batch may be retried.
+func (b *breaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == sinkOK || b.state == sinkFailing
+}
+
+// record notes the outcome of a write.
+func (b *breaker) record(err error, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state == sinkHalfOpen || b.state == sinkFailing && now.Sub(b.lastFail) >= b.window {
+			b.state, b.since = sinkOK, now
+			b.failures, b.recent = 0, b.recent[:0]
+			return breakerRecovered
+		}
+		return breakerSteady
+	}
+	b.failures++
+	b.lastFail, b.lastErr = now, err
+	if b.threshold > 0 {
+		if len(b.recent) == b.threshold {
+			b.recent = append(b.recent[:0], b.recent[1:]...)
+		}
+		b.recent = append(b.recent, now)
+	}
+	switch {
+	case b.state == sinkHalfOpen:
+		b.state, b.since, b.next = sinkOpen, now, now.Add(b.probe)
+	case b.threshold > 0 && len(b.recent) == b.threshold && now.Sub(b.recent[0]) <= b.window:
+		b.state, b.since, b.next = sinkOpen, now, now.Add(b.probe)
+		b.trips++
+		return breakerTripped
+	case b.state == sinkOK:
+		b.state, b.since = sinkFailing, now
+		return breakerFailing
+	}
+	return breakerSteady
+}
+
+// sinkHealth is a snapshot of a sink's breaker.
+type sinkHealth struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Failures  int       `json:"failures,omitempty"` // failed writes since the sink was last ok
+	Trips     int64     `json:"breaker_trips,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (b *breaker) health() sinkHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := sinkHealth{State: b.state, Since: b.since, Failures: b.failures, Trips: b.trips}
+	if b.lastErr != nil {
+		h.LastError = b.lastErr.Error()
+	}
+	return h
+}
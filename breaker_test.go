@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	errDown := errors.New("down")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	// A step writes at start+at, failing with err unless it is nil, or with
+	// allow only asks whether a write may go ahead.
+	type step struct {
+		at      time.Duration
+		allow   bool
+		err     error
+		outcome int    // of record
+		ok      bool   // of allow
+		probe   bool   // of allow
+		state   string // afterwards
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+		trips     int64
+	}{
+		{
+			name:      "trips within the window",
+			threshold: 3,
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerFailing, state: sinkFailing},
+				{at: time.Second, err: errDown, outcome: breakerSteady, state: sinkFailing},
+				{at: 2 * time.Second, err: errDown, outcome: breakerTripped, state: sinkOpen},
+				{at: 3 * time.Second, allow: true, ok: false, state: sinkOpen},
+			},
+			trips: 1,
+		},
+		{
+			name:      "failures spread beyond the window",
+			threshold: 2,
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerFailing, state: sinkFailing},
+				{at: 2 * time.Minute, err: errDown, outcome: breakerSteady, state: sinkFailing},
+				{at: 4 * time.Minute, err: errDown, outcome: breakerSteady, state: sinkFailing},
+			},
+		},
+		{
+			name:      "probe closes",
+			threshold: 1,
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerTripped, state: sinkOpen},
+				{at: 29 * time.Second, allow: true, ok: false, state: sinkOpen},
+				{at: 30 * time.Second, allow: true, ok: true, probe: true, state: sinkHalfOpen},
+				{at: 30 * time.Second, outcome: breakerRecovered, state: sinkOK},
+				{at: 31 * time.Second, allow: true, ok: true, state: sinkOK},
+			},
+			trips: 1,
+		},
+		{
+			name:      "failed probe opens again",
+			threshold: 1,
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerTripped, state: sinkOpen},
+				{at: 30 * time.Second, allow: true, ok: true, probe: true, state: sinkHalfOpen},
+				{at: 30 * time.Second, err: errDown, outcome: breakerSteady, state: sinkOpen},
+				{at: 59 * time.Second, allow: true, ok: false, state: sinkOpen},
+				{at: 60 * time.Second, allow: true, ok: true, probe: true, state: sinkHalfOpen},
+			},
+			trips: 1,
+		},
+		{
+			name: "ok a window after the last failure",
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerFailing, state: sinkFailing},
+				{at: 30 * time.Second, outcome: breakerSteady, state: sinkFailing},
+				{at: time.Minute, outcome: breakerRecovered, state: sinkOK},
+			},
+		},
+		{
+			name: "no threshold never opens",
+			steps: []step{
+				{at: 0, err: errDown, outcome: breakerFailing, state: sinkFailing},
+				{at: time.Millisecond, err: errDown, outcome: breakerSteady, state: sinkFailing},
+				{at: 2 * time.Millisecond, err: errDown, outcome: breakerSteady, state: sinkFailing},
+				{at: 3 * time.Millisecond, allow: true, ok: true, state: sinkFailing},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(tt.threshold, time.Minute, 30*time.Second)
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				if s.allow {
+					if ok, probe := b.allow(now); ok != s.ok || probe != s.probe {
+						t.Errorf("step %d: allow = %v, %v; want %v, %v", i, ok, probe, s.ok, s.probe)
+					}
+				} else if got := b.record(s.err, now); got != s.outcome {
+					t.Errorf("step %d: record = %d, want %d", i, got, s.outcome)
+				}
+				if got := b.health().State; got != s.state {
+					t.Errorf("step %d: state %s, want %s", i, got, s.state)
+				}
+			}
+			if h := b.health(); h.Trips != tt.trips {
+				t.Errorf("%d trips, want %d", h.Trips, tt.trips)
+			}
+		})
+	}
+}
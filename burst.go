@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+// burster imitates a gateway's store-and-forward after it loses its
+// uplink: every interval it holds readings back until size have
+// accumulated, then releases them all at once, as fast as the sinks take
+// them. Readings keep their order and timestamps; only their delivery is
+// bunched up, so downstream sees silence followed by a flood.
+type burster struct {
+	size    int
+	every   time.Duration
+	next    time.Time // when the next outage starts
+	holding bool
+	held    []SensorReading
+}
+
+func newBurster(size int, every time.Duration) *burster {
+	if size <= 0 {
+		return nil
+	}
+	return &burster{size: size, every: every}
+}
+
+// pass takes a batch generated at now and returns what to deliver: the
+// batch itself, nothing while an outage holds readings back, or the held
+// backlog once it reaches size.
+func (b *burster) pass(batch []SensorReading, now time.Time) []SensorReading {
+	if b.next.IsZero() {
+		b.next = now.Add(b.every)
+	}
+	if !b.holding {
+		if now.Before(b.next) {
+			return batch
+		}
+		b.holding = true
+	}
+	b.held = append(b.held, batch...)
+	if len(b.held) < b.size {
+		return nil
+	}
+	out := b.held
+	b.held, b.holding = nil, false
+	b.next = now.Add(b.every)
+	return out
+}
+
+// flush returns the readings still held back, at the end of a run.
+func (b *burster) flush() []SensorReading {
+	out := b.held
+	b.held = nil
+	return out
+}
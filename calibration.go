@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Calibration event kind and cause.
+const (
+	eventRecalibration = "recalibration"
+	causeDrift         = "calibration_drift"
+)
+
+// calibration is a fleet sensor's calibration error: a bias that grows
+// steadily from what was left at its last calibration, at a rate of the
+// sensor's own, until a technician recalibrates it and the readings snap
+// back.
+type calibration struct {
+	rate float64   // drift per day, in the sensor's unit
+	left float64   // error left by the last calibration
+	last time.Time // last calibration
+}
+
+// calibrator drifts the fleet's calibrations and recalibrates each sensor
+// every interval, logging each recalibration as an event with the errors
+// in the units the readings are reported in.
+type calibrator struct {
+	drift    float64 // standard deviation of drift rates, as a fraction of range per day
+	interval time.Duration
+	units    map[string]unitConversion
+	log      *eventLog
+}
+
+func newCalibrator(drift float64, interval time.Duration, units map[string]unitConversion, log *eventLog) *calibrator {
+	return &calibrator{drift: drift, interval: interval, units: units, log: log}
+}
+
+// bias returns s's calibration error at now, recalibrating it if it has
+// come due. A sensor's first reading finds it part way through its
+// calibration interval, so the fleet's recalibrations are spread out.
+func (c *calibrator) bias(s *fleetSensor, now time.Time, rng *rand.Rand) float64 {
+	cal := s.cal
+	st := sensorTypes[s.Type]
+	span := st.Max - st.Min
+	scale, res := 1.0, st.Resolution
+	if u, ok := c.units[st.Unit]; ok {
+		scale, res = u.scale, u.resolution
+	}
+	if cal == nil {
+		cal = &calibration{
+			rate: rng.NormFloat64() * c.drift * span,
+			left: rng.NormFloat64() * 0.001 * span,
+			last: now.Add(-time.Duration(rng.Int63n(int64(c.interval)))),
+		}
+		s.cal = cal
+	}
+	for due := cal.last.Add(c.interval); !now.Before(due); due = cal.last.Add(c.interval) {
+		found := cal.at(due)
+		cal.left = rng.NormFloat64() * 0.001 * span
+		cal.last = due
+		ev := c.log.record(due, eventRecalibration, s.Pipeline, s.ID, causeDrift, s.Location.MilePost)
+		// Adding 0 turns an error rounded to -0 into 0.
+		ev.AsFound, ev.AsLeft = limit(quantize(found*scale, res)+0), limit(quantize(cal.left*scale, res)+0)
+	}
+	return cal.at(now)
+}
+
+// at returns the calibration error at t.
+func (cal *calibration) at(t time.Time) float64 {
+	return cal.left + cal.rate*t.Sub(cal.last).Hours()/24
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Cathodic protection sensor types: the pipe-to-soil potential at a test
+// station, more negative than -850 mV where the pipe is protected, and the
+// output current of the rectifier that drives it. Like the tank farm
+// types, they are only generated when -type-mix asks for them.
+const (
+	pipeToSoilType       = "pipe_to_soil"
+	rectifierCurrentType = "rectifier_current"
+)
+
+// cpInterval is how often cathodic protection sensors report: the remote
+// monitoring units on test stations and rectifiers poll hourly. Fleet
+// sensors keep to it whether picked at random or scheduled by -intervals,
+// unless -intervals lists their type.
+const cpInterval = time.Hour
+
+// cpDriest is the day of the year soil is driest. Dry soil conducts
+// worst, so less protective current reaches the pipe: the potential is
+// least negative and the rectifier current lowest.
+const cpDriest = 200
+
+// isCPType reports whether the sensor type at index t in sensorTypes is a
+// cathodic protection type.
+func isCPType(t int) bool {
+	typ := sensorTypes[t].Type
+	return typ == pipeToSoilType || typ == rectifierCurrentType
+}
+
+// cpCircuit is the cathodic protection at one test station or rectifier:
+// a level that swings with the seasons around its own baseline.
+type cpCircuit struct {
+	base  float64 // mV for potentials, A for currents
+	swing float64 // seasonal swing either side of base, in the same units
+}
+
+func newCPCircuit(typ string, rng *rand.Rand) *cpCircuit {
+	if typ == pipeToSoilType {
+		return &cpCircuit{base: -1150 + rng.Float64()*200, swing: 30 + rng.Float64()*50}
+	}
+	base := 5 + rng.Float64()*25
+	return &cpCircuit{base: base, swing: base * (0.1 + rng.Float64()*0.1)}
+}
+
+// measure returns the circuit's reading at now.
+func (c *cpCircuit) measure(typ string, now time.Time, rng *rand.Rand) float64 {
+	dry := math.Cos(2 * math.Pi * float64(now.YearDay()-cpDriest) / 365)
+	if typ == pipeToSoilType {
+		return c.base + c.swing*dry + rng.NormFloat64()*2
+	}
+	return c.base - c.swing*dry + rng.NormFloat64()*0.05
+}
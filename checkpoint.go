@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Checkpoint is the recipe of a run so far, saved with -checkpoint so a
+// restarted run carries on where it stopped. The generator's state (the
+// fleet, per-sensor sequence numbers, the random source) is not stored
+// itself: it is rebuilt from the seed by taking the recipe's samples again
+// without emitting them, so the resumed run continues exactly as the
+// original would have.
+type Checkpoint struct {
+	Recipe
+	// Records is the number of records written up to the checkpoint.
+	Records int64 `json:"records"`
+	// OutputSize is the size of the -o file at the checkpoint, if the run
+	// writes a single file. Records written after it are cut off on
+	// resume, as they are written again.
+	OutputSize *int64 `json:"output_size,omitempty"`
+}
+
+// write saves the checkpoint to path, replacing the previous one only once
+// it is complete.
+func (c *Checkpoint) write(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+tmpSuffix, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return finalize(path+tmpSuffix, path)
+}
+
+// loadCheckpoint reads the checkpoint at path. The error wraps
+// fs.ErrNotExist if there is none.
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: %w", err)
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// truncateOutput cuts the -o file back to its size at the checkpoint.
+func (c *Checkpoint) truncateOutput(path string) error {
+	if c.OutputSize == nil {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	if fi.Size() < *c.OutputSize {
+		return fmt.Errorf("checkpoint: %s is %d bytes, shorter than the %d it had at the checkpoint", path, fi.Size(), *c.OutputSize)
+	}
+	return os.Truncate(path, *c.OutputSize)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// chromatographType is the composite sensor type: a gas chromatograph
+// reporting the heating value of the gas as its value and the composition
+// behind it as components. It is only generated when -type-mix asks for
+// it, so the default mix keeps the single-value types.
+const chromatographType = "chromatograph"
+
+// gasComponents are the keys of a chromatograph reading's components: mole
+// percent of methane, ethane and CO2, and H2S in ppm.
+var gasComponents = []string{"methane", "ethane", "co2", "h2s"}
+
+// Higher heating values of the hydrocarbons, in BTU/scf.
+const (
+	methaneBTU = 1010.0
+	ethaneBTU  = 1770.0
+)
+
+// gasStream is the gas a chromatograph samples: the diluents and H2S of
+// its supply, which move little, while the methane-ethane split follows
+// the heating value the sensor reports.
+type gasStream struct {
+	co2   float64 // mol %
+	inert float64 // nitrogen and the rest, mol %
+	h2s   float64 // ppm
+}
+
+func newGasStream(rng *rand.Rand) *gasStream {
+	return &gasStream{
+		co2:   0.5 + rng.Float64()*2,
+		inert: 0.5 + rng.Float64()*1.5,
+		h2s:   rng.Float64() * 4,
+	}
+}
+
+// analyze returns the composition of a sample with heating value hv, or
+// nil if hv is not a number: the ethane in the hydrocarbons is what makes
+// up hv over pure methane.
+func (g *gasStream) analyze(hv float64, rng *rand.Rand) map[string]float64 {
+	if !isFinite(hv) {
+		return nil
+	}
+	co2 := math.Max(g.co2+rng.NormFloat64()*0.02, 0)
+	h2s := math.Max(g.h2s+rng.NormFloat64()*0.1, 0)
+	hydrocarbons := 100 - co2 - g.inert
+	ethane := (hv*100 - hydrocarbons*methaneBTU) / (ethaneBTU - methaneBTU)
+	ethane = math.Min(math.Max(ethane, 0), hydrocarbons)
+	return map[string]float64{
+		"methane": quantize(hydrocarbons-ethane, 0.001),
+		"ethane":  quantize(ethane, 0.001),
+		"co2":     quantize(co2, 0.001),
+		"h2s":     quantize(h2s, 0.01),
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CloudEvents content modes.
+const (
+	ceStructured = "structured"
+	ceBinary     = "binary"
+)
+
+// cloudEvent is a reading as a CloudEvents 1.0 event. The record's Data is
+// the event in structured mode, which every sink can carry; in binary mode
+// sinks with message headers (HTTP, NATS) send the attributes as ce-
+// headers and Data here as the body.
+type cloudEvent struct {
+	id, source, typ, subject, time string
+	runID                          string // runid extension attribute, with -run-id-field
+	binary                         bool
+	Data                           []byte // the reading's JSON
+}
+
+// ceWrapper wraps records in CloudEvents envelopes.
+type ceWrapper struct {
+	binary bool
+	source string // template, see expandTemplate
+	typ    string // template
+}
+
+// newCEWrapper returns a wrapper for the given -cloudevents mode, or nil
+// when mode is empty.
+func newCEWrapper(mode, source, typ string) (*ceWrapper, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case ceStructured, ceBinary:
+	default:
+		return nil, fmt.Errorf("unknown mode %q (want structured or binary)", mode)
+	}
+	if source == "" || typ == "" {
+		return nil, fmt.Errorf("source and type must not be empty")
+	}
+	return &ceWrapper{binary: mode == ceBinary, source: source, typ: typ}, nil
+}
+
+// wrap turns rec into an event. The id combines the sensor and the
+// reading's timestamp, so a retransmitted duplicate keeps its original's
+// id as consumers deduplicating on source and id expect.
+func (w *ceWrapper) wrap(rec *Record) {
+	r := rec.Reading
+	ev := &cloudEvent{
+		id:      r.SensorID + "/" + r.Timestamp,
+		source:  expandTemplate(w.source, r),
+		typ:     expandTemplate(w.typ, r),
+		subject: r.SensorID,
+		time:    r.Timestamp,
+		runID:   r.RunID,
+		binary:  w.binary,
+		Data:    rec.Data,
+	}
+	// Data is spliced in unchanged, so malformed readings stay malformed.
+	b := make([]byte, 0, len(rec.Data)+256)
+	b = append(b, `{"specversion":"1.0"`...)
+	for _, attr := range ev.attributes() {
+		v, _ := json.Marshal(attr[1])
+		b = fmt.Appendf(b, ",%q:%s", attr[0], v)
+	}
+	b = append(b, `,"datacontenttype":"application/json","data":`...)
+	b = append(b, rec.Data...)
+	rec.Data = append(b, '}')
+	rec.Event = ev
+}
+
+// attributes returns the event's context attributes other than
+// specversion and datacontenttype, as name and value pairs.
+func (ev *cloudEvent) attributes() [][2]string {
+	attrs := [][2]string{
+		{"id", ev.id},
+		{"source", ev.source},
+		{"type", ev.typ},
+		{"subject", ev.subject},
+	}
+	if ev.time != "" {
+		attrs = append(attrs, [2]string{"time", ev.time})
+	}
+	if ev.runID != "" {
+		attrs = append(attrs, [2]string{"runid", ev.runID})
+	}
+	return attrs
+}
+
+// appendHeaders appends the binary-mode headers of ev in "Name: value\r\n"
+// form, as NATS header blocks use them.
+func (ev *cloudEvent) appendHeaders(b []byte) []byte {
+	b = append(b, "ce-specversion: 1.0\r\ncontent-type: application/json\r\n"...)
+	for _, attr := range ev.attributes() {
+		b = fmt.Appendf(b, "ce-%s: %s\r\n", attr[0], attr[1])
+	}
+	return b
+}
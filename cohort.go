@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Cohort is one arm of an experiment: readings from a Weight share of the
+// sensors carry Name in their cohort field.
+type Cohort struct {
+	Name   string
+	Weight float64
+}
+
+// parseCohorts parses a -cohorts value: comma-separated names, each with
+// an optional =weight (default 1), e.g. "control=90,shadow=10".
+func parseCohorts(spec string) ([]Cohort, error) {
+	var cohorts []Cohort
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, weight, hasWeight := strings.Cut(item, "=")
+		c := Cohort{Name: strings.TrimSpace(name), Weight: 1}
+		if hasWeight {
+			w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+			if err != nil || !(w > 0) {
+				return nil, fmt.Errorf("cohort %q: weight must be a positive number", c.Name)
+			}
+			c.Weight = w
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("cohort %q: missing name", item)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("cohort %q listed twice", c.Name)
+		}
+		seen[c.Name] = true
+		cohorts = append(cohorts, c)
+	}
+	if len(cohorts) == 0 {
+		return nil, fmt.Errorf("no cohorts in %q", spec)
+	}
+	return cohorts, nil
+}
+
+// cohortAssigner maps sensor IDs to cohorts. Assignment hashes the salted
+// ID, so a sensor lands in the same cohort on every reading and on every
+// run with the same cohorts and salt, independent of the random seed.
+type cohortAssigner struct {
+	names  []string
+	bounds []uint64 // cumulative upper bound of each cohort's hash range
+	salt   string
+}
+
+func newCohortAssigner(cohorts []Cohort, salt string) *cohortAssigner {
+	if len(cohorts) == 0 {
+		return nil
+	}
+	var total float64
+	for _, c := range cohorts {
+		total += c.Weight
+	}
+	a := &cohortAssigner{salt: salt}
+	var cum float64
+	for _, c := range cohorts {
+		cum += c.Weight
+		a.names = append(a.names, c.Name)
+		a.bounds = append(a.bounds, uint64(cum/total*(1<<63))<<1)
+	}
+	a.bounds[len(a.bounds)-1] = ^uint64(0)
+	return a
+}
+
+// assign returns the cohort of the sensor with the given ID.
+func (a *cohortAssigner) assign(id string) string {
+	h := fnv.New64a()
+	h.Write([]byte(a.salt))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	// FNV alone leaves IDs that differ in their last digits close
+	// together; the splitmix64 finaliser spreads them over the range.
+	sum := h.Sum64()
+	sum = (sum ^ sum>>30) * 0xbf58476d1ce4e5b9
+	sum = (sum ^ sum>>27) * 0x94d049bb133111eb
+	sum ^= sum >> 31
+	for i, bound := range a.bounds {
+		if sum <= bound {
+			return a.names[i]
+		}
+	}
+	return a.names[len(a.names)-1]
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// compressMain implements "sensor-gen compress": it simulates a stretch of
+// fleet output on a virtual clock, then compresses it both interleaved, as
+// written live, and ordered per sensor, as a time-series store lays it
+// out, reporting the ratio each codec achieves on each layout.
+func compressMain(args []string) int {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	fleetSize := fs.Int("fleet", 200, "Number of fleet sensors")
+	rate := fs.Int("rate", 500, "Simulated samples per second")
+	duration := fs.Duration("d", 10*time.Minute, "Simulated time span")
+	bgEvents := fs.Float64("background-events", 0, "Background events per pipeline per hour (0 = off)")
+	deadband := fs.Float64("deadband", 0, "Report-by-exception deadband as a fraction of range (0 = report every sample)")
+	keepalive := fs.Duration("keepalive", time.Minute, "Report-by-exception keepalive")
+	quantizeValues := fs.Bool("quantize", false, "Round values to instrument resolution")
+	configFile := fs.String("config", "", "JSON configuration file (per-type noise models)")
+	dumpDir := fs.String("dump", "", "Also write both layouts as JSONL files to this directory, for codecs and levels not built in")
+	fs.Parse(args)
+
+	if *fleetSize <= 0 || *rate <= 0 || *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -fleet, -rate and -d must be positive")
+		return 1
+	}
+	var cfg Config
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		cfg = *c
+	}
+
+	start := time.Now().Truncate(time.Second)
+	step := time.Second / time.Duration(*rate)
+	clock := start
+	gen := NewGenerator(GeneratorConfig{
+		Seed:             start.UnixNano(),
+		BackgroundEvents: *bgEvents,
+		Fleet:            *fleetSize,
+		Deadband:         *deadband,
+		Keepalive:        *keepalive,
+		Quantize:         *quantizeValues,
+		Noise:            cfg.Noise,
+		Clock: func() time.Time {
+			clock = clock.Add(step)
+			return clock
+		},
+	})
+	end := start.Add(*duration)
+	fmt.Printf("Simulating %v of a %d-sensor fleet at %d samples/sec...\n", *duration, *fleetSize, *rate)
+	set := newSeriesSet()
+	for clock.Before(end) {
+		for _, r := range gen.GenerateBatch(1000) {
+			if err := set.add(&r); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+		}
+	}
+	if len(set.rows) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no readings reported")
+		return 1
+	}
+
+	interleaved := make([]int, len(set.rows))
+	for i := range interleaved {
+		interleaved[i] = i
+	}
+	// Per sensor: stable, so each series stays in time order.
+	bySensor := slices.Clone(interleaved)
+	slices.SortStableFunc(bySensor, func(a, b int) int { return int(set.rows[a].sensor) - int(set.rows[b].sensor) })
+
+	if *dumpDir != "" {
+		for _, layout := range []struct {
+			file  string
+			order []int
+		}{{"interleaved.jsonl", interleaved}, {"by-sensor.jsonl", bySensor}} {
+			path := filepath.Join(*dumpDir, layout.file)
+			if err := set.dump(path, layout.order); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return 1
+			}
+		}
+	}
+
+	fmt.Printf("%d readings from %d sensors, %.1f MB as JSONL\n\n", len(set.rows), len(set.sensors), float64(len(set.arena)+len(set.rows))/1e6)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Codec\tInterleaved\tRatio\tPer sensor\tRatio\tSpeed\t")
+	raw := float64(len(set.arena) + len(set.rows))
+	for _, c := range compressCodecs {
+		var sizes [2]int64
+		var elapsed time.Duration
+		for i, order := range [][]int{interleaved, bySensor} {
+			cw := &countingWriter{}
+			t := time.Now()
+			if err := c.encode(set, cw, order); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %v\n", c.name, err)
+				return 1
+			}
+			elapsed += time.Since(t)
+			sizes[i] = cw.n
+		}
+		speed := float64(2*len(set.rows)) / elapsed.Seconds() / 1e6
+		fmt.Fprintf(tw, "%s\t%.2f MB\t%.1fx\t%.2f MB\t%.1fx\t%.1fM readings/s\t\n", c.name,
+			float64(sizes[0])/1e6, raw/float64(sizes[0]), float64(sizes[1])/1e6, raw/float64(sizes[1]), speed)
+	}
+	tw.Flush()
+	fmt.Println()
+	fmt.Println("Ratios are against the JSONL size. binary is 20-byte rows (sensor, timestamp ns, value);")
+	fmt.Println("gorilla encodes each row against the previous one: delta-of-delta ms timestamps and XOR'd values.")
+	fmt.Println("zstd is sensor-gen's own fast-level encoder, which compresses about as well as zstd -1;")
+	fmt.Println("use -dump and run zstd on the files for other levels.")
+	return 0
+}
+
+// seriesSet holds simulated readings compactly: the JSON of every reading
+// in one arena plus the numeric fields the binary codecs need.
+type seriesSet struct {
+	arena   []byte
+	rows    []seriesRow
+	sensors map[string]uint32
+}
+
+type seriesRow struct {
+	sensor uint32
+	ts     int64 // ns since the epoch
+	value  float64
+	start  int // JSON is arena[start:end]
+	end    int
+}
+
+func newSeriesSet() *seriesSet {
+	return &seriesSet{sensors: make(map[string]uint32)}
+}
+
+func (s *seriesSet) add(r *SensorReading) error {
+	t, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if err != nil {
+		return err
+	}
+	id, ok := s.sensors[r.SensorID]
+	if !ok {
+		id = uint32(len(s.sensors))
+		s.sensors[r.SensorID] = id
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	start := len(s.arena)
+	s.arena = append(s.arena, data...)
+	s.rows = append(s.rows, seriesRow{sensor: id, ts: t.UnixNano(), value: r.Value, start: start, end: len(s.arena)})
+	return nil
+}
+
+func (s *seriesSet) writeJSONL(w io.Writer, order []int) error {
+	bw := bufio.NewWriterSize(w, 256*1024)
+	for _, i := range order {
+		row := &s.rows[i]
+		bw.Write(s.arena[row.start:row.end])
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+func (s *seriesSet) dump(path string, order []int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.writeJSONL(f, order); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Printf("Wrote %s\n", path)
+	return f.Close()
+}
+
+// compressCodecs are the codecs compared, each encoding the rows of a set
+// in the given order.
+var compressCodecs = []struct {
+	name   string
+	encode func(s *seriesSet, w io.Writer, order []int) error
+}{
+	{"jsonl+gzip -1", gzipped(gzip.BestSpeed, (*seriesSet).writeJSONL)},
+	{"jsonl+gzip -6", gzipped(gzip.DefaultCompression, (*seriesSet).writeJSONL)},
+	{"jsonl+gzip -9", gzipped(gzip.BestCompression, (*seriesSet).writeJSONL)},
+	{"jsonl+zstd", zstdCompressed((*seriesSet).writeJSONL)},
+	{"binary", writeBinaryRows},
+	{"binary+gzip", gzipped(gzip.DefaultCompression, writeBinaryRows)},
+	{"binary+zstd", zstdCompressed(writeBinaryRows)},
+	{"gorilla", writeGorilla},
+	{"gorilla+gzip", gzipped(gzip.DefaultCompression, writeGorilla)},
+	{"gorilla+zstd", zstdCompressed(writeGorilla)},
+}
+
+func gzipped(level int, encode func(*seriesSet, io.Writer, []int) error) func(*seriesSet, io.Writer, []int) error {
+	return func(s *seriesSet, w io.Writer, order []int) error {
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		if err := encode(s, zw, order); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+}
+
+func zstdCompressed(encode func(*seriesSet, io.Writer, []int) error) func(*seriesSet, io.Writer, []int) error {
+	return func(s *seriesSet, w io.Writer, order []int) error {
+		zw := newZstdWriter(w)
+		if err := encode(s, zw, order); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+}
+
+func writeBinaryRows(s *seriesSet, w io.Writer, order []int) error {
+	bw := bufio.NewWriterSize(w, 256*1024)
+	var buf [20]byte
+	for _, i := range order {
+		row := &s.rows[i]
+		binary.LittleEndian.PutUint32(buf[0:], row.sensor)
+		binary.LittleEndian.PutUint64(buf[4:], uint64(row.ts))
+		binary.LittleEndian.PutUint64(buf[12:], math.Float64bits(row.value))
+		bw.Write(buf[:])
+	}
+	return bw.Flush()
+}
+
+// writeGorilla encodes rows the way Gorilla-style time-series stores
+// compress a series, each row against the previous one: delta-of-delta
+// millisecond timestamps (with Prometheus's bucket sizes) and XOR'd values
+// with a reused bit window. A sensor change costs a flag bit and the 16-bit
+// sensor index.
+func writeGorilla(s *seriesSet, w io.Writer, order []int) error {
+	bw := &bitWriter{w: bufio.NewWriterSize(w, 256*1024)}
+	var prevSensor uint32 = math.MaxUint32
+	var prevTS, prevDelta int64
+	var prevBits uint64
+	leading, trailing := -1, 0
+	for _, i := range order {
+		row := &s.rows[i]
+		if row.sensor == prevSensor {
+			bw.write(0, 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint64(row.sensor), 16)
+			prevSensor = row.sensor
+		}
+
+		ts := row.ts / int64(time.Millisecond)
+		delta := ts - prevTS
+		dod := delta - prevDelta
+		switch {
+		case dod == 0:
+			bw.write(0, 1)
+		case dod >= -(1<<13) && dod < 1<<13:
+			bw.write(0b10, 2)
+			bw.write(uint64(dod), 14)
+		case dod >= -(1<<16) && dod < 1<<16:
+			bw.write(0b110, 3)
+			bw.write(uint64(dod), 17)
+		case dod >= -(1<<19) && dod < 1<<19:
+			bw.write(0b1110, 4)
+			bw.write(uint64(dod), 20)
+		default:
+			bw.write(0b1111, 4)
+			bw.write(uint64(dod), 64)
+		}
+		prevTS, prevDelta = ts, delta
+
+		v := math.Float64bits(row.value)
+		xor := v ^ prevBits
+		prevBits = v
+		if xor == 0 {
+			bw.write(0, 1)
+			continue
+		}
+		lz, tz := min(bits.LeadingZeros64(xor), 31), bits.TrailingZeros64(xor)
+		if leading >= 0 && lz >= leading && tz >= trailing {
+			bw.write(0b10, 2)
+			bw.write(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = lz, tz
+		sig := 64 - lz - tz
+		bw.write(0b11, 2)
+		bw.write(uint64(lz), 5)
+		bw.write(uint64(sig&63), 6) // 64 significant bits is written as 0
+		bw.write(xor>>tz, sig)
+	}
+	return bw.flush()
+}
+
+// bitWriter packs values MSB first.
+type bitWriter struct {
+	w    *bufio.Writer
+	acc  uint64
+	nacc int
+}
+
+// write appends the low n bits of v.
+func (b *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		take := min(n, 64-b.nacc)
+		n -= take
+		chunk := v >> n
+		if take < 64 {
+			chunk &= 1<<take - 1
+		}
+		if b.nacc == 0 {
+			b.acc = chunk
+		} else {
+			b.acc = b.acc<<take | chunk
+		}
+		b.nacc += take
+		if b.nacc == 64 {
+			b.w.Write(binary.BigEndian.AppendUint64(nil, b.acc))
+			b.acc, b.nacc = 0, 0
+		}
+	}
+}
+
+func (b *bitWriter) flush() error {
+	for b.nacc > 0 {
+		take := min(b.nacc, 8)
+		b.w.WriteByte(byte(b.acc >> (b.nacc - take) << (8 - take)))
+		b.nacc -= take
+	}
+	return b.w.Flush()
+}
+
+// countingWriter counts bytes written to it and discards them.
+type countingWriter struct{ n int64 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
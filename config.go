@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON configuration file given with -config. It
+// holds settings too detailed for flags.
+//
+//	{
+//	  "noise": {
+//	    "pressure": {"gaussian": 0.8, "spike_rate": 0.001, "spike_amplitude": 40},
+//	    "*":        {"periodic_amplitude": 0.2, "periodic_hz": 60}
+//	  },
+//	  "alerts": {
+//	    "pressure": {"warning": {"low": 400, "high": 1200}, "critical": {"low": 250, "high": 1400}}
+//	  },
+//	  "status": {
+//	    "warning": {"dwell": "15m", "next": {"normal": 0.9, "maintenance": 0.1}}
+//	  },
+//	  "failures": [
+//	    {"sensor": "SNS-pre-0001", "mode": "stuck", "at": "10m", "duration": "5m"}
+//	  ],
+//	  "rate": 5000,
+//	  "type_mix": {"pressure": 60, "flow_rate": 20, "corrosion": 5},
+//	  "anomalies": {"background_events": 2, "leaks": 0.5, "failures": 1},
+//	  "fields": {"rename": {"sensor_id": "deviceId"}, "drop": ["quality_score"], "add": {"tenant": "acme"}}
+//	}
+//
+// The file is read again on SIGHUP, see reload.go.
+type Config struct {
+	// Noise maps a sensor type, or "*" for every type without its own
+	// entry, to the measurement noise added to its readings.
+	Noise map[string]NoiseModel `json:"noise"`
+	// Alerts maps a sensor type, or "*" for every type without its own
+	// entry, to the thresholds that set its readings' alert level. Types
+	// without an entry keep the default thresholds.
+	Alerts map[string]AlertThresholds `json:"alerts"`
+	// Status maps a device status to the dwell time and transitions of
+	// that state in the fleet's status chain. States without an entry keep
+	// their defaults.
+	Status map[string]StatusState `json:"status"`
+	// Failures schedules failures of individual fleet sensors.
+	Failures []FailureSpec `json:"failures"`
+	// Rate, TypeMix and Anomalies, when set, override the -rate,
+	// -type-mix, -background-events, -leaks and -failures flags.
+	Rate      int                `json:"rate,omitempty"`
+	TypeMix   map[string]float64 `json:"type_mix,omitempty"`
+	Anomalies *Anomalies         `json:"anomalies,omitempty"`
+	// Fields reshapes the JSON records written.
+	Fields *FieldMapping `json:"fields,omitempty"`
+}
+
+// Anomalies sets the rates of the simulated anomalies; those left out keep
+// their flag's value.
+type Anomalies struct {
+	BackgroundEvents *float64 `json:"background_events,omitempty"` // per pipeline per hour
+	Leaks            *float64 `json:"leaks,omitempty"`             // per pipeline per day
+	Failures         *float64 `json:"failures,omitempty"`          // per fleet sensor per day
+}
+
+// FailureSpec schedules a failure of one fleet sensor.
+type FailureSpec struct {
+	Sensor string `json:"sensor"`
+	// Mode is one of stuck, zero, nan, inf, dropout and dead.
+	Mode string `json:"mode"`
+	// At is when the failure starts, after the first sample.
+	At Duration `json:"at"`
+	// Duration is how long it lasts; zero (and mode dead) means for the
+	// rest of the run.
+	Duration Duration `json:"duration"`
+}
+
+// Duration is a time.Duration written in JSON as a string such as "5m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// NoiseModel describes measurement noise in the sensor's engineering units.
+type NoiseModel struct {
+	// Gaussian is the standard deviation of additive white noise.
+	Gaussian float64 `json:"gaussian"`
+	// SpikeRate is the probability that a reading carries an impulse of
+	// between half and all of SpikeAmplitude, in either direction.
+	SpikeRate      float64 `json:"spike_rate"`
+	SpikeAmplitude float64 `json:"spike_amplitude"`
+	// PeriodicAmplitude is the amplitude of sinusoidal interference at
+	// PeriodicHz (default 60), evaluated at each reading's timestamp, the
+	// way mains pickup aliases into sampled data.
+	PeriodicAmplitude float64 `json:"periodic_amplitude"`
+	PeriodicHz        float64 `json:"periodic_hz"`
+}
+
+// loadConfig reads and validates the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+	var cfg Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the configuration's values.
+func (c *Config) validate() error {
+	for name, n := range c.Noise {
+		if name != "*" && sensorTypeIndex(name) < 0 {
+			return fmt.Errorf("noise: unknown sensor type %q", name)
+		}
+		if n.Gaussian < 0 || n.SpikeRate < 0 || n.SpikeRate > 1 || n.SpikeAmplitude < 0 || n.PeriodicAmplitude < 0 || n.PeriodicHz < 0 {
+			return fmt.Errorf("noise %q: amplitudes must be non-negative and spike_rate at most 1", name)
+		}
+	}
+	for name, t := range c.Alerts {
+		if name != "*" && sensorTypeIndex(name) < 0 {
+			return fmt.Errorf("alerts: unknown sensor type %q", name)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("alerts %q: %w", name, err)
+		}
+	}
+	for name, s := range c.Status {
+		if !slices.Contains(statusNames, name) {
+			return fmt.Errorf("status: unknown state %q", name)
+		}
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("status %q: %w", name, err)
+		}
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	if len(c.TypeMix) > 0 {
+		if _, err := parseTypeMix(c.typeMixSpec()); err != nil {
+			return fmt.Errorf("type_mix: %w", err)
+		}
+	}
+	if a := c.Anomalies; a != nil {
+		for _, v := range []*float64{a.BackgroundEvents, a.Leaks, a.Failures} {
+			if v != nil && *v < 0 {
+				return fmt.Errorf("anomalies: rates must not be negative")
+			}
+		}
+	}
+	if c.Fields != nil {
+		if err := c.Fields.validate(); err != nil {
+			return fmt.Errorf("fields: %w", err)
+		}
+	}
+	for i, f := range c.Failures {
+		if f.Sensor == "" {
+			return fmt.Errorf("failures[%d]: missing sensor", i)
+		}
+		if !slices.Contains(failureModes, f.Mode) {
+			return fmt.Errorf("failures[%d]: unknown mode %q", i, f.Mode)
+		}
+		if f.At < 0 || f.Duration < 0 {
+			return fmt.Errorf("failures[%d]: at and duration must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// flags returns the flag values the configuration overrides.
+func (c *Config) flags() map[string]string {
+	f := make(map[string]string)
+	if c.Rate > 0 {
+		f["rate"] = strconv.Itoa(c.Rate)
+	}
+	if len(c.TypeMix) > 0 {
+		f["type-mix"] = c.typeMixSpec()
+	}
+	if a := c.Anomalies; a != nil {
+		for name, v := range map[string]*float64{"background-events": a.BackgroundEvents, "leaks": a.Leaks, "failures": a.Failures} {
+			if v != nil {
+				f[name] = strconv.FormatFloat(*v, 'g', -1, 64)
+			}
+		}
+	}
+	return f
+}
+
+// typeMixSpec writes TypeMix in the form of -type-mix, types in their
+// usual order.
+func (c *Config) typeMixSpec() string {
+	var items []string
+	for _, st := range sensorTypes {
+		if w, ok := c.TypeMix[st.Type]; ok {
+			items = append(items, st.Type+"="+strconv.FormatFloat(w, 'g', -1, 64))
+		}
+	}
+	for name := range c.TypeMix {
+		if sensorTypeIndex(name) < 0 {
+			items = append(items, name) // rejected by parseTypeMix
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// sensorTypeIndex returns the index of the named type in sensorTypes, or -1.
+func sensorTypeIndex(name string) int {
+	for i, st := range sensorTypes {
+		if st.Type == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// noiseByType resolves per-type noise models, applying the "*" default,
+// into a slice indexed like sensorTypes. Types without noise are nil.
+func noiseByType(models map[string]NoiseModel) []*NoiseModel {
+	if len(models) == 0 {
+		return nil
+	}
+	out := make([]*NoiseModel, len(sensorTypes))
+	for i, st := range sensorTypes {
+		n, ok := models[st.Type]
+		if !ok {
+			n, ok = models["*"]
+		}
+		if ok {
+			if n.PeriodicHz == 0 {
+				n.PeriodicHz = 60
+			}
+			out[i] = &n
+		}
+	}
+	return out
+}
+
+// apply returns v with noise added for a reading taken at t.
+func (n *NoiseModel) apply(v float64, t time.Time, rng *rand.Rand) float64 {
+	if n.Gaussian > 0 {
+		v += rng.NormFloat64() * n.Gaussian
+	}
+	if n.SpikeRate > 0 && rng.Float64() < n.SpikeRate {
+		spike := n.SpikeAmplitude * (0.5 + rng.Float64()*0.5)
+		if rng.Intn(2) == 0 {
+			spike = -spike
+		}
+		v += spike
+	}
+	if n.PeriodicAmplitude > 0 {
+		secs := float64(t.UnixNano()%int64(time.Hour)) / float64(time.Second)
+		v += n.PeriodicAmplitude * math.Sin(2*math.Pi*n.PeriodicHz*secs)
+	}
+	return v
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record file formats.
+const (
+	formatJSONL   = "jsonl"
+	formatCSV     = "csv"
+	formatAvro    = "avro"
+	formatParquet = "parquet"
+)
+
+// convertMain implements "sensor-gen convert": it rewrites a JSONL file of
+// readings as CSV, Avro or Parquet, one reading at a time, so files of any
+// size convert in bounded memory.
+func convertMain(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output file path (default: the input path with the format's extension)")
+	format := fs.String("to", "", "Output format: csv, avro or parquet (default: from the -o extension)")
+	compression := fs.String("compression", "gzip", "Avro and Parquet compression: gzip (deflate in Avro) or none")
+	rowGroup := fs.Int("row-group", 100000, "Parquet rows per row group; bounds memory use")
+	maxErrors := fs.Int("max-errors", 0, "Abort once more than this many errors occur, unreadable lines included (-1 = never abort)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sensor-gen convert [flags] FILE.jsonl[.gz]  (- reads standard input)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	input := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(*outputFile, ".gz")), ".")
+	}
+	switch *format {
+	case formatCSV, formatAvro, formatParquet:
+	case "":
+		fmt.Fprintln(os.Stderr, "Error: set -to, or -o with a .csv, .avro or .parquet extension")
+		return 1
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (want csv, avro or parquet)\n", *format)
+		return 1
+	}
+	if *outputFile == "" {
+		if input == "-" {
+			fmt.Fprintln(os.Stderr, "Error: -o is required when reading standard input")
+			return 1
+		}
+		base := strings.TrimSuffix(input, ".gz")
+		*outputFile = strings.TrimSuffix(base, filepath.Ext(base)) + "." + *format
+	}
+	if *compression != "gzip" && *compression != "none" {
+		fmt.Fprintf(os.Stderr, "Error: unknown compression %q (want gzip or none)\n", *compression)
+		return 1
+	}
+	if *rowGroup <= 0 {
+		fmt.Fprintln(os.Stderr, "Error: -row-group must be positive")
+		return 1
+	}
+
+	in, err := openReadings("convert", input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer in.Close()
+	f, err := os.Create(*outputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: convert: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	bw := bufio.NewWriterSize(f, 1<<20)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if *format == formatCSV && strings.HasSuffix(*outputFile, ".gz") {
+		zw = gzip.NewWriter(bw)
+		w = zw
+	}
+	compress := *compression == "gzip"
+	var table tableWriter
+	switch *format {
+	case formatCSV:
+		table, err = newCSVTable(w, readingColumns)
+	case formatAvro:
+		table, err = newAvroTable(w, readingColumns, compress)
+	case formatParquet:
+		table, err = newParquetTable(w, readingColumns, compress, *rowGroup)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: convert: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Converting %s to %s (%s)\n", input, *outputFile, *format)
+	start := time.Now()
+	errs := newErrorBudget(*maxErrors)
+	var total, bytes int64
+	runErr := scanReadings(in, errs, func(r *SensorReading, line []byte) error {
+		row, err := newConvRow(r)
+		if err != nil {
+			if errs.Record(errClassParse, err) {
+				return errs.Err()
+			}
+			return nil
+		}
+		if err := table.Write(row); err != nil {
+			return err
+		}
+		total++
+		bytes += int64(len(line) + 1)
+		return nil
+	})
+	if runErr == nil {
+		runErr = table.Close()
+	}
+	if runErr == nil && zw != nil {
+		runErr = zw.Close()
+	}
+	if runErr == nil {
+		runErr = bw.Flush()
+	}
+	if runErr == nil {
+		runErr = f.Close()
+	}
+
+	fmt.Printf("JSONL read: %.2f MB\n", float64(bytes)/(1024*1024))
+	printFinalStats(total, bytes, start, *outputFile, errs)
+	if err := errs.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if runErr != nil {
+		fmt.Fprintf(os.Stderr, "Error: convert %s: %v\n", input, runErr)
+		return 1
+	}
+	return 0
+}
+
+// tableWriter writes readings as rows of a columnar or tabular format.
+// Close finishes the format's trailer but leaves the underlying writer
+// open.
+type tableWriter interface {
+	Write(r *convRow) error
+	Close() error
+}
+
+// convRow is a reading being converted, with its timestamps parsed.
+type convRow struct {
+	*SensorReading
+	ts, ingested, transmitted time.Time
+}
+
+func newConvRow(r *SensorReading) (*convRow, error) {
+	row := &convRow{SensorReading: r}
+	var err error
+	if row.ts, err = time.Parse(time.RFC3339Nano, r.Timestamp); err != nil {
+		return nil, fmt.Errorf("sensor %s: timestamp: %w", r.SensorID, err)
+	}
+	if r.IngestedAt != "" {
+		if row.ingested, err = time.Parse(time.RFC3339Nano, r.IngestedAt); err != nil {
+			return nil, fmt.Errorf("sensor %s: ingested_at: %w", r.SensorID, err)
+		}
+	}
+	if r.TransmittedAt != "" {
+		if row.transmitted, err = time.Parse(time.RFC3339Nano, r.TransmittedAt); err != nil {
+			return nil, fmt.Errorf("sensor %s: transmitted_at: %w", r.SensorID, err)
+		}
+	}
+	return row, nil
+}
+
+// colKind is the type of a converted column.
+type colKind int
+
+const (
+	colString colKind = iota
+	colDouble
+	colInt64
+	colBool
+	colTimestamp // microseconds since the Unix epoch in binary formats
+)
+
+// column is a column of converted readings. value returns a string,
+// float64, int64, bool or time.Time according to kind, or nil for a null
+// in an optional column.
+type column struct {
+	name     string
+	kind     colKind
+	optional bool
+	value    func(r *convRow) any
+}
+
+// readingColumns lays a reading out flat, the location's fields and the
+// components as columns of their own. Fields the JSON omits when empty
+// are optional.
+var readingColumns = []column{
+	{"sensor_id", colString, false, func(r *convRow) any { return r.SensorID }},
+	{"timestamp", colTimestamp, false, func(r *convRow) any { return r.ts }},
+	{"type", colString, false, func(r *convRow) any { return r.Type }},
+	{"value", colDouble, false, func(r *convRow) any { return r.Value }},
+	{"unit", colString, false, func(r *convRow) any { return r.Unit }},
+	{"lat", colDouble, false, func(r *convRow) any { return r.Location.Lat }},
+	{"lon", colDouble, false, func(r *convRow) any { return r.Location.Lon }},
+	{"mile_post", colDouble, false, func(r *convRow) any { return r.Location.MilePost }},
+	{"pipeline_id", colString, false, func(r *convRow) any { return r.PipelineID }},
+	{"status", colString, false, func(r *convRow) any { return r.Status }},
+	{"quality_score", colDouble, false, func(r *convRow) any { return r.Quality }},
+	{"alert_level", colString, true, func(r *convRow) any { return optional(r.AlertLevel) }},
+	{"pair_id", colString, true, func(r *convRow) any { return optional(r.PairID) }},
+	{"backfilled", colBool, false, func(r *convRow) any { return r.Backfilled }},
+	{"cohort", colString, true, func(r *convRow) any { return optional(r.Cohort) }},
+	{"ingested_at", colTimestamp, true, func(r *convRow) any {
+		if r.IngestedAt == "" {
+			return nil
+		}
+		return r.ingested
+	}},
+	{"sequence", colInt64, true, func(r *convRow) any {
+		if r.Sequence == 0 {
+			return nil
+		}
+		return int64(r.Sequence)
+	}},
+	{"terminal_id", colString, true, func(r *convRow) any { return optional(r.TerminalID) }},
+	{"tank_id", colString, true, func(r *convRow) any { return optional(r.TankID) }},
+	{"station_id", colString, true, func(r *convRow) any { return optional(r.StationID) }},
+	{"gateway_id", colString, true, func(r *convRow) any { return optional(r.GatewayID) }},
+	{"transmitted_at", colTimestamp, true, func(r *convRow) any {
+		if r.TransmittedAt == "" {
+			return nil
+		}
+		return r.transmitted
+	}},
+	{"battery_pct", colDouble, true, func(r *convRow) any { return optional(r.BatteryPct) }},
+	{"rssi_dbm", colDouble, true, func(r *convRow) any { return optional(r.RSSI) }},
+	{"uptime_s", colInt64, true, func(r *convRow) any { return optional(r.Uptime) }},
+	{"firmware_version", colString, true, func(r *convRow) any { return optional(r.Firmware) }},
+	{"run_id", colString, true, func(r *convRow) any { return optional(r.RunID) }},
+	componentColumn("methane"),
+	componentColumn("ethane"),
+	componentColumn("co2"),
+	componentColumn("h2s"),
+}
+
+// componentColumn is the column of a chromatograph component, null in
+// readings of other types.
+func componentColumn(name string) column {
+	return column{name, colDouble, true, func(r *convRow) any {
+		if v, ok := r.Components[name]; ok {
+			return v
+		}
+		return nil
+	}}
+}
+
+// optional returns v, or nil for the zero value.
+func optional[T comparable](v T) any {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
+}
+
+// csvTable writes readings as CSV with a header row. Nulls are empty
+// cells and timestamps keep their RFC 3339 form.
+type csvTable struct {
+	w    *csv.Writer
+	cols []column
+	rec  []string
+}
+
+func newCSVTable(w io.Writer, cols []column) (*csvTable, error) {
+	t := &csvTable{w: csv.NewWriter(w), cols: cols, rec: make([]string, len(cols))}
+	for i, c := range cols {
+		t.rec[i] = c.name
+	}
+	return t, t.w.Write(t.rec)
+}
+
+func (t *csvTable) Write(r *convRow) error {
+	for i, c := range t.cols {
+		switch v := c.value(r).(type) {
+		case nil:
+			t.rec[i] = ""
+		case string:
+			t.rec[i] = v
+		case float64:
+			t.rec[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case int64:
+			t.rec[i] = strconv.FormatInt(v, 10)
+		case bool:
+			t.rec[i] = strconv.FormatBool(v)
+		case time.Time:
+			t.rec[i] = v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return t.w.Write(t.rec)
+}
+
+func (t *csvTable) Close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// readCSVTable reads CSV as written by csvTable, calling fn with each
+// row's values in the order of cols, as their value functions return
+// them, or with the error that kept a row from being read. The header
+// must name exactly the columns of cols, in any order.
+func readCSVTable(in io.Reader, cols []column, fn func(row []any, err error) error) error {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	index := make(map[string]int, len(cols))
+	for i, c := range cols {
+		index[c.name] = i
+	}
+	pos := make([]int, len(header)) // column index of each field
+	seen := make(map[string]bool)
+	var diffs []string
+	for i, name := range header {
+		j, ok := index[name]
+		if !ok || seen[name] {
+			diffs = append(diffs, "unexpected column "+name)
+			continue
+		}
+		pos[i] = j
+		seen[name] = true
+	}
+	for _, c := range cols {
+		if !seen[c.name] {
+			diffs = append(diffs, "missing column "+c.name)
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("header: %s", strings.Join(diffs, "; "))
+	}
+
+	row := make([]any, len(cols))
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return err
+			}
+		} else if len(rec) != len(header) {
+			err = fmt.Errorf("%d fields, want %d", len(rec), len(header))
+		} else {
+			for i, cell := range rec {
+				c := cols[pos[i]]
+				if row[pos[i]], err = parseCell(c, cell); err != nil {
+					err = fmt.Errorf("%s: %w", c.name, err)
+					break
+				}
+			}
+		}
+		if err != nil {
+			err = fn(nil, err)
+		} else {
+			err = fn(row, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseCell parses a CSV cell of column c.
+func parseCell(c column, cell string) (any, error) {
+	if cell == "" && c.optional {
+		return nil, nil
+	}
+	switch c.kind {
+	case colString:
+		return cell, nil
+	case colDouble:
+		return strconv.ParseFloat(cell, 64)
+	case colInt64:
+		return strconv.ParseInt(cell, 10, 64)
+	case colBool:
+		return strconv.ParseBool(cell)
+	default:
+		return time.Parse(time.RFC3339Nano, cell)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// debugVars are the run's counters, served on /debug/vars under
+// "sensorgen" next to the runtime's memstats and cmdline.
+var debugVars = expvar.NewMap("sensorgen")
+
+// serveDebug serves the runtime profiles (/debug/pprof/) and expvar
+// (/debug/vars) on addr, for profiling a run under load. Listening happens
+// up front so a busy port is reported before generation starts.
+func serveDebug(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("-debug-addr: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// No write timeout: CPU profiles and traces stream for as long as asked.
+	go (&http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}).Serve(ln)
+	return nil
+}
+
+// publishDebugVars adds the error budget, the sinks' queues, the
+// outcomes of their failed batches and their health to debugVars; records
+// and bytes are added as batches are written.
+func publishDebugVars(errs *errorBudget, out *fanOut, names []string) {
+	debugVars.Set("errors", expvar.Func(func() any { return errs.Total() }))
+	debugVars.Set("queued", expvar.Func(func() any {
+		queued := make(map[string]int, len(names))
+		for i, n := range out.Queued() {
+			queued[names[i]] = n
+		}
+		return queued
+	}))
+	debugVars.Set("delivery", expvar.Func(func() any {
+		delivery := make(map[string]deliveryCounts, len(names))
+		for i, d := range out.Deliveries() {
+			delivery[names[i]] = d
+		}
+		return delivery
+	}))
+	debugVars.Set("health", expvar.Func(func() any {
+		health := make(map[string]sinkHealth, len(names))
+		for i, h := range out.Health() {
+			health[names[i]] = h
+		}
+		return health
+	}))
+}
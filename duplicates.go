@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// duplicateInjector retransmits a fraction of readings, as field gateways
+// do on flaky links when an acknowledgement goes missing. Most copies are
+// exact; a share are near duplicates that a gateway re-encoded on the way:
+// the timestamp truncated to milliseconds, the value rounded to three
+// decimals and the quality score recomputed.
+type duplicateInjector struct {
+	fraction float64
+	near     float64 // share of duplicates that are near duplicates
+}
+
+func newDuplicateInjector(fraction, near float64) *duplicateInjector {
+	if fraction <= 0 {
+		return nil
+	}
+	return &duplicateInjector{fraction: fraction, near: near}
+}
+
+// duplicate returns a copy of r to retransmit, if r is chosen.
+func (d *duplicateInjector) duplicate(r SensorReading, rng *rand.Rand) (SensorReading, bool) {
+	if rng.Float64() >= d.fraction {
+		return r, false
+	}
+	if rng.Float64() < d.near {
+		if t, err := time.Parse(time.RFC3339Nano, r.Timestamp); err == nil {
+			r.Timestamp = t.Truncate(time.Millisecond).Format(time.RFC3339Nano)
+		}
+		if isFinite(r.Value) {
+			r.Value = math.Round(r.Value*1000) / 1000
+		}
+		r.Quality = min(r.Quality+(rng.Float64()-0.5)*0.02, 1)
+	}
+	return r, true
+}
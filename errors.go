@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// Error classes counted by the error budget.
+const (
+	errClassMarshal    = "marshal"     // reading could not be encoded; record skipped
+	errClassWrite      = "write"       // sink rejected a batch
+	errClassClose      = "close"       // sink failed to flush on shutdown
+	errClassDeadLetter = "dead-letter" // failed batch could not be dead-lettered; records lost
+	errClassStat       = "stat"        // output file could not be inspected for stats
+	errClassRecipe     = "recipe"      // run recipe could not be written
+	errClassManifest   = "manifest"    // run manifest could not be written
+	errClassCheckpoint = "checkpoint"  // checkpoint could not be saved
+	errClassParse      = "parse"       // replayed line could not be decoded; line skipped
+)
+
+// sinkErrClass qualifies class with the sink it applies to when several
+// sinks are in use, e.g. "write (s3)".
+func sinkErrClass(class, sink string) string {
+	if sink == "" {
+		return class
+	}
+	return class + " (" + sink + ")"
+}
+
+// errBudgetExceeded is returned once more errors occurred than allowed.
+var errBudgetExceeded = errors.New("error budget exceeded")
+
+// errorBudget counts errors by class and trips once more than max have
+// occurred. It is safe for concurrent use.
+type errorBudget struct {
+	mu       sync.Mutex
+	max      int // negative means unlimited
+	counts   map[string]int64
+	last     map[string]error
+	total    int64
+	exceeded bool
+}
+
+func newErrorBudget(max int) *errorBudget {
+	return &errorBudget{max: max, counts: make(map[string]int64), last: make(map[string]error)}
+}
+
+// Record counts err under class and reports whether the budget is now
+// exceeded.
+func (b *errorBudget) Record(class string, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.counts[class]++
+	b.last[class] = err
+	b.total++
+	if b.max >= 0 && b.total > int64(b.max) {
+		b.exceeded = true
+	}
+	return b.exceeded
+}
+
+// Err returns errBudgetExceeded once the budget has been exceeded.
+func (b *errorBudget) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exceeded {
+		return fmt.Errorf("%w: %d errors (max %d)", errBudgetExceeded, b.total, b.max)
+	}
+	return nil
+}
+
+// Total returns the number of errors recorded.
+func (b *errorBudget) Total() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
+
+// Print writes the per-class breakdown with the most recent error of each
+// class.
+func (b *errorBudget) Print() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Printf("Errors: %d\n", b.total)
+	for _, class := range b.classes() {
+		fmt.Printf("  %s: %d (last: %v)\n", class, b.counts[class], b.last[class])
+	}
+}
+
+// Attr is Print's breakdown as a log attribute.
+func (b *errorBudget) Attr() slog.Attr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	attrs := []any{slog.Int64("total", b.total)}
+	for _, class := range b.classes() {
+		attrs = append(attrs, slog.Group(class, "count", b.counts[class], "last", b.last[class].Error()))
+	}
+	return slog.Group("errors", attrs...)
+}
+
+// errorStats is a snapshot of an error budget's counts, as -stats-json
+// writes it.
+type errorStats struct {
+	Total   int64                 `json:"total"`
+	Classes map[string]classStats `json:"classes,omitempty"`
+}
+
+type classStats struct {
+	Count int64  `json:"count"`
+	Last  string `json:"last"`
+}
+
+// Stats returns a snapshot of the counts.
+func (b *errorBudget) Stats() errorStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := errorStats{Total: b.total}
+	for class, n := range b.counts {
+		if s.Classes == nil {
+			s.Classes = make(map[string]classStats)
+		}
+		s.Classes[class] = classStats{Count: n, Last: b.last[class].Error()}
+	}
+	return s
+}
+
+// classes returns the classes with errors, sorted. b.mu must be held.
+func (b *errorBudget) classes() []string {
+	classes := make([]string, 0, len(b.counts))
+	for class := range b.counts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Kinds of event record.
+const (
+	eventESDActivated = "esd_activated"
+	eventESDReset     = "esd_reset"
+	eventValveClosed  = "valve_closed"
+	eventValveOpened  = "valve_opened"
+	eventPumpRestart  = "pump_restart" // eventPumpTrip starts the trip
+)
+
+// EventRecord is a discrete SCADA event: an emergency shutdown, a valve
+// actuation, a pump trip, a recalibration or a firmware update. Events are a record type of
+// their own, kept apart from the analog readings; AssetID names what acted
+// and Cause what set it off, so the two streams can be joined.
+type EventRecord struct {
+	EventID    string   `json:"event_id"`
+	Timestamp  string   `json:"timestamp"`
+	Type       string   `json:"event_type"`
+	PipelineID string   `json:"pipeline_id"`
+	AssetID    string   `json:"asset_id"` // pipeline, valve or other sensor, or pump station
+	Cause      string   `json:"cause"`    // leak, pump_trip, calibration_drift or firmware_rollout
+	MilePost   float64  `json:"mile_post"`
+	AsFound    *float64 `json:"as_found,omitempty"`         // recalibrations: the error found, in the sensor's unit
+	AsLeft     *float64 `json:"as_left,omitempty"`          // and the error left
+	Firmware   string   `json:"firmware_version,omitempty"` // firmware updates: the version installed
+}
+
+// esdSystem is the emergency shutdown system of the fleet. A leak trips
+// its pipeline's ESD once detected, 2-10 minutes after it starts, and the
+// ESD drives the nearest valve either side of the leak closed; once the
+// leak is over, the ESD is reset and the valves reopen. Pump trips are
+// reported as they start and end. Each action is recorded as an event.
+type esdSystem struct {
+	leaks map[leakKey]*esdTrip
+	down  map[*pumpStation]bool // stations whose trip has been reported
+	log   *eventLog
+}
+
+// leakKey identifies a leak by its pipeline and start.
+type leakKey struct {
+	pipeline string
+	start    time.Time
+}
+
+// esdTrip is the ESD response to one leak.
+type esdTrip struct {
+	detect time.Time      // when the leak is detected
+	fired  bool           // the ESD has tripped
+	valves []*fleetSensor // valves it closed
+}
+
+func newESDSystem(log *eventLog) *esdSystem {
+	return &esdSystem{leaks: make(map[leakKey]*esdTrip), down: make(map[*pumpStation]bool), log: log}
+}
+
+// update acts on the leaks in progress at now and those that ended
+// before it, and notes pump trips starting or ending.
+func (e *esdSystem) update(f *fleet, events *eventScheduler, ended []backgroundEvent, now time.Time, rng *rand.Rand) {
+	if events != nil {
+		for _, ev := range events.active {
+			if ev.kind != eventLeak {
+				continue
+			}
+			key := leakKey{ev.pipeline, ev.start}
+			t := e.leaks[key]
+			if t == nil {
+				t = &esdTrip{detect: ev.start.Add(2*time.Minute + time.Duration(rng.Int63n(int64(8*time.Minute))))}
+				e.leaks[key] = t
+			}
+			if !t.fired && !now.Before(t.detect) {
+				e.trip(f, t, ev, now)
+			}
+		}
+		for _, ev := range ended {
+			if ev.kind != eventLeak {
+				continue
+			}
+			key := leakKey{ev.pipeline, ev.start}
+			if t := e.leaks[key]; t != nil && t.fired {
+				e.reset(t, ev, now)
+			}
+			delete(e.leaks, key)
+		}
+	}
+	for _, st := range f.stations {
+		switch {
+		case !st.running && !e.down[st]:
+			e.down[st] = true
+			e.log.record(st.tripStart, eventPumpTrip, st.Pipeline, st.ID, eventPumpTrip, st.Location.MilePost)
+		case st.running && e.down[st]:
+			delete(e.down, st)
+			e.log.record(st.tripEnd, eventPumpRestart, st.Pipeline, st.ID, eventPumpTrip, st.Location.MilePost)
+		}
+	}
+}
+
+// trip activates the ESD for leak ev and closes the valves either side
+// of it.
+func (e *esdSystem) trip(f *fleet, t *esdTrip, ev backgroundEvent, now time.Time) {
+	t.fired = true
+	e.log.record(now, eventESDActivated, ev.pipeline, ev.pipeline, eventLeak, ev.milePost)
+	var up, down *fleetSensor
+	for _, s := range f.byPipeline[ev.pipeline] {
+		if sensorTypes[s.Type].Type != "valve_position" || s.process != nil {
+			continue
+		}
+		mp := s.Location.MilePost
+		switch {
+		case mp <= ev.milePost && (up == nil || mp > up.Location.MilePost):
+			up = s
+		case mp > ev.milePost && (down == nil || mp < down.Location.MilePost):
+			down = s
+		}
+	}
+	for _, v := range []*fleetSensor{up, down} {
+		if v == nil || v.shut {
+			continue
+		}
+		v.shut = true
+		t.valves = append(t.valves, v)
+		e.log.record(now, eventValveClosed, ev.pipeline, v.ID, eventLeak, v.Location.MilePost)
+	}
+}
+
+// reset resets the ESD for leak ev and reopens the valves it closed.
+func (e *esdSystem) reset(t *esdTrip, ev backgroundEvent, now time.Time) {
+	e.log.record(now, eventESDReset, ev.pipeline, ev.pipeline, eventLeak, ev.milePost)
+	for _, v := range t.valves {
+		v.shut = false
+		e.log.record(now, eventValveOpened, ev.pipeline, v.ID, eventLeak, v.Location.MilePost)
+	}
+}
+
+// eventLog collects the event records of a run, numbering them.
+type eventLog struct {
+	records []EventRecord
+	seq     int
+}
+
+// record logs an event at at and returns it to fill in.
+func (l *eventLog) record(at time.Time, kind, pipeline, asset, cause string, milePost float64) *EventRecord {
+	l.seq++
+	l.records = append(l.records, EventRecord{
+		EventID:    fmt.Sprintf("EVT-%08d", l.seq),
+		Timestamp:  at.UTC().Format(time.RFC3339Nano),
+		Type:       kind,
+		PipelineID: pipeline,
+		AssetID:    asset,
+		Cause:      cause,
+		MilePost:   milePost,
+	})
+	return &l.records[len(l.records)-1]
+}
+
+// TakeEvents returns the event records made since the last call, oldest
+// first, or nil when no events are simulated.
+func (g *Generator) TakeEvents() []EventRecord {
+	if g.eventLog == nil {
+		return nil
+	}
+	records := g.eventLog.records
+	g.eventLog.records = nil
+	return records
+}
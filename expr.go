@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a compiled expression over a reading, for derived fields. The
+// language is small: numbers, strings in single or double quotes, true
+// and false; the reading's fields by their JSON names (location's as lat,
+// lon and mile_post); arithmetic (+ - * / %, + also joining strings),
+// comparisons (== != < <= > >=), logic (&& || !), the conditional
+// c ? a : b, parentheses, and the functions abs, min, max, round, floor and
+// ceil. An operation on values of the wrong type yields null.
+type expr func(r *SensorReading) any
+
+// exprVars are the reading fields expressions can use.
+var exprVars = map[string]expr{
+	"sensor_id":        func(r *SensorReading) any { return r.SensorID },
+	"timestamp":        func(r *SensorReading) any { return r.Timestamp },
+	"type":             func(r *SensorReading) any { return r.Type },
+	"value":            func(r *SensorReading) any { return r.Value },
+	"unit":             func(r *SensorReading) any { return r.Unit },
+	"lat":              func(r *SensorReading) any { return r.Location.Lat },
+	"lon":              func(r *SensorReading) any { return r.Location.Lon },
+	"mile_post":        func(r *SensorReading) any { return r.Location.MilePost },
+	"pipeline_id":      func(r *SensorReading) any { return r.PipelineID },
+	"status":           func(r *SensorReading) any { return r.Status },
+	"quality_score":    func(r *SensorReading) any { return r.Quality },
+	"alert_level":      func(r *SensorReading) any { return r.AlertLevel },
+	"pair_id":          func(r *SensorReading) any { return r.PairID },
+	"backfilled":       func(r *SensorReading) any { return r.Backfilled },
+	"cohort":           func(r *SensorReading) any { return r.Cohort },
+	"ingested_at":      func(r *SensorReading) any { return r.IngestedAt },
+	"sequence":         func(r *SensorReading) any { return float64(r.Sequence) },
+	"terminal_id":      func(r *SensorReading) any { return r.TerminalID },
+	"tank_id":          func(r *SensorReading) any { return r.TankID },
+	"station_id":       func(r *SensorReading) any { return r.StationID },
+	"gateway_id":       func(r *SensorReading) any { return r.GatewayID },
+	"transmitted_at":   func(r *SensorReading) any { return r.TransmittedAt },
+	"battery_pct":      func(r *SensorReading) any { return r.BatteryPct },
+	"rssi_dbm":         func(r *SensorReading) any { return r.RSSI },
+	"uptime_s":         func(r *SensorReading) any { return float64(r.Uptime) },
+	"firmware_version": func(r *SensorReading) any { return r.Firmware },
+	"run_id":           func(r *SensorReading) any { return r.RunID },
+}
+
+// exprFuncs are the functions expressions can call, by name, with the
+// number of arguments each takes.
+var exprFuncs = map[string]struct {
+	args int
+	fn   func(x []float64) float64
+}{
+	"abs":   {1, func(x []float64) float64 { return math.Abs(x[0]) }},
+	"min":   {2, func(x []float64) float64 { return math.Min(x[0], x[1]) }},
+	"max":   {2, func(x []float64) float64 { return math.Max(x[0], x[1]) }},
+	"round": {1, func(x []float64) float64 { return math.Round(x[0]) }},
+	"floor": {1, func(x []float64) float64 { return math.Floor(x[0]) }},
+	"ceil":  {1, func(x []float64) float64 { return math.Ceil(x[0]) }},
+}
+
+// exprParser parses an expression by recursive descent.
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+// compileExpr compiles the expression src.
+func compileExpr(src string) (expr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return e, nil
+}
+
+// lexExpr splits src into tokens: numbers, quoted strings (kept quoted),
+// names and operators.
+func lexExpr(src string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			toks, i = append(toks, src[i:j]), j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(src[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks, i = append(toks, src[i:i+j+2]), i+j+2
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks, i = append(toks, src[i:j]), j
+		default:
+			if i+1 < len(src) {
+				if op := src[i : i+2]; op == "==" || op == "!=" || op == "<=" || op == ">=" || op == "&&" || op == "||" {
+					toks, i = append(toks, op), i+2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!?:(),", rune(c)) {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks, i = append(toks, string(c)), i+1
+		}
+	}
+	return toks, nil
+}
+
+// peek returns the next token, "" at the end.
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(tok string) error {
+	if p.peek() != tok {
+		if p.pos >= len(p.toks) {
+			return fmt.Errorf("missing %q at end", tok)
+		}
+		return fmt.Errorf("want %q, found %q", tok, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// conditional parses c ? a : b, or a lower-precedence expression.
+func (p *exprParser) conditional() (expr, error) {
+	cond, err := p.binary(0)
+	if err != nil || p.peek() != "?" {
+		return cond, err
+	}
+	p.pos++
+	a, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	return func(r *SensorReading) any {
+		if cond(r) == true {
+			return a(r)
+		}
+		return b(r)
+	}, nil
+}
+
+// exprLevels are the binary operators by precedence, lowest first.
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses the left-associative binary operators of level and above.
+func (p *exprParser) binary(level int) (expr, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if !slices.Contains(exprLevels[level], op) {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr(op, x, y)
+	}
+}
+
+// unary parses -x, !x or a primary expression.
+func (p *exprParser) unary() (expr, error) {
+	switch p.peek() {
+	case "-":
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *SensorReading) any {
+			if v, ok := x(r).(float64); ok {
+				return -v
+			}
+			return nil
+		}, nil
+	case "!":
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *SensorReading) any { return x(r) != true }, nil
+	}
+	return p.primary()
+}
+
+// primary parses a literal, a field, a call or a parenthesized expression.
+func (p *exprParser) primary() (expr, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	switch c := tok[0]; {
+	case tok == "(":
+		x, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case c == '"' || c == '\'':
+		s := tok[1 : len(tok)-1]
+		return func(*SensorReading) any { return s }, nil
+	case c >= '0' && c <= '9' || c == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", tok)
+		}
+		return func(*SensorReading) any { return v }, nil
+	case tok == "true" || tok == "false":
+		v := tok == "true"
+		return func(*SensorReading) any { return v }, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		if p.peek() == "(" {
+			return p.call(tok)
+		}
+		if v, ok := exprVars[tok]; ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("unknown field %q", tok)
+	}
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
+
+// call parses the arguments of a call to the function name.
+func (p *exprParser) call(name string) (expr, error) {
+	f, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	p.pos++ // (
+	var args []expr
+	for p.peek() != ")" {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.conditional()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	p.pos++ // )
+	if len(args) != f.args {
+		return nil, fmt.Errorf("%s takes %d arguments, not %d", name, f.args, len(args))
+	}
+	return func(r *SensorReading) any {
+		x := make([]float64, len(args))
+		for i, a := range args {
+			v, ok := a(r).(float64)
+			if !ok {
+				return nil
+			}
+			x[i] = v
+		}
+		return f.fn(x)
+	}, nil
+}
+
+// binaryExpr applies the binary operator op to x and y.
+func binaryExpr(op string, x, y expr) expr {
+	switch op {
+	case "||":
+		return func(r *SensorReading) any { return x(r) == true || y(r) == true }
+	case "&&":
+		return func(r *SensorReading) any { return x(r) == true && y(r) == true }
+	case "==":
+		return func(r *SensorReading) any { return x(r) == y(r) }
+	case "!=":
+		return func(r *SensorReading) any { return x(r) != y(r) }
+	}
+	return func(r *SensorReading) any {
+		a, b := x(r), y(r)
+		if s, ok := a.(string); ok {
+			t, ok := b.(string)
+			if !ok {
+				return nil
+			}
+			switch op {
+			case "+":
+				return s + t
+			case "<":
+				return s < t
+			case "<=":
+				return s <= t
+			case ">":
+				return s > t
+			case ">=":
+				return s >= t
+			}
+			return nil
+		}
+		u, ok1 := a.(float64)
+		v, ok2 := b.(float64)
+		if !ok1 || !ok2 {
+			return nil
+		}
+		switch op {
+		case "+":
+			return u + v
+		case "-":
+			return u - v
+		case "*":
+			return u * v
+		case "/":
+			return u / v
+		case "%":
+			return math.Mod(u, v)
+		case "<":
+			return u < v
+		case "<=":
+			return u <= v
+		case ">":
+			return u > v
+		case ">=":
+			return u >= v
+		}
+		return nil
+	}
+}
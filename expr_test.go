@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileExpr(t *testing.T) {
+	r := &SensorReading{
+		SensorID:   "SNS-pre-0001",
+		Type:       "pressure",
+		Value:      812.5,
+		Unit:       "psi",
+		Location:   Location{Lat: 29.76, Lon: -95.37, MilePost: 12},
+		PipelineID: "PIPE-TX-001",
+		Status:     "normal",
+		Quality:    0.98,
+		Backfilled: true,
+		Sequence:   42,
+		Uptime:     3600,
+	}
+	tests := []struct {
+		src  string
+		want any
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0},
+		{"7 % 4", 3.0},
+		{"-value", -812.5},
+		{"1.5e2", 150.0},
+		{"value / 2", 406.25},
+		{"'a' + \"b\"", "ab"},
+		{"pipeline_id + '/' + sensor_id", "PIPE-TX-001/SNS-pre-0001"},
+		{"value > 800", true},
+		{"value <= 800", false},
+		{"type == 'pressure'", true},
+		{"type != 'pressure'", false},
+		{"'a' < 'b'", true},
+		{"backfilled && quality_score > 0.9", true},
+		{"!backfilled || false", false},
+		{"value > 1000 ? 'high' : value > 500 ? 'mid' : 'low'", "mid"},
+		{"abs(lon)", 95.37},
+		{"min(value, 100)", 100.0},
+		{"max(sequence, uptime_s)", 3600.0},
+		{"round(quality_score * 10)", 10.0},
+		{"floor(mile_post / 5)", 2.0},
+		{"ceil(mile_post / 5)", 3.0},
+		{"value + 'x'", nil},
+		{"-unit", nil},
+		{"abs(unit)", nil},
+		{"alert_level", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := compileExpr(tt.src)
+			if err != nil {
+				t.Fatalf("compileExpr: %v", err)
+			}
+			if got := e(r); got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"", "unexpected end"},
+		{"1 +", "unexpected end"},
+		{"(1 + 2", `missing ")" at end`},
+		{"1 2", `unexpected "2"`},
+		{"'open", "unterminated string"},
+		{"value # 2", `unexpected '#'`},
+		{"speed", `unknown field "speed"`},
+		{"sqrt(value)", `unknown function "sqrt"`},
+		{"min(value)", "min takes 2 arguments, not 1"},
+		{"value > 1 ? 2", `missing ":" at end`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := compileExpr(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Sensor failure modes.
+const (
+	failStuck   = "stuck"   // output frozen at the last reported value
+	failZero    = "zero"    // flatline at zero
+	failNaN     = "nan"     // value is NaN
+	failInf     = "inf"     // value is +Inf or -Inf
+	failDropout = "dropout" // most samples go missing
+	failDead    = "dead"    // the sensor stops reporting for good
+)
+
+var failureModes = []string{failStuck, failZero, failNaN, failInf, failDropout, failDead}
+
+// dropoutLoss is the fraction of samples lost during a dropout.
+const dropoutLoss = 0.8
+
+// parseFailureModes parses a comma-separated list of failure modes.
+func parseFailureModes(spec string) ([]string, error) {
+	var modes []string
+	for _, m := range strings.Split(spec, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if !slices.Contains(failureModes, m) {
+			return nil, fmt.Errorf("unknown failure mode %q (want %s)", m, strings.Join(failureModes, ", "))
+		}
+		if !slices.Contains(modes, m) {
+			modes = append(modes, m)
+		}
+	}
+	if len(modes) == 0 {
+		return nil, fmt.Errorf("no failure modes in %q", spec)
+	}
+	return modes, nil
+}
+
+// marshalReading encodes r as JSON. JSON has no NaN or infinity, so a
+// non-finite value is written as the string "NaN", "Infinity" or
+// "-Infinity", as the protobuf JSON mapping does.
+func marshalReading(r *SensorReading) ([]byte, error) {
+	if isFinite(r.Value) {
+		return json.Marshal(r)
+	}
+	v := "NaN"
+	if math.IsInf(r.Value, 1) {
+		v = "Infinity"
+	} else if math.IsInf(r.Value, -1) {
+		v = "-Infinity"
+	}
+	return json.Marshal(struct {
+		*SensorReading
+		Value string `json:"value"`
+	}{r, v})
+}
+
+// unmarshalReading decodes a reading encoded by marshalReading, taking
+// the strings "NaN", "Infinity" and "-Infinity" for the value.
+func unmarshalReading(data []byte, r *SensorReading) error {
+	var aux struct {
+		*SensorReading
+		Value json.RawMessage `json:"value"`
+	}
+	aux.SensorReading = r
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	switch string(aux.Value) {
+	case "":
+		return fmt.Errorf("missing value")
+	case `"NaN"`:
+		r.Value = math.NaN()
+	case `"Infinity"`:
+		r.Value = math.Inf(1)
+	case `"-Infinity"`:
+		r.Value = math.Inf(-1)
+	default:
+		return json.Unmarshal(aux.Value, &r.Value)
+	}
+	return nil
+}
+
+// checkFailureSensors reports an error if a scheduled failure names a
+// sensor that is not in the fleet.
+func checkFailureSensors(specs []FailureSpec, points []SensorPoint) error {
+	for _, f := range specs {
+		if !slices.ContainsFunc(points, func(p SensorPoint) bool { return p.ID == f.Sensor }) {
+			return fmt.Errorf("failure of unknown sensor %q", f.Sensor)
+		}
+	}
+	return nil
+}
+
+// sensorFailure is a failure in progress on one sensor.
+type sensorFailure struct {
+	mode string
+	end  time.Time // zero for a failure that lasts the rest of the run
+	held float64   // stuck value, or the sign of an infinite value
+}
+
+// failureInjector starts failures on fleet sensors: at random, perDay per
+// sensor per day with the mode drawn from modes, and at the times the
+// schedule gives relative to the first sample.
+type failureInjector struct {
+	perDay   float64
+	modes    []string
+	schedule []FailureSpec // sorted by At; started entries are removed
+	bySensor map[string]*fleetSensor
+	start    time.Time
+}
+
+func newFailureInjector(perDay float64, modes []string, schedule []FailureSpec, f *fleet) *failureInjector {
+	if perDay <= 0 && len(schedule) == 0 {
+		return nil
+	}
+	if len(modes) == 0 {
+		modes = failureModes
+	}
+	fi := &failureInjector{
+		perDay:   perDay,
+		modes:    modes,
+		schedule: slices.Clone(schedule),
+		bySensor: make(map[string]*fleetSensor, len(f.sensors)),
+	}
+	slices.SortStableFunc(fi.schedule, func(a, b FailureSpec) int { return cmp.Compare(a.At, b.At) })
+	for _, s := range f.sensors {
+		fi.bySensor[s.ID] = s
+	}
+	return fi
+}
+
+// advance starts the scheduled failures due at now.
+func (fi *failureInjector) advance(now time.Time) {
+	if fi.start.IsZero() {
+		fi.start = now
+	}
+	for len(fi.schedule) > 0 && !now.Before(fi.start.Add(time.Duration(fi.schedule[0].At))) {
+		spec := fi.schedule[0]
+		fi.schedule = fi.schedule[1:]
+		if s := fi.bySensor[spec.Sensor]; s != nil {
+			var end time.Time
+			if spec.Duration > 0 && spec.Mode != failDead {
+				end = now.Add(time.Duration(spec.Duration))
+			}
+			s.fail(spec.Mode, end)
+		}
+	}
+}
+
+// apply starts and retires failures on s and applies the current one to
+// r, sampled at now. It reports false if the sample is lost.
+func (fi *failureInjector) apply(s *fleetSensor, r *SensorReading, now time.Time, rng *rand.Rand) bool {
+	if s.failure != nil && !s.failure.end.IsZero() && !now.Before(s.failure.end) {
+		s.failure = nil
+	}
+	if s.failure == nil && fi.perDay > 0 && !s.sampled.IsZero() &&
+		rng.Float64() < fi.perDay*now.Sub(s.sampled).Hours()/24 {
+		mode := fi.modes[rng.Intn(len(fi.modes))]
+		var end time.Time
+		if mode != failDead {
+			end = now.Add(time.Minute + time.Duration(rng.Int63n(int64(29*time.Minute))))
+		}
+		s.fail(mode, end)
+		if mode == failInf && rng.Intn(2) == 0 {
+			s.failure.held = -1
+		}
+	}
+	s.sampled = now
+	if s.failure == nil {
+		return true
+	}
+	switch s.failure.mode {
+	case failStuck:
+		r.Value = s.failure.held
+	case failZero:
+		r.Value = 0
+	case failNaN:
+		r.Value = math.NaN()
+	case failInf:
+		r.Value = math.Inf(int(s.failure.held))
+	case failDropout:
+		if rng.Float64() < dropoutLoss {
+			s.sequence++ // sent, but lost on the way
+			return false
+		}
+	case failDead:
+		return false
+	}
+	return true
+}
+
+// fail starts a failure of the given mode on s, lasting until end.
+func (s *fleetSensor) fail(mode string, end time.Time) {
+	f := &sensorFailure{mode: mode, end: end, held: 1}
+	if mode == failStuck {
+		f.held = s.lastValue
+		if s.lastTime.IsZero() || !isFinite(s.lastValue) {
+			f.held = s.value
+		}
+	}
+	s.failure = f
+}
+
+// isFinite reports whether v is neither NaN nor infinite.
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
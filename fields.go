@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FieldMapping reshapes the JSON records of readings into a consumer's
+// own schema. It applies to top-level fields.
+type FieldMapping struct {
+	// Rename maps a reading field to the name it is written under.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Drop lists reading fields left out.
+	Drop []string `json:"drop,omitempty"`
+	// Add maps the names of fields to add to their values, any JSON.
+	// Strings may derive the value from the reading with the placeholders
+	// of sink templates, such as "{pipeline_id}/{sensor_id}".
+	Add map[string]json.RawMessage `json:"add,omitempty"`
+	// Derive maps the names of fields to add to expressions computing
+	// them from the reading, such as "value * 6.895"; see expr.
+	Derive map[string]string `json:"derive,omitempty"`
+}
+
+// validate checks that m names reading fields, and that no two fields
+// end up with the same name.
+func (m *FieldMapping) validate() error {
+	names := make(map[string]string) // written name -> reading field
+	for _, f := range m.Drop {
+		if _, ok := readingFields[f]; !ok {
+			return fmt.Errorf("drop: unknown field %q", f)
+		}
+		if _, ok := m.Rename[f]; ok {
+			return fmt.Errorf("field %q both renamed and dropped", f)
+		}
+	}
+	for f := range readingFields {
+		if slices.Contains(m.Drop, f) {
+			continue
+		}
+		to := f
+		if r, ok := m.Rename[f]; ok {
+			to = r
+		}
+		if to == "" {
+			return fmt.Errorf("rename %q: empty name", f)
+		}
+		if prev, ok := names[to]; ok {
+			return fmt.Errorf("fields %q and %q both written as %q", min(f, prev), max(f, prev), to)
+		}
+		names[to] = f
+	}
+	for f := range m.Rename {
+		if _, ok := readingFields[f]; !ok {
+			return fmt.Errorf("rename: unknown field %q", f)
+		}
+	}
+	for name := range m.Add {
+		if name == "" {
+			return fmt.Errorf("add: empty name")
+		}
+		if f, ok := names[name]; ok {
+			return fmt.Errorf("add %q: already written for field %q", name, f)
+		}
+	}
+	for name, src := range m.Derive {
+		if name == "" {
+			return fmt.Errorf("derive: empty name")
+		}
+		if f, ok := names[name]; ok {
+			return fmt.Errorf("derive %q: already written for field %q", name, f)
+		}
+		if _, ok := m.Add[name]; ok {
+			return fmt.Errorf("derive %q: also added", name)
+		}
+		if _, err := compileExpr(src); err != nil {
+			return fmt.Errorf("derive %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// fieldMapper applies a FieldMapping to encoded readings.
+type fieldMapper struct {
+	rename map[string]string
+	drop   map[string]bool
+	add    []addedField // by name
+}
+
+// addedField is a field FieldMapping adds: a constant JSON value, a
+// string template expanded for each reading, or an expression computed
+// from it.
+type addedField struct {
+	name     string
+	value    json.RawMessage
+	template string
+	expr     expr
+}
+
+// newFieldMapper returns the mapper of m, nil if m changes nothing.
+func newFieldMapper(m *FieldMapping) *fieldMapper {
+	if m == nil || len(m.Rename) == 0 && len(m.Drop) == 0 && len(m.Add) == 0 && len(m.Derive) == 0 {
+		return nil
+	}
+	fm := &fieldMapper{rename: m.Rename, drop: make(map[string]bool)}
+	for _, f := range m.Drop {
+		fm.drop[f] = true
+	}
+	for name, v := range m.Add {
+		var b bytes.Buffer
+		json.Compact(&b, v) // one line per record
+		a := addedField{name: name, value: b.Bytes()}
+		var s string
+		if json.Unmarshal(v, &s) == nil && strings.Contains(s, "{") {
+			a.template = s
+		}
+		fm.add = append(fm.add, a)
+	}
+	for name, src := range m.Derive {
+		e, _ := compileExpr(src) // checked by validate
+		fm.add = append(fm.add, addedField{name: name, expr: e})
+	}
+	slices.SortFunc(fm.add, func(a, b addedField) int { return strings.Compare(a.name, b.name) })
+	return fm
+}
+
+// apply returns the encoded reading r, data, reshaped: fields renamed in
+// place and dropped, then the added and derived fields in order of name.
+func (fm *fieldMapper) apply(data []byte, r *SensorReading) []byte {
+	if fm == nil {
+		return data
+	}
+	keys, values, ok := jsonFields(data)
+	if !ok {
+		return data
+	}
+	n := 0
+	for i, k := range keys {
+		if fm.drop[k] {
+			continue
+		}
+		if to, ok := fm.rename[k]; ok {
+			k = to
+		}
+		keys[n], values[n] = k, values[i]
+		n++
+	}
+	keys, values = keys[:n], values[:n]
+	for _, a := range fm.add {
+		v := a.value
+		switch {
+		case a.template != "":
+			v = strconv.AppendQuote(nil, expandTemplate(a.template, r))
+		case a.expr != nil:
+			var err error
+			if v, err = json.Marshal(a.expr(r)); err != nil {
+				v = json.RawMessage("null") // NaN or infinite
+			}
+		}
+		keys, values = append(keys, a.name), append(values, v)
+	}
+	return joinJSONFields(keys, values)
+}
+
+// written returns the names fields are written under, leaving out those
+// the mapping drops.
+func (fm *fieldMapper) written(fields []string) []string {
+	if fm == nil {
+		return fields
+	}
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if fm.drop[f] {
+			continue
+		}
+		if to, ok := fm.rename[f]; ok {
+			f = to
+		}
+		names = append(names, f)
+	}
+	return names
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Firmware update event kinds and cause.
+const (
+	eventFirmwareUpdated = "firmware_updated"
+	eventFirmwareFailed  = "firmware_update_failed"
+	causeRollout         = "firmware_rollout"
+)
+
+// firmwareRollout is a staged over-the-air update of the fleet to one
+// firmware version. The fleet is updated in waves, one every interval
+// from an interval into the run: each wave takes the fleet up to its
+// cumulative share, and its sensors pull the update at random within the
+// first half of the wave. A sensor is offline while it flashes and
+// reboots. A failed update leaves it running the new version degraded, its
+// quality scores halved for the rest of the run.
+type firmwareRollout struct {
+	version  string
+	waves    []float64 // cumulative fractions of the fleet, ascending
+	every    time.Duration
+	failures float64
+	log      *eventLog
+}
+
+// firmwareUpdate is one sensor's update in a rollout.
+type firmwareUpdate struct {
+	start, end time.Time // offline while flashing and rebooting
+	failed     bool
+	done       bool
+}
+
+func newFirmwareRollout(version string, waves []float64, every time.Duration, failures float64, log *eventLog) *firmwareRollout {
+	return &firmwareRollout{version: version, waves: waves, every: every, failures: failures, log: log}
+}
+
+// parseWaves parses a comma-separated list of cumulative percentages of
+// the fleet, such as 1,10,50,100, into fractions.
+func parseWaves(s string) ([]float64, error) {
+	var waves []float64
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("wave %q: %w", f, err)
+		}
+		if p <= 0 || p > 100 || len(waves) > 0 && p/100 <= waves[len(waves)-1] {
+			return nil, fmt.Errorf("wave %q: want rising percentages up to 100", f)
+		}
+		waves = append(waves, p/100)
+	}
+	return waves, nil
+}
+
+// plan schedules the update of the device h, first seen in a run that
+// started at epoch, unless it already runs the version or no wave takes
+// it.
+func (fr *firmwareRollout) plan(h *deviceHealth, epoch time.Time, rng *rand.Rand) {
+	u := rng.Float64()
+	if h.firmware == fr.version {
+		return
+	}
+	for k, share := range fr.waves {
+		if u < share {
+			start := epoch.Add(time.Duration(k+1)*fr.every + time.Duration(rng.Int63n(int64(fr.every/2)+1)))
+			h.ota = &firmwareUpdate{
+				start:  start,
+				end:    start.Add(30*time.Second + time.Duration(rng.Int63n(int64(150*time.Second)))),
+				failed: rng.Float64() < fr.failures,
+			}
+			return
+		}
+	}
+}
+
+// online reports whether s is up at now rather than mid-update, finishing
+// its update once it is over.
+func (fr *firmwareRollout) online(s *fleetSensor, now time.Time) bool {
+	up := s.health.ota
+	if up == nil || up.done || now.Before(up.start) {
+		return true
+	}
+	if now.Before(up.end) {
+		return false
+	}
+	up.done = true
+	s.health.firmware = fr.version
+	s.health.boot = up.end
+	s.health.degraded = up.failed
+	kind := eventFirmwareUpdated
+	if up.failed {
+		kind = eventFirmwareFailed
+	}
+	fr.log.record(up.end, kind, s.Pipeline, s.ID, causeRollout, s.Location.MilePost).Firmware = fr.version
+	return true
+}
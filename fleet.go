@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// fleetSensor is a persistent simulated sensor. Its value follows a
+// mean-reverting random walk around a per-sensor baseline, so consecutive
+// readings from one sensor are related instead of independent draws.
+type fleetSensor struct {
+	ID       string
+	Type     int // index into sensorTypes
+	Pipeline string
+	Location Location
+	PairID   string // point shared by both transmitters of a redundant pair
+
+	baseline float64
+	value    float64
+	process  *fleetSensor // B transmitter: the A transmitter whose process value it measures
+	fault    *transmitterFault
+	failure  *sensorFailure // nil while the sensor is healthy
+	sampled  time.Time      // time of the latest sample, reported or not
+	flow     *pipelineFlow  // flow meters: the throughput of their pipeline
+	line     *hydraulicLine // pressure, flow and valve sensors with -hydraulics
+	gas      *gasStream     // chromatographs: the gas they sample
+	tank     *tank          // tank farm sensors: the tank they gauge
+	station  *pumpStation   // pump station sensors: their station
+	cp       *cpCircuit     // cathodic protection sensors: what they measure
+	shut     bool           // valves: held closed by the ESD
+	cal      *calibration   // calibration error with calibration drift
+	gateway  *gateway       // the gateway that forwards its readings, if any
+	health   *deviceHealth  // with device health; nil before the first reading
+	bias     float64        // flow meters: fixed calibration error, as a fraction
+	output   float64        // last quantized output, see hold
+	holding  bool
+
+	clockOffset time.Duration // error of the sensor's clock at the start of the run
+	clockDrift  float64       // rate at which the clock gains (or loses) time, as a fraction
+
+	sequence uint64    // number of the latest reading sent
+	due      time.Time // next sample with -intervals
+
+	status      int       // index into statusNames
+	statusUntil time.Time // end of the current status; zero before the first reading
+
+	lastValue float64       // value of the most recent emitted reading
+	lastTime  time.Time     // time of the most recent emitted reading
+	interval  time.Duration // smoothed time between emissions
+}
+
+// fleet is a fixed population of sensors spread across the pipelines.
+type fleet struct {
+	sensors    []*fleetSensor
+	byPipeline map[string][]*fleetSensor
+	flows      map[string]*pipelineFlow
+	tanks      map[string][]*tank  // by pipeline, numbered from 1
+	terminals  map[string]Location // by pipeline, once it has tanks
+	stations   []*pumpStation
+}
+
+// pipelineFlow is the throughput of one pipeline. Every flow meter on the
+// pipeline measures it, so inflow and outflow balance to within meter
+// error unless a leak removes product between them.
+type pipelineFlow struct {
+	baseline float64
+	value    float64
+}
+
+func (f *pipelineFlow) step(rng *rand.Rand) {
+	f.value += 0.02*(f.baseline-f.value) + rng.NormFloat64()*0.002*f.baseline
+}
+
+// redundantTypes are the critical measurements that can be instrumented
+// with dual-redundant transmitter pairs.
+var redundantTypes = map[string]bool{"pressure": true, "flow_rate": true, "gas_detector": true}
+
+// newFleet creates n sensors with the default types assigned round-robin,
+// or in the proportions of types when it is not nil, and each type's
+// sensors spread round-robin over the pipelines, or the fleet's spread
+// over them in the proportions of pipelines when it is not nil. A fraction
+// redundant of the critical points get a second (B) transmitter measuring
+// the same process.
+func newFleet(n int, redundant float64, types, pipelines *mixer, routes routeSet, rng *rand.Rand) *fleet {
+	f := &fleet{
+		byPipeline: make(map[string][]*fleetSensor),
+		flows:      make(map[string]*pipelineFlow),
+		tanks:      make(map[string][]*tank),
+		terminals:  make(map[string]Location),
+	}
+	for _, p := range pipelineIDs {
+		base := 15000 + rng.Float64()*20000
+		f.flows[p] = &pipelineFlow{baseline: base, value: base}
+	}
+	perType := make([]int, len(sensorTypes))
+	for i := range n {
+		t := i % defaultTypes
+		if types != nil {
+			t = types.next()
+		}
+		st := sensorTypes[t]
+		perType[t]++
+		pipeline := pipelineIDs[(perType[t]-1)%len(pipelineIDs)]
+		if pipelines != nil {
+			pipeline = pipelineIDs[pipelines.next()]
+		}
+		baseline := st.Min + (0.3+rng.Float64()*0.4)*(st.Max-st.Min)
+		s := &fleetSensor{
+			ID:       fmt.Sprintf("SNS-%s-%04d", st.Type[:3], perType[t]),
+			Type:     t,
+			Pipeline: pipeline,
+			Location: routes.place(pipeline, rng),
+			baseline: baseline,
+			value:    baseline,
+		}
+		if st.Type == "flow_rate" {
+			s.flow = f.flows[pipeline]
+			s.bias = rng.NormFloat64() * 0.003
+		}
+		if st.Type == chromatographType {
+			s.gas = newGasStream(rng)
+		}
+		if isCPType(t) {
+			s.cp = newCPCircuit(st.Type, rng)
+		}
+		if isTankType(t) {
+			s.tank = f.tankFor(pipeline, st.Type, routes, rng)
+			s.ID = s.tank.ID + "-" + tankSuffixes[st.Type]
+			s.Location = s.tank.Location
+		}
+		f.add(s)
+		if redundantTypes[st.Type] && rng.Float64() < redundant {
+			s.PairID = s.ID
+			b := *s
+			s.ID += "-A"
+			b.ID += "-B"
+			b.process = s
+			f.add(&b)
+		}
+	}
+	return f
+}
+
+// SensorPoint describes one fleet sensor, for servers that expose each
+// sensor's current value (OPC UA, Modbus).
+type SensorPoint struct {
+	ID         string
+	Type       string
+	Unit       string
+	PipelineID string
+	MilePost   float64
+	Min        float64 // instrument range
+	Max        float64
+	Resolution float64
+}
+
+// Points lists the fleet's sensors in creation order, or nil without a
+// fleet.
+func (g *Generator) Points() []SensorPoint {
+	if g.fleet == nil {
+		return nil
+	}
+	points := make([]SensorPoint, len(g.fleet.sensors))
+	for i, s := range g.fleet.sensors {
+		st := sensorTypes[s.Type]
+		points[i] = SensorPoint{
+			ID:         s.ID,
+			Type:       st.Type,
+			Unit:       st.Unit,
+			PipelineID: s.Pipeline,
+			MilePost:   s.Location.MilePost,
+			Min:        st.Min,
+			Max:        st.Max,
+			Resolution: st.Resolution,
+		}
+		if c, ok := g.units[st.Unit]; ok {
+			p := &points[i]
+			p.Unit, p.Min, p.Max, p.Resolution = c.unit, c.apply(st.Min), c.apply(st.Max), c.resolution
+		}
+	}
+	return points
+}
+
+func (f *fleet) add(s *fleetSensor) {
+	f.sensors = append(f.sensors, s)
+	f.byPipeline[s.Pipeline] = append(f.byPipeline[s.Pipeline], s)
+}
+
+// step advances the sensor's random walk and returns the new value. A
+// valve shut by the ESD reads closed until it is reopened, when it walks
+// back to its setpoint.
+func (s *fleetSensor) step(rng *rand.Rand) float64 {
+	st := sensorTypes[s.Type]
+	if s.shut {
+		s.value = st.Min
+		return s.value
+	}
+	span := st.Max - st.Min
+	s.value += 0.05*(s.baseline-s.value) + rng.NormFloat64()*0.005*span
+	s.value = min(max(s.value, st.Min), st.Max)
+	return s.value
+}
+
+// measure returns the sensor's reading of its process at now, or of its
+// tank, station or circuit for tank farm, pump station and cathodic
+// protection sensors. Transmitters
+// in a redundant pair add their own small noise, so the pair agrees to
+// about 0.1% of range, and occasionally diverge through a fault.
+//
+// Flow meters measure their pipeline's throughput with their own
+// calibration bias and 0.2% noise. With hydraulics, pressure sensors
+// measure the line pressure at their mile post.
+func (s *fleetSensor) measure(now time.Time, rng *rand.Rand) float64 {
+	var v float64
+	switch {
+	case s.flow != nil:
+		if s.line != nil {
+			s.line.update(now, rng)
+		} else {
+			s.flow.step(rng)
+		}
+		v = s.flow.value * (1 + s.bias + rng.NormFloat64()*0.002)
+	case s.line != nil && sensorTypes[s.Type].Type == "pressure":
+		s.line.update(now, rng)
+		s.value = s.line.pressure(s.Location.MilePost)
+		v = s.value + rng.NormFloat64()*0.001*(sensorTypes[s.Type].Max-sensorTypes[s.Type].Min)
+	case s.tank != nil:
+		s.value = s.tank.measure(sensorTypes[s.Type].Type, now, rng)
+		v = s.value
+	case s.station != nil:
+		s.value = s.station.measure(sensorTypes[s.Type].Type, now, rng)
+		v = s.value
+	case s.cp != nil:
+		s.value = s.cp.measure(sensorTypes[s.Type].Type, now, rng)
+		v = s.value
+	case s.process != nil:
+		v = s.process.value
+	default:
+		v = s.step(rng)
+	}
+	if s.PairID == "" {
+		return v
+	}
+	st := sensorTypes[s.Type]
+	v += rng.NormFloat64() * 0.001 * (st.Max - st.Min)
+	return s.applyFault(v, now, rng)
+}
+
+// Transmitter fault kinds.
+const (
+	faultDrift = "drift" // calibration drift: a bias growing over the fault
+	faultStuck = "stuck" // output frozen at its last value
+)
+
+// transmitterFault is a period during which one transmitter of a pair
+// disagrees with its partner.
+type transmitterFault struct {
+	kind  string
+	start time.Time
+	end   time.Time
+	peak  float64 // drift bias at end of the fault, in engineering units
+	held  float64 // stuck value
+}
+
+// applyFault starts, applies and retires faults on a paired transmitter.
+// Faults start on average once per transmitter per hour and last 1-10
+// minutes.
+func (s *fleetSensor) applyFault(v float64, now time.Time, rng *rand.Rand) float64 {
+	if s.fault != nil && !now.Before(s.fault.end) {
+		s.fault = nil
+	}
+	if s.fault == nil && !s.lastTime.IsZero() && rng.Float64() < now.Sub(s.lastTime).Hours() {
+		st := sensorTypes[s.Type]
+		f := &transmitterFault{
+			kind:  faultDrift,
+			start: now,
+			end:   now.Add(time.Minute + time.Duration(rng.Int63n(int64(9*time.Minute)))),
+			peak:  (0.02 + rng.Float64()*0.06) * (st.Max - st.Min),
+			held:  v,
+		}
+		if rng.Intn(2) == 0 {
+			f.peak = -f.peak
+		}
+		if rng.Float64() < 0.3 {
+			f.kind = faultStuck
+		}
+		s.fault = f
+	}
+	if s.fault == nil {
+		return v
+	}
+	if s.fault.kind == faultStuck {
+		return s.fault.held
+	}
+	return v + s.fault.peak*float64(now.Sub(s.fault.start))/float64(s.fault.end.Sub(s.fault.start))
+}
+
+// hold quantizes v to the sensor's resolution, keeping the previous output
+// until v moves at least one full step away from it.
+func (s *fleetSensor) hold(v float64) float64 {
+	res := sensorTypes[s.Type].Resolution
+	if !s.holding || math.Abs(v-s.output) >= res {
+		s.output, s.holding = quantize(v, res), true
+	}
+	return s.output
+}
+
+// skewClocks gives every sensor a clock offset drawn from a normal
+// distribution with standard deviation offset, and a drift rate with
+// standard deviation drift (a fraction: 50 ppm is 50e-6).
+func (f *fleet) skewClocks(offset time.Duration, drift float64, rng *rand.Rand) {
+	for _, s := range f.sensors {
+		s.clockOffset = time.Duration(rng.NormFloat64() * float64(offset))
+		s.clockDrift = rng.NormFloat64() * drift
+	}
+}
+
+// clock returns the time the sensor's own clock shows at true time t,
+// epoch being the start of the run.
+func (s *fleetSensor) clock(t, epoch time.Time) time.Time {
+	return t.Add(s.clockOffset + time.Duration(s.clockDrift*float64(t.Sub(epoch))))
+}
+
+// nextSequence returns the sequence number of the sensor's next reading.
+func (s *fleetSensor) nextSequence() uint64 {
+	s.sequence++
+	return s.sequence
+}
+
+// emitted records that the sensor reported value at t.
+func (s *fleetSensor) emitted(value float64, t time.Time) {
+	if !s.lastTime.IsZero() {
+		gap := t.Sub(s.lastTime)
+		if s.interval == 0 {
+			s.interval = gap
+		} else {
+			s.interval = (s.interval*7 + gap) / 8
+		}
+	}
+	s.lastValue, s.lastTime = value, t
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// eventGatewayOutage is a gateway's uplink outage, as an anomaly.
+const eventGatewayOutage = "gateway_outage"
+
+// gateway is an edge gateway: it collects the readings of the fleet
+// sensors attached to it and forwards them upstream together, every
+// interval, all stamped with the transmission's time. While its uplink is
+// down it keeps buffering, and sends everything in one catch-up burst when
+// the link comes back.
+type gateway struct {
+	ID       string
+	Pipeline string
+
+	buffer     []SensorReading
+	next       time.Time // next transmission; zero before the first sample
+	nextOutage time.Time
+	outageEnd  time.Time // end of the outage in progress, or zero
+}
+
+// gatewaySet is the fleet's gateways, with the link behaviour they share.
+type gatewaySet struct {
+	gateways       []*gateway
+	byID           map[string]*gateway
+	interval       time.Duration
+	outagesPerHour float64
+}
+
+// gatewayID returns the ID of gateway n on pipeline: GW-TX-001-03.
+func gatewayID(pipeline string, n int) string {
+	return fmt.Sprintf("GW-%s-%02d", strings.TrimPrefix(pipeline, "PIPE-"), n)
+}
+
+// attachGateways puts perPipeline gateways on every pipeline, each serving
+// an equal stretch of it, and attaches every fleet sensor to the gateway
+// of its stretch. The gateways transmit every interval and lose their
+// uplink outagesPerDay times a day on average.
+func (f *fleet) attachGateways(perPipeline int, interval time.Duration, outagesPerDay float64, routes routeSet) *gatewaySet {
+	gs := &gatewaySet{byID: make(map[string]*gateway), interval: interval, outagesPerHour: outagesPerDay / 24}
+	for _, p := range pipelineIDs {
+		first := len(gs.gateways)
+		for i := range perPipeline {
+			gw := &gateway{ID: gatewayID(p, i+1), Pipeline: p}
+			gs.gateways = append(gs.gateways, gw)
+			gs.byID[gw.ID] = gw
+		}
+		length := routes.length(p)
+		for _, s := range f.byPipeline[p] {
+			i := min(int(s.Location.MilePost/length*float64(perPipeline)), perPipeline-1)
+			s.gateway = gs.gateways[first+max(i, 0)]
+		}
+	}
+	return gs
+}
+
+// hold buffers r at its gateway.
+func (gs *gatewaySet) hold(r SensorReading) {
+	gw := gs.byID[r.GatewayID]
+	gw.buffer = append(gw.buffer, r)
+}
+
+// transmit passes the readings each gateway sends by now to send, with the
+// time they were sent. The first transmissions are staggered over an
+// interval, so the gateways do not all send at once.
+func (gs *gatewaySet) transmit(now time.Time, rng *rand.Rand, send func(r *SensorReading, t time.Time)) {
+	for _, gw := range gs.gateways {
+		if gw.next.IsZero() {
+			gw.next = now.Add(time.Duration(rng.Int63n(int64(gs.interval))))
+			if gs.outagesPerHour > 0 {
+				gw.nextOutage = now.Add(interarrival(gs.outagesPerHour, rng))
+			}
+			continue
+		}
+		for !now.Before(gw.next) {
+			t := gw.next
+			if gs.outagesPerHour > 0 && !t.Before(gw.nextOutage) {
+				// The link goes down: keep buffering and send on its return.
+				gw.outageEnd = gw.nextOutage.Add(time.Minute + time.Duration(rng.Int63n(int64(29*time.Minute))))
+				gw.nextOutage = gw.outageEnd.Add(interarrival(gs.outagesPerHour, rng))
+				gw.next = gw.outageEnd
+				continue
+			}
+			stamp := t.UTC().Format(time.RFC3339Nano)
+			for i := range gw.buffer {
+				gw.buffer[i].TransmittedAt = stamp
+				send(&gw.buffer[i], t)
+			}
+			gw.buffer = gw.buffer[:0]
+			gw.next = t.Add(gs.interval)
+		}
+	}
+}
+
+// down reports whether gw's uplink is down at now.
+func (gw *gateway) down(now time.Time) bool {
+	return !gw.outageEnd.IsZero() && now.Before(gw.outageEnd)
+}
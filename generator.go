@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// SensorReading represents a single IoT/OT sensor data point from pipeline infrastructure
+type SensorReading struct {
+	SensorID   string   `json:"sensor_id"`
+	Timestamp  string   `json:"timestamp"`
+	Type       string   `json:"type"`
+	Value      float64  `json:"value"`
+	Unit       string   `json:"unit"`
+	Location   Location `json:"location"`
+	PipelineID string   `json:"pipeline_id"`
+	Status     string   `json:"status"`
+	Quality    float64  `json:"quality_score"`
+	AlertLevel string   `json:"alert_level,omitempty"`
+	PairID     string   `json:"pair_id,omitempty"`
+	Backfilled bool     `json:"backfilled,omitempty"`
+	Cohort     string   `json:"cohort,omitempty"`
+	IngestedAt string   `json:"ingested_at,omitempty"`
+	Sequence   uint64   `json:"sequence,omitempty"`
+
+	Components map[string]float64 `json:"components,omitempty"`  // chromatographs only, see gasComponents
+	TerminalID string             `json:"terminal_id,omitempty"` // tank farm sensors only
+	TankID     string             `json:"tank_id,omitempty"`
+	StationID  string             `json:"station_id,omitempty"` // pump station sensors only
+
+	GatewayID     string `json:"gateway_id,omitempty"`     // with gateways: the gateway that forwarded it
+	TransmittedAt string `json:"transmitted_at,omitempty"` // and when, shared by its whole transmission
+
+	// Device health, with -device-health.
+	BatteryPct float64 `json:"battery_pct,omitempty"`
+	RSSI       float64 `json:"rssi_dbm,omitempty"`
+	Uptime     int64   `json:"uptime_s,omitempty"`
+	Firmware   string  `json:"firmware_version,omitempty"`
+
+	RunID string `json:"run_id,omitempty"` // with -run-id-field: the run that generated it
+}
+
+type Location struct {
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	MilePost float64 `json:"mile_post"`
+}
+
+var sensorTypes = []struct {
+	Type       string
+	Unit       string
+	Min        float64
+	Max        float64
+	Resolution float64 // smallest step the instrument reports
+}{
+	{"pressure", "psi", 200, 1500, 0.1},
+	{"temperature", "fahrenheit", -20, 180, 0.1},
+	{"flow_rate", "bbl/hr", 0, 50000, 1},
+	{"vibration", "mm/s", 0, 25, 0.01},
+	{"corrosion", "mpy", 0, 50, 0.01},
+	{"humidity", "percent", 0, 100, 0.1},
+	{"gas_detector", "ppm", 0, 1000, 1},
+	{"valve_position", "percent", 0, 100, 0.1},
+	// Types past defaultTypes are left out of the default mix.
+	{chromatographType, "BTU/scf", 1000, 1100, 0.1},
+	{tankLevelType, "ft", 0, tankHeight, 0.01},
+	{tankTemperatureType, "fahrenheit", 30, 130, 0.1},
+	{roofPositionType, "ft", 0, tankHeight, 0.01},
+	{pipeToSoilType, "mV", -2000, 0, 1},
+	{rectifierCurrentType, "A", 0, 50, 0.01},
+	// Types past mixedTypes only come with -stations.
+	{suctionPressureType, "psi", 0, 600, 0.1},
+	{dischargePressureType, "psi", 0, 1500, 0.1},
+	{pumpSpeedType, "rpm", 0, 3600, 1},
+	{motorCurrentType, "A", 0, 400, 0.1},
+	{bearingTemperatureType, "fahrenheit", 40, 250, 0.1},
+}
+
+// defaultTypes is how many of sensorTypes, from the start, the default
+// even mix covers, and mixedTypes how many -type-mix can ask for.
+const (
+	defaultTypes = 8
+	mixedTypes   = 14
+)
+
+// quantize rounds v to a multiple of res. Fractional resolutions divide by
+// an integer scale so the result prints without float noise (123.4, not
+// 123.40000000000001).
+func quantize(v, res float64) float64 {
+	if res < 1 {
+		scale := math.Round(1 / res)
+		return math.Round(v*scale) / scale
+	}
+	return math.Round(v/res) * res
+}
+
+var pipelineIDs = []string{
+	"PIPE-TX-001", "PIPE-TX-002", "PIPE-OK-001", "PIPE-LA-001",
+	"PIPE-NM-001", "PIPE-CO-001", "PIPE-WY-001", "PIPE-ND-001",
+}
+
+// statuses weights the status of independent readings; fleet sensors
+// follow a status chain instead.
+var statuses = []string{"normal", "normal", "normal", "normal", "warning", "maintenance"}
+
+// GeneratorConfig controls what a Generator produces.
+type GeneratorConfig struct {
+	// Seed initialises the random source.
+	Seed int64
+	// BackgroundEvents is the rate of minor background events (small
+	// pressure excursions, brief comms hiccups) per pipeline per hour.
+	// Zero disables them.
+	BackgroundEvents float64
+	// Fleet is the number of persistent sensors to simulate. Zero draws
+	// every reading from an independent, randomly named sensor.
+	Fleet int
+	// TypeMix weights the sensor types, indexed like sensorTypes: the
+	// fleet's composition, or how often each type is drawn without a
+	// fleet. Nil mixes them evenly.
+	TypeMix []float64
+	// PipelineMix weights the pipelines, indexed like pipelineIDs: how
+	// the fleet's sensors are spread over them, and so their share of the
+	// readings, or how often each is drawn without a fleet. Nil spreads
+	// them evenly.
+	PipelineMix []float64
+	// Intervals samples each fleet sensor at its type's interval, indexed
+	// like sensorTypes, instead of picking sensors at random. A sample
+	// with no sensor due reports nothing. Requires a fleet.
+	Intervals []time.Duration
+	// RedundantPairs is the fraction of critical fleet points (pressure,
+	// flow, gas detection) instrumented with an A/B transmitter pair.
+	RedundantPairs float64
+	// Leaks is the rate of leak scenarios per pipeline per day. During a
+	// leak, flow meters downstream of it read up to LeakImbalance (a
+	// fraction of throughput) less than those upstream, and pressure
+	// drops most near the leak. Both effects travel out from the leak
+	// along the line. Requires a fleet.
+	Leaks         float64
+	LeakImbalance float64
+	// Stations puts this many pump stations on every pipeline, each
+	// hosting suction and discharge pressure, pump speed, motor current
+	// and bearing temperature sensors that read one pump's state. The
+	// stations trip PumpTrips times a day on average, their sensors all
+	// showing it. Requires a fleet.
+	Stations  int
+	PumpTrips float64
+	// ESD simulates the emergency shutdown system: a leak trips its
+	// pipeline's ESD a few minutes after it starts, closing the nearest
+	// valve either side, and pump trips are reported as they happen.
+	// Each action is an EventRecord, collected with TakeEvents. Requires
+	// a fleet.
+	ESD bool
+	// Operators simulates the controllers: alerting readings raise alarms
+	// that they acknowledge and, when critical, respond to by changing a
+	// setpoint or overriding the point. Each action is an OperatorAction,
+	// collected with TakeActions. Requires a fleet.
+	Operators bool
+	// CalibrationDrift gives each fleet sensor a calibration error that
+	// grows steadily, at a rate drawn with standard deviation
+	// CalibrationDrift (a fraction of the sensor's range per day). Every
+	// Recalibration the sensor is recalibrated, its readings snap back,
+	// and the recalibration is an EventRecord. Requires a fleet.
+	CalibrationDrift float64
+	Recalibration    time.Duration
+	// Gateways puts this many edge gateways on every pipeline, each
+	// forwarding the readings of the fleet sensors on its stretch every
+	// GatewayInterval, stamped with the transmission time. Each gateway
+	// loses its uplink GatewayOutages times a day on average, buffering
+	// until it returns and then sending the backlog in one burst.
+	// Requires a fleet.
+	Gateways        int
+	GatewayInterval time.Duration
+	GatewayOutages  float64
+	// DeviceHealth adds each fleet sensor's device health to its
+	// readings: battery level, signal strength, uptime and firmware
+	// version, evolving per sensor. Requires a fleet.
+	DeviceHealth bool
+	// FirmwareRollout, if set, updates the fleet to this firmware version
+	// in waves (see firmwareRollout), every RolloutEvery, each taking the
+	// fleet up to its share in RolloutWaves. RolloutFailures is the
+	// fraction of updates that fail, degrading the sensor's quality
+	// scores. Updates are EventRecords. Requires DeviceHealth.
+	FirmwareRollout string
+	RolloutWaves    []float64
+	RolloutEvery    time.Duration
+	RolloutFailures float64
+	// Hydraulics ties each pipeline's pressure, flow and valve position
+	// readings together through a simple hydraulic model: valve openings
+	// set the flow, and the flow the pressure profile along the line.
+	// Requires a fleet.
+	Hydraulics bool
+	// Routes places sensors along real pipeline routes, with mile posts
+	// measured along them. Pipelines without a route keep sensors
+	// scattered over the region.
+	Routes routeSet
+	// Backfill emits interpolated readings, flagged as backfilled, for the
+	// window a pipeline was silent once its comms hiccup ends. It requires
+	// a fleet and background events.
+	Backfill bool
+	// Deadband enables report-by-exception for the fleet: a sensor only
+	// reports when its value has moved by more than Deadband (a fraction
+	// of the sensor's range) since its last report, or when Keepalive has
+	// passed without one. Zero reports every sample.
+	Deadband  float64
+	Keepalive time.Duration
+	// Quantize rounds values to each sensor type's instrument resolution.
+	// Fleet sensors also hold their output until the measurement moves a
+	// full step, so noise near a rounding boundary does not flicker.
+	Quantize bool
+	// Noise is measurement noise per sensor type (see Config.Noise).
+	Noise map[string]NoiseModel
+	// Alerts overrides the default alert thresholds per sensor type (see
+	// Config.Alerts).
+	Alerts map[string]AlertThresholds
+	// Status overrides states of the fleet's status chain (see
+	// Config.Status).
+	Status map[string]StatusState
+	// Cohorts tags each sensor's readings with an experiment cohort,
+	// chosen by weight from a hash of the sensor ID and CohortSalt so
+	// membership is stable across readings and runs. Both transmitters of
+	// a redundant pair share a cohort. Empty leaves readings untagged.
+	Cohorts    []Cohort
+	CohortSalt string
+	// Failures is the rate of random sensor failures per fleet sensor per
+	// day, each with a mode drawn from FailureModes (every mode when
+	// empty) and lasting 1-30 minutes, or for good if the sensor dies.
+	// ScheduledFailures start at set times. Failed readings are not
+	// flagged: detecting them is the consumer's job. Requires a fleet.
+	Failures          float64
+	FailureModes      []string
+	ScheduledFailures []FailureSpec
+	// Late is the fraction of readings delayed so they arrive out of
+	// order, each released after a random delay of up to MaxLateness with
+	// its original timestamp. Zero keeps every reading in order.
+	Late        float64
+	MaxLateness time.Duration
+	// ClockSkew and ClockDrift give each fleet sensor a clock of its own:
+	// a fixed offset drawn with standard deviation ClockSkew and a drift
+	// rate with standard deviation ClockDrift (a fraction, 1e-6 per ppm).
+	// Readings are stamped by the sensor's clock. Requires a fleet.
+	ClockSkew  time.Duration
+	ClockDrift float64
+	// Sequence numbers each fleet sensor's readings 1, 2, 3, ... so
+	// consumers can detect gaps and reordering. A reading lost in a
+	// dropout still uses up its number. Requires a fleet.
+	Sequence bool
+	// RunID, if set, is stamped on every reading.
+	RunID string
+	// IngestDelay, if set, stamps each reading's IngestedAt with the true
+	// time it left the sensor plus a transmission delay drawn from it.
+	// Late readings leave when they are released; backfilled ones when
+	// the comms hiccup ends.
+	IngestDelay *delayDist
+	// Duplicates is the fraction of readings retransmitted, the copy
+	// following later in the same batch. NearDuplicates is the share of
+	// copies that differ slightly from the original instead of being
+	// exact (see duplicateInjector).
+	Duplicates     float64
+	NearDuplicates float64
+	// Units is the unit system readings are reported in: imperial (or
+	// empty), the generator's own, or metric. Alert thresholds stay in
+	// the generator's units.
+	Units string
+	// Clock returns the time of each sample; nil means time.Now.
+	// Simulations supply their own to generate hours of data in seconds.
+	Clock func() time.Time
+}
+
+// Generator produces synthetic sensor readings. It is not safe for
+// concurrent use; give each goroutine its own Generator.
+type Generator struct {
+	rng        *rand.Rand
+	events     *eventScheduler // nil when background events are off
+	fleet      *fleet          // nil in stateless mode
+	backfill   bool
+	pending    []SensorReading    // backfilled and late readings due to be returned
+	late       *lateInjector      // nil when every reading is on time
+	duplicates *duplicateInjector // nil when nothing is retransmitted
+	ingest     *delayDist         // nil when readings carry no ingestion time
+	sequence   bool
+	runID      string // stamped on every reading, if set
+	samples    int64
+
+	deadband  float64
+	keepalive time.Duration
+	quantize  bool
+	noise     []*NoiseModel     // indexed like sensorTypes; nil when noise is off
+	alerts    []AlertThresholds // indexed like sensorTypes
+	status    *statusChain      // nil without a fleet
+	schedule  *sampleSchedule   // nil when fleet sensors are picked at random
+	routes    routeSet
+	typeMix   []float64        // cumulative type weights; nil for an even mix
+	pipeMix   []float64        // cumulative pipeline weights; nil for an even mix
+	cohorts   *cohortAssigner  // nil when readings are untagged
+	failures  *failureInjector // nil when sensors never fail
+	eventLog  *eventLog        // nil without event records
+	esd       *esdSystem       // nil without ESD events
+	calibrate *calibrator      // nil while calibrations hold
+	gateways  *gatewaySet      // nil when sensors send directly
+	health    bool
+	rollout   *firmwareRollout          // nil without a firmware rollout
+	units     map[string]unitConversion // nil for the generator's own units
+	operators *controlRoom              // nil without operator actions
+	clock     func() time.Time
+	epoch     time.Time // time of the first sample
+	last      time.Time // time of the latest sample
+	rate      int       // samples per second of a Run in progress
+}
+
+// NewGenerator returns a Generator configured by cfg.
+func NewGenerator(cfg GeneratorConfig) *Generator {
+	g := &Generator{
+		rng:        rand.New(rand.NewSource(cfg.Seed)),
+		quantize:   cfg.Quantize,
+		noise:      noiseByType(cfg.Noise),
+		alerts:     alertsByType(cfg.Alerts),
+		routes:     cfg.Routes,
+		cohorts:    newCohortAssigner(cfg.Cohorts, cfg.CohortSalt),
+		clock:      cfg.Clock,
+		late:       newLateInjector(cfg.Late, cfg.MaxLateness),
+		duplicates: newDuplicateInjector(cfg.Duplicates, cfg.NearDuplicates),
+		ingest:     cfg.IngestDelay,
+		sequence:   cfg.Sequence && cfg.Fleet > 0,
+		runID:      cfg.RunID,
+	}
+	g.units, _ = parseUnits(cfg.Units)
+	if g.clock == nil {
+		g.clock = time.Now
+	}
+	if cfg.TypeMix != nil {
+		g.typeMix = cumulative(cfg.TypeMix)
+	}
+	if cfg.PipelineMix != nil {
+		g.pipeMix = cumulative(cfg.PipelineMix)
+	}
+	if cfg.BackgroundEvents > 0 || cfg.Leaks > 0 {
+		g.events = newEventScheduler(cfg.BackgroundEvents, cfg.Leaks/24, cfg.LeakImbalance, cfg.Routes)
+	}
+	if cfg.Fleet > 0 {
+		g.fleet = newFleet(cfg.Fleet, cfg.RedundantPairs, newMixer(cfg.TypeMix), newMixer(cfg.PipelineMix), cfg.Routes, g.rng)
+		g.status = newStatusChain(cfg.Status)
+		g.schedule = newSampleSchedule(cfg.Intervals)
+		if cfg.Stations > 0 {
+			g.fleet.addStations(cfg.Stations, cfg.PumpTrips, cfg.Routes, g.rng)
+		}
+		if cfg.Hydraulics {
+			g.fleet.connectHydraulics(cfg.Routes, g.rng)
+		}
+		g.health = cfg.DeviceHealth
+		if cfg.Gateways > 0 {
+			g.gateways = g.fleet.attachGateways(cfg.Gateways, cfg.GatewayInterval, cfg.GatewayOutages, cfg.Routes)
+		}
+		g.backfill = cfg.Backfill && g.events != nil
+		g.deadband, g.keepalive = cfg.Deadband, cfg.Keepalive
+		if cfg.ClockSkew > 0 || cfg.ClockDrift > 0 {
+			g.fleet.skewClocks(cfg.ClockSkew, cfg.ClockDrift, g.rng)
+		}
+		g.failures = newFailureInjector(cfg.Failures, cfg.FailureModes, cfg.ScheduledFailures, g.fleet)
+		if cfg.ESD || cfg.CalibrationDrift > 0 || cfg.FirmwareRollout != "" {
+			g.eventLog = &eventLog{}
+		}
+		if cfg.ESD {
+			g.esd = newESDSystem(g.eventLog)
+		}
+		if cfg.CalibrationDrift > 0 {
+			g.calibrate = newCalibrator(cfg.CalibrationDrift, cfg.Recalibration, g.units, g.eventLog)
+		}
+		if cfg.DeviceHealth && cfg.FirmwareRollout != "" {
+			g.rollout = newFirmwareRollout(cfg.FirmwareRollout, cfg.RolloutWaves, cfg.RolloutEvery, cfg.RolloutFailures, g.eventLog)
+		}
+		if cfg.Operators {
+			g.operators = newControlRoom()
+		}
+	}
+	return g
+}
+
+// Next generates a single reading. In report-by-exception mode it samples
+// until a sensor reports. Backfilled, late and duplicate readings are not
+// returned by Next; GenerateBatch and GenerateColumns append them to their output.
+// With gateways no reading goes out directly, so Next returns the
+// readings they forward, in the order sent.
+func (g *Generator) Next() SensorReading {
+	for {
+		if g.gateways != nil && len(g.pending) > 0 {
+			r := g.pending[0]
+			g.pending = g.pending[1:]
+			return r
+		}
+		if r, ok := g.sample(); ok {
+			return r
+		}
+	}
+}
+
+// sample takes one sensor sample, reporting false if the sensor suppresses
+// it under report-by-exception or the reading is held back.
+func (g *Generator) sample() (SensorReading, bool) {
+	rng := g.rng
+	now := g.clock()
+	g.samples++
+	if g.epoch.IsZero() {
+		g.epoch = now
+	}
+	g.last = now
+	var ended []backgroundEvent
+	if g.events != nil {
+		ended = g.events.advance(now, rng)
+		for _, ev := range ended {
+			if g.backfill && ev.kind == eventCommsHiccup {
+				g.queueBackfill(ev, now)
+			}
+		}
+	}
+	if g.esd != nil {
+		g.esd.update(g.fleet, g.events, ended, now, rng)
+	}
+	if g.operators != nil {
+		g.operators.update(now, rng)
+	}
+	if g.gateways != nil {
+		g.gateways.transmit(now, rng, func(r *SensorReading, t time.Time) {
+			if g.deliver(r, t) {
+				g.pending = append(g.pending, *r)
+			}
+		})
+	}
+	if g.late != nil {
+		g.pending = g.late.release(g.pending, now)
+	}
+	if g.fleet != nil {
+		r, ok := g.nextFleet(now)
+		if ok && g.gateways != nil {
+			g.gateways.hold(r)
+			return r, false
+		}
+		if ok {
+			ok = g.deliver(&r, now)
+		}
+		return r, ok
+	}
+
+	var typ int
+	if g.typeMix != nil {
+		typ = pick(g.typeMix, rng)
+	} else {
+		typ = rng.Intn(defaultTypes)
+	}
+	st := sensorTypes[typ]
+	pipeline := g.pickPipeline(rng)
+	if g.events != nil {
+		// Pipelines in a comms hiccup go quiet; the rest of the fleet
+		// carries the load.
+		for range pipelineIDs {
+			if !g.events.silenced(pipeline, now) {
+				break
+			}
+			pipeline = g.pickPipeline(rng)
+		}
+	}
+	status := statuses[rng.Intn(len(statuses))]
+
+	// Generate value with occasional anomalies
+	value := st.Min + rng.Float64()*(st.Max-st.Min)
+	if isCPType(typ) {
+		value = newCPCircuit(st.Type, rng).measure(st.Type, now, rng)
+	}
+	if rng.Float64() < 0.02 { // 2% chance of anomaly
+		value = st.Max + rng.Float64()*st.Max*0.2 // Exceed max by up to 20%
+	}
+	if g.events != nil && st.Type == "pressure" {
+		value += g.events.excursion(pipeline, now) * (st.Max - st.Min)
+	}
+	if g.noise != nil && g.noise[typ] != nil {
+		value = g.noise[typ].apply(value, now, rng)
+	}
+	if g.quantize {
+		value = quantize(value, st.Resolution)
+	}
+
+	r := SensorReading{
+		SensorID:   fmt.Sprintf("SNS-%s-%04d", st.Type[:3], rng.Intn(10000)),
+		Timestamp:  now.UTC().Format(time.RFC3339Nano),
+		Type:       st.Type,
+		Value:      value,
+		Unit:       st.Unit,
+		PipelineID: pipeline,
+		Status:     status,
+		Quality:    0.85 + rng.Float64()*0.15,
+		AlertLevel: g.alerts[typ].level(value),
+		Location:   g.routes.place(pipeline, rng),
+	}
+	if st.Type == chromatographType {
+		r.Components = newGasStream(rng).analyze(value, rng)
+	}
+	if isTankType(typ) {
+		n := rng.Intn(tanksPerFarm) + 1
+		r.TerminalID, r.TankID = terminalID(pipeline), tankID(pipeline, n)
+		r.SensorID = r.TankID + "-" + tankSuffixes[st.Type]
+		r.Location = terminalLocation(g.routes, pipeline, rng)
+	}
+	if g.cohorts != nil {
+		r.Cohort = g.cohorts.assign(r.SensorID)
+	}
+	ok := g.deliver(&r, now)
+	return r, ok
+}
+
+// deliver converts r to the output units, queues any duplicate of r,
+// sampled at now, stamps its run ID and ingestion time and reports whether r goes out now rather than being held back to
+// arrive late.
+func (g *Generator) deliver(r *SensorReading, now time.Time) bool {
+	if g.units != nil {
+		g.convertUnits(r)
+	}
+	if g.duplicates != nil {
+		if d, ok := g.duplicates.duplicate(*r, g.rng); ok {
+			g.stamp(&d, now)
+			g.pending = append(g.pending, d)
+		}
+	}
+	if g.late != nil {
+		if due, ok := g.late.delay(now, g.rng); ok {
+			g.stamp(r, due)
+			g.late.add(*r, due)
+			return false
+		}
+	}
+	g.stamp(r, now)
+	return true
+}
+
+// stamp sets r's run ID and its ingestion time for a reading sent at t.
+func (g *Generator) stamp(r *SensorReading, t time.Time) {
+	r.RunID = g.runID
+	if g.ingest != nil {
+		r.IngestedAt = t.Add(g.ingest.sample(g.rng)).UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// pickPipeline draws the pipeline of a reading without a fleet.
+func (g *Generator) pickPipeline(rng *rand.Rand) string {
+	if g.pipeMix != nil {
+		return pipelineIDs[pick(g.pipeMix, rng)]
+	}
+	return pipelineIDs[rng.Intn(len(pipelineIDs))]
+}
+
+// nextFleet samples a randomly chosen fleet sensor, or with a schedule
+// the sensor due, if any.
+func (g *Generator) nextFleet(now time.Time) (SensorReading, bool) {
+	rng := g.rng
+	if g.failures != nil {
+		g.failures.advance(now)
+	}
+	if g.schedule != nil {
+		s := g.schedule.next(g.fleet, now, rng)
+		if s == nil || g.events != nil && g.events.silenced(s.Pipeline, now) {
+			return SensorReading{}, false
+		}
+		return g.sampleFleet(s, now)
+	}
+	s := g.fleet.sensors[rng.Intn(len(g.fleet.sensors))]
+	if g.events != nil {
+		for range pipelineIDs {
+			if !g.events.silenced(s.Pipeline, now) {
+				break
+			}
+			s = g.fleet.sensors[rng.Intn(len(g.fleet.sensors))]
+		}
+	}
+	// Cathodic protection sensors report hourly; the sample goes to
+	// another sensor, or to none if it keeps landing on one not due.
+	for range pipelineIDs {
+		if s.cp == nil || s.lastTime.IsZero() || now.Sub(s.lastTime) >= cpInterval {
+			return g.sampleFleet(s, now)
+		}
+		s = g.fleet.sensors[rng.Intn(len(g.fleet.sensors))]
+	}
+	return SensorReading{}, false
+}
+
+// sampleFleet samples fleet sensor s at now.
+func (g *Generator) sampleFleet(s *fleetSensor, now time.Time) (SensorReading, bool) {
+	rng := g.rng
+	if g.rollout != nil && s.health != nil && !g.rollout.online(s, now) {
+		return SensorReading{}, false
+	}
+	st := sensorTypes[s.Type]
+	r := g.fleetReading(s, s.measure(now, rng), now)
+	if rng.Float64() < 0.02 { // 2% chance of anomaly
+		r.Value = st.Max + rng.Float64()*st.Max*0.2
+	}
+	if g.events != nil && st.Type == "pressure" {
+		r.Value += g.events.excursion(s.Pipeline, now) * (st.Max - st.Min)
+		r.Value -= g.events.leakPressure(s.Pipeline, s.Location.MilePost, now) * (st.Max - st.Min)
+	}
+	if g.events != nil && s.flow != nil {
+		r.Value -= s.flow.value * g.events.leakLoss(s.Pipeline, s.Location.MilePost, now)
+	}
+	if g.calibrate != nil {
+		r.Value += g.calibrate.bias(s, now, rng)
+	}
+	if g.noise != nil && g.noise[s.Type] != nil {
+		r.Value = g.noise[s.Type].apply(r.Value, now, rng)
+	}
+	if g.quantize {
+		r.Value = s.hold(r.Value)
+	}
+	if g.failures != nil && !g.failures.apply(s, &r, now, rng) {
+		return r, false
+	}
+	r.AlertLevel = g.alerts[s.Type].level(r.Value)
+	if s.gas != nil {
+		r.Components = s.gas.analyze(r.Value, rng)
+	}
+
+	if g.deadband > 0 && !s.lastTime.IsZero() && now.Sub(s.lastTime) < g.keepalive &&
+		math.Abs(r.Value-s.lastValue) <= g.deadband*(st.Max-st.Min) {
+		return r, false
+	}
+	s.emitted(r.Value, now)
+	if g.health {
+		if s.health == nil {
+			s.health = newDeviceHealth(now, rng)
+			if g.rollout != nil {
+				g.rollout.plan(s.health, g.epoch, rng)
+			}
+		}
+		s.health.stamp(&r, now, rng)
+	}
+	if g.operators != nil {
+		g.operators.observe(s, &r, now, rng)
+	}
+	if g.sequence {
+		r.Sequence = s.nextSequence()
+	}
+	return r, true
+}
+
+func (g *Generator) fleetReading(s *fleetSensor, value float64, t time.Time) SensorReading {
+	rng := g.rng
+	st := sensorTypes[s.Type]
+	r := SensorReading{
+		SensorID:   s.ID,
+		Timestamp:  s.clock(t, g.epoch).UTC().Format(time.RFC3339Nano),
+		Type:       st.Type,
+		Value:      value,
+		Unit:       st.Unit,
+		PipelineID: s.Pipeline,
+		Status:     g.status.status(s, t, rng),
+		Quality:    0.85 + rng.Float64()*0.15,
+		AlertLevel: g.alerts[s.Type].level(value),
+		Location:   s.Location,
+		PairID:     s.PairID,
+	}
+	if s.tank != nil {
+		r.TerminalID, r.TankID = s.tank.Terminal, s.tank.ID
+	}
+	if s.station != nil {
+		r.StationID = s.station.ID
+	}
+	if s.gateway != nil {
+		r.GatewayID = s.gateway.ID
+	}
+	if g.cohorts != nil {
+		key := s.ID
+		if s.PairID != "" {
+			key = s.PairID
+		}
+		r.Cohort = g.cohorts.assign(key)
+	}
+	return r
+}
+
+// queueBackfill reconstructs the samples each sensor on ev's pipeline
+// missed during the hiccup, the way gateways replay buffered or
+// interpolated data on reconnect. Values are interpolated linearly from the
+// sensor's last reading before the gap to its value at now, at the sensor's
+// usual reporting interval.
+func (g *Generator) queueBackfill(ev backgroundEvent, now time.Time) {
+	for _, s := range g.fleet.byPipeline[ev.pipeline] {
+		if s.lastTime.IsZero() || s.interval <= 0 || s.failure != nil || !isFinite(s.lastValue) {
+			continue
+		}
+		from, fromTime := s.lastValue, s.lastTime
+		to, span := s.measure(now, g.rng), float64(now.Sub(fromTime))
+		for t := fromTime.Add(s.interval); t.Before(ev.end); t = t.Add(s.interval) {
+			if t.Before(ev.start) {
+				continue
+			}
+			value := from + (to-from)*float64(t.Sub(fromTime))/span
+			if g.quantize {
+				value = quantize(value, sensorTypes[s.Type].Resolution)
+			}
+			r := g.fleetReading(s, value, t)
+			r.Backfilled = true
+			if s.gas != nil {
+				r.Components = s.gas.analyze(value, g.rng)
+			}
+			if g.sequence {
+				r.Sequence = s.nextSequence()
+			}
+			g.stamp(&r, now)
+			if g.units != nil {
+				g.convertUnits(&r)
+			}
+			g.pending = append(g.pending, r)
+			s.lastValue, s.lastTime = value, t
+		}
+	}
+}
+
+// Run samples at rate per second, paced by a token bucket, passing the
+// reported readings to emit in batches, until ctx is cancelled or emit
+// returns an error. Time lost to a slow emit is made up only in part (see
+// tokenBucket). It returns
+// ctx.Err() on cancellation, otherwise emit's error. emit may change the
+// rate with SetRate.
+func (g *Generator) Run(ctx context.Context, rate int, emit func([]SensorReading) error) error {
+	g.rate = rate
+	batchSize := runBatchSize(rate)
+	bucket := newTokenBucket(rate, batchSize)
+	for {
+		if err := bucket.wait(ctx, batchSize); err != nil {
+			return err
+		}
+		if batch := g.GenerateBatch(batchSize); len(batch) > 0 {
+			if err := emit(batch); err != nil {
+				return err
+			}
+		}
+		if g.rate != rate {
+			rate = g.rate
+			batchSize = runBatchSize(rate)
+			bucket.setRate(rate, batchSize)
+		}
+	}
+}
+
+// SetRate changes the rate of the Run in progress from its next batch.
+// The sample clock is the caller's to change.
+func (g *Generator) SetRate(rate int) {
+	g.rate = rate
+}
+
+// Replay samples as fast as possible, in the batches Run would use at
+// rate, until samples samples have been taken in total. Given the same
+// configuration, seed and clock it emits exactly what Run emitted.
+func (g *Generator) Replay(ctx context.Context, rate int, samples int64, emit func([]SensorReading) error) error {
+	batchSize := runBatchSize(rate)
+	for g.samples < samples {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := g.GenerateBatch(batchSize)
+		if len(batch) == 0 {
+			continue
+		}
+		if err := emit(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pacedWindow is the span of sample times RunPaced batches together.
+const pacedWindow = 10 * time.Millisecond
+
+// RunPaced samples whenever the clock's next sample time, given by peek,
+// has passed, passing the reported readings to emit in batches, one per
+// pacedWindow of sample time from start. It returns nil once peek returns
+// the zero time, otherwise as Run does. With a clock whose spacing varies
+// this follows its rate, where Run samples at a fixed one.
+func (g *Generator) RunPaced(ctx context.Context, start time.Time, peek func() time.Time, emit func([]SensorReading) error) error {
+	ticker := time.NewTicker(pacedWindow)
+	defer ticker.Stop()
+
+	end := start.Add(pacedWindow)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			for !end.After(time.Now()) {
+				batch := g.pacedBatch(peek, end)
+				end = end.Add(pacedWindow)
+				if len(batch) > 0 {
+					if err := emit(batch); err != nil {
+						return err
+					}
+				}
+				if peek().IsZero() {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// ReplayPaced is Replay for RunPaced: it emits the same batches without
+// waiting for their time to come.
+func (g *Generator) ReplayPaced(ctx context.Context, start time.Time, peek func() time.Time, samples int64, emit func([]SensorReading) error) error {
+	end := start.Add(pacedWindow)
+	for g.samples < samples && !peek().IsZero() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := g.pacedBatch(peek, end)
+		end = end.Add(pacedWindow)
+		if len(batch) > 0 {
+			if err := emit(batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pacedBatch takes the samples due before end, as GenerateBatch does.
+func (g *Generator) pacedBatch(peek func() time.Time, end time.Time) []SensorReading {
+	var batch []SensorReading
+	for t := peek(); !t.IsZero() && t.Before(end); t = peek() {
+		if r, ok := g.sample(); ok {
+			batch = append(batch, r)
+		}
+	}
+	batch = append(batch, g.pending...)
+	g.pending = g.pending[:0]
+	return batch
+}
+
+// runBatchSize is the number of samples Run takes per batch at rate: a
+// pacedWindow's worth, so batches are small enough to pace smoothly at low
+// rates and large enough for throughput at high ones.
+func runBatchSize(rate int) int {
+	return max(min(int(float64(rate)*pacedWindow.Seconds()), 1000), 1)
+}
+
+// Samples returns the number of samples taken so far, reported or not.
+func (g *Generator) Samples() int64 {
+	return g.samples
+}
+
+// GenerateBatch takes n samples and returns the readings reported, followed
+// by any backfilled, late or duplicate readings that became due meanwhile.
+// Every sample is reported unless report-by-exception is on or it is
+// delayed.
+func (g *Generator) GenerateBatch(n int) []SensorReading {
+	batch := make([]SensorReading, 0, n)
+	for range n {
+		if r, ok := g.sample(); ok {
+			batch = append(batch, r)
+		}
+	}
+	batch = append(batch, g.pending...)
+	g.pending = g.pending[:0]
+	return batch
+}
+
+// GenerateColumns is GenerateBatch in columnar (struct-of-arrays) form,
+// suitable for Parquet/Arrow writers and bulk database inserts.
+func (g *Generator) GenerateColumns(n int) *ReadingColumns {
+	cols := NewReadingColumns(n)
+	for range n {
+		if r, ok := g.sample(); ok {
+			cols.Append(r)
+		}
+	}
+	for _, r := range g.pending {
+		cols.Append(r)
+	}
+	g.pending = g.pending[:0]
+	return cols
+}
+
+// ReadingColumns holds a batch of readings as parallel column slices; row i
+// of the batch is the i-th element of every slice.
+type ReadingColumns struct {
+	SensorID   []string
+	Timestamp  []string
+	Type       []string
+	Value      []float64
+	Unit       []string
+	Lat        []float64
+	Lon        []float64
+	MilePost   []float64
+	PipelineID []string
+	Status     []string
+	Quality    []float64
+	AlertLevel []string
+	PairID     []string
+	Backfilled []bool
+	Cohort     []string
+	IngestedAt []string
+	Sequence   []uint64
+
+	Components []map[string]float64
+	TerminalID []string
+	TankID     []string
+	StationID  []string
+
+	GatewayID     []string
+	TransmittedAt []string
+
+	BatteryPct []float64
+	RSSI       []float64
+	Uptime     []int64
+	Firmware   []string
+
+	RunID []string
+}
+
+// NewReadingColumns returns empty columns with room for capacity rows.
+func NewReadingColumns(capacity int) *ReadingColumns {
+	return &ReadingColumns{
+		SensorID:   make([]string, 0, capacity),
+		Timestamp:  make([]string, 0, capacity),
+		Type:       make([]string, 0, capacity),
+		Value:      make([]float64, 0, capacity),
+		Unit:       make([]string, 0, capacity),
+		Lat:        make([]float64, 0, capacity),
+		Lon:        make([]float64, 0, capacity),
+		MilePost:   make([]float64, 0, capacity),
+		PipelineID: make([]string, 0, capacity),
+		Status:     make([]string, 0, capacity),
+		Quality:    make([]float64, 0, capacity),
+		AlertLevel: make([]string, 0, capacity),
+		PairID:     make([]string, 0, capacity),
+		Backfilled: make([]bool, 0, capacity),
+		Cohort:     make([]string, 0, capacity),
+		IngestedAt: make([]string, 0, capacity),
+		Sequence:   make([]uint64, 0, capacity),
+
+		Components: make([]map[string]float64, 0, capacity),
+		TerminalID: make([]string, 0, capacity),
+		TankID:     make([]string, 0, capacity),
+		StationID:  make([]string, 0, capacity),
+
+		GatewayID:     make([]string, 0, capacity),
+		TransmittedAt: make([]string, 0, capacity),
+
+		BatteryPct: make([]float64, 0, capacity),
+		RSSI:       make([]float64, 0, capacity),
+		Uptime:     make([]int64, 0, capacity),
+		Firmware:   make([]string, 0, capacity),
+
+		RunID: make([]string, 0, capacity),
+	}
+}
+
+// Len returns the number of rows.
+func (c *ReadingColumns) Len() int {
+	return len(c.SensorID)
+}
+
+// Append adds r as a new row.
+func (c *ReadingColumns) Append(r SensorReading) {
+	c.SensorID = append(c.SensorID, r.SensorID)
+	c.Timestamp = append(c.Timestamp, r.Timestamp)
+	c.Type = append(c.Type, r.Type)
+	c.Value = append(c.Value, r.Value)
+	c.Unit = append(c.Unit, r.Unit)
+	c.Lat = append(c.Lat, r.Location.Lat)
+	c.Lon = append(c.Lon, r.Location.Lon)
+	c.MilePost = append(c.MilePost, r.Location.MilePost)
+	c.PipelineID = append(c.PipelineID, r.PipelineID)
+	c.Status = append(c.Status, r.Status)
+	c.Quality = append(c.Quality, r.Quality)
+	c.AlertLevel = append(c.AlertLevel, r.AlertLevel)
+	c.PairID = append(c.PairID, r.PairID)
+	c.Backfilled = append(c.Backfilled, r.Backfilled)
+	c.Cohort = append(c.Cohort, r.Cohort)
+	c.IngestedAt = append(c.IngestedAt, r.IngestedAt)
+	c.Sequence = append(c.Sequence, r.Sequence)
+	c.Components = append(c.Components, r.Components)
+	c.TerminalID = append(c.TerminalID, r.TerminalID)
+	c.TankID = append(c.TankID, r.TankID)
+	c.StationID = append(c.StationID, r.StationID)
+	c.GatewayID = append(c.GatewayID, r.GatewayID)
+	c.TransmittedAt = append(c.TransmittedAt, r.TransmittedAt)
+	c.BatteryPct = append(c.BatteryPct, r.BatteryPct)
+	c.RSSI = append(c.RSSI, r.RSSI)
+	c.Uptime = append(c.Uptime, r.Uptime)
+	c.Firmware = append(c.Firmware, r.Firmware)
+	c.RunID = append(c.RunID, r.RunID)
+}
+
+// Row reassembles row i as a SensorReading.
+func (c *ReadingColumns) Row(i int) SensorReading {
+	return SensorReading{
+		SensorID:   c.SensorID[i],
+		Timestamp:  c.Timestamp[i],
+		Type:       c.Type[i],
+		Value:      c.Value[i],
+		Unit:       c.Unit[i],
+		Location:   Location{Lat: c.Lat[i], Lon: c.Lon[i], MilePost: c.MilePost[i]},
+		PipelineID: c.PipelineID[i],
+		Status:     c.Status[i],
+		Quality:    c.Quality[i],
+		AlertLevel: c.AlertLevel[i],
+		PairID:     c.PairID[i],
+		Backfilled: c.Backfilled[i],
+		Cohort:     c.Cohort[i],
+		IngestedAt: c.IngestedAt[i],
+		Sequence:   c.Sequence[i],
+
+		Components: c.Components[i],
+		TerminalID: c.TerminalID[i],
+		TankID:     c.TankID[i],
+		StationID:  c.StationID[i],
+
+		GatewayID:     c.GatewayID[i],
+		TransmittedAt: c.TransmittedAt[i],
+
+		BatteryPct: c.BatteryPct[i],
+		RSSI:       c.RSSI[i],
+		Uptime:     c.Uptime[i],
+		Firmware:   c.Firmware[i],
+
+		RunID: c.RunID[i],
+	}
+}
+
+// Reset truncates all columns to zero rows, keeping their capacity.
+func (c *ReadingColumns) Reset() {
+	c.SensorID = c.SensorID[:0]
+	c.Timestamp = c.Timestamp[:0]
+	c.Type = c.Type[:0]
+	c.Value = c.Value[:0]
+	c.Unit = c.Unit[:0]
+	c.Lat = c.Lat[:0]
+	c.Lon = c.Lon[:0]
+	c.MilePost = c.MilePost[:0]
+	c.PipelineID = c.PipelineID[:0]
+	c.Status = c.Status[:0]
+	c.Quality = c.Quality[:0]
+	c.AlertLevel = c.AlertLevel[:0]
+	c.PairID = c.PairID[:0]
+	c.Backfilled = c.Backfilled[:0]
+	c.Cohort = c.Cohort[:0]
+	c.IngestedAt = c.IngestedAt[:0]
+	c.Sequence = c.Sequence[:0]
+	clear(c.Components) // release the maps
+	c.Components = c.Components[:0]
+	c.TerminalID = c.TerminalID[:0]
+	c.TankID = c.TankID[:0]
+	c.StationID = c.StationID[:0]
+	c.GatewayID = c.GatewayID[:0]
+	c.TransmittedAt = c.TransmittedAt[:0]
+	c.BatteryPct = c.BatteryPct[:0]
+	c.RSSI = c.RSSI[:0]
+	c.Uptime = c.Uptime[:0]
+	c.Firmware = c.Firmware[:0]
+	c.RunID = c.RunID[:0]
+}
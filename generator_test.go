@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// allFieldsReadings returns test readings that between them set every
+// field of SensorReading, so that round-trip tests over them cover every
+// field.
+func allFieldsReadings(t *testing.T) []SensorReading {
+	t.Helper()
+	readings := testReadings(t, 2000)
+	readings[0].Backfilled = true // backfill needs comms hiccups to end
+	typ := reflect.TypeFor[SensorReading]()
+	for i := range typ.NumField() {
+		set := false
+		for _, r := range readings {
+			if !reflect.ValueOf(r).Field(i).IsZero() {
+				set = true
+				break
+			}
+		}
+		if !set {
+			t.Errorf("no test reading sets %s", typ.Field(i).Name)
+		}
+	}
+	return readings
+}
+
+func TestReadingColumns(t *testing.T) {
+	readings := allFieldsReadings(t)
+	cols := NewReadingColumns(0)
+	for _, r := range readings {
+		cols.Append(r)
+	}
+	if cols.Len() != len(readings) {
+		t.Fatalf("Len = %d, want %d", cols.Len(), len(readings))
+	}
+	for i, r := range readings {
+		// Sprint, as NaN values are never DeepEqual.
+		if got := cols.Row(i); fmt.Sprint(got) != fmt.Sprint(r) {
+			t.Fatalf("row %d = %+v, want %+v", i, got, r)
+		}
+	}
+	cols.Reset()
+	if cols.Len() != 0 {
+		t.Errorf("Len after Reset = %d", cols.Len())
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// grafanaTargets lists the sink schemes a Grafana bundle can be generated
+// for, i.e. outputs Grafana can query directly.
+var grafanaTargets = map[string]func(u *url.URL) grafanaDatasource{
+	"elasticsearch": elasticsearchDatasource,
+	"opensearch":    elasticsearchDatasource,
+}
+
+// grafanaDatasource describes how Grafana reaches the data a sink wrote and
+// how the dashboard queries it.
+type grafanaDatasource struct {
+	kind     string // Grafana datasource type
+	yaml     string // provisioning entry, indented as a list item
+	panels   []map[string]any
+	variable func(name, field string) map[string]any
+}
+
+// grafanaMain implements "sensor-gen grafana": it writes a dashboard plus
+// datasource and dashboard provisioning files for the given sink.
+func grafanaMain(args []string) int {
+	fs := flag.NewFlagSet("grafana", flag.ExitOnError)
+	sinkURL := fs.String("sink", "", "Sink URL the generator writes to, e.g. elasticsearch://localhost:9200")
+	outDir := fs.String("out", "grafana", "Directory to write the bundle to")
+	fs.Parse(args)
+
+	u, err := url.Parse(*sinkURL)
+	if err != nil || u.Scheme == "" {
+		fmt.Fprintf(os.Stderr, "Error: -sink must be a sink URL\n")
+		return 1
+	}
+	files, err := grafanaBundle(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	for name, data := range files {
+		path := filepath.Join(*outDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	abs, _ := filepath.Abs(*outDir)
+	fmt.Printf("Wrote Grafana bundle to %s. Mount it into Grafana with:\n", *outDir)
+	fmt.Printf("  -v %s/provisioning:/etc/grafana/provisioning -v %s/dashboards:/var/lib/grafana/dashboards\n",
+		abs, abs)
+	return 0
+}
+
+// grafanaBundle returns the bundle's files for the sink at u, keyed by
+// path relative to the bundle directory.
+func grafanaBundle(u *url.URL) (map[string][]byte, error) {
+	build, ok := grafanaTargets[u.Scheme]
+	if !ok {
+		var names []string
+		for name := range grafanaTargets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no Grafana bundle for %q sinks (supported: %s)", u.Scheme, strings.Join(names, ", "))
+	}
+	ds := build(u)
+
+	return map[string][]byte{
+		"dashboards/sensor-gen.json":               grafanaDashboard(ds),
+		"provisioning/datasources/sensor-gen.yaml": []byte("apiVersion: 1\ndatasources:\n" + ds.yaml),
+		"provisioning/dashboards/sensor-gen.yaml": []byte(`apiVersion: 1
+providers:
+  - name: sensor-gen
+    folder: Sensor Gen
+    type: file
+    options:
+      path: /var/lib/grafana/dashboards
+`),
+	}, nil
+}
+
+// grafanaDashboard builds the dashboard JSON: pipeline and type selectors,
+// reading rate, values per pipeline, and alerts.
+func grafanaDashboard(ds grafanaDatasource) []byte {
+	for i, p := range ds.panels {
+		p["id"] = i + 1
+		p["datasource"] = map[string]any{"type": ds.kind, "uid": "sensor-gen"}
+		p["gridPos"] = map[string]any{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8}
+	}
+	dash := map[string]any{
+		"uid":           "sensor-gen",
+		"title":         "Pipeline Sensors",
+		"tags":          []string{"sensor-gen"},
+		"timezone":      "utc",
+		"schemaVersion": 39,
+		"refresh":       "10s",
+		"time":          map[string]any{"from": "now-15m", "to": "now"},
+		"templating": map[string]any{"list": []any{
+			ds.variable("pipeline", "pipeline_id"),
+			ds.variable("type", "type"),
+		}},
+		"panels": ds.panels,
+	}
+	data, _ := json.MarshalIndent(dash, "", "  ")
+	return append(data, '\n')
+}
+
+// elasticsearchDatasource targets the index pattern matching the sink's
+// index template, with string fields queried through their .keyword
+// sub-fields as created by dynamic mapping.
+func elasticsearchDatasource(u *url.URL) grafanaDatasource {
+	q := u.Query()
+	index := q.Get("index")
+	if index == "" {
+		index = "sensors-{yyyy.MM.dd}"
+	}
+	index = strings.ToLower(regexp.MustCompile(`\{[^}]*\}`).ReplaceAllString(index, "*"))
+	scheme := "http"
+	if q.Get("tls") == "true" {
+		scheme = "https"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":9200"
+	}
+	kind := "elasticsearch"
+	if u.Scheme == "opensearch" {
+		kind = "grafana-opensearch-datasource"
+	}
+
+	yaml := fmt.Sprintf(`  - name: sensor-gen
+    uid: sensor-gen
+    type: %s
+    access: proxy
+    url: %s://%s
+    jsonData:
+      index: %q
+      timeField: timestamp
+`, kind, scheme, host, index)
+	if q.Get("insecure") == "true" {
+		yaml += "      tlsSkipVerify: true\n"
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		yaml += fmt.Sprintf("    basicAuth: true\n    basicAuthUser: %q\n    secureJsonData:\n      basicAuthPassword: %q\n",
+			u.User.Username(), pass)
+	}
+
+	filter := "pipeline_id.keyword:$pipeline AND type.keyword:$type"
+	target := func(query string, metric map[string]any, groupBy ...map[string]any) map[string]any {
+		buckets := append(groupBy, map[string]any{
+			"id": "9", "type": "date_histogram", "field": "timestamp",
+			"settings": map[string]any{"interval": "auto"},
+		})
+		return map[string]any{
+			"refId": "A", "query": query, "timeField": "timestamp",
+			"metrics": []any{metric}, "bucketAggs": buckets,
+		}
+	}
+	terms := func(field string) map[string]any {
+		return map[string]any{
+			"id": "2", "type": "terms", "field": field + ".keyword",
+			"settings": map[string]any{"size": "10", "order": "asc", "orderBy": "_term", "min_doc_count": "1"},
+		}
+	}
+	panel := func(title, unit string, t map[string]any) map[string]any {
+		return map[string]any{
+			"type": "timeseries", "title": title, "targets": []any{t},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+		}
+	}
+	count := map[string]any{"id": "1", "type": "count"}
+	avg := map[string]any{"id": "1", "type": "avg", "field": "value"}
+
+	return grafanaDatasource{
+		kind: kind,
+		yaml: yaml,
+		panels: []map[string]any{
+			panel("Readings per interval by type", "short", target("pipeline_id.keyword:$pipeline", count, terms("type"))),
+			panel("Average $type by pipeline", "none", target(filter, avg, terms("pipeline_id"))),
+			panel("Alerts by level", "short", target(filter+" AND alert_level:*", count, terms("alert_level"))),
+			panel("Readings per interval by status", "short", target(filter, count, terms("status"))),
+		},
+		variable: func(name, field string) map[string]any {
+			return map[string]any{
+				"name": name, "label": field, "type": "query",
+				"datasource": map[string]any{"type": kind, "uid": "sensor-gen"},
+				"query":      fmt.Sprintf(`{"find": "terms", "field": "%s.keyword"}`, field),
+				"multi":      true, "includeAll": true, "allValue": "*", "refresh": 2,
+				"current": map[string]any{"text": "All", "value": "$__all"},
+			}
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Device health. Each fleet sensor is a battery-powered wireless device
+// that reports on itself alongside its measurement.
+const (
+	batteryReplace = 10.0 // % at which a technician swaps the battery
+	rssiFade       = 10 * time.Minute
+	rebootsPerDay  = 0.1 // watchdog resets and power blips
+)
+
+// firmwareVersions are the versions the fleet runs at the start, oldest
+// first, and the shares of sensors on each.
+var firmwareVersions = []struct {
+	version string
+	share   float64
+}{
+	{"3.1.4", 0.2},
+	{"3.2.0", 0.3},
+	{"3.2.1", 0.5},
+}
+
+// deviceHealth is a sensor's device state. The battery drains at a rate of
+// its own and is swapped when low; the signal strength fades in and out
+// around the level the sensor's site gets; the device reboots now and
+// then, restarting its uptime.
+type deviceHealth struct {
+	battery  float64 // %
+	drain    float64 // % per day
+	rssi     float64 // dBm at the site
+	fade     float64 // dB, the current fade from it
+	boot     time.Time
+	firmware string
+	ota      *firmwareUpdate // in a firmware rollout, if it takes the device
+	degraded bool            // running firmware that failed to update cleanly
+	at       time.Time
+}
+
+func newDeviceHealth(now time.Time, rng *rand.Rand) *deviceHealth {
+	h := &deviceHealth{
+		battery: 15 + rng.Float64()*85,
+		drain:   0.05 + rng.Float64()*0.45,
+		rssi:    -100 + rng.Float64()*45,
+		boot:    now.Add(-time.Duration(rng.Int63n(int64(60 * 24 * time.Hour)))),
+		at:      now,
+	}
+	u := rng.Float64()
+	for _, fw := range firmwareVersions {
+		h.firmware = fw.version
+		if u -= fw.share; u < 0 {
+			break
+		}
+	}
+	return h
+}
+
+// update moves the device on to now.
+func (h *deviceHealth) update(now time.Time, rng *rand.Rand) {
+	dt := now.Sub(h.at)
+	if dt <= 0 {
+		return
+	}
+	h.at = now
+	if h.battery -= h.drain * dt.Hours() / 24; h.battery < batteryReplace {
+		h.battery = 100
+	}
+	decay := math.Exp(-float64(dt) / float64(rssiFade))
+	h.fade = h.fade*decay + rng.NormFloat64()*4*math.Sqrt(1-decay*decay)
+	if rng.Float64() < rebootsPerDay*dt.Hours()/24 {
+		h.boot = now.Add(-time.Duration(rng.Int63n(int64(dt))))
+	}
+}
+
+// stamp sets r's device health fields at now.
+func (h *deviceHealth) stamp(r *SensorReading, now time.Time, rng *rand.Rand) {
+	h.update(now, rng)
+	r.BatteryPct = quantize(h.battery, 0.1)
+	r.RSSI = math.Min(math.Round(h.rssi+h.fade+rng.NormFloat64()), -1)
+	r.Uptime = 1 + int64(now.Sub(h.boot)/time.Second)
+	r.Firmware = h.firmware
+	if h.degraded {
+		r.Quality /= 2
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// valveShare is the fraction of a line's pressure drop taken across its
+// valves at their initial openings; the rest is pipe friction.
+const valveShare = 0.2
+
+// valveMovesPerHour is how often an operator moves each valve to a new
+// setpoint. The valve strokes towards it over the following samples.
+const valveMovesPerHour = 0.5
+
+// hydraulicLine is a physics-lite model of one pipeline: a pump holds the
+// inlet at mile post 0 near a set pressure, product is delivered at a
+// lower pressure at the far end, and the drop between them is shared by
+// pipe friction along the line and the valves on it. Both losses grow
+// with the square of the flow, so the line settles at the flow whose
+// losses use up the pressure available.
+//
+// Closing a valve adds resistance: flow falls, pressure upstream of the
+// valve rises towards the inlet's, and pressure downstream falls towards
+// the outlet's.
+type hydraulicLine struct {
+	flow   *pipelineFlow
+	inlet  float64        // pump discharge pressure, psi
+	target float64        // the pump's set pressure
+	outlet float64        // delivery pressure, psi
+	length float64        // miles
+	pipeR  float64        // friction over the whole line, psi per (bbl/hr)²
+	valveK float64        // resistance of a fully open valve, psi per (bbl/hr)²
+	valves []*fleetSensor // by mile post
+	losses []float64      // pressure dropped across each valve
+	at     time.Time      // time the state was last solved for
+}
+
+// connectHydraulics models every pipeline as a hydraulic line, tying its
+// pressure, flow and valve position sensors together.
+func (f *fleet) connectHydraulics(routes routeSet, rng *rand.Rand) {
+	for _, p := range pipelineIDs {
+		l := &hydraulicLine{
+			flow:   f.flows[p],
+			target: 1200 + rng.Float64()*150,
+			outlet: 350 + rng.Float64()*100,
+			length: routes.length(p),
+		}
+		l.inlet = l.target
+		for _, s := range f.byPipeline[p] {
+			switch sensorTypes[s.Type].Type {
+			case "pressure", "flow_rate":
+				s.line = l
+			case "valve_position":
+				s.line = l
+				l.valves = append(l.valves, s)
+			}
+		}
+		slices.SortFunc(l.valves, func(a, b *fleetSensor) int {
+			return cmp.Compare(a.Location.MilePost, b.Location.MilePost)
+		})
+		l.losses = make([]float64, len(l.valves))
+
+		// Size the losses so the line carries its baseline throughput
+		// with the valves at their initial openings.
+		drop := (l.target - l.outlet) / (l.flow.baseline * l.flow.baseline)
+		l.pipeR = drop
+		if len(l.valves) > 0 {
+			l.pipeR = drop * (1 - valveShare)
+			sum := 0.0
+			for _, v := range l.valves {
+				sum += 1 / math.Pow(opening(v), 2)
+			}
+			l.valveK = drop * valveShare / sum
+		}
+	}
+}
+
+// opening returns a valve's opening as a fraction, kept off zero so a
+// closed valve still passes a trickle.
+func opening(v *fleetSensor) float64 {
+	return max(v.value/100, 0.02)
+}
+
+// update moves the line to its state at now: the pump pressure wanders,
+// operators occasionally move valves, and the flow settles to match.
+func (l *hydraulicLine) update(now time.Time, rng *rand.Rand) {
+	if !l.at.IsZero() && !now.After(l.at) {
+		return
+	}
+	if !l.at.IsZero() {
+		p := valveMovesPerHour * now.Sub(l.at).Hours()
+		for _, v := range l.valves {
+			if rng.Float64() < p {
+				v.baseline = 10 + rng.Float64()*90
+			}
+		}
+	}
+	l.at = now
+	l.inlet += 0.05*(l.target-l.inlet) + rng.NormFloat64()*0.002*l.target
+
+	r := l.pipeR
+	for i, v := range l.valves {
+		l.losses[i] = l.valveK / math.Pow(opening(v), 2)
+		r += l.losses[i]
+	}
+	q := math.Sqrt(max(l.inlet-l.outlet, 0) / r)
+	for i := range l.losses {
+		l.losses[i] *= q * q
+	}
+	l.flow.value = q
+}
+
+// pressure returns the line pressure at milePost: the inlet pressure less
+// the friction loss up to that point and the drop across each valve
+// upstream of it.
+func (l *hydraulicLine) pressure(milePost float64) float64 {
+	q := l.flow.value
+	p := l.inlet - l.pipeR*q*q*min(milePost/l.length, 1)
+	for i, v := range l.valves {
+		if v.Location.MilePost >= milePost {
+			break
+		}
+		p -= l.losses[i]
+	}
+	return p
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// delayDist is a distribution of transmission delays.
+type delayDist struct {
+	kind  string // fixed, uniform, exp or lognormal
+	a, b  time.Duration
+	sigma float64
+}
+
+// parseDelayDist parses a -ingest-delay value:
+//
+//	200ms                fixed
+//	uniform:50ms,2s      uniform between the bounds
+//	exp:200ms            exponential with the given mean
+//	lognormal:150ms,0.8  log-normal with the given median and sigma
+func parseDelayDist(spec string) (*delayDist, error) {
+	kind, args, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, args = "fixed", spec
+	}
+	parts := strings.Split(args, ",")
+	want := map[string]int{"fixed": 1, "uniform": 2, "exp": 1, "lognormal": 2}[kind]
+	if want == 0 {
+		return nil, fmt.Errorf("unknown delay distribution %q (want fixed, uniform, exp or lognormal)", kind)
+	}
+	if len(parts) != want {
+		return nil, fmt.Errorf("%s takes %d parameter(s), got %q", kind, want, args)
+	}
+	d := &delayDist{kind: kind}
+	var err error
+	if d.a, err = time.ParseDuration(strings.TrimSpace(parts[0])); err != nil || d.a < 0 {
+		return nil, fmt.Errorf("%s: invalid duration %q", kind, parts[0])
+	}
+	switch kind {
+	case "uniform":
+		if d.b, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil || d.b < d.a {
+			return nil, fmt.Errorf("uniform: invalid upper bound %q", parts[1])
+		}
+	case "lognormal":
+		if d.sigma, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil || d.sigma < 0 {
+			return nil, fmt.Errorf("lognormal: invalid sigma %q", parts[1])
+		}
+	}
+	return d, nil
+}
+
+// sample draws a delay.
+func (d *delayDist) sample(rng *rand.Rand) time.Duration {
+	switch d.kind {
+	case "uniform":
+		return d.a + time.Duration(rng.Float64()*float64(d.b-d.a))
+	case "exp":
+		return time.Duration(rng.ExpFloat64() * float64(d.a))
+	case "lognormal":
+		return time.Duration(float64(d.a) * math.Exp(rng.NormFloat64()*d.sigma))
+	}
+	return d.a
+}
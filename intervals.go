@@ -0,0 +1,132 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// parseIntervals parses an -intervals value: comma-separated
+// type=interval pairs, e.g. "pressure=1s,corrosion=1h", with "*" for every
+// type not listed. It returns the intervals indexed like sensorTypes,
+// with def for types neither listed nor covered by "*". Cathodic
+// protection types keep cpInterval unless listed themselves.
+func parseIntervals(spec string, def time.Duration) ([]time.Duration, error) {
+	byName := make(map[string]time.Duration)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("%q: want type=interval", item)
+		}
+		if name != "*" && sensorTypeIndex(name) < 0 {
+			return nil, fmt.Errorf("unknown sensor type %q", name)
+		}
+		if _, dup := byName[name]; dup {
+			return nil, fmt.Errorf("sensor type %q listed twice", name)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("sensor type %q: interval must be a positive duration", name)
+		}
+		byName[name] = d
+	}
+	if len(byName) == 0 {
+		return nil, fmt.Errorf("no intervals in %q", spec)
+	}
+	if d, ok := byName["*"]; ok {
+		def = d
+	}
+	out := make([]time.Duration, len(sensorTypes))
+	for i, st := range sensorTypes {
+		d, ok := byName[st.Type]
+		switch {
+		case ok:
+		case isCPType(i):
+			d = cpInterval
+		default:
+			d = def
+		}
+		out[i] = d
+	}
+	return out, nil
+}
+
+// sampleSchedule samples each fleet sensor at its type's interval rather
+// than picking sensors at random: every sample takes the sensor due
+// soonest, if it is due yet. A sensor's first sample falls at a random
+// point of its first interval, so sensors of a type do not all report in
+// the same sample.
+type sampleSchedule struct {
+	intervals []time.Duration // indexed like sensorTypes
+	queue     scheduleQueue
+}
+
+func newSampleSchedule(intervals []time.Duration) *sampleSchedule {
+	if intervals == nil {
+		return nil
+	}
+	return &sampleSchedule{intervals: intervals}
+}
+
+// next returns the sensor due at now, or nil if none is. A sensor that
+// falls behind is sampled as soon as it can be, and its next sample is
+// then due a full interval later; missed samples are not made up.
+func (sc *sampleSchedule) next(f *fleet, now time.Time, rng *rand.Rand) *fleetSensor {
+	if sc.queue == nil {
+		sc.queue = make(scheduleQueue, len(f.sensors))
+		for i, s := range f.sensors {
+			s.due = now.Add(time.Duration(rng.Float64() * float64(sc.intervals[s.Type])))
+			sc.queue[i] = s
+		}
+		heap.Init(&sc.queue)
+	}
+	s := sc.queue[0]
+	if s.due.After(now) {
+		return nil
+	}
+	s.due = s.due.Add(sc.intervals[s.Type])
+	if !s.due.After(now) {
+		s.due = now.Add(sc.intervals[s.Type])
+	}
+	heap.Fix(&sc.queue, 0)
+	return s
+}
+
+// rate returns the samples per second the schedule needs.
+func (sc *sampleSchedule) rate(f *fleet) float64 {
+	total := 0.0
+	for _, s := range f.sensors {
+		total += 1 / sc.intervals[s.Type].Seconds()
+	}
+	return total
+}
+
+// scheduleQueue is a heap of sensors ordered by when they are next due.
+type scheduleQueue []*fleetSensor
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q scheduleQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *scheduleQueue) Push(x any)        { *q = append(*q, x.(*fleetSensor)) }
+func (q *scheduleQueue) Pop() any {
+	old := *q
+	s := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return s
+}
+
+// ScheduledRate returns the samples per second the fleet's sampling
+// schedule needs, or 0 without one.
+func (g *Generator) ScheduledRate() float64 {
+	if g.schedule == nil {
+		return 0
+	}
+	return g.schedule.rate(g.fleet)
+}
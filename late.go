@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// lateInjector delays a fraction of readings so they arrive after newer
+// ones, the way readings buffered by a gateway or retried over a slow link
+// reach a stream processor behind its watermark. A delayed reading keeps
+// its original timestamp and is released up to maxLateness later.
+type lateInjector struct {
+	fraction    float64
+	maxLateness time.Duration
+	held        []lateReading // in release order
+}
+
+type lateReading struct {
+	due     time.Time
+	reading SensorReading
+}
+
+func newLateInjector(fraction float64, maxLateness time.Duration) *lateInjector {
+	if fraction <= 0 || maxLateness <= 0 {
+		return nil
+	}
+	return &lateInjector{fraction: fraction, maxLateness: maxLateness}
+}
+
+// delay reports whether a reading sampled at now is delayed, and until
+// when.
+func (l *lateInjector) delay(now time.Time, rng *rand.Rand) (time.Time, bool) {
+	if rng.Float64() >= l.fraction {
+		return time.Time{}, false
+	}
+	return now.Add(1 + time.Duration(rng.Int63n(int64(l.maxLateness)))), true
+}
+
+// add keeps r until due.
+func (l *lateInjector) add(r SensorReading, due time.Time) {
+	i, _ := slices.BinarySearchFunc(l.held, due, func(h lateReading, t time.Time) int { return h.due.Compare(t) })
+	l.held = slices.Insert(l.held, i, lateReading{due, r})
+}
+
+// release appends the readings due by now to dst.
+func (l *lateInjector) release(dst []SensorReading, now time.Time) []SensorReading {
+	n := 0
+	for n < len(l.held) && !l.held[n].due.After(now) {
+		dst = append(dst, l.held[n].reading)
+		n++
+	}
+	if n > 0 {
+		l.held = slices.Delete(l.held, 0, n)
+	}
+	return dst
+}
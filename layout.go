@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileLayout is how file sinks lay records out: their order, how many
+// files they are sharded across and by what, the keys of the Hive-style
+// partition directories they are written into, when their files are
+// rotated and pruned, and whether they appear only once finished.
+type fileLayout struct {
+	order       recordOrder
+	shards      int
+	shardBy     string
+	partitionBy []string
+	rotateSize  int64         // bytes per file before rotating (0 = no limit)
+	rotateEvery time.Duration // age of a file before rotating (0 = no limit)
+	maxDisk     int64         // bytes the rotated files may take up (0 = no cap)
+	atomic      bool          // write each file as .tmp and rename it when finished
+}
+
+// fileLayoutFlags defines the flags shaping file output on fs. The
+// returned function builds and checks the layout once fs is parsed.
+func fileLayoutFlags(fs *flag.FlagSet) func() (fileLayout, error) {
+	order := fs.String("order", orderInterleaved, "Record order in file output: interleaved, sensor (grouped by sensor) or pipeline (grouped by pipeline)")
+	orderWindow := fs.Duration("order-window", time.Minute, "Span of reading time regrouped at once with -order sensor or pipeline; bounds the time skew")
+	shards := fs.Int("shards", 1, "Split file output round-robin across this many files, e.g. out-00.jsonl to out-63.jsonl for -shards 64")
+	shardBy := fs.String("shard-by", shardRoundRobin, "Shard assignment with -shards: round-robin (evenly sized files) or sensor (each sensor's readings in one file)")
+	partitionBy := fs.String("partition-by", "", "Write file output into Hive-style partition directories by these keys, e.g. dt,pipeline_id (-o names the directory; keys: dt, hour, pipeline_id, type, sensor_id, status, cohort)")
+	rotateSize := fs.String("rotate-size", "", "Rotate file output to a new timestamped file once it reaches this size, e.g. 100MB")
+	rotateEvery := fs.Duration("rotate-every", 0, "Rotate file output to a new timestamped file at this interval, e.g. 1h")
+	maxDisk := fs.String("max-disk", "", "With rotation, delete the oldest rotated files to keep file output under this total size, e.g. 10GB")
+	atomic := fs.Bool("atomic", false, "Write each output file under a .tmp name and rename it when finished (on exit or rotation), so file watchers never see partial files")
+
+	return func() (fileLayout, error) {
+		l := fileLayout{
+			order:       recordOrder{by: *order, window: *orderWindow},
+			shards:      *shards,
+			shardBy:     *shardBy,
+			rotateEvery: *rotateEvery,
+			atomic:      *atomic,
+		}
+		var err error
+		if *partitionBy != "" {
+			if l.partitionBy, err = parsePartitionKeys(*partitionBy); err != nil {
+				return l, fmt.Errorf("-partition-by: %w", err)
+			}
+		}
+		if *rotateSize != "" {
+			if l.rotateSize, err = parseBytes(*rotateSize); err != nil {
+				return l, fmt.Errorf("-rotate-size: %w", err)
+			}
+		}
+		if *maxDisk != "" {
+			if l.maxDisk, err = parseBytes(*maxDisk); err != nil {
+				return l, fmt.Errorf("-max-disk: %w", err)
+			}
+		}
+		return l, l.validate()
+	}
+}
+
+func (l fileLayout) validate() error {
+	if err := l.order.validate(); err != nil {
+		return fmt.Errorf("-order: %w", err)
+	}
+	if l.shards < 1 {
+		return errors.New("-shards must be at least 1")
+	}
+	if l.shardBy != shardRoundRobin && l.shardBy != shardSensor {
+		return fmt.Errorf("-shard-by: unknown assignment %q (want %s or %s)", l.shardBy, shardRoundRobin, shardSensor)
+	}
+	if l.shards > 1 && len(l.partitionBy) > 0 {
+		return errors.New("-shards and -partition-by cannot be combined")
+	}
+	if l.rotateSize < 0 || l.rotateEvery < 0 || l.maxDisk < 0 {
+		return errors.New("-rotate-size, -rotate-every and -max-disk must not be negative")
+	}
+	if l.rotates() && len(l.partitionBy) > 0 {
+		return errors.New("-partition-by writes a part file per run; it cannot be combined with rotation")
+	}
+	if l.maxDisk > 0 && !l.rotates() {
+		return errors.New("-max-disk needs -rotate-size or -rotate-every")
+	}
+	if l.maxDisk > 0 && l.maxDisk < l.rotateSize*int64(l.shards) {
+		return errors.New("-max-disk must leave room for the files being written (-rotate-size per shard)")
+	}
+	return nil
+}
+
+// rotates reports whether file output is rotated.
+func (l fileLayout) rotates() bool {
+	return l.rotateSize > 0 || l.rotateEvery > 0
+}
+
+// singleFile reports whether file output goes to exactly the named file.
+func (l fileLayout) singleFile() bool {
+	return l.shards == 1 && len(l.partitionBy) == 0 && !l.rotates()
+}
+
+// describe describes file output to path for the startup message.
+func (l fileLayout) describe(path string, appendMode bool) string {
+	if len(l.partitionBy) > 0 {
+		dir := filepath.Join(strings.TrimSuffix(path, ".jsonl"), strings.Join(l.partitionBy, "=*/")+"=*")
+		if l.atomic {
+			return dir + " (partitioned, renamed from .tmp on exit)"
+		}
+		return dir + " (partitioned)"
+	}
+	mode := "overwriting"
+	if appendMode {
+		mode = "appending"
+	}
+	name := func(p string) string { return p }
+	if l.rotates() {
+		name = func(p string) string {
+			ext := filepath.Ext(p)
+			return strings.TrimSuffix(p, ext) + "-<time>" + ext
+		}
+		var limits []string
+		if l.rotateEvery > 0 {
+			limits = append(limits, l.rotateEvery.String())
+		}
+		if l.rotateSize > 0 {
+			limits = append(limits, fmt.Sprintf("%.4gMB", float64(l.rotateSize)/(1<<20)))
+		}
+		mode = "rotating every " + strings.Join(limits, " or ")
+		if l.maxDisk > 0 {
+			mode += fmt.Sprintf(", keeping %.4gMB", float64(l.maxDisk)/(1<<20))
+		}
+	}
+	if l.atomic {
+		mode += ", renamed from .tmp when finished"
+	}
+	if l.shards > 1 {
+		path = name(shardPath(path, 0, l.shards)) + " ... " + name(shardPath(path, l.shards-1, l.shards))
+	} else {
+		path = name(path)
+	}
+	return fmt.Sprintf("%s (%s)", path, mode)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Log formats for -log-format.
+const (
+	logText = "text" // the messages alone, for people
+	logJSON = "json" // one JSON object per record on stderr, for log pipelines
+)
+
+// logFlags defines the flags shaping status output on fs. The returned
+// function installs the default slog logger once fs is parsed.
+func logFlags(fs *flag.FlagSet) func() error {
+	format := fs.String("log-format", logText, "Status output format: text (human-readable) or json (one JSON object per line on stderr)")
+	level := fs.String("log-level", "info", "Least severe status output shown: debug, info, warn or error")
+	quiet := fs.Bool("quiet", false, "Only show warnings and errors (same as -log-level warn)")
+
+	return func() error {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(*level)); err != nil {
+			return fmt.Errorf("-log-level: unknown level %q (want debug, info, warn or error)", *level)
+		}
+		if *quiet {
+			l = max(l, slog.LevelWarn)
+		}
+		switch *format {
+		case logText:
+			slog.SetDefault(slog.New(newHumanHandler(l)))
+		case logJSON:
+			slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+		default:
+			return fmt.Errorf("-log-format: unknown format %q (want %s or %s)", *format, logText, logJSON)
+		}
+		return nil
+	}
+}
+
+// humanHandler writes each record's message alone: info and debug on
+// stdout, warnings and errors on stderr behind a "Warning: " or "Error: "
+// prefix. Attributes are left to JSON logs, as the messages already say
+// what they hold.
+type humanHandler struct {
+	level slog.Level
+	mu    *sync.Mutex
+}
+
+func newHumanHandler(level slog.Level) *humanHandler {
+	return &humanHandler{level: level, mu: new(sync.Mutex)}
+}
+
+func (h *humanHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *humanHandler) Handle(_ context.Context, r slog.Record) error {
+	w, prefix := io.Writer(os.Stdout), ""
+	switch {
+	case r.Level >= slog.LevelError:
+		w, prefix = os.Stderr, "Error: "
+	case r.Level >= slog.LevelWarn:
+		w, prefix = os.Stderr, "Warning: "
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintln(w, prefix+r.Message)
+	return err
+}
+
+func (h *humanHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *humanHandler) WithGroup(string) slog.Handler      { return h }
+
+// humanLogs reports whether status output is for people, so multi-line
+// summaries are printed as such rather than as a single record.
+func humanLogs() bool {
+	_, ok := slog.Default().Handler().(*humanHandler)
+	return ok
+}
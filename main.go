@@ -1,210 +1,1150 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"math/rand"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
-// SensorReading represents a single IoT/OT sensor data point from pipeline infrastructure
-type SensorReading struct {
-	SensorID    string  `json:"sensor_id"`
-	Timestamp   string  `json:"timestamp"`
-	Type        string  `json:"type"`
-	Value       float64 `json:"value"`
-	Unit        string  `json:"unit"`
-	Location    Location `json:"location"`
-	PipelineID  string  `json:"pipeline_id"`
-	Status      string  `json:"status"`
-	Quality     float64 `json:"quality_score"`
-	AlertLevel  string  `json:"alert_level,omitempty"`
-}
-
-type Location struct {
-	Lat      float64 `json:"lat"`
-	Lon      float64 `json:"lon"`
-	MilePost float64 `json:"mile_post"`
-}
-
-var sensorTypes = []struct {
-	Type string
-	Unit string
-	Min  float64
-	Max  float64
-}{
-	{"pressure", "psi", 200, 1500},
-	{"temperature", "fahrenheit", -20, 180},
-	{"flow_rate", "bbl/hr", 0, 50000},
-	{"vibration", "mm/s", 0, 25},
-	{"corrosion", "mpy", 0, 50},
-	{"humidity", "percent", 0, 100},
-	{"gas_detector", "ppm", 0, 1000},
-	{"valve_position", "percent", 0, 100},
-}
+// shutdownTimeout is the default -drain-timeout: how long buffered output
+// may take to flush once generation has stopped.
+const shutdownTimeout = 10 * time.Second
 
-var pipelineIDs = []string{
-	"PIPE-TX-001", "PIPE-TX-002", "PIPE-OK-001", "PIPE-LA-001",
-	"PIPE-NM-001", "PIPE-CO-001", "PIPE-WY-001", "PIPE-ND-001",
-}
+func main() {
+	// Human-readable status output until the flags say otherwise.
+	slog.SetDefault(slog.New(newHumanHandler(slog.LevelInfo)))
 
-var statuses = []string{"normal", "normal", "normal", "normal", "warning", "maintenance"}
-var alertLevels = []string{"", "", "", "", "", "low", "medium", "high"}
+	// "sensor-gen serve [flags]" streams readings to WebSocket and gRPC
+	// clients, and to any sinks given with -sink.
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "grafana" {
+		os.Exit(grafanaMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "stack" {
+		os.Exit(stackMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "compress" {
+		os.Exit(compressMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "replay" {
+		os.Exit(replayMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "convert" {
+		os.Exit(convertMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "validate" {
+		os.Exit(validateMain(args[1:]))
+	}
+	if len(args) > 0 && args[0] == "stats" {
+		os.Exit(statsMain(args[1:]))
+	}
+	serve := len(args) > 0 && args[0] == "serve"
+	// "sensor-gen generate -recipe FILE" regenerates a previous run.
+	regenerate := len(args) > 0 && args[0] == "generate"
+	if serve || regenerate {
+		args = args[1:]
+	}
 
-func main() {
 	outputFile := flag.String("o", "output.jsonl", "Output file path")
-	rate := flag.Int("rate", 10000, "Target entries per second")
+	rate := new(int)
+	*rate = 10000
+	rateFlag := &rateValue{n: rate}
+	flag.Var(rateFlag, "rate", "Target entries per second, or a bandwidth such as 50MB/s")
 	duration := flag.Duration("d", 0, "Duration to run (0 = indefinite)")
 	verbose := flag.Bool("v", false, "Verbose output with stats")
+	bench := flag.Bool("bench", false, "Benchmark instead of running: generate unthrottled for -d (default 5s) through each encoder and sink in turn and report the records/sec and MB/sec each sustains")
+	tui := flag.Bool("tui", false, "Show a live dashboard (rates, totals, sink queues and errors, anomalies) with keys to pause, change the rate or quit")
+	statsJSON := flag.String("stats-json", "", "Also write the final stats as JSON to this file (- = stderr)")
 	appendMode := flag.Bool("append", false, "Append to existing file instead of overwriting")
-	flag.Parse()
+	layoutFlags := fileLayoutFlags(flag.CommandLine)
+	retryFlags := sinkRetryFlags(flag.CommandLine)
+	bpFlags := backpressureFlags(flag.CommandLine)
+	var sinkURLs sinkList
+	flag.Var(&sinkURLs, "sink", "Output sink URL, e.g. s3://bucket/prefix; repeat to write to several sinks (default: write to the -o file)")
+	bgEvents := flag.Float64("background-events", 0, "Minor background events (pressure excursions, comms hiccups) per pipeline per hour (0 = off)")
+	fleetSize := flag.Int("fleet", 0, "Simulate a fixed fleet of this many sensors with continuous values (0 = independent random readings)")
+	intervalsFlag := flag.String("intervals", "", "Sample fleet sensors at per-type intervals, e.g. pressure=1s,corrosion=1h,*=1m (unlisted types default to fleet size/rate; needs -fleet)")
+	typeMixFlag := flag.String("type-mix", "", "Relative frequency of sensor types, e.g. pressure=60,flow_rate=20,corrosion=5 (unlisted types are left out; default: even)")
+	pipelineMixFlag := flag.String("pipeline-mix", "", "Relative share of readings per pipeline, e.g. PIPE-TX-001=40,*=10 (* = every unlisted pipeline; unlisted pipelines are otherwise left out; default: even)")
+	redundant := flag.Float64("redundant-pairs", 0, "Fraction of critical fleet points (pressure, flow, gas) with A/B redundant transmitters (needs -fleet)")
+	routesFile := flag.String("routes", "", "GeoJSON file of pipeline routes (LineStrings) to place sensors along")
+	stations := flag.Int("stations", 0, "Pump stations per pipeline, each with suction and discharge pressure, pump speed, motor current and bearing temperature sensors that agree (needs -fleet)")
+	pumpTrips := flag.Float64("pump-trips", 0, "Pump trips per station per day, stopping the pump and moving all its station's readings together (needs -stations)")
+	esd := flag.Bool("esd", false, "Simulate the emergency shutdown system: leaks trip their pipeline's ESD and close the valves either side, and pump trips are reported, each as an event record (needs -fleet)")
+	calibrationDrift := flag.Float64("calibration-drift", 0, "Standard deviation of each fleet sensor's calibration drift, as a fraction of its range per day, e.g. 0.001 (needs -fleet)")
+	recalibrate := flag.Duration("recalibrate", 30*24*time.Hour, "Time between a sensor's recalibrations with -calibration-drift, each snapping its readings back and logged as an event")
+	gateways := flag.Int("gateways", 0, "Edge gateways per pipeline, each forwarding the readings of the fleet sensors on its stretch in shared transmissions (needs -fleet)")
+	gatewayInterval := flag.Duration("gateway-interval", 10*time.Second, "Time between a gateway's transmissions")
+	gatewayOutages := flag.Float64("gateway-outages", 0, "Uplink outages per gateway per day, each lasting 1-30 minutes and ending in a catch-up burst (needs -gateways)")
+	deviceHealth := flag.Bool("device-health", false, "Add each fleet sensor's battery level, signal strength, uptime and firmware version to its readings (needs -fleet)")
+	firmwareRollout := flag.String("firmware-rollout", "", "Roll this firmware version out over the fleet in waves, each sensor going offline while it updates (needs -device-health)")
+	rolloutWaves := flag.String("rollout-waves", "1,10,50,100", "Cumulative percentages of the fleet updated by each -firmware-rollout wave")
+	rolloutEvery := flag.Duration("rollout-every", time.Hour, "Time between -firmware-rollout waves")
+	rolloutFailures := flag.Float64("rollout-failures", 0.02, "Fraction of firmware updates that fail, leaving the sensor with halved quality scores")
+	eventsOut := flag.String("events-out", "", "Write ESD, valve, pump and recalibration event records to this file as JSON lines, apart from the readings (needs -esd or -calibration-drift)")
+	operators := flag.Bool("operators", false, "Simulate the controllers: alerting readings raise alarms they acknowledge, and they answer critical ones with setpoint changes or manual overrides (needs -fleet)")
+	actionsOut := flag.String("actions-out", "", "Write the operators' actions to this file as JSON lines, an audit log apart from the readings (needs -operators)")
+	hydraulics := flag.Bool("hydraulics", false, "Model each pipeline hydraulically, so its pressure, flow and valve readings agree (needs -fleet)")
+	leaks := flag.Float64("leaks", 0, "Leak scenarios per pipeline per day, unbalancing flow meters downstream of the leak (needs -fleet)")
+	leakImbalance := flag.Float64("leak-imbalance", 0.05, "Maximum fraction of pipeline throughput lost during a leak")
+	deadband := flag.Float64("deadband", 0, "Report by exception: fleet sensors only report after moving this fraction of their range (0 = report every sample; needs -fleet)")
+	keepalive := flag.Duration("keepalive", time.Minute, "Report by exception: longest a sensor stays silent before a keepalive report")
+	units := flag.String("units", unitsImperial, "Unit system of the readings: imperial (psi, fahrenheit, bbl/hr, ft, BTU/scf) or metric (kPa, celsius, m3/h, m, MJ/m3)")
+	quantizeValues := flag.Bool("quantize", false, "Round values to each sensor type's instrument resolution (e.g. 0.1 psi)")
+	backfill := flag.Bool("backfill", false, "After a comms hiccup, emit interpolated readings flagged as backfilled for the silent window (needs -fleet and -background-events)")
+	cohorts := flag.String("cohorts", "", "Tag each sensor with an experiment cohort, e.g. control=90,shadow=10 (weights default to 1)")
+	cohortSalt := flag.String("cohort-salt", "", "Salt for cohort assignment; change it to reshuffle sensors between cohorts")
+	failures := flag.Float64("failures", 0, "Random sensor failures per fleet sensor per day: stuck, zero, NaN/Inf values, dropouts or death (needs -fleet)")
+	failureModes := flag.String("failure-modes", strings.Join(failureModes, ","), "Failure modes -failures draws from")
+	late := flag.Float64("late", 0, "Fraction of readings delayed to arrive out of order, with their original timestamps (0-1)")
+	maxLateness := flag.Duration("max-lateness", 30*time.Second, "Longest delay of a late reading")
+	duplicates := flag.Float64("duplicates", 0, "Fraction of readings retransmitted as duplicates (0-1)")
+	nearDuplicates := flag.Float64("near-duplicates", 0.5, "Share of duplicates that differ slightly from the original (0-1)")
+	burstSize := flag.Int("burst", 0, "Store-and-forward bursts: every -burst-every, hold readings back until this many have built up, then deliver them all at once (0 = off)")
+	burstEvery := flag.Duration("burst-every", 5*time.Minute, "Time between -burst bursts")
+	malformed := flag.Float64("malformed", 0, "Chaos: fraction of records written malformed (truncated JSON, wrong types, missing fields)")
+	pluginCmd := flag.String("plugin", "", "Pass readings through an external plugin process: a command reading JSON lines on stdin and writing one reading (or null) per line to stdout")
+	valuePluginCmd := flag.String("plugin-values", "", "Take reading values from an external plugin process: a command reading JSON lines on stdin and writing one value (or null for the model's) per line to stdout")
+	padTo := flag.String("pad-to", "", "Pad records with a filler field to this average size, e.g. 1KB")
+	padField := flag.String("pad-field", "padding", "Name of the -pad-to filler field")
+	tsFormat := flag.String("ts-format", tsRFC3339, "Timestamp format in JSON output: rfc3339, epoch_ms, epoch_ns or custom (see -ts-layout)")
+	tsLayout := flag.String("ts-layout", "", "Go time layout of -ts-format custom, e.g. '2006-01-02 15:04:05.000'")
+	tsPrecision := flag.String("ts-precision", "nano", "Truncate timestamps in JSON output to second, milli, micro or nano")
+	tsZone := flag.String("ts-zone", "UTC", "Time zone of timestamps in JSON output: an IANA name such as America/Chicago, or pipeline for each pipeline's local time")
+	cloudEvents := flag.String("cloudevents", "", "Wrap readings in CloudEvents 1.0 envelopes: structured, or binary (attributes as headers on HTTP and NATS sinks)")
+	ceSource := flag.String("ce-source", "/sensor-gen/{pipeline_id}", "CloudEvents source attribute; accepts {sensor_id}, {pipeline_id}, {type}, {unit} and {status}")
+	ceType := flag.String("ce-type", "io.sensorgen.reading", "CloudEvents type attribute; accepts the -ce-source placeholders")
+	clockSkew := flag.Duration("clock-skew", 0, "Standard deviation of each fleet sensor's clock offset, e.g. 2s (needs -fleet)")
+	clockDrift := flag.Float64("clock-drift", 0, "Standard deviation of each fleet sensor's clock drift in ppm, e.g. 50 (needs -fleet)")
+	sequence := flag.Bool("sequence", false, "Number each fleet sensor's readings with a per-sensor sequence field (needs -fleet)")
+	ingestDelay := flag.String("ingest-delay", "", "Add an ingested_at timestamp this transmission delay after each reading: 200ms, uniform:50ms,2s, exp:200ms or lognormal:150ms,0.8 (median, sigma)")
+	profileFile := flag.String("profile", "", "JSON rate profile shaping the sample rate over the run: ramps, steps, daily sine load, Poisson arrivals (replaces -rate)")
+	configFile := flag.String("config", "", "JSON configuration file (noise models, alert thresholds, status chain, scheduled failures)")
+	seedFlag := flag.Int64("seed", 0, "Random seed (0 = pick one; the run's recipe records it)")
+	recipeFile := flag.String("recipe", "", "With generate: the recipe of the run to regenerate")
+	recipeOut := flag.String("recipe-out", "auto", "Write the run's recipe to this file (auto = <-o file>.recipe.json when writing the -o file; empty = off)")
+	manifestOut := flag.String("manifest", "auto", "Write a manifest of the run, with its settings, seed, times, record count and the files written with their SHA-256 checksums, to this file (auto = <-o file>.manifest.json when writing the -o file; empty = off)")
+	runID := flag.String("run-id", "", "Identify the run by this ID in sink message metadata, the manifest and, with -run-id-field, every reading (default: a random UUID, which recipes and checkpoints keep)")
+	runIDField := flag.Bool("run-id-field", false, "Add the run ID to every reading as a run_id field, and with -cloudevents as a runid extension attribute")
+	checkpointFile := flag.String("checkpoint", "", "Save the run's state to this file periodically and on exit, and resume from it if it exists, appending to the output")
+	checkpointEvery := flag.Duration("checkpoint-every", 10*time.Second, "Time between -checkpoint saves")
+	drainTimeout := flag.Duration("drain-timeout", shutdownTimeout, "On stopping (end of -d, SIGINT or SIGTERM), how long to wait for sinks to write buffered and in-flight batches before dropping them")
+	maxErrors := flag.Int("max-errors", -1, "Abort once more than this many errors occur (-1 = never abort, only count and report them)")
+	addr := flag.String("addr", ":8080", "WebSocket listen address in serve mode (empty = off)")
+	grpcAddr := flag.String("grpc-addr", "", "gRPC (h2c) listen address in serve mode (empty = off)")
+	opcuaAddr := flag.String("opcua-addr", "", "OPC UA (opc.tcp) listen address in serve mode, e.g. :4840 (empty = off; needs -fleet)")
+	modbusAddr := flag.String("modbus-addr", "", "Modbus TCP listen address in serve mode, e.g. :5020 (empty = off; needs -fleet)")
+	coapAddr := flag.String("coap-addr", "", "CoAP (UDP) listen address in serve mode, e.g. :5683 (empty = off; per-sensor resources need -fleet)")
+	debugAddr := flag.String("debug-addr", "", "Serve pprof profiles (/debug/pprof/) and expvar counters (/debug/vars) on this address, e.g. localhost:6060 (empty = off)")
+	setupLogs := logFlags(flag.CommandLine)
+	modbusMap := flag.String("modbus-map", "", "Write the Modbus register map to this CSV file (needs -modbus-addr)")
+	flag.CommandLine.Parse(args)
+	if err := setupLogs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	// Open file in truncate (default) or append mode
-	var file *os.File
-	var err error
-	if *appendMode {
-		file, err = os.OpenFile(*outputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if *bench && (serve || regenerate || *checkpointFile != "" || *tui) {
+		slog.Error("-bench cannot be combined with serve, generate, -checkpoint or -tui")
+		os.Exit(1)
+	}
+
+	var recipe *Recipe
+	if *recipeFile != "" && !regenerate {
+		slog.Error("-recipe requires the generate command")
+		os.Exit(1)
+	}
+	if regenerate {
+		if *recipeFile == "" {
+			slog.Error("generate requires -recipe")
+			os.Exit(1)
+		}
+		// The recipe's -o file is the output being regenerated; writing
+		// the copy there would overwrite it.
+		given := false
+		flag.Visit(func(f *flag.Flag) { given = given || f.Name == "o" })
+		if !given && len(sinkURLs) == 0 {
+			slog.Error("generate would overwrite the output the recipe regenerates; give -o or -sink")
+			os.Exit(1)
+		}
+		var err error
+		if recipe, err = loadRecipe(*recipeFile); err == nil {
+			err = recipe.apply(flag.CommandLine)
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+			slog.Error(err.Error())
 			os.Exit(1)
 		}
-	} else {
-		file, err = os.Create(*outputFile)
+		if v := buildVersion(); recipe.Version != v {
+			slog.Warn(fmt.Sprintf("recipe is from sensor-gen %s, this is %s; output may differ", recipe.Version, v))
+		}
+	}
+
+	// A checkpoint resumes the run it was saved from: its flags fill in
+	// those not given again, as a recipe's do.
+	var resume *Checkpoint
+	if *checkpointFile != "" {
+		if regenerate {
+			slog.Error("-checkpoint cannot be combined with generate")
+			os.Exit(1)
+		}
+		cp, err := loadCheckpoint(*checkpointFile)
+		if err == nil {
+			err = cp.apply(flag.CommandLine)
+			resume = cp
+		} else if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating file: %v\n", err)
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		if *profileFile != "" || *burstSize > 0 || *eventsOut != "" || *actionsOut != "" || *pluginCmd != "" || *valuePluginCmd != "" {
+			slog.Error("-checkpoint cannot be combined with -profile, -burst, -events-out, -actions-out, -plugin or -plugin-values")
+			os.Exit(1)
+		}
+		if *checkpointEvery <= 0 {
+			slog.Error("-checkpoint-every must be positive")
 			os.Exit(1)
 		}
 	}
-	defer file.Close()
 
-	// Buffered writer for performance
-	writer := bufio.NewWriterSize(file, 1024*1024) // 1MB buffer
-	defer writer.Flush()
+	// The run ID is kept as a flag, so a regenerated or resumed run keeps
+	// the one its recipe or checkpoint recorded.
+	if *runID == "" {
+		flag.Set("run-id", newRunID())
+	} else if err := checkRunID(*runID); err != nil {
+		slog.Error(fmt.Sprintf("-run-id: %v", err))
+		os.Exit(1)
+	}
 
-	// Handle graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	var cfg Config
+	if recipe != nil {
+		// The recipe carries the configuration the run used.
+		if recipe.Config != nil {
+			cfg = *recipe.Config
+		}
+	} else if resume != nil {
+		if resume.Config != nil {
+			cfg = *resume.Config
+		}
+	} else if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		cfg = *c
+		// Settings in the file override their flags.
+		for name, value := range cfg.flags() {
+			if err := flag.Set(name, value); err != nil {
+				slog.Error(fmt.Sprintf("config: %s: %v", name, err))
+				os.Exit(1)
+			}
+		}
+	}
+	var profile *RateProfile
+	if recipe != nil {
+		profile = recipe.Profile
+	} else if *profileFile != "" {
+		p, err := loadProfile(*profileFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		profile = p
+	}
+	var routes routeSet
+	if *routesFile != "" {
+		rs, err := loadRoutes(*routesFile)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		routes = rs
+	}
+	if *backfill && (*fleetSize <= 0 || *bgEvents <= 0) {
+		slog.Error("-backfill requires -fleet and -background-events")
+		os.Exit(1)
+	}
+	if *stations > 0 && *fleetSize <= 0 {
+		slog.Error("-stations requires -fleet")
+		os.Exit(1)
+	}
+	if *pumpTrips > 0 && *stations <= 0 {
+		slog.Error("-pump-trips requires -stations")
+		os.Exit(1)
+	}
+	if *esd && *fleetSize <= 0 {
+		slog.Error("-esd requires -fleet")
+		os.Exit(1)
+	}
+	if *calibrationDrift > 0 && *fleetSize <= 0 {
+		slog.Error("-calibration-drift requires -fleet")
+		os.Exit(1)
+	}
+	if *calibrationDrift < 0 || *recalibrate <= 0 {
+		slog.Error("-calibration-drift must not be negative and -recalibrate must be positive")
+		os.Exit(1)
+	}
+	if *gateways > 0 && *fleetSize <= 0 {
+		slog.Error("-gateways requires -fleet")
+		os.Exit(1)
+	}
+	if *gatewayOutages > 0 && *gateways <= 0 {
+		slog.Error("-gateway-outages requires -gateways")
+		os.Exit(1)
+	}
+	if *gateways < 0 || *gatewayInterval <= 0 || *gatewayOutages < 0 {
+		slog.Error("-gateways and -gateway-outages must not be negative and -gateway-interval must be positive")
+		os.Exit(1)
+	}
+	if *deviceHealth && *fleetSize <= 0 {
+		slog.Error("-device-health requires -fleet")
+		os.Exit(1)
+	}
+	if _, err := parseUnits(*units); err != nil {
+		slog.Error(fmt.Sprintf("-units: %v", err))
+		os.Exit(1)
+	}
+	if *firmwareRollout != "" && !*deviceHealth {
+		slog.Error("-firmware-rollout requires -device-health")
+		os.Exit(1)
+	}
+	waves, err := parseWaves(*rolloutWaves)
+	if err != nil {
+		slog.Error(fmt.Sprintf("-rollout-waves: %v", err))
+		os.Exit(1)
+	}
+	if *rolloutEvery <= 0 || *rolloutFailures < 0 || *rolloutFailures > 1 {
+		slog.Error("-rollout-every must be positive and -rollout-failures between 0 and 1")
+		os.Exit(1)
+	}
+	if *eventsOut != "" && !*esd && *calibrationDrift <= 0 && *firmwareRollout == "" {
+		slog.Error("-events-out requires -esd, -calibration-drift or -firmware-rollout")
+		os.Exit(1)
+	}
+	if *operators && *fleetSize <= 0 {
+		slog.Error("-operators requires -fleet")
+		os.Exit(1)
+	}
+	if *actionsOut != "" && !*operators {
+		slog.Error("-actions-out requires -operators")
+		os.Exit(1)
+	}
+	if *hydraulics && *fleetSize <= 0 {
+		slog.Error("-hydraulics requires -fleet")
+		os.Exit(1)
+	}
+	if *leaks > 0 && *fleetSize <= 0 {
+		slog.Error("-leaks requires -fleet")
+		os.Exit(1)
+	}
+	if *deadband > 0 && *fleetSize <= 0 {
+		slog.Error("-deadband requires -fleet")
+		os.Exit(1)
+	}
+	if (*failures > 0 || len(cfg.Failures) > 0) && *fleetSize <= 0 {
+		slog.Error("-failures and configured failures require -fleet")
+		os.Exit(1)
+	}
+	if len(cfg.Status) > 0 && *fleetSize <= 0 {
+		slog.Error("a configured status chain requires -fleet")
+		os.Exit(1)
+	}
+	modes, err := parseFailureModes(*failureModes)
+	if err != nil {
+		slog.Error(fmt.Sprintf("-failure-modes: %v", err))
+		os.Exit(1)
+	}
+	if *burstSize < 0 || (*burstSize > 0 && *burstEvery <= 0) {
+		slog.Error("-burst must not be negative and -burst-every must be positive")
+		os.Exit(1)
+	}
+	if *late < 0 || *late > 1 || (*late > 0 && *maxLateness <= 0) {
+		slog.Error("-late must be between 0 and 1, with a positive -max-lateness")
+		os.Exit(1)
+	}
+	if *sequence && *fleetSize <= 0 {
+		slog.Error("-sequence requires -fleet")
+		os.Exit(1)
+	}
+	if (*clockSkew > 0 || *clockDrift > 0) && *fleetSize <= 0 {
+		slog.Error("-clock-skew and -clock-drift require -fleet")
+		os.Exit(1)
+	}
+	var ingest *delayDist
+	if *ingestDelay != "" {
+		var err error
+		if ingest, err = parseDelayDist(*ingestDelay); err != nil {
+			slog.Error(fmt.Sprintf("-ingest-delay: %v", err))
+			os.Exit(1)
+		}
+	}
+	if *malformed < 0 || *malformed > 1 {
+		slog.Error("-malformed must be between 0 and 1")
+		os.Exit(1)
+	}
+	tsf, err := newTimestampFormat(*tsFormat, *tsLayout, *tsPrecision, *tsZone)
+	if err != nil {
+		slog.Error(fmt.Sprintf("-ts-format: %v", err))
+		os.Exit(1)
+	}
+	var padSize int64
+	if *padTo != "" {
+		if padSize, err = parseBytes(*padTo); err != nil {
+			slog.Error(fmt.Sprintf("-pad-to: %v", err))
+			os.Exit(1)
+		}
+	}
+	if _, ok := readingFields[*padField]; ok || *padField == "" {
+		slog.Error(fmt.Sprintf("-pad-field %q is a reading field", *padField))
+		os.Exit(1)
+	}
+	var plug, valuePlug *plugin
+	if *pluginCmd != "" {
+		if plug, err = startPlugin(*pluginCmd); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if *valuePluginCmd != "" {
+		if valuePlug, err = startPlugin(*valuePluginCmd); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if *duplicates < 0 || *duplicates > 1 || *nearDuplicates < 0 || *nearDuplicates > 1 {
+		slog.Error("-duplicates and -near-duplicates must be between 0 and 1")
+		os.Exit(1)
+	}
+	if rateFlag.bandwidth > 0 && (*intervalsFlag != "" || *profileFile != "") {
+		slog.Error("a -rate bandwidth cannot be combined with -intervals or -profile, which set the sample rate")
+		os.Exit(1)
+	}
+	var intervals []time.Duration
+	if *intervalsFlag != "" {
+		if *fleetSize <= 0 {
+			slog.Error("-intervals requires -fleet")
+			os.Exit(1)
+		}
+		var err error
+		def := time.Duration(float64(time.Second) * float64(*fleetSize) / float64(*rate))
+		if intervals, err = parseIntervals(*intervalsFlag, def); err != nil {
+			slog.Error(fmt.Sprintf("-intervals: %v", err))
+			os.Exit(1)
+		}
+	}
+	var typeMix []float64
+	if *typeMixFlag != "" {
+		var err error
+		if typeMix, err = parseTypeMix(*typeMixFlag); err != nil {
+			slog.Error(fmt.Sprintf("-type-mix: %v", err))
+			os.Exit(1)
+		}
+	}
+	var pipelineMix []float64
+	if *pipelineMixFlag != "" {
+		var err error
+		if pipelineMix, err = parsePipelineMix(*pipelineMixFlag); err != nil {
+			slog.Error(fmt.Sprintf("-pipeline-mix: %v", err))
+			os.Exit(1)
+		}
+	}
+	var cohortList []Cohort
+	if *cohorts != "" {
+		var err error
+		if cohortList, err = parseCohorts(*cohorts); err != nil {
+			slog.Error(fmt.Sprintf("-cohorts: %v", err))
+			os.Exit(1)
+		}
+	}
+	ce, err := newCEWrapper(*cloudEvents, *ceSource, *ceType)
+	if err != nil {
+		slog.Error(fmt.Sprintf("-cloudevents: %v", err))
+		os.Exit(1)
+	}
+	layout, err := layoutFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	retry, err := retryFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	bp, err := bpFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if *checkpointFile != "" && layout.atomic && !layout.rotates() && len(layout.partitionBy) == 0 {
+		slog.Error("-checkpoint resumes by appending to the output, which -atomic replaces (rotated or partitioned output can be combined)")
+		os.Exit(1)
+	}
+	if *tui {
+		if err := checkTerminal(); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if *modbusMap != "" && (!serve || *modbusAddr == "") {
+		slog.Error("-modbus-map requires serve -modbus-addr")
+		os.Exit(1)
+	}
+	if *debugAddr != "" {
+		if err := serveDebug(*debugAddr); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
 
-	mode := "overwriting"
-	if *appendMode {
-		mode = "appending"
+	seed, start := *seedFlag, time.Now()
+	if seed == 0 {
+		seed = start.UnixNano()
+	}
+	if recipe != nil {
+		seed, start = recipe.Seed, recipe.Start
+	}
+	if resume != nil {
+		seed, start = resume.Seed, resume.Start
+	}
+	// Regenerated and resumed runs stamp readings at their nominal sample
+	// times, which the recipe or checkpoint determines; live runs stamp
+	// them with the wall clock.
+	var nominal *nominalClock
+	clock := time.Now
+	if recipe != nil || *checkpointFile != "" {
+		nominal = newNominalClock(start, *rate)
+		clock = nominal.next
 	}
-	fmt.Printf("Generating sensor data to %s (%s) at ~%d entries/sec\n", *outputFile, mode, *rate)
-	if *duration > 0 {
-		fmt.Printf("Duration: %v\n", *duration)
+	var paced *profileClock
+	if profile != nil {
+		paced = newProfileClock(profile, start, seed)
+		clock = paced.next
+	}
+	fieldRunID := ""
+	if *runIDField {
+		fieldRunID = *runID
+	}
+	genCfg := GeneratorConfig{
+		Seed:              seed,
+		BackgroundEvents:  *bgEvents,
+		Fleet:             *fleetSize,
+		TypeMix:           typeMix,
+		PipelineMix:       pipelineMix,
+		Intervals:         intervals,
+		RedundantPairs:    *redundant,
+		Leaks:             *leaks,
+		Stations:          *stations,
+		PumpTrips:         *pumpTrips,
+		ESD:               *esd,
+		Operators:         *operators,
+		CalibrationDrift:  *calibrationDrift,
+		Recalibration:     *recalibrate,
+		Gateways:          *gateways,
+		GatewayInterval:   *gatewayInterval,
+		GatewayOutages:    *gatewayOutages,
+		DeviceHealth:      *deviceHealth,
+		FirmwareRollout:   *firmwareRollout,
+		RolloutWaves:      waves,
+		RolloutEvery:      *rolloutEvery,
+		RolloutFailures:   *rolloutFailures,
+		Hydraulics:        *hydraulics,
+		Routes:            routes,
+		LeakImbalance:     *leakImbalance,
+		Deadband:          *deadband,
+		Keepalive:         *keepalive,
+		Quantize:          *quantizeValues,
+		Units:             *units,
+		Noise:             cfg.Noise,
+		Alerts:            cfg.Alerts,
+		Status:            cfg.Status,
+		Backfill:          *backfill,
+		Cohorts:           cohortList,
+		CohortSalt:        *cohortSalt,
+		Failures:          *failures,
+		FailureModes:      modes,
+		ScheduledFailures: cfg.Failures,
+		Late:              *late,
+		MaxLateness:       *maxLateness,
+		ClockSkew:         *clockSkew,
+		ClockDrift:        *clockDrift * 1e-6,
+		Sequence:          *sequence,
+		IngestDelay:       ingest,
+		RunID:             fieldRunID,
+		Duplicates:        *duplicates,
+		NearDuplicates:    *nearDuplicates,
+		Clock:             clock,
+	}
+	if rateFlag.bandwidth > 0 {
+		// Measure the records as this run encodes them.
+		probeFields, probePad := newFieldMapper(cfg.Fields), newPadder(padSize, *padField, seed)
+		size := sampleSize(genCfg, start, func(readings []SensorReading) int64 {
+			var n int64
+			for i := range readings {
+				if data, err := tsf.marshal(&readings[i]); err == nil {
+					rec := Record{Reading: &readings[i], Data: probePad.apply(probeFields.apply(data, &readings[i]))}
+					if ce != nil {
+						ce.wrap(&rec)
+					}
+					n += int64(len(rec.Data) + 1)
+				}
+			}
+			return n
+		})
+		if size == 0 {
+			slog.Error("-rate: no records to measure the bandwidth by")
+			os.Exit(1)
+		}
+		*rate = max(int(float64(rateFlag.bandwidth)/size), 1)
+		nominal.setRate(*rate)
+		slog.Info(fmt.Sprintf("%s at ~%.0f bytes per sample is ~%d samples/sec", rateFlag.spec, size, *rate), "bandwidth", rateFlag.bandwidth, "sample_bytes", size, "rate", *rate)
+	}
+	gen := NewGenerator(genCfg)
+	if need := gen.ScheduledRate(); need > float64(*rate) {
+		slog.Warn(fmt.Sprintf("-intervals need %.0f samples/sec but -rate is %d; sensors will report late", need, *rate))
+	}
+	if err := checkFailureSensors(cfg.Failures, gen.Points()); err != nil {
+		slog.Error(fmt.Sprintf("config: %v", err))
+		os.Exit(1)
+	}
+	if *bench {
+		stageTime := *duration
+		if stageTime == 0 {
+			stageTime = benchStageTime
+		}
+		os.Exit(runBench(benchConfig{
+			gen:        gen,
+			batch:      runBatchSize(*rate),
+			stageTime:  stageTime,
+			malform:    newMalformer(*malformed, seed),
+			timestamps: tsf,
+			fields:     newFieldMapper(cfg.Fields),
+			pad:        newPadder(padSize, *padField, seed),
+			ce:         ce,
+			sinks:      sinkURLs,
+			outputFile: *outputFile,
+			appendMode: *appendMode,
+			layout:     layout,
+		}))
 	}
-	fmt.Println("Press Ctrl+C to stop...")
 
-	// Batch for better throughput
-	batchSize := 1000
-	if *rate < batchSize {
-		batchSize = *rate
+	var sinks []Sink
+	var sinkNames []string
+	if serve {
+		h, err := openServers(*addr, *grpcAddr, *opcuaAddr, *modbusAddr, *modbusMap, *coapAddr, gen.Points())
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		sinks, sinkNames = append(sinks, h), append(sinkNames, "serve")
 	}
-	if batchSize < 1 {
-		batchSize = 1
+	if resume != nil && !serve && len(sinkURLs) == 0 {
+		if err := resume.truncateOutput(*outputFile); err != nil {
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	if resume != nil && !layout.atomic {
+		*appendMode = true
+	}
+	if !serve || len(sinkURLs) > 0 {
+		opened, names, err := openSinks(sinkURLs, *outputFile, *appendMode, layout, *runID)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close(context.Background())
+			}
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
+		sinks, sinkNames = append(sinks, opened...), append(sinkNames, names...)
+	}
+	// Event records and operator actions go to files of their own: the
+	// sinks all expect readings.
+	var eventSink, actionSink *fileSink
+	for _, side := range []struct {
+		path string
+		sink **fileSink
+	}{{*eventsOut, &eventSink}, {*actionsOut, &actionSink}} {
+		if side.path == "" {
+			continue
+		}
+		if *side.sink, err = newFileSink(side.path, *appendMode, false); err != nil {
+			for _, s := range sinks {
+				s.Close(context.Background())
+			}
+			if eventSink != nil {
+				eventSink.Close(context.Background())
+			}
+			slog.Error(err.Error())
+			os.Exit(1)
+		}
 	}
-	// Use float64 to avoid integer division truncation
-	interval := time.Duration(float64(time.Second) * float64(batchSize) / float64(*rate))
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	// Handle graceful shutdown: the signal cancels generation, then buffered
+	// output is flushed under its own deadline.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	signalled := ctx
+	if *duration > 0 && recipe == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
 
-	var endTime time.Time
-	if *duration > 0 {
-		endTime = time.Now().Add(*duration)
+	var targets []string
+	if serve {
+		var servers []string
+		if *addr != "" {
+			servers = append(servers, "WebSocket on "+*addr)
+		}
+		if *grpcAddr != "" {
+			servers = append(servers, "gRPC on "+*grpcAddr)
+		}
+		if *opcuaAddr != "" {
+			servers = append(servers, "OPC UA on "+*opcuaAddr)
+		}
+		if *modbusAddr != "" {
+			servers = append(servers, "Modbus TCP on "+*modbusAddr)
+		}
+		if *coapAddr != "" {
+			servers = append(servers, "CoAP on "+*coapAddr)
+		}
+		targets = append(targets, "clients ("+strings.Join(servers, ", ")+")")
+	}
+	targets = append(targets, sinkURLs...)
+	if len(targets) == 0 {
+		targets = append(targets, layout.describe(*outputFile, *appendMode))
+	}
+	target := strings.Join(targets, ", ")
+	if profile != nil {
+		slog.Info(fmt.Sprintf("Generating sensor data to %s at the rates of profile %s", target, *profileFile), "target", target, "profile", *profileFile)
+	} else if *deadband > 0 {
+		slog.Info(fmt.Sprintf("Generating sensor data to %s, sampling ~%d readings/sec and reporting by exception", target, *rate), "target", target, "rate", *rate)
+	} else {
+		slog.Info(fmt.Sprintf("Generating sensor data to %s at ~%d entries/sec", target, *rate), "target", target, "rate", *rate)
+	}
+	if recipe != nil {
+		slog.Info(fmt.Sprintf("Regenerating %d samples from %s", recipe.Samples, *recipeFile), "recipe", *recipeFile, "samples", recipe.Samples)
+	} else if resume != nil {
+		slog.Info(fmt.Sprintf("Resuming from %s after %d records (%d samples)", *checkpointFile, resume.Records, resume.Samples), "checkpoint", *checkpointFile, "records", resume.Records, "samples", resume.Samples)
 	}
+	if recipe == nil && *duration > 0 {
+		slog.Info(fmt.Sprintf("Duration: %v", *duration), "duration", duration.String())
+	}
+	slog.Info(fmt.Sprintf("Run ID: %s", *runID), "run_id", *runID)
+	if *debugAddr != "" {
+		slog.Info(fmt.Sprintf("Debug endpoints on http://%s/debug/pprof/ and /debug/vars", *debugAddr), "debug_addr", *debugAddr)
+	}
+	slog.Info("Press Ctrl+C to stop...")
 
 	totalEntries := int64(0)
+	totalBytes := int64(0)
 	startTime := time.Now()
 	lastReport := startTime
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	errs := newErrorBudget(*maxErrors)
+	out := newFanOut(sinks, sinkNames, errs, retry, bp)
+	if *debugAddr != "" {
+		publishDebugVars(errs, out, sinkNames)
+	}
+	var dash *dashboard
+	if *tui {
+		dashRate, fixed := *rate, ""
+		switch {
+		case profile != nil:
+			dashRate, fixed = 0, "-profile sets the rate"
+		case recipe != nil || *checkpointFile != "":
+			fixed = "runs regenerated from a recipe or with -checkpoint must stay reproducible"
+		}
+		dash = newDashboard(dashRate, fixed, stop)
+		dash.open(sinkNames, out.Queued, out.Slots(), out.Health, errs)
+		defer dash.close()
+	}
+	var records []Record
+	malform := newMalformer(*malformed, seed)
+	fields := newFieldMapper(cfg.Fields)
+	pad := newPadder(padSize, *padField, seed)
+	var samples int64 // samples whose readings reached the sinks
+	var written int64 // records written before this run resumed
+	if resume != nil {
+		written = resume.Records
+	}
+	saveCheckpoint := func() {
+		cp := &Checkpoint{Recipe: *newRecipe(flag.CommandLine, seed, start, &cfg), Records: written + totalEntries}
+		cp.Samples = samples
+		if layout.singleFile() && !serve && len(sinkURLs) == 0 {
+			if fi, err := os.Stat(*outputFile); err == nil {
+				size := fi.Size()
+				cp.OutputSize = &size
+			}
+		}
+		if err := cp.write(*checkpointFile); err != nil {
+			errs.Record(errClassCheckpoint, err)
+		}
+	}
+	lastCheckpoint := time.Now()
 
-	for {
-		select {
-		case <-sigChan:
-			writer.Flush()
-			printFinalStats(totalEntries, startTime, *outputFile)
-			return
-		case <-ticker.C:
-			if *duration > 0 && time.Now().After(endTime) {
-				writer.Flush()
-				printFinalStats(totalEntries, startTime, *outputFile)
-				return
+	write := func(ctx context.Context, readings []SensorReading) error {
+		// Generate the next batch while the writers drain the previous one
+		records = records[:0]
+		batchBytes := int64(0)
+		for i := range readings {
+			data, err := tsf.marshal(&readings[i])
+			if err != nil {
+				if errs.Record(errClassMarshal, err) {
+					break
+				}
+				continue
 			}
+			data = pad.apply(fields.apply(data, &readings[i]))
+			if malform != nil {
+				data = malform.apply(data, fields)
+			}
+			records = append(records, Record{Reading: &readings[i], Data: data})
+			if ce != nil {
+				ce.wrap(&records[len(records)-1])
+			}
+			batchBytes += int64(len(records[len(records)-1].Data) + 1)
+		}
+		if err := out.Write(ctx, records); err != nil {
+			return err
+		}
+		if events := gen.TakeEvents(); eventSink != nil && len(events) > 0 {
+			writeLines(ctx, eventSink, "events", events, errs)
+		}
+		if actions := gen.TakeActions(); actionSink != nil && len(actions) > 0 {
+			writeLines(ctx, actionSink, "actions", actions, errs)
+		}
+		totalEntries += int64(len(records))
+		totalBytes += batchBytes
+		if dash != nil {
+			dash.count(int64(len(records)), batchBytes)
+		}
+		debugVars.Add("records", int64(len(records)))
+		debugVars.Add("bytes", batchBytes)
+		samples = gen.Samples()
 
-			// Write batch
-			for range batchSize {
-				reading := generateReading(rng)
-				data, _ := json.Marshal(reading)
-				writer.Write(data)
-				writer.WriteByte('\n')
-				totalEntries++
+		// Checkpoint once what has been queued is written, so the
+		// checkpoint never counts records a crash could still lose.
+		if *checkpointFile != "" && time.Since(lastCheckpoint) >= *checkpointEvery {
+			if err := out.Flush(ctx); err != nil {
+				return err
 			}
+			saveCheckpoint()
+			lastCheckpoint = time.Now()
+		}
 
-			// Flush after each batch for real-time observability (tail -f)
-			writer.Flush()
+		// Periodic stats
+		if *verbose && time.Since(lastReport) >= 5*time.Second {
+			elapsed := time.Since(startTime).Seconds()
+			rate := float64(totalEntries) / elapsed
+			slog.Info(fmt.Sprintf("  %d entries written (%.0f/sec avg)", totalEntries, rate), "entries", totalEntries, "rate", rate)
+			lastReport = time.Now()
+		}
+		return errs.Err()
+	}
+	burst := newBurster(*burstSize, *burstEvery)
+
+	// SIGHUP reads the -config file again and applies what can change
+	// mid-run, between batches. Flag overrides left out of the file
+	// afterwards keep their last value.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	reloaded := false
+	retimed := false // rate changed from the dashboard
+	reload := func() {
+		switch {
+		case *configFile == "":
+			slog.Warn("SIGHUP ignored: no -config file to reload")
+			return
+		case recipe != nil || *checkpointFile != "":
+			slog.Warn("SIGHUP ignored: runs regenerated from a recipe or with -checkpoint must stay reproducible")
+			return
+		}
+		c, err := loadConfig(*configFile)
+		if err == nil {
+			err = checkReload(c, *fleetSize > 0, gen.Points())
+		}
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Reload failed, keeping the previous settings: %v", err), "config", *configFile, "error", err)
+			return
+		}
+		oldRate := *rate
+		for name, value := range c.flags() {
+			flag.Set(name, value)
+		}
+		if *typeMixFlag != "" {
+			typeMix, _ = parseTypeMix(*typeMixFlag)
+		}
+		genCfg.Noise, genCfg.Alerts, genCfg.Status, genCfg.ScheduledFailures = c.Noise, c.Alerts, c.Status, c.Failures
+		genCfg.TypeMix = typeMix
+		genCfg.BackgroundEvents, genCfg.Leaks, genCfg.Failures = *bgEvents, *leaks, *failures
+		gen.Reload(genCfg)
+		fields = newFieldMapper(c.Fields)
+		cfg, reloaded = *c, true
 
-			// Periodic stats
-			if *verbose && time.Since(lastReport) >= 5*time.Second {
-				elapsed := time.Since(startTime).Seconds()
-				rate := float64(totalEntries) / elapsed
-				fmt.Printf("  %d entries written (%.0f/sec avg)\n", totalEntries, rate)
-				lastReport = time.Now()
+		msg := "Reloaded " + *configFile
+		if *rate != oldRate {
+			if profile != nil {
+				msg += fmt.Sprintf(" (rate %d ignored: -profile sets the rate)", *rate)
+			} else {
+				nominal.setRate(*rate)
+				gen.SetRate(*rate)
+				if dash != nil {
+					dash.setRate(*rate)
+				}
+				msg += fmt.Sprintf(", now at ~%d entries/sec", *rate)
 			}
 		}
+		slog.Info(msg, "config", *configFile, "rate", *rate)
 	}
-}
-
-func generateReading(rng *rand.Rand) SensorReading {
-	st := sensorTypes[rng.Intn(len(sensorTypes))]
-	pipeline := pipelineIDs[rng.Intn(len(pipelineIDs))]
-	status := statuses[rng.Intn(len(statuses))]
-	alert := alertLevels[rng.Intn(len(alertLevels))]
-
-	// Generate value with occasional anomalies
-	value := st.Min + rng.Float64()*(st.Max-st.Min)
-	if rng.Float64() < 0.02 { // 2% chance of anomaly
-		value = st.Max + rng.Float64()*st.Max*0.2 // Exceed max by up to 20%
-		if alert == "" {
-			alert = "medium"
-		}
-	}
-
-	return SensorReading{
-		SensorID:   fmt.Sprintf("SNS-%s-%04d", st.Type[:3], rng.Intn(10000)),
-		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
-		Type:       st.Type,
-		Value:      value,
-		Unit:       st.Unit,
-		PipelineID: pipeline,
-		Status:     status,
-		Quality:    0.85 + rng.Float64()*0.15,
-		AlertLevel: alert,
-		Location: Location{
-			Lat:      25.0 + rng.Float64()*20, // Roughly US oil/gas regions
-			Lon:      -105.0 + rng.Float64()*15,
-			MilePost: rng.Float64() * 500,
-		},
+	emit := func(readings []SensorReading) error {
+		select {
+		case <-hup:
+			reload()
+		default:
+		}
+		if dash != nil {
+			if err := dash.wait(ctx); err != nil {
+				return err
+			}
+			if r, ok := dash.takeRate(); ok {
+				nominal.setRate(r)
+				gen.SetRate(r)
+				*rate, retimed = r, true
+			}
+			dash.poll(gen)
+		}
+		if valuePlug != nil {
+			if err := valuePlug.values(readings, gen.Rederive); err != nil {
+				return err
+			}
+		}
+		if plug != nil {
+			var err error
+			if readings, err = plug.apply(readings); err != nil {
+				return err
+			}
+		}
+		if burst != nil {
+			if readings = burst.pass(readings, time.Now()); len(readings) == 0 {
+				return nil
+			}
+		}
+		return write(ctx, readings)
+	}
+	var runErr error
+	if resume != nil {
+		// Take the samples already written again, discarding them, to
+		// bring the generator (and the corruption source and padding) back
+		// to where the checkpoint left it.
+		runErr = gen.Replay(ctx, *rate, resume.Samples, func(readings []SensorReading) error {
+			if malform == nil && pad == nil {
+				return nil
+			}
+			for i := range readings {
+				if data, err := tsf.marshal(&readings[i]); err == nil {
+					data = pad.apply(fields.apply(data, &readings[i]))
+					if malform != nil {
+						malform.apply(data, fields)
+					}
+				}
+			}
+			return nil
+		})
+		samples = gen.Samples()
+	}
+	switch {
+	case runErr != nil: // interrupted while catching up
+	case recipe != nil && paced != nil:
+		runErr = gen.ReplayPaced(ctx, start, paced.peek, recipe.Samples, emit)
+	case recipe != nil:
+		runErr = gen.Replay(ctx, *rate, recipe.Samples, emit)
+	case paced != nil:
+		runErr = gen.RunPaced(ctx, start, paced.peek, emit)
+	default:
+		runErr = gen.Run(ctx, *rate, emit)
 	}
-}
 
-func printFinalStats(total int64, start time.Time, filename string) {
-	elapsed := time.Since(start)
-	rate := float64(total) / elapsed.Seconds()
+	// Flush whatever is queued, bounded so a stuck sink cannot hang exit.
+	// Once a signal has stopped generation, a second one exits at once.
+	stopped, interrupted := ctx.Err() != nil, signalled.Err() != nil
+	stop()
+	if dash != nil {
+		dash.close()
+	}
+	if interrupted {
+		slog.Info(fmt.Sprintf("Stopping: flushing output (up to %v; signal again to quit now)", *drainTimeout), "drain_timeout", drainTimeout.String())
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if burst != nil {
+		if held := burst.flush(); len(held) > 0 {
+			write(drainCtx, held)
+		}
+	}
+	out.Close(drainCtx)
+	for _, p := range []*plugin{valuePlug, plug} {
+		if p == nil {
+			continue
+		}
+		if err := p.close(); err != nil {
+			errs.Record(sinkErrClass(errClassClose, "plugin"), err)
+		}
+	}
+	if eventSink != nil {
+		if err := eventSink.Close(drainCtx); err != nil {
+			errs.Record(sinkErrClass(errClassClose, "events"), err)
+		}
+	}
+	if actionSink != nil {
+		if err := actionSink.Close(drainCtx); err != nil {
+			errs.Record(sinkErrClass(errClassClose, "actions"), err)
+		}
+	}
+	if drainCtx.Err() != nil {
+		slog.Warn(fmt.Sprintf("Drain deadline of %v reached; output not yet written was dropped", *drainTimeout), "drain_timeout", drainTimeout.String())
+	}
+	if *checkpointFile != "" && (resume == nil || samples > resume.Samples) {
+		saveCheckpoint()
+	}
 
-	fi, _ := os.Stat(filename)
-	sizeMB := float64(fi.Size()) / (1024 * 1024)
+	statsFile := ""
+	if len(sinkURLs) == 0 && !serve {
+		statsFile = *outputFile
+	}
+	recipePath, manifestPath := *recipeOut, *manifestOut
+	if recipePath == "auto" {
+		recipePath = ""
+		if statsFile != "" {
+			recipePath = statsFile + ".recipe.json"
+		}
+	}
+	if manifestPath == "auto" {
+		manifestPath = ""
+		if statsFile != "" {
+			manifestPath = statsFile + ".manifest.json"
+		}
+	}
+	var outputs []string // by file output, for the manifest
+	if manifestPath != "" && statsFile != "" {
+		if outputs, err = outputFiles(statsFile, layout, startTime); err != nil {
+			errs.Record(errClassManifest, err)
+			manifestPath = ""
+		}
+	}
+	if !layout.singleFile() {
+		statsFile = "" // the files' sizes add up to the bytes written
+	}
+	if recipePath != "" && reloaded {
+		slog.Info("Recipe not written: the configuration was reloaded, so it would not regenerate the run")
+		recipePath = ""
+	}
+	if recipePath != "" && retimed {
+		slog.Info("Recipe not written: the rate was changed from the dashboard, so it would not regenerate the run")
+		recipePath = ""
+	}
+	r := newRecipe(flag.CommandLine, seed, start, &cfg)
+	r.Profile = profile
+	r.Samples = samples
+	if recipePath != "" {
+		if err := r.write(recipePath); err != nil {
+			errs.Record(errClassRecipe, err)
+			recipePath = ""
+		} else {
+			slog.Info(fmt.Sprintf("Recipe written to %s", recipePath), "recipe", recipePath)
+		}
+	}
+	if manifestPath != "" {
+		m := &Manifest{
+			SchemaVersion: recordSchemaVersion,
+			Version:       r.Version,
+			RunID:         *runID,
+			Started:       startTime,
+			Ended:         time.Now(),
+			Seed:          seed,
+			Records:       totalEntries,
+			Bytes:         totalBytes,
+			Sinks:         sinkNames,
+			Regenerable:   !reloaded && !retimed && (nominal != nil || paced != nil),
+			Recipe:        r,
+		}
+		if err := m.write(manifestPath, append(outputs, *eventsOut, *actionsOut, recipePath)); err != nil {
+			errs.Record(errClassManifest, err)
+		} else {
+			slog.Info(fmt.Sprintf("Manifest written to %s", manifestPath), "manifest", manifestPath)
+		}
+	}
+	stats := newFinalStats(totalEntries, totalBytes, startTime, statsFile, sinkNames, errs)
+	stats.addDeliveries(out.Deliveries(), out.Health())
+	stats.RunID = *runID
+	if profile == nil {
+		stats.TargetRate = *rate
+	}
+	stats.print(errs)
+	if *statsJSON != "" {
+		if err := stats.write(*statsJSON); err != nil {
+			slog.Error(fmt.Sprintf("-stats-json: %v", err))
+			os.Exit(1)
+		}
+	}
+	if err := errs.Err(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if runErr != nil && !stopped {
+		slog.Error(runErr.Error())
+		os.Exit(1)
+	}
+}
 
-	fmt.Printf("\n--- Final Stats ---\n")
-	fmt.Printf("Total entries: %d\n", total)
-	fmt.Printf("Duration: %v\n", elapsed.Round(time.Millisecond))
-	fmt.Printf("Average rate: %.0f entries/sec\n", rate)
-	fmt.Printf("File size: %.2f MB\n", sizeMB)
-	fmt.Printf("Avg entry size: %.0f bytes\n", float64(fi.Size())/float64(total))
+// openServers starts the serve-mode servers on the given addresses, each
+// optional, and returns the hub feeding them.
+func openServers(wsAddr, grpcAddr, opcuaAddr, modbusAddr, modbusMap, coapAddr string, points []SensorPoint) (*hub, error) {
+	if wsAddr == "" && grpcAddr == "" && opcuaAddr == "" && modbusAddr == "" && coapAddr == "" {
+		return nil, fmt.Errorf("serve: set -addr, -grpc-addr, -opcua-addr, -modbus-addr and/or -coap-addr")
+	}
+	h := newHub()
+	if wsAddr != "" {
+		if err := serveWebSocket(h, wsAddr); err != nil {
+			return nil, err
+		}
+	}
+	if grpcAddr != "" {
+		if err := serveGRPC(h, grpcAddr); err != nil {
+			h.Close(context.Background())
+			return nil, err
+		}
+	}
+	if opcuaAddr != "" {
+		if err := serveOPCUA(h, opcuaAddr, points); err != nil {
+			h.Close(context.Background())
+			return nil, err
+		}
+	}
+	if modbusAddr != "" {
+		if err := serveModbus(h, modbusAddr, points, modbusMap); err != nil {
+			h.Close(context.Background())
+			return nil, err
+		}
+	}
+	if coapAddr != "" {
+		if err := serveCoAP(h, coapAddr, points); err != nil {
+			h.Close(context.Background())
+			return nil, err
+		}
+	}
+	return h, nil
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+)
+
+// malformer corrupts a fraction of encoded records, to exercise the
+// error paths of consumers' parsers. Each corrupted record is one of:
+// JSON truncated at a random byte, a field with the wrong JSON type, or a
+// required field missing. The Reading behind the record is untouched, so
+// sinks routing on it still see valid keys.
+type malformer struct {
+	fraction float64
+	rng      *rand.Rand
+}
+
+// requiredFields are the fields a malformed record may lose.
+var requiredFields = []string{"sensor_id", "timestamp", "type", "value", "unit", "pipeline_id"}
+
+func newMalformer(fraction float64, seed int64) *malformer {
+	if fraction <= 0 {
+		return nil
+	}
+	// A source of its own, so corruption does not change the readings
+	// generated for a seed.
+	return &malformer{fraction: fraction, rng: rand.New(rand.NewSource(seed ^ 0x6d616c666f726d))}
+}
+
+// apply returns data, or a corrupted copy if this record is chosen. The
+// required fields go by the names fields writes them under; those it
+// drops are missing already.
+func (m *malformer) apply(data []byte, fields *fieldMapper) []byte {
+	if m.rng.Float64() >= m.fraction {
+		return data
+	}
+	switch m.rng.Intn(3) {
+	case 1:
+		return m.retype(data)
+	case 2:
+		if required := fields.written(requiredFields); len(required) > 0 {
+			return m.drop(data, required[m.rng.Intn(len(required))])
+		}
+	}
+	return data[:m.rng.Intn(len(data)-1)+1]
+}
+
+// jsonFields splits a JSON object into its members, in order.
+func jsonFields(data []byte) (keys []string, values []json.RawMessage, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, nil, false
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, nil, false
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, nil, false
+		}
+		keys, values = append(keys, t.(string)), append(values, v)
+	}
+	return keys, values, true
+}
+
+func joinJSONFields(keys []string, values []json.RawMessage) []byte {
+	b := []byte{'{'}
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, k)
+		b = append(b, ':')
+		b = append(b, values[i]...)
+	}
+	return append(b, '}')
+}
+
+// retype gives one field a value of the wrong JSON type: numbers become
+// strings, strings numbers, and objects strings.
+func (m *malformer) retype(data []byte) []byte {
+	keys, values, ok := jsonFields(data)
+	if !ok || len(keys) == 0 {
+		return data
+	}
+	i := m.rng.Intn(len(keys))
+	v := values[i]
+	if v[0] == '"' {
+		values[i] = json.RawMessage(strconv.Itoa(m.rng.Intn(100000)))
+	} else {
+		values[i] = json.RawMessage(strconv.Quote(string(v)))
+	}
+	return joinJSONFields(keys, values)
+}
+
+// drop removes the named field.
+func (m *malformer) drop(data []byte, field string) []byte {
+	keys, values, ok := jsonFields(data)
+	if !ok {
+		return data
+	}
+	for i, k := range keys {
+		if k == field {
+			keys = append(keys[:i], keys[i+1:]...)
+			values = append(values[:i], values[i+1:]...)
+			break
+		}
+	}
+	return joinJSONFields(keys, values)
+}
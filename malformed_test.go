@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestMalformerMappedFields(t *testing.T) {
+	fields := newFieldMapper(&FieldMapping{
+		Rename: map[string]string{"sensor_id": "deviceId"},
+		Drop:   []string{"unit"},
+	})
+	r := &SensorReading{SensorID: "P1-PT-001", Timestamp: "2026-01-14T05:22:42Z", Type: "pressure", Value: 812.5, Unit: "psi", PipelineID: "P1"}
+	data, _ := json.Marshal(r)
+	data = fields.apply(data, r)
+	keys, _, _ := jsonFields(data)
+
+	m := newMalformer(1, 1)
+	missing := make(map[string]int)
+	for range 1000 {
+		got, _, ok := jsonFields(m.apply(data, fields))
+		if !ok || len(got) != len(keys)-1 {
+			continue // truncated or retyped
+		}
+		for _, k := range keys {
+			if !slices.Contains(got, k) {
+				missing[k]++
+			}
+		}
+	}
+	want := fields.written(requiredFields)
+	if !slices.Equal(want, []string{"deviceId", "timestamp", "type", "value", "pipeline_id"}) {
+		t.Fatalf("required fields written as %q", want)
+	}
+	for _, k := range want {
+		if missing[k] == 0 {
+			t.Errorf("%q never dropped", k)
+		}
+	}
+	for k, n := range missing {
+		if !slices.Contains(want, k) {
+			t.Errorf("%q dropped %d times: not a required field", k, n)
+		}
+	}
+}
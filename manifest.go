@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// recordSchemaVersion versions the fields of the records sensor-gen
+// writes. It goes up when a field is removed or changes meaning, not when
+// an optional one is added.
+const recordSchemaVersion = 1
+
+// Manifest records how a run's output was generated, for consumers of the
+// dataset: the settings, the seed, when the run went, how many records it
+// wrote and to which files, with their checksums. It is written as JSON
+// next to the output once the run has finished.
+type Manifest struct {
+	SchemaVersion int       `json:"schema_version"`
+	Version       string    `json:"sensor_gen_version"`
+	RunID         string    `json:"run_id"`
+	Started       time.Time `json:"started"`
+	Ended         time.Time `json:"ended"`
+	Seed          int64     `json:"seed"`
+	Records       int64     `json:"records"`
+	Bytes         int64     `json:"bytes"`
+	// Sinks names where records went, without URL options or credentials.
+	Sinks []string `json:"sinks"`
+	// Regenerable reports whether the recipe regenerates the output byte
+	// for byte: not if readings were timestamped with the wall clock, the
+	// configuration was reloaded or the rate changed during the run.
+	Regenerable bool `json:"regenerable"`
+	// Recipe holds the run's settings, as its recipe file does.
+	Recipe *Recipe        `json:"recipe"`
+	Files  []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file the run wrote.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// write lists files in the manifest, with their sizes and checksums, and
+// saves it to path. Empty and repeated names are skipped.
+func (m *Manifest) write(path string, files []string) error {
+	m.Files = m.Files[:0]
+	for _, p := range files {
+		if p == "" || slices.ContainsFunc(m.Files, func(f ManifestFile) bool { return f.Path == p }) {
+			continue
+		}
+		f, err := checksumFile(p)
+		if err != nil {
+			return fmt.Errorf("manifest: %w", err)
+		}
+		m.Files = append(m.Files, f)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// checksumFile returns the size and SHA-256 checksum of the file at path.
+func checksumFile(path string) (ManifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return ManifestFile{Path: path, Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// outputFiles lists the files that file output to path, laid out by
+// layout, wrote in a run started at since. Sharded output goes to the
+// shard files; rotated and partitioned output to whichever of its files
+// were modified during the run, which leaves out those of earlier runs
+// and those -max-disk deleted.
+func outputFiles(path string, layout fileLayout, since time.Time) ([]string, error) {
+	if layout.singleFile() {
+		return []string{path}, nil
+	}
+	var files []string
+	since = since.Truncate(time.Second) // for file systems with coarse timestamps
+	recent := func(p string) bool {
+		fi, err := os.Stat(p)
+		return err == nil && fi.Mode().IsRegular() && !fi.ModTime().Before(since) && !strings.HasSuffix(p, tmpSuffix)
+	}
+	if len(layout.partitionBy) > 0 {
+		err := filepath.WalkDir(strings.TrimSuffix(path, ".jsonl"), func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && recent(p) {
+				files = append(files, p)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %w", err)
+		}
+		return files, nil
+	}
+	paths := []string{path}
+	if layout.shards > 1 {
+		paths = make([]string, layout.shards)
+		for i := range paths {
+			paths[i] = shardPath(path, i, layout.shards)
+		}
+	}
+	if !layout.rotates() {
+		return paths, nil
+	}
+	for _, p := range paths {
+		ext := filepath.Ext(p)
+		rotated, err := filepath.Glob(strings.TrimSuffix(p, ext) + "-*" + ext)
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %w", err)
+		}
+		for _, r := range rotated {
+			if recent(r) {
+				files = append(files, r)
+			}
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Operator actions.
+const (
+	actionAcknowledge    = "acknowledge"
+	actionSetpointChange = "setpoint_change"
+	actionManualOverride = "manual_override"
+)
+
+// OperatorAction is an entry in the control room's audit log: a
+// controller acknowledging an alarm, or responding to it by changing a
+// setpoint or overriding the point. Like event records, actions are kept
+// apart from the readings; AlarmID and SensorID tie them to the alerting
+// readings that raised the alarm.
+type OperatorAction struct {
+	ActionID    string   `json:"action_id"`
+	Timestamp   string   `json:"timestamp"`
+	Operator    string   `json:"operator_id"`
+	Action      string   `json:"action"`
+	PipelineID  string   `json:"pipeline_id"`
+	SensorID    string   `json:"sensor_id"`
+	AlarmID     string   `json:"alarm_id"`
+	AlarmTime   string   `json:"alarm_time"`
+	AlertLevel  string   `json:"alert_level"`
+	Target      string   `json:"target,omitempty"` // pump station or valve sensor whose setpoint changed
+	OldSetpoint *float64 `json:"old_setpoint,omitempty"`
+	NewSetpoint *float64 `json:"new_setpoint,omitempty"`
+	Until       string   `json:"until,omitempty"` // end of a manual override
+}
+
+// alarm is an alarm raised by a fleet sensor's alerting readings. It
+// stands until acknowledged and then until the sensor reads normal.
+type alarm struct {
+	ID      string
+	sensor  *fleetSensor
+	raised  time.Time
+	level   string  // the highest level reached before acknowledgement
+	value   float64 // the latest alerting reading before acknowledgement
+	ackAt   time.Time
+	acked   bool
+	cleared bool
+}
+
+// controlRoom simulates the controllers watching the fleet. An alerting
+// reading raises an alarm on its sensor unless one stands or the point is
+// overridden; a controller acknowledges it 20 seconds to 3 minutes later,
+// and responds to a critical alarm:
+//
+//   - on a pump station, by slowing the pump by 2-10% of its rated speed
+//     (to no less than 80%);
+//   - on a line pressure sensor with hydraulics, reading high, by opening
+//     the nearest valve downstream of it further;
+//   - otherwise by overriding the point for 15-60 minutes, during which
+//     it raises no alarms.
+type controlRoom struct {
+	alarms    []*alarm // by time raised
+	bySensor  map[*fleetSensor]*alarm
+	overrides map[*fleetSensor]time.Time // end of each point's override
+	records   []OperatorAction
+	nextAlarm int
+	seq       int
+}
+
+func newControlRoom() *controlRoom {
+	return &controlRoom{bySensor: make(map[*fleetSensor]*alarm), overrides: make(map[*fleetSensor]time.Time)}
+}
+
+// operatorID returns the controller on the console of pipeline at t. Each
+// console covers two pipelines, worked by a day and a night shift, so
+// there are eight controllers: OPR-01 to OPR-04 by day and OPR-05 to
+// OPR-08 by night.
+func operatorID(pipeline string, t time.Time) string {
+	n := 1 + slices.Index(pipelineIDs, pipeline)/2
+	if h := t.UTC().Hour(); h < 6 || h >= 18 {
+		n += 4
+	}
+	return fmt.Sprintf("OPR-%02d", n)
+}
+
+// observe raises, escalates or clears s's alarm on its reading r.
+func (c *controlRoom) observe(s *fleetSensor, r *SensorReading, now time.Time, rng *rand.Rand) {
+	a := c.bySensor[s]
+	if r.AlertLevel == "" {
+		if a != nil {
+			a.cleared = true
+		}
+		return
+	}
+	if a != nil {
+		a.cleared = false
+		if !a.acked {
+			a.value = r.Value
+			if r.AlertLevel == alertCritical {
+				a.level = alertCritical
+			}
+		}
+		return
+	}
+	if until, ok := c.overrides[s]; ok {
+		if now.Before(until) {
+			return
+		}
+		delete(c.overrides, s)
+	}
+	c.nextAlarm++
+	a = &alarm{
+		ID:     fmt.Sprintf("ALM-%08d", c.nextAlarm),
+		sensor: s,
+		raised: now,
+		level:  r.AlertLevel,
+		value:  r.Value,
+		ackAt:  now.Add(20*time.Second + time.Duration(rng.Int63n(int64(160*time.Second)))),
+	}
+	c.alarms = append(c.alarms, a)
+	c.bySensor[s] = a
+}
+
+// update acknowledges the alarms due by now and responds to them, and
+// retires acknowledged alarms that have cleared.
+func (c *controlRoom) update(now time.Time, rng *rand.Rand) {
+	var due []*alarm
+	for _, a := range c.alarms {
+		if !a.acked && !now.Before(a.ackAt) {
+			due = append(due, a)
+		}
+	}
+	slices.SortStableFunc(due, func(a, b *alarm) int { return a.ackAt.Compare(b.ackAt) })
+	for _, a := range due {
+		a.acked = true
+		c.record(a, a.ackAt, actionAcknowledge)
+		if a.level == alertCritical {
+			c.respond(a, rng)
+		}
+	}
+	c.alarms = slices.DeleteFunc(c.alarms, func(a *alarm) bool {
+		if a.acked && a.cleared {
+			delete(c.bySensor, a.sensor)
+			return true
+		}
+		return false
+	})
+}
+
+// respond takes the controller's action on critical alarm a.
+func (c *controlRoom) respond(a *alarm, rng *rand.Rand) {
+	s := a.sensor
+	if st := s.station; st != nil {
+		old := st.setpoint
+		st.setpoint = max(st.setpoint-0.02-rng.Float64()*0.08, 0.8)
+		act := c.record(a, a.ackAt, actionSetpointChange)
+		act.Target = st.ID
+		act.OldSetpoint, act.NewSetpoint = limit(quantize(old*st.ratedSpeed, 1)), limit(quantize(st.setpoint*st.ratedSpeed, 1))
+		return
+	}
+	if s.line != nil && sensorTypes[s.Type].Type == "pressure" && a.value > sensorTypes[s.Type].Max/2 {
+		for _, v := range s.line.valves {
+			if v.Location.MilePost > s.Location.MilePost && !v.shut && v.baseline < 100 {
+				old := v.baseline
+				v.baseline = min(v.baseline+10+rng.Float64()*20, 100)
+				act := c.record(a, a.ackAt, actionSetpointChange)
+				act.Target = v.ID
+				act.OldSetpoint, act.NewSetpoint = limit(quantize(old, 0.1)), limit(quantize(v.baseline, 0.1))
+				return
+			}
+		}
+	}
+	until := a.ackAt.Add(15*time.Minute + time.Duration(rng.Int63n(int64(45*time.Minute))))
+	c.overrides[s] = until
+	c.record(a, a.ackAt, actionManualOverride).Until = until.UTC().Format(time.RFC3339Nano)
+}
+
+// record logs action on alarm a at t and returns the entry to fill in.
+func (c *controlRoom) record(a *alarm, t time.Time, action string) *OperatorAction {
+	c.seq++
+	c.records = append(c.records, OperatorAction{
+		ActionID:   fmt.Sprintf("ACT-%08d", c.seq),
+		Timestamp:  t.UTC().Format(time.RFC3339Nano),
+		Operator:   operatorID(a.sensor.Pipeline, t),
+		Action:     action,
+		PipelineID: a.sensor.Pipeline,
+		SensorID:   a.sensor.ID,
+		AlarmID:    a.ID,
+		AlarmTime:  a.raised.UTC().Format(time.RFC3339Nano),
+		AlertLevel: a.level,
+	})
+	return &c.records[len(c.records)-1]
+}
+
+// TakeActions returns the operator actions logged since the last call,
+// oldest first, or nil without operators.
+func (g *Generator) TakeActions() []OperatorAction {
+	if g.operators == nil {
+		return nil
+	}
+	records := g.operators.records
+	g.operators.records = nil
+	return records
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+// padder pads encoded records with a filler field to bring their average
+// size up to a target, for benchmarks specified in message size. Each
+// record is padded by what the records so far fall short of the target,
+// so a record longer than the target is made up for by shorter padding on
+// the next. The filler is random letters and digits, so padded records do
+// not compress better than real ones.
+type padder struct {
+	target  int64
+	prefix  []byte // ,"field":"
+	filler  []byte
+	next    int   // offset into filler of the next padding
+	records int64 // records padded so far
+	bytes   int64 // and their size
+}
+
+const padFillerSize = 64 << 10
+
+func newPadder(target int64, field string, seed int64) *padder {
+	if target <= 0 {
+		return nil
+	}
+	// A source of its own, so padding does not change the readings
+	// generated for a seed.
+	rng := rand.New(rand.NewSource(seed ^ 0x706164))
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	filler := make([]byte, padFillerSize)
+	for i := range filler {
+		filler[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	prefix := append(strconv.AppendQuote([]byte{','}, field), ':', '"')
+	return &padder{target: target, prefix: prefix, filler: filler}
+}
+
+// apply returns the encoded record data, padded if it is short of the
+// target.
+func (p *padder) apply(data []byte) []byte {
+	if p == nil {
+		return data
+	}
+	p.records++
+	n := p.target*p.records - p.bytes - int64(len(data)) - int64(len(p.prefix)) - 1
+	if n < 0 || len(data) <= 2 || data[len(data)-1] != '}' {
+		p.bytes += int64(len(data))
+		return data
+	}
+	b := make([]byte, 0, len(data)+len(p.prefix)+int(n)+1)
+	b = append(b, data[:len(data)-1]...)
+	b = append(b, p.prefix...)
+	for left := int(n); left > 0; {
+		k := min(left, len(p.filler)-p.next)
+		b = append(b, p.filler[p.next:p.next+k]...)
+		p.next = (p.next + k) % len(p.filler)
+		left -= k
+	}
+	b = append(b, '"', '}')
+	p.bytes += int64(len(b))
+	return b
+}
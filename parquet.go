@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Parquet physical types, converted types, codecs and encodings used by
+// parquetTable, as numbered in parquet.thrift.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+
+	parquetUncompressed = 0
+	parquetGzip         = 2
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// parquetTable writes readings as a Parquet file. Rows are buffered a row
+// group at a time, column by column, and each column of a row group is
+// written as a single PLAIN-encoded data page, so memory use is bounded
+// by the row group size.
+type parquetTable struct {
+	w        io.Writer
+	off      int64 // bytes written so far
+	cols     []column
+	compress bool
+	rowGroup int
+	chunks   []parquetChunk
+	rows     int // rows in the current row group
+	total    int64
+	groups   []parquetGroup
+}
+
+// parquetChunk accumulates one column of the current row group.
+type parquetChunk struct {
+	values  []byte
+	bools   []bool // BOOLEAN values, bit-packed when the page is written
+	defined []bool // definition levels of an optional column
+}
+
+// parquetGroup is the footer metadata of a written row group.
+type parquetGroup struct {
+	rows    int64
+	size    int64
+	columns []parquetColumnMeta
+}
+
+type parquetColumnMeta struct {
+	offset             int64
+	uncompressed, size int64
+}
+
+func newParquetTable(w io.Writer, cols []column, compress bool, rowGroup int) (*parquetTable, error) {
+	t := &parquetTable{w: w, cols: cols, compress: compress, rowGroup: rowGroup, chunks: make([]parquetChunk, len(cols))}
+	return t, t.write([]byte("PAR1"))
+}
+
+func (t *parquetTable) write(b []byte) error {
+	n, err := t.w.Write(b)
+	t.off += int64(n)
+	return err
+}
+
+func (t *parquetTable) Write(r *convRow) error {
+	for i, c := range t.cols {
+		ch := &t.chunks[i]
+		v := c.value(r)
+		if c.optional {
+			ch.defined = append(ch.defined, v != nil)
+		}
+		switch v := v.(type) {
+		case string:
+			ch.values = binary.LittleEndian.AppendUint32(ch.values, uint32(len(v)))
+			ch.values = append(ch.values, v...)
+		case float64:
+			ch.values = binary.LittleEndian.AppendUint64(ch.values, math.Float64bits(v))
+		case int64:
+			ch.values = binary.LittleEndian.AppendUint64(ch.values, uint64(v))
+		case bool:
+			ch.bools = append(ch.bools, v)
+		case time.Time:
+			ch.values = binary.LittleEndian.AppendUint64(ch.values, uint64(v.UnixMicro()))
+		}
+	}
+	t.rows++
+	if t.rows >= t.rowGroup {
+		return t.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (t *parquetTable) flush() error {
+	if t.rows == 0 {
+		return nil
+	}
+	g := parquetGroup{rows: int64(t.rows)}
+	for i, c := range t.cols {
+		ch := &t.chunks[i]
+		var page []byte
+		if c.optional {
+			levels := bitPackedRun(ch.defined)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+			page = append(page, levels...)
+		}
+		page = append(page, ch.values...)
+		if c.kind == colBool {
+			page = append(page, packBits(ch.bools)...)
+		}
+		data := page
+		if t.compress {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(page)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		}
+		var hdr thriftWriter
+		hdr.begin()
+		hdr.i32(1, 0) // DATA_PAGE
+		hdr.i32(2, int32(len(page)))
+		hdr.i32(3, int32(len(data)))
+		hdr.structField(5)
+		hdr.i32(1, int32(t.rows))
+		hdr.i32(2, parquetPlain)
+		hdr.i32(3, parquetRLE)
+		hdr.i32(4, parquetRLE)
+		hdr.end()
+		hdr.end()
+
+		m := parquetColumnMeta{
+			offset:       t.off,
+			uncompressed: int64(len(hdr.buf) + len(page)),
+			size:         int64(len(hdr.buf) + len(data)),
+		}
+		if err := t.write(hdr.buf); err != nil {
+			return err
+		}
+		if err := t.write(data); err != nil {
+			return err
+		}
+		g.columns = append(g.columns, m)
+		g.size += m.uncompressed
+		*ch = parquetChunk{values: ch.values[:0], bools: ch.bools[:0], defined: ch.defined[:0]}
+	}
+	t.groups = append(t.groups, g)
+	t.total += g.rows
+	t.rows = 0
+	return nil
+}
+
+// Close writes the last row group and the footer.
+func (t *parquetTable) Close() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	codec := int32(parquetUncompressed)
+	if t.compress {
+		codec = parquetGzip
+	}
+	var m thriftWriter
+	m.begin()
+	m.i32(1, 1) // version
+	m.listField(2, thriftStruct, len(t.cols)+1)
+	m.begin()
+	m.str(4, "schema")
+	m.i32(5, int32(len(t.cols)))
+	m.end()
+	for _, c := range t.cols {
+		typ, converted := parquetType(c.kind)
+		m.begin()
+		m.i32(1, typ)
+		rep := int32(0) // REQUIRED
+		if c.optional {
+			rep = 1 // OPTIONAL
+		}
+		m.i32(3, rep)
+		m.str(4, c.name)
+		if converted >= 0 {
+			m.i32(6, converted)
+		}
+		m.end()
+	}
+	m.i64(3, t.total)
+	m.listField(4, thriftStruct, len(t.groups))
+	for _, g := range t.groups {
+		m.begin()
+		m.listField(1, thriftStruct, len(g.columns))
+		for i, cm := range g.columns {
+			typ, _ := parquetType(t.cols[i].kind)
+			m.begin()
+			m.i64(2, cm.offset)
+			m.structField(3)
+			m.i32(1, typ)
+			m.listField(2, thriftI32, 2)
+			m.buf = binary.AppendVarint(m.buf, parquetPlain)
+			m.buf = binary.AppendVarint(m.buf, parquetRLE)
+			m.listField(3, thriftBinary, 1)
+			m.buf = binary.AppendUvarint(m.buf, uint64(len(t.cols[i].name)))
+			m.buf = append(m.buf, t.cols[i].name...)
+			m.i32(4, codec)
+			m.i64(5, g.rows)
+			m.i64(6, cm.uncompressed)
+			m.i64(7, cm.size)
+			m.i64(9, cm.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, g.size)
+		m.i64(3, g.rows)
+		m.end()
+	}
+	m.str(6, "sensor-gen "+buildVersion())
+	m.end()
+
+	m.buf = binary.LittleEndian.AppendUint32(m.buf, uint32(len(m.buf)))
+	m.buf = append(m.buf, "PAR1"...)
+	return t.write(m.buf)
+}
+
+// parquetType returns the physical and converted type of a column kind;
+// the converted type is -1 when there is none.
+func parquetType(k colKind) (typ, converted int32) {
+	switch k {
+	case colString:
+		return parquetByteArray, parquetUTF8
+	case colDouble:
+		return parquetDouble, -1
+	case colInt64:
+		return parquetInt64, -1
+	case colBool:
+		return parquetBoolean, -1
+	default:
+		return parquetInt64, parquetTimestampMicros
+	}
+}
+
+// packBits packs v one bit per value, least significant bit first.
+func packBits(v []bool) []byte {
+	b := make([]byte, (len(v)+7)/8)
+	for i, set := range v {
+		if set {
+			b[i/8] |= 1 << (i % 8)
+		}
+	}
+	return b
+}
+
+// bitPackedRun encodes definition levels of bit width 1 in Parquet's
+// RLE/bit-packing hybrid, as a single bit-packed run.
+func bitPackedRun(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+	b := binary.AppendUvarint(nil, uint64(groups)<<1|1)
+	return append(b, packBits(levels)...)
+}
+
+// Thrift compact protocol type codes.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the Thrift compact protocol structs of Parquet's
+// page headers and footer.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // field ID last written in each open struct
+}
+
+// begin opens a struct; end closes it.
+func (t *thriftWriter) begin() { t.last = append(t.last, 0) }
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf = append(t.buf, byte(d)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// structField opens a struct-valued field; close it with end.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// listField starts a list field of n elements of type elem, which the
+// caller then writes.
+func (t *thriftWriter) listField(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+// readParquetTable reads a Parquet file as written by parquetTable,
+// calling fn with each row's values in the order of cols, as their value
+// functions return them. The file's columns may come in any order but
+// must match cols in name, type and nullability. Only PLAIN-encoded data
+// pages, uncompressed or gzipped, are supported; files written by other
+// tools often use dictionary encoding or Snappy, and are rejected.
+func readParquetTable(f io.ReaderAt, size int64, cols []column, fn func(row []any) error) error {
+	tail := make([]byte, 8)
+	if size < 12 {
+		return fmt.Errorf("not a Parquet file")
+	}
+	if _, err := f.ReadAt(tail, size-8); err != nil {
+		return err
+	}
+	if string(tail[4:]) != "PAR1" {
+		return fmt.Errorf("not a Parquet file")
+	}
+	n := int64(binary.LittleEndian.Uint32(tail))
+	if n > size-12 {
+		return fmt.Errorf("footer length %d exceeds the file", n)
+	}
+	footer := make([]byte, n)
+	if _, err := f.ReadAt(footer, size-8-n); err != nil {
+		return err
+	}
+	tr := thriftReader{b: footer}
+	md := tr.structValue()
+	if tr.err != nil {
+		return fmt.Errorf("footer: %w", tr.err)
+	}
+	index, err := parquetSchemaIndex(thriftListOf(md[2]), cols)
+	if err != nil {
+		return err
+	}
+
+	for g, rg := range thriftListOf(md[4]) {
+		group := thriftStructOf(rg)
+		rows := int(thriftIntOf(group[3]))
+		values := make([][]any, len(cols))
+		for _, cc := range thriftListOf(group[1]) {
+			meta := thriftStructOf(thriftStructOf(cc)[3])
+			var path []string
+			for _, p := range thriftListOf(meta[3]) {
+				b, _ := p.([]byte)
+				path = append(path, string(b))
+			}
+			i, ok := index[strings.Join(path, ".")]
+			if !ok {
+				return fmt.Errorf("row group %d: column %s is not in the schema", g, strings.Join(path, "."))
+			}
+			if _, dict := meta[11]; dict {
+				return fmt.Errorf("column %s: dictionary encoding is not supported", cols[i].name)
+			}
+			chunk := make([]byte, thriftIntOf(meta[7]))
+			if _, err := f.ReadAt(chunk, thriftIntOf(meta[9])); err != nil {
+				return fmt.Errorf("column %s: %w", cols[i].name, err)
+			}
+			v, err := readParquetChunk(chunk, cols[i], thriftIntOf(meta[4]), rows)
+			if err != nil {
+				return fmt.Errorf("row group %d: column %s: %w", g, cols[i].name, err)
+			}
+			values[i] = v
+		}
+		for i, v := range values {
+			if v == nil {
+				return fmt.Errorf("row group %d: column %s missing", g, cols[i].name)
+			}
+		}
+		row := make([]any, len(cols))
+		for r := range rows {
+			for i := range cols {
+				row[i] = values[i][r]
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parquetSchemaIndex checks a file's schema elements against cols and
+// maps each column name to its index in cols.
+func parquetSchemaIndex(schema []any, cols []column) (map[string]int, error) {
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("schema: empty")
+	}
+	index := make(map[string]int, len(cols))
+	for i, c := range cols {
+		index[c.name] = i
+	}
+	seen := make(map[string]bool)
+	var diffs []string
+	for _, el := range schema[1:] {
+		e := thriftStructOf(el)
+		name := string(thriftBytesOf(e[4]))
+		if thriftIntOf(e[5]) > 0 {
+			return nil, fmt.Errorf("schema: nested column %s is not supported", name)
+		}
+		i, ok := index[name]
+		if !ok {
+			diffs = append(diffs, "unexpected column "+name)
+			continue
+		}
+		seen[name] = true
+		c := cols[i]
+		typ, converted := parquetType(c.kind)
+		conv := int64(-1)
+		if _, ok := e[6]; ok {
+			conv = thriftIntOf(e[6])
+		}
+		optional := thriftIntOf(e[3]) == 1
+		if thriftIntOf(e[1]) != int64(typ) || conv != int64(converted) {
+			diffs = append(diffs, "column "+name+" has another type")
+		} else if optional != c.optional {
+			diffs = append(diffs, fmt.Sprintf("column %s nullable is %v, want %v", name, optional, c.optional))
+		}
+	}
+	for _, c := range cols {
+		if !seen[c.name] {
+			diffs = append(diffs, "missing column "+c.name)
+		}
+	}
+	if len(diffs) > 0 {
+		return nil, fmt.Errorf("schema: %s", strings.Join(diffs, "; "))
+	}
+	return index, nil
+}
+
+// readParquetChunk decodes the pages of one column chunk into rows values,
+// nil for nulls.
+func readParquetChunk(chunk []byte, c column, codec int64, rows int) ([]any, error) {
+	if codec != parquetUncompressed && codec != parquetGzip {
+		return nil, fmt.Errorf("codec %d is not supported", codec)
+	}
+	values := make([]any, 0, rows)
+	for len(values) < rows {
+		tr := thriftReader{b: chunk}
+		ph := tr.structValue()
+		if tr.err != nil {
+			return nil, fmt.Errorf("page header: %w", tr.err)
+		}
+		chunk = chunk[tr.i:]
+		size := thriftIntOf(ph[3])
+		if size < 0 || size > int64(len(chunk)) {
+			return nil, fmt.Errorf("page overruns the column chunk")
+		}
+		data := chunk[:size]
+		chunk = chunk[size:]
+		if t := thriftIntOf(ph[1]); t != 0 {
+			return nil, fmt.Errorf("page type %d is not supported", t)
+		}
+		dph := thriftStructOf(ph[5])
+		if enc := thriftIntOf(dph[2]); enc != parquetPlain {
+			return nil, fmt.Errorf("encoding %d is not supported", enc)
+		}
+		if codec == parquetGzip {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = io.ReadAll(zr); err != nil {
+				return nil, err
+			}
+		}
+		n := int(thriftIntOf(dph[1]))
+		if n <= 0 || n > rows-len(values) {
+			return nil, fmt.Errorf("page holds %d values", n)
+		}
+		defined := make([]bool, n)
+		for i := range defined {
+			defined[i] = true
+		}
+		if c.optional {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated page")
+			}
+			l := int(binary.LittleEndian.Uint32(data))
+			if l > len(data)-4 {
+				return nil, fmt.Errorf("truncated definition levels")
+			}
+			var err error
+			if defined, err = readLevels(data[4:4+l], n); err != nil {
+				return nil, err
+			}
+			data = data[4+l:]
+		}
+		var bit int
+		for _, d := range defined {
+			if !d {
+				values = append(values, nil)
+				continue
+			}
+			var v any
+			switch c.kind {
+			case colBool:
+				if bit/8 >= len(data) {
+					return nil, fmt.Errorf("truncated page")
+				}
+				v = data[bit/8]>>(bit%8)&1 == 1
+				bit++
+			case colString:
+				if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+					return nil, fmt.Errorf("truncated page")
+				}
+				l := int(binary.LittleEndian.Uint32(data))
+				v, data = string(data[4:4+l]), data[4+l:]
+			default:
+				if len(data) < 8 {
+					return nil, fmt.Errorf("truncated page")
+				}
+				u := binary.LittleEndian.Uint64(data)
+				data = data[8:]
+				switch c.kind {
+				case colDouble:
+					v = math.Float64frombits(u)
+				case colInt64:
+					v = int64(u)
+				case colTimestamp:
+					v = time.UnixMicro(int64(u)).UTC()
+				}
+			}
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// readLevels decodes n definition levels of bit width 1 in the
+// RLE/bit-packing hybrid encoding.
+func readLevels(b []byte, n int) ([]bool, error) {
+	levels := make([]bool, 0, n)
+	for len(levels) < n {
+		h, k := binary.Uvarint(b)
+		if k <= 0 {
+			return nil, fmt.Errorf("truncated definition levels")
+		}
+		b = b[k:]
+		if h&1 == 1 { // bit-packed groups of 8
+			groups := int(h >> 1)
+			if groups > len(b) {
+				return nil, fmt.Errorf("truncated definition levels")
+			}
+			for i := 0; i < groups*8 && len(levels) < n; i++ {
+				levels = append(levels, b[i/8]>>(i%8)&1 == 1)
+			}
+			b = b[groups:]
+		} else { // a run of one repeated value
+			if len(b) == 0 {
+				return nil, fmt.Errorf("truncated definition levels")
+			}
+			for i := 0; i < int(h>>1) && len(levels) < n; i++ {
+				levels = append(levels, b[0]&1 == 1)
+			}
+			b = b[1:]
+		}
+	}
+	return levels, nil
+}
+
+// thriftReader decodes Thrift compact protocol structs into maps from
+// field ID to value: int64 for integers, bool, float64, []byte, []any for
+// lists and sets, and map[int16]any for structs. Maps are skipped.
+type thriftReader struct {
+	b   []byte
+	i   int
+	err error
+}
+
+func (t *thriftReader) fail() {
+	if t.err == nil {
+		t.err = fmt.Errorf("malformed Thrift data at byte %d", t.i)
+	}
+	t.i = len(t.b)
+}
+
+func (t *thriftReader) byte() byte {
+	if t.i >= len(t.b) {
+		t.fail()
+		return 0
+	}
+	t.i++
+	return t.b[t.i-1]
+}
+
+func (t *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(t.b[t.i:])
+	if n <= 0 {
+		t.fail()
+		return 0
+	}
+	t.i += n
+	return v
+}
+
+func (t *thriftReader) varint() int64 {
+	v, n := binary.Varint(t.b[t.i:])
+	if n <= 0 {
+		t.fail()
+		return 0
+	}
+	t.i += n
+	return v
+}
+
+func (t *thriftReader) structValue() map[int16]any {
+	m := make(map[int16]any)
+	var last int16
+	for t.err == nil {
+		h := t.byte()
+		if h == 0 {
+			break
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(t.varint())
+		}
+		last = id
+		m[id] = t.value(h&0x0f, false)
+	}
+	return m
+}
+
+// value reads a value of type typ. Booleans are in the field header,
+// except as container elements, where they take a byte.
+func (t *thriftReader) value(typ byte, elem bool) any {
+	switch typ {
+	case 1, 2:
+		if elem {
+			return t.byte() == 1
+		}
+		return typ == 1
+	case 3:
+		return int64(int8(t.byte()))
+	case 4, thriftI32, thriftI64:
+		return t.varint()
+	case 7:
+		if len(t.b)-t.i < 8 {
+			t.fail()
+			return 0.0
+		}
+		t.i += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(t.b[t.i-8:]))
+	case thriftBinary:
+		n := t.uvarint()
+		if n > uint64(len(t.b)-t.i) {
+			t.fail()
+			return []byte(nil)
+		}
+		t.i += int(n)
+		return t.b[t.i-int(n) : t.i]
+	case thriftList, 10: // list, set
+		h := t.byte()
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = t.uvarint()
+		}
+		if n > uint64(len(t.b)-t.i) {
+			t.fail()
+			return []any(nil)
+		}
+		l := make([]any, 0, n)
+		for range n {
+			l = append(l, t.value(h&0x0f, true))
+		}
+		return l
+	case 11: // map
+		n := t.uvarint()
+		if n == 0 {
+			return nil
+		}
+		if n > uint64(len(t.b)-t.i) {
+			t.fail()
+			return nil
+		}
+		kv := t.byte()
+		for range n {
+			t.value(kv>>4, true)
+			t.value(kv&0x0f, true)
+		}
+		return nil
+	case thriftStruct:
+		return t.structValue()
+	}
+	t.fail()
+	return nil
+}
+
+func thriftStructOf(v any) map[int16]any {
+	m, _ := v.(map[int16]any)
+	return m
+}
+
+func thriftListOf(v any) []any {
+	l, _ := v.([]any)
+	return l
+}
+
+func thriftIntOf(v any) int64 {
+	n, _ := v.(int64)
+	return n
+}
+
+func thriftBytesOf(v any) []byte {
+	b, _ := v.([]byte)
+	return b
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testReadings returns readings from a fleet with redundant pairs,
+// sequence numbers and ingest times, so that most optional columns are
+// filled in.
+func testReadings(t *testing.T, n int) []SensorReading {
+	t.Helper()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ingest, err := parseDelayDist("200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mix, err := parseTypeMix("*=1,chromatograph=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGenerator(GeneratorConfig{
+		Seed:            1,
+		Fleet:           60,
+		TypeMix:         mix,
+		RedundantPairs:  0.5,
+		Stations:        1,
+		Gateways:        1,
+		GatewayInterval: 100 * time.Millisecond,
+		DeviceHealth:    true,
+		RunID:           "test-run",
+		Cohorts:         []Cohort{{"control", 1}, {"shadow", 1}},
+		Sequence:        true,
+		IngestDelay:     ingest,
+		Clock: func() time.Time {
+			now = now.Add(time.Millisecond)
+			return now
+		},
+	})
+	return g.GenerateBatch(n)
+}
+
+// writeTable converts readings with a table writer.
+func writeTable(t *testing.T, table tableWriter, readings []SensorReading) {
+	t.Helper()
+	for i := range readings {
+		row, err := newConvRow(&readings[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := table.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkRows compares rows read back from a table with the column values
+// of the readings written, times cut to the formats' microseconds.
+func checkRows(t *testing.T, cols []column, readings []SensorReading, rows [][]any) {
+	t.Helper()
+	if len(rows) != len(readings) {
+		t.Fatalf("read %d rows, wrote %d", len(rows), len(readings))
+	}
+	for i := range readings {
+		row, err := newConvRow(&readings[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, c := range cols {
+			want := c.value(row)
+			if ts, ok := want.(time.Time); ok {
+				want = time.UnixMicro(ts.UnixMicro())
+			}
+			if !reflect.DeepEqual(rows[i][j], want) {
+				t.Fatalf("row %d, %s: got %v, want %v", i, c.name, rows[i][j], want)
+			}
+		}
+	}
+}
+
+// checkReadBack compares the readings read back from a file with those
+// written, their times cut to the formats' microseconds, and checks them
+// as validate and stats would.
+func checkReadBack(t *testing.T, want, got []SensorReading) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d readings, wrote %d", len(got), len(want))
+	}
+	micros := func(s *string) {
+		if ts, err := time.Parse(time.RFC3339Nano, *s); err == nil {
+			*s = ts.Truncate(time.Microsecond).Format(time.RFC3339Nano)
+		}
+	}
+	for i := range want {
+		w := want[i]
+		micros(&w.Timestamp)
+		micros(&w.IngestedAt)
+		micros(&w.TransmittedAt)
+		a, _ := json.Marshal(&w)
+		b, _ := json.Marshal(&got[i])
+		if !bytes.Equal(a, b) {
+			t.Fatalf("reading %d:\n got %s\nwant %s", i, b, a)
+		}
+	}
+	v := &validator{tolerance: 0.25, enabled: make(map[string]bool), sensors: make(map[string]*sensorTrack)}
+	for _, name := range validateChecks {
+		v.enabled[name] = true
+	}
+	p := newProfiler()
+	for i := range got {
+		v.check("", &got[i])
+		p.add(&got[i])
+	}
+	var report bytes.Buffer
+	if !v.report(&report, "test", "") {
+		t.Errorf("validate failed:\n%s", &report)
+	}
+	if prof := p.profile("test", 0); prof.Records != int64(len(want)) || prof.Unreadable != 0 {
+		t.Errorf("stats counted %d records, %d unreadable, want %d", prof.Records, prof.Unreadable, len(want))
+	}
+}
+
+// compactReader decodes the Thrift compact protocol into generic values:
+// structs as maps from field ID to value, lists as slices, integers as
+// int64 and binaries as byte slices.
+type compactReader struct {
+	b []byte
+}
+
+func (r *compactReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errors.New("bad varint")
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *compactReader) value(typ byte) (any, error) {
+	switch typ {
+	case 1, 2: // boolean true, false (as struct fields)
+		return typ == 1, nil
+	case 3:
+		if len(r.b) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := int64(int8(r.b[0]))
+		r.b = r.b[1:]
+		return v, nil
+	case 4, 5, 6: // i16, i32, i64, zigzag
+		u, err := r.uvarint()
+		return int64(u>>1) ^ -int64(u&1), err
+	case 7:
+		if len(r.b) < 8 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.b))
+		r.b = r.b[8:]
+		return v, nil
+	case 8:
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(r.b)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v, nil
+	case 9, 10: // list, set
+		if len(r.b) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n, elem := uint64(r.b[0]>>4), r.b[0]&15
+		r.b = r.b[1:]
+		if n == 15 {
+			var err error
+			if n, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]any, n)
+		for i := range list {
+			v, err := r.value(elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case 12:
+		return r.structure()
+	}
+	return nil, fmt.Errorf("unknown thrift type %d", typ)
+}
+
+func (r *compactReader) structure() (map[int16]any, error) {
+	s := make(map[int16]any)
+	var id int16
+	for {
+		if len(r.b) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		h := r.b[0]
+		r.b = r.b[1:]
+		if h == 0 {
+			return s, nil
+		}
+		if d := h >> 4; d != 0 {
+			id += int16(d)
+		} else {
+			u, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(u>>1) ^ -int16(u&1)
+		}
+		v, err := r.value(h & 15)
+		if err != nil {
+			return nil, err
+		}
+		s[id] = v
+	}
+}
+
+// readParquet decodes every row of a Parquet file written for cols,
+// following the specification rather than parquetTable: the footer, each
+// column chunk's data page and its definition levels.
+func readParquet(data []byte, cols []column) ([][]any, error) {
+	if len(data) < 12 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		return nil, errors.New("bad magic")
+	}
+	n := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if n > len(data)-12 {
+		return nil, errors.New("bad footer length")
+	}
+	footer := &compactReader{b: data[len(data)-8-n : len(data)-8]}
+	meta, err := footer.structure()
+	if err != nil {
+		return nil, fmt.Errorf("footer: %w", err)
+	}
+	schema, _ := meta[2].([]any)
+	if len(schema) != len(cols)+1 {
+		return nil, fmt.Errorf("schema has %d elements, want %d", len(schema), len(cols)+1)
+	}
+	for i, c := range cols {
+		el := schema[i+1].(map[int16]any)
+		typ, converted := parquetType(c.kind)
+		rep := int64(0)
+		if c.optional {
+			rep = 1
+		}
+		if string(el[4].([]byte)) != c.name || el[1] != int64(typ) || el[3] != rep {
+			return nil, fmt.Errorf("schema element %d is %v, want %s", i+1, el, c.name)
+		}
+		if got, ok := el[6]; ok != (converted >= 0) || ok && got != int64(converted) {
+			return nil, fmt.Errorf("column %s has converted type %v, want %d", c.name, got, converted)
+		}
+	}
+	var rows [][]any
+	groups, _ := meta[4].([]any)
+	for _, g := range groups {
+		g := g.(map[int16]any)
+		count := int(g[3].(int64))
+		start := len(rows)
+		for range count {
+			rows = append(rows, make([]any, len(cols)))
+		}
+		for j, chunk := range g[1].([]any) {
+			cm := chunk.(map[int16]any)[3].(map[int16]any)
+			values, err := readParquetPage(data, cm, cols[j], count)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", cols[j].name, err)
+			}
+			for i, v := range values {
+				rows[start+i][j] = v
+			}
+		}
+	}
+	if total := meta[3].(int64); total != int64(len(rows)) {
+		return nil, fmt.Errorf("footer counts %d rows, row groups %d", total, len(rows))
+	}
+	return rows, nil
+}
+
+// readParquetPage decodes the single data page of a column chunk.
+func readParquetPage(data []byte, cm map[int16]any, c column, count int) ([]any, error) {
+	off := cm[9].(int64)
+	if off < 4 || off >= int64(len(data)) {
+		return nil, errors.New("bad page offset")
+	}
+	r := &compactReader{b: data[off:]}
+	hdr, err := r.structure()
+	if err != nil {
+		return nil, fmt.Errorf("page header: %w", err)
+	}
+	size, uncompressed := int(hdr[3].(int64)), int(hdr[2].(int64))
+	if hdr[1] != int64(0) || size > len(r.b) {
+		return nil, fmt.Errorf("bad page header %v", hdr)
+	}
+	page := r.b[:size]
+	switch cm[4] {
+	case int64(parquetGzip):
+		zr, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+		if page, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	case int64(parquetUncompressed):
+	default:
+		return nil, fmt.Errorf("unknown codec %v", cm[4])
+	}
+	if len(page) != uncompressed {
+		return nil, fmt.Errorf("page is %d bytes, header says %d", len(page), uncompressed)
+	}
+	dp := hdr[5].(map[int16]any)
+	if dp[1] != int64(count) || dp[2] != int64(parquetPlain) {
+		return nil, fmt.Errorf("bad data page header %v", dp)
+	}
+
+	defined := make([]bool, count)
+	for i := range defined {
+		defined[i] = true
+	}
+	if c.optional {
+		if len(page) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint32(page))
+		if n > len(page)-4 {
+			return nil, errors.New("bad definition levels length")
+		}
+		levels := page[4 : 4+n]
+		page = page[4+n:]
+		// The RLE/bit-packing hybrid, at bit width 1.
+		for i := 0; i < count; {
+			h, k := binary.Uvarint(levels)
+			if k <= 0 {
+				return nil, errors.New("bad definition levels")
+			}
+			levels = levels[k:]
+			if h&1 == 1 { // bit-packed, 8 values a byte
+				groups := int(h >> 1)
+				if groups > len(levels) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				for b := range groups * 8 {
+					if i+b < count {
+						defined[i+b] = levels[b/8]>>(b%8)&1 == 1
+					}
+				}
+				i += groups * 8
+				levels = levels[groups:]
+			} else { // a run of one value
+				if len(levels) < 1 {
+					return nil, io.ErrUnexpectedEOF
+				}
+				for range h >> 1 {
+					if i < count {
+						defined[i] = levels[0] == 1
+					}
+					i++
+				}
+				levels = levels[1:]
+			}
+		}
+	}
+
+	values := make([]any, count)
+	bit := 0
+	for i := range values {
+		if !defined[i] {
+			continue
+		}
+		switch c.kind {
+		case colString:
+			if len(page) < 4 || int(binary.LittleEndian.Uint32(page)) > len(page)-4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			n := int(binary.LittleEndian.Uint32(page))
+			values[i] = string(page[4 : 4+n])
+			page = page[4+n:]
+		case colDouble, colInt64, colTimestamp:
+			if len(page) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			u := binary.LittleEndian.Uint64(page)
+			page = page[8:]
+			switch c.kind {
+			case colDouble:
+				values[i] = math.Float64frombits(u)
+			case colInt64:
+				values[i] = int64(u)
+			default:
+				values[i] = time.UnixMicro(int64(u))
+			}
+		case colBool:
+			if bit/8 >= len(page) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			values[i] = page[bit/8]>>(bit%8)&1 == 1
+			bit++
+		}
+	}
+	if rest := len(page) - (bit+7)/8; rest != 0 {
+		return nil, fmt.Errorf("%d bytes left over in page", rest)
+	}
+	return values, nil
+}
+
+func TestParquetWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		compress bool
+		rowGroup int
+	}{
+		{"empty", 0, false, 100},
+		{"plain", 2000, false, 1 << 20},
+		{"compressed", 2000, true, 1 << 20},
+		{"row groups", 2000, false, 300},
+		{"compressed row groups", 2000, true, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings := testReadings(t, tt.n)
+			var buf bytes.Buffer
+			table, err := newParquetTable(&buf, readingColumns, tt.compress, tt.rowGroup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTable(t, table, readings)
+			rows, err := readParquet(buf.Bytes(), readingColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRows(t, readingColumns, readings, rows)
+		})
+	}
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	readings := testReadings(t, 2000)
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		table, err := newParquetTable(&buf, readingColumns, compress, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTable(t, table, readings)
+		var got []SensorReading
+		err = readParquetTable(bytes.NewReader(buf.Bytes()), int64(buf.Len()), readingColumns, func(row []any) error {
+			got = append(got, *rowReading(readingColumns, row))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("compress %v: %v", compress, err)
+		}
+		checkReadBack(t, readings, got)
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	table, err := newParquetTable(&buf, readingColumns, false, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = readParquetTable(bytes.NewReader(buf.Bytes()), int64(buf.Len()), readingColumns, func(row []any) error {
+		return io.ErrUnexpectedEOF
+	})
+	if err != nil {
+		t.Fatalf("reading an empty table: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partitionKeys maps the keys of a Hive-style partition layout to the
+// reading's value for them.
+var partitionKeys = map[string]func(r *SensorReading) string{
+	"dt": func(r *SensorReading) string {
+		if len(r.Timestamp) >= 10 {
+			return r.Timestamp[:10]
+		}
+		return r.Timestamp
+	},
+	"hour": func(r *SensorReading) string {
+		if len(r.Timestamp) >= 13 {
+			return r.Timestamp[11:13]
+		}
+		return ""
+	},
+	"pipeline_id": func(r *SensorReading) string { return r.PipelineID },
+	"type":        func(r *SensorReading) string { return r.Type },
+	"sensor_id":   func(r *SensorReading) string { return r.SensorID },
+	"status":      func(r *SensorReading) string { return r.Status },
+	"cohort":      func(r *SensorReading) string { return r.Cohort },
+}
+
+// hiveDefaultPartition is the directory value Hive uses for a missing key.
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// parsePartitionKeys parses a comma-separated list of partition keys, e.g.
+// dt,pipeline_id.
+func parsePartitionKeys(s string) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if _, ok := partitionKeys[k]; !ok {
+			return nil, fmt.Errorf("unknown partition key %q (want dt, hour, pipeline_id, type, sensor_id, status or cohort)", k)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// partitionPath returns r's partition directory, e.g.
+// dt=2024-05-01/pipeline_id=PIPE-TX-001, escaping values as Hive does.
+func partitionPath(keys []string, r *SensorReading) string {
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte('/')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		v := partitionKeys[k](r)
+		if v == "" {
+			b.WriteString(hiveDefaultPartition)
+			continue
+		}
+		for j := 0; j < len(v); j++ {
+			c := v[j]
+			if c < 0x20 || c >= 0x7f || strings.IndexByte("\"#%'*/:=?\\{[]^", c) >= 0 {
+				fmt.Fprintf(&b, "%%%02X", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// partitionMaxOpen bounds the partition files a partitioned sink keeps
+// open; the least recently written is closed to make room and reopened
+// for appending when it is written again.
+const partitionMaxOpen = 128
+
+// partitionedSink writes records into a Hive-style directory tree under
+// dir, one part file per partition and run:
+//
+//	<dir>/dt=YYYY-MM-DD/pipeline_id=<id>/part-<run>-<n>.jsonl
+type partitionedSink struct {
+	dir    string
+	keys   []string
+	runID  string
+	atomic bool // write part files as .tmp until Close
+	seq    int
+	tick   int64 // write counter, for least-recently-used closing
+	parts  map[string]*partFile
+	open   int
+}
+
+// partFile is the part file of one partition.
+type partFile struct {
+	path     string
+	file     *os.File // nil while closed
+	writer   *bufio.Writer
+	lastUsed int64
+	dirty    bool
+}
+
+func newPartitionedSink(dir string, keys []string, atomic bool) *partitionedSink {
+	return &partitionedSink{
+		dir:    dir,
+		keys:   keys,
+		runID:  time.Now().UTC().Format("20060102T150405Z"),
+		atomic: atomic,
+		parts:  make(map[string]*partFile),
+	}
+}
+
+func (s *partitionedSink) Write(ctx context.Context, batch []Record) error {
+	for _, rec := range batch {
+		p, err := s.part(rec.Reading)
+		if err != nil {
+			return err
+		}
+		p.writer.Write(rec.Data)
+		p.writer.WriteByte('\n')
+		p.dirty = true
+	}
+	// Flush after each batch, as the file sink does.
+	for _, p := range s.parts {
+		if p.dirty {
+			if err := p.writer.Flush(); err != nil {
+				return err
+			}
+			p.dirty = false
+		}
+	}
+	return nil
+}
+
+// part returns the open part file for r's partition.
+func (s *partitionedSink) part(r *SensorReading) (*partFile, error) {
+	partition := partitionPath(s.keys, r)
+	p, ok := s.parts[partition]
+	if !ok {
+		s.seq++
+		p = &partFile{path: filepath.Join(s.dir, filepath.FromSlash(partition), fmt.Sprintf("part-%s-%05d.jsonl", s.runID, s.seq))}
+		if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+			return nil, err
+		}
+		s.parts[partition] = p
+	}
+	s.tick++
+	p.lastUsed = s.tick
+	if p.file != nil {
+		return p, nil
+	}
+	if s.open >= partitionMaxOpen {
+		if err := s.closeOldest(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(s.writePath(p), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.file, p.writer = f, bufio.NewWriterSize(f, 64*1024)
+	s.open++
+	return p, nil
+}
+
+// writePath is the name p is written under until the sink is closed.
+func (s *partitionedSink) writePath(p *partFile) string {
+	if s.atomic {
+		return p.path + tmpSuffix
+	}
+	return p.path
+}
+
+// closeOldest closes the least recently written open part file.
+func (s *partitionedSink) closeOldest() error {
+	var oldest *partFile
+	for _, p := range s.parts {
+		if p.file != nil && (oldest == nil || p.lastUsed < oldest.lastUsed) {
+			oldest = p
+		}
+	}
+	return s.closePart(oldest)
+}
+
+func (s *partitionedSink) closePart(p *partFile) error {
+	err := p.writer.Flush()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	p.file, p.writer, p.dirty = nil, nil, false
+	s.open--
+	return err
+}
+
+func (s *partitionedSink) Close(ctx context.Context) error {
+	var errs []error
+	for _, p := range s.parts {
+		if p.file != nil {
+			errs = append(errs, s.closePart(p))
+		}
+		if s.atomic {
+			errs = append(errs, finalize(s.writePath(p), p.path))
+		}
+	}
+	return errors.Join(errs...)
+}
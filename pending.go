@@ -0,0 +1,79 @@
+package main
+
+import "time"
+
+// pendingRecords is the bookkeeping shared by the sinks that buffer
+// records across batches and send them later, several batches to a
+// request. For each pending record it logs what the sink needs to take
+// the record back out of its buffers. When a request fails, the batch
+// being written is taken back out, as it is reported failed as a whole,
+// while what earlier batches buffered stays pending for the next request.
+// So no record is both reported failed and sent later, or reported
+// written and then lost.
+type pendingRecords[T any] struct {
+	items  []T       // one per pending record, oldest first
+	keep   int       // items buffered by earlier batches
+	oldest time.Time // when the oldest pending record was added
+	failed bool      // the last request failed: send pending with the next batch
+}
+
+// begin starts a batch: the records pending so far are kept if it fails.
+func (p *pendingRecords[T]) begin() {
+	p.keep = len(p.items)
+}
+
+// add logs a record added to the sink's buffers.
+func (p *pendingRecords[T]) add(v T) {
+	if len(p.items) == 0 {
+		p.oldest = time.Now()
+	}
+	p.items = append(p.items, v)
+}
+
+// len returns the number of pending records.
+func (p *pendingRecords[T]) len() int {
+	return len(p.items)
+}
+
+// due reports whether the pending records are to be sent: the oldest has
+// waited maxDelay, or the last request failed, so those it left go at once.
+func (p *pendingRecords[T]) due(maxDelay time.Duration) bool {
+	return len(p.items) > 0 && (p.failed || time.Since(p.oldest) >= maxDelay)
+}
+
+// sent drops all pending records once a request has sent them.
+func (p *pendingRecords[T]) sent() {
+	clear(p.items)
+	p.items, p.keep, p.failed = p.items[:0], 0, false
+}
+
+// retain keeps the pending records for which f reports true, replaced
+// by the item f returns, and drops the rest, which the sink has sent.
+func (p *pendingRecords[T]) retain(f func(i int, v T) (T, bool)) {
+	n, keep := 0, 0
+	for i, v := range p.items {
+		v, ok := f(i, v)
+		if !ok {
+			continue
+		}
+		if i < p.keep {
+			keep++
+		}
+		p.items[n] = v
+		n++
+	}
+	clear(p.items[n:])
+	p.items, p.keep = p.items[:n], keep
+}
+
+// fail takes the records the current batch added back out, calling undo
+// for each, newest first, and returns err.
+func (p *pendingRecords[T]) fail(err error, undo func(T)) error {
+	for i := len(p.items) - 1; i >= p.keep; i-- {
+		undo(p.items[i])
+	}
+	clear(p.items[p.keep:])
+	p.items = p.items[:p.keep]
+	p.failed = true
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPendingRecords(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name   string
+		run    func(p *pendingRecords[int], undo func(int)) error
+		want   []int // pending items afterwards
+		undone []int // items undone, in order
+	}{
+		{
+			name: "fail first batch",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.add(2)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{},
+			undone: []int{2, 1},
+		},
+		{
+			name: "fail keeps earlier batches",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.add(2)
+				p.begin()
+				p.add(3)
+				p.add(4)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{1, 2},
+			undone: []int{4, 3},
+		},
+		{
+			name: "fail after a failed batch",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.begin()
+				p.add(2)
+				p.fail(errFailed, undo)
+				p.begin()
+				p.add(3)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{1},
+			undone: []int{2, 3},
+		},
+		{
+			name: "retain drops sent records",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.add(2)
+				p.add(3)
+				p.begin()
+				p.add(4)
+				p.add(5)
+				p.retain(func(_ int, v int) (int, bool) { return v * 10, v%2 == 1 })
+				p.add(6)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{10, 30},
+			undone: []int{6, 50},
+		},
+		{
+			name: "sent clears all",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.begin()
+				p.add(2)
+				p.sent()
+				p.add(3)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{},
+			undone: []int{3},
+		},
+		{
+			name: "retain passes indexes",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(7)
+				p.add(8)
+				p.add(9)
+				p.retain(func(i int, v int) (int, bool) { return i, v != 8 })
+				return nil
+			},
+			want: []int{0, 2},
+		},
+		{
+			name: "sent mid-batch",
+			run: func(p *pendingRecords[int], undo func(int)) error {
+				p.begin()
+				p.add(1)
+				p.begin()
+				p.add(2)
+				p.retain(func(int, int) (int, bool) { return 0, false })
+				p.add(3)
+				return p.fail(errFailed, undo)
+			},
+			want:   []int{},
+			undone: []int{3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p pendingRecords[int]
+			var undone []int
+			err := tt.run(&p, func(v int) { undone = append(undone, v) })
+			if tt.undone != nil && !errors.Is(err, errFailed) {
+				t.Errorf("err = %v, want %v", err, errFailed)
+			}
+			if got := append([]int{}, p.items...); !slices.Equal(got, tt.want) || p.len() != len(tt.want) {
+				t.Errorf("pending = %v, want %v", got, tt.want)
+			}
+			if !slices.Equal(undone, tt.undone) {
+				t.Errorf("undone = %v, want %v", undone, tt.undone)
+			}
+		})
+	}
+}
+
+func TestPendingRecordsDue(t *testing.T) {
+	var p pendingRecords[int]
+	if p.due(0) {
+		t.Error("due with nothing pending")
+	}
+	p.begin()
+	p.add(1)
+	if p.due(time.Hour) {
+		t.Error("due before the delay")
+	}
+	if !p.due(0) {
+		t.Error("not due after the delay")
+	}
+	p.begin()
+	p.add(2)
+	p.fail(errors.New("failed"), func(int) {})
+	if !p.due(time.Hour) {
+		t.Error("not due after a failed request")
+	}
+	p.sent()
+	p.add(3)
+	if p.due(time.Hour) {
+		t.Error("still due after a request succeeded")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// plugin runs custom generation logic in an external process, written in
+// any language: each batch of readings goes to the process's standard
+// input as JSON lines, and for each it writes back one line, the reading
+// to emit in its place (with a value from its own signal model, say, or
+// fields changed) or null to drop it. Readings flow through it in order,
+// before bursts, encoding and the sinks, so the plugin runs inside the
+// run's rate and scheduling. A process rather than a Go or WASM module
+// keeps sensor-gen a static, standard-library binary, and the plugin's
+// code out of its address space.
+//
+// A value plugin is the lighter form for signal models alone: it answers
+// each reading with just the value to give it, and the generator derives
+// the reading's alert level from that value as from its own.
+type plugin struct {
+	name string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Reader
+	err  error // the failure that ended the run, if the plugin failed
+}
+
+// startPlugin starts the plugin command, a program and its arguments
+// separated by spaces.
+func startPlugin(command string) (*plugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("plugin: empty command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", args[0], err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", args[0], err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", args[0], err)
+	}
+	return &plugin{name: args[0], cmd: cmd, in: in, out: bufio.NewReaderSize(out, 256*1024)}, nil
+}
+
+// apply passes readings through the plugin and returns what it emits in
+// their place.
+func (p *plugin) apply(readings []SensorReading) ([]SensorReading, error) {
+	out := make([]SensorReading, 0, len(readings))
+	err := p.exchange(readings, func(_ int, line []byte) error {
+		if string(line) == "null" {
+			return nil
+		}
+		out = append(out, SensorReading{})
+		if err := unmarshalReading(line, &out[len(out)-1]); err != nil {
+			return fmt.Errorf("bad reading %.80q: %w", line, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// values has a value plugin, which answers each reading with a number or
+// null, set the readings' values in place. The plugin runs before what
+// the generator derives from a value is final: derive is called on each
+// reading given a new value to derive it again.
+func (p *plugin) values(readings []SensorReading, derive func(*SensorReading)) error {
+	return p.exchange(readings, func(i int, line []byte) error {
+		if string(line) == "null" {
+			return nil // the model's value stands
+		}
+		v, err := strconv.ParseFloat(string(line), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("bad value %.80q", line)
+		}
+		readings[i].Value = v
+		derive(&readings[i])
+		return nil
+	})
+}
+
+// exchange writes readings to the plugin and hands answer its line for
+// each, in order.
+func (p *plugin) exchange(readings []SensorReading, answer func(i int, line []byte) error) error {
+	if err := p.roundTrip(readings, answer); err != nil {
+		p.err = fmt.Errorf("plugin %s: %w", p.name, err)
+		return p.err
+	}
+	return nil
+}
+
+func (p *plugin) roundTrip(readings []SensorReading, answer func(i int, line []byte) error) error {
+	// Write while reading, so a plugin answering line by line never
+	// blocks on a full pipe.
+	sent := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriterSize(p.in, 256*1024)
+		for i := range readings {
+			data, err := marshalReading(&readings[i])
+			if err != nil {
+				data = []byte("null") // unencodable readings are dropped
+			}
+			w.Write(data)
+			w.WriteByte('\n')
+		}
+		sent <- w.Flush()
+	}()
+	for i := range readings {
+		line, err := p.out.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("exited")
+			}
+			return err
+		}
+		if err := answer(i, bytes.TrimSpace(line)); err != nil {
+			return err
+		}
+	}
+	return <-sent
+}
+
+// close ends the plugin's input and waits for it to exit. A plugin that
+// failed mid-run has been reported already.
+func (p *plugin) close() error {
+	p.in.Close()
+	if err := p.cmd.Wait(); err != nil && p.err == nil {
+		return fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// shellPlugin writes a shell script answering the readings it reads with
+// answers, one per line in turn, and returns the command running it.
+func shellPlugin(t *testing.T, answers ...string) string {
+	t.Helper()
+	script := "#!/bin/sh\nfor a in " + strings.Join(answers, " ") + "; do read -r line || exit 0; echo \"$a\"; done\n"
+	path := filepath.Join(t.TempDir(), "plugin.sh")
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValuePlugin(t *testing.T) {
+	g := NewGenerator(GeneratorConfig{Seed: 1})
+	tests := []struct {
+		name    string
+		answers []string
+		values  []float64
+		levels  []string
+		err     string
+	}{
+		{
+			name:    "values and null",
+			answers: []string{"1450", "null", "1600", "700"},
+			values:  []float64{1450, 700, 1600, 700},
+			levels:  []string{alertWarning, alertCritical, alertCritical, ""},
+		},
+		{
+			name:    "bad value",
+			answers: []string{"1450", "NaN"},
+			err:     `bad value "NaN"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := startPlugin(shellPlugin(t, tt.answers...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			readings := make([]SensorReading, len(tt.answers))
+			for i := range readings {
+				// The second reading keeps a critical level the plugin
+				// leaves alone by answering null.
+				readings[i] = SensorReading{SensorID: "s1", Type: "pressure", Unit: "psi", Value: 700, AlertLevel: alertCritical}
+			}
+			err = p.values(readings, g.Rederive)
+			p.close()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, r := range readings {
+				if r.Value != tt.values[i] || r.AlertLevel != tt.levels[i] {
+					t.Errorf("reading %d: value %v, level %q; want %v, %q", i, r.Value, r.AlertLevel, tt.values[i], tt.levels[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// RateProfile shapes the sample rate over a run, read from the JSON file
+// given with -profile:
+//
+//	{
+//	  "arrivals": "poisson",
+//	  "repeat": true,
+//	  "stages": [
+//	    {"for": "5m", "rate": 1000, "to": 20000},
+//	    {"for": "10m", "rate": 20000},
+//	    {"for": "2m", "rate": 60000},
+//	    {"for": "24h", "rate": 8000, "amplitude": 6000, "period": "24h"},
+//	    {"for": "5m", "rate": 20000, "to": 0}
+//	  ]
+//	}
+type RateProfile struct {
+	// Stages follow each other from the start of the run.
+	Stages []RateStage `json:"stages"`
+	// Repeat starts over after the last stage; otherwise the run ends
+	// there.
+	Repeat bool `json:"repeat,omitempty"`
+	// Arrivals is "even" (the default) for samples evenly spaced at the
+	// current rate, or "poisson" for exponentially distributed gaps.
+	Arrivals string `json:"arrivals,omitempty"`
+}
+
+// RateStage is one stretch of a profile. Its rate is Rate, ramping
+// linearly to To over the stage when To is set, plus a sinusoid of
+// Amplitude and Period peaking PeakAt into the stage (by default half a
+// period in, so a day-long period starting at midnight peaks at noon).
+// A rate that works out negative is zero.
+type RateStage struct {
+	For       Duration `json:"for"`
+	Rate      float64  `json:"rate"`
+	To        *float64 `json:"to,omitempty"`
+	Amplitude float64  `json:"amplitude,omitempty"`
+	Period    Duration `json:"period,omitempty"`
+	PeakAt    Duration `json:"peak_at,omitempty"`
+}
+
+// loadProfile reads and validates the rate profile at path.
+func loadProfile(path string) (*RateProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("profile: %w", err)
+	}
+	defer f.Close()
+	var p RateProfile
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+func (p *RateProfile) validate() error {
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("no stages")
+	}
+	if p.Arrivals != "" && p.Arrivals != "even" && p.Arrivals != "poisson" {
+		return fmt.Errorf("unknown arrivals %q (want even or poisson)", p.Arrivals)
+	}
+	busy := false
+	for i, s := range p.Stages {
+		if s.For <= 0 {
+			return fmt.Errorf("stages[%d]: for must be positive", i)
+		}
+		if s.Rate < 0 || s.To != nil && *s.To < 0 || s.Amplitude < 0 {
+			return fmt.Errorf("stages[%d]: rates must not be negative", i)
+		}
+		if s.Amplitude > 0 && s.Period <= 0 {
+			return fmt.Errorf("stages[%d]: amplitude needs a period", i)
+		}
+		busy = busy || s.Rate > 0 || s.To != nil && *s.To > 0 || s.Amplitude > 0
+	}
+	if !busy {
+		return fmt.Errorf("every stage has a zero rate")
+	}
+	return nil
+}
+
+// rate returns the stage's rate at offset u into it.
+func (s *RateStage) rate(u time.Duration) float64 {
+	r := s.Rate
+	if s.To != nil {
+		r += (*s.To - s.Rate) * float64(u) / float64(s.For)
+	}
+	if s.Amplitude > 0 {
+		peak := time.Duration(s.PeakAt)
+		if peak == 0 {
+			peak = time.Duration(s.Period) / 2
+		}
+		r += s.Amplitude * math.Cos(2*math.Pi*float64(u-peak)/float64(s.Period))
+	}
+	return max(r, 0)
+}
+
+// profileClock is a Generator clock that spaces samples as a rate profile
+// says, starting at start. Poisson gaps come from their own random source,
+// so the readings themselves do not depend on the arrival process.
+type profileClock struct {
+	p     *RateProfile
+	start time.Time
+	rng   *rand.Rand
+	t     time.Duration // offset of the next sample
+	stage int           // stage the next sample falls in
+	from  time.Duration // offset that stage began at
+	done  bool          // the profile has ended
+}
+
+func newProfileClock(p *RateProfile, start time.Time, seed int64) *profileClock {
+	c := &profileClock{p: p, start: start, rng: rand.New(rand.NewSource(seed ^ 0x70726f66696c65))}
+	c.advance()
+	return c
+}
+
+// peek returns the time of the next sample, or the zero time once a
+// profile without repeat has ended.
+func (c *profileClock) peek() time.Time {
+	if c.done {
+		return time.Time{}
+	}
+	return c.start.Add(c.t)
+}
+
+// next returns the time of the next sample and moves past it. After the
+// profile ends it keeps returning the end.
+func (c *profileClock) next() time.Time {
+	t := c.start.Add(c.t)
+	if !c.done {
+		c.advance()
+	}
+	return t
+}
+
+// profileStep is the step over which the clock integrates the rate.
+const profileStep = 10 * time.Millisecond
+
+// advance moves t to the following sample: the point where the rate,
+// integrated from t, reaches one sample, or with Poisson arrivals an
+// exponentially distributed amount.
+func (c *profileClock) advance() {
+	need := 1.0
+	if c.p.Arrivals == "poisson" {
+		need = c.rng.ExpFloat64()
+	}
+	for !c.done {
+		s := &c.p.Stages[c.stage]
+		end := c.from + time.Duration(s.For)
+		dt := min(profileStep, end-c.t)
+		r := s.rate(c.t - c.from)
+		if r > 0 && r*dt.Seconds() >= need {
+			c.t += max(time.Duration(need/r*float64(time.Second)), 1)
+			return
+		}
+		need -= r * dt.Seconds()
+		c.t += dt
+		if c.t >= end {
+			c.from = end
+			c.stage++
+			if c.stage == len(c.p.Stages) {
+				c.stage = 0
+				c.done = !c.p.Repeat
+			}
+		}
+	}
+}
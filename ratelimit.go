@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// bucketCatchUp is how much time's worth of work a tokenBucket lets
+// through at once after a stall.
+const bucketCatchUp = 100 * time.Millisecond
+
+// tokenBucket paces work at a steady rate. Tokens accrue continuously at
+// rate per second and wait takes them, sleeping only for the shortfall, so
+// timer slack and uneven work even out rather than adding up. The bucket
+// holds at most bucketCatchUp's worth (and at least one take), so after a
+// stall the rate recovers with a bounded burst instead of making up all
+// the time lost.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	max    float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns an empty bucket filling at rate for takes of up
+// to n tokens.
+func newTokenBucket(rate, n int) *tokenBucket {
+	b := &tokenBucket{last: time.Now()}
+	b.setRate(rate, n)
+	return b
+}
+
+// setRate changes the fill rate and the largest take from now on.
+func (b *tokenBucket) setRate(rate, n int) {
+	b.fill(time.Now())
+	b.rate = float64(rate)
+	b.max = max(float64(n), b.rate*bucketCatchUp.Seconds())
+	b.tokens = min(b.tokens, b.max)
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	b.tokens = min(b.max, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait takes n tokens, blocking until they have accrued or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.fill(time.Now())
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			return nil
+		}
+		timer := time.NewTimer(time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
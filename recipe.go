@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// Recipe records what a run generated: the effective settings, the seed
+// and the sample clock, so "sensor-gen generate -recipe" can regenerate
+// the same readings later. It is written as JSON, which YAML parsers also
+// accept.
+type Recipe struct {
+	Version string `json:"sensor_gen_version"`
+	Seed    int64  `json:"seed"`
+	// Start is the timestamp of the first sample; sample k is taken at
+	// Start + k/rate.
+	Start time.Time `json:"start"`
+	// Samples is the number of samples taken, whether or not they were
+	// reported.
+	Samples int64 `json:"samples"`
+	// Flags holds the value of every generation flag, set or not.
+	Flags map[string]string `json:"flags"`
+	// Config is the -config file's content at the time of the run.
+	Config *Config `json:"config,omitempty"`
+	// Profile is the -profile file's content, if the run had one.
+	Profile *RateProfile `json:"profile,omitempty"`
+}
+
+// recipeSkipFlags are left out of recipes: sink URLs may carry
+// credentials, -tui and -debug-addr only concern how the run was watched,
+// -append would make a regenerated copy append to its -o file, and the
+// rest only concern where recipes, manifests and checkpoints go.
+var recipeSkipFlags = []string{"sink", "tui", "debug-addr", "append", "recipe", "recipe-out", "manifest", "checkpoint", "checkpoint-every"}
+
+// newRecipe captures the current flag values of fs.
+func newRecipe(fs *flag.FlagSet, seed int64, start time.Time, cfg *Config) *Recipe {
+	r := &Recipe{Version: buildVersion(), Seed: seed, Start: start, Flags: make(map[string]string)}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !slices.Contains(recipeSkipFlags, f.Name) {
+			r.Flags[f.Name] = f.Value.String()
+		}
+	})
+	if len(cfg.Noise) > 0 || len(cfg.Alerts) > 0 || len(cfg.Status) > 0 || len(cfg.Failures) > 0 || cfg.Fields != nil {
+		r.Config = cfg
+	}
+	return r
+}
+
+// write saves the recipe to path.
+func (r *Recipe) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// loadRecipe reads a recipe written by a previous run.
+func loadRecipe(path string) (*Recipe, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("recipe: %w", err)
+	}
+	var r Recipe
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("recipe %s: %w", path, err)
+	}
+	if err := r.validate(); err != nil {
+		return nil, fmt.Errorf("recipe %s: %w", path, err)
+	}
+	return &r, nil
+}
+
+// validate checks a loaded recipe.
+func (r *Recipe) validate() error {
+	if r.Start.IsZero() || r.Flags == nil {
+		return errors.New("not a sensor-gen recipe")
+	}
+	if r.Config != nil {
+		if err := r.Config.validate(); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if r.Profile != nil {
+		if err := r.Profile.validate(); err != nil {
+			return fmt.Errorf("profile: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply sets every flag in fs that the recipe records and the command
+// line did not set.
+func (r *Recipe) apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range r.Flags {
+		if set[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("recipe: -%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// buildVersion identifies the binary: its module version, or the VCS
+// revision it was built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev, dirty string
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision":
+			rev = s.Value
+		case s.Key == "vcs.modified" && s.Value == "true":
+			dirty = "-dirty"
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	return rev + dirty
+}
+
+// nominalClock is a clock for Generator that stamps sample k at
+// start + k/rate, so timestamps depend only on the recipe and not on how
+// fast the host generated them.
+type nominalClock struct {
+	start    time.Time
+	k        int64
+	interval float64
+}
+
+func newNominalClock(start time.Time, rate int) *nominalClock {
+	return &nominalClock{start: start, interval: float64(time.Second) / float64(rate)}
+}
+
+func (c *nominalClock) next() time.Time {
+	t := c.start.Add(time.Duration(float64(c.k) * c.interval))
+	c.k++
+	return t
+}
+
+// setRate spaces the samples from the next one on at rate. A nil clock,
+// as live runs have, ignores it.
+func (c *nominalClock) setRate(rate int) {
+	if c == nil {
+		return
+	}
+	c.start = c.start.Add(time.Duration(float64(c.k) * c.interval))
+	c.k = 0
+	c.interval = float64(time.Second) / float64(rate)
+}
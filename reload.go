@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Reload applies the settings of cfg that can change mid-run to the
+// generator: noise, alert thresholds, the status chain, the type mix
+// (without a fleet; a fleet's composition is fixed), the rates of
+// background events, leaks and failures, and scheduled failures. Failures
+// scheduled before the latest sample are dropped rather than started late.
+// The rest of cfg is ignored. Call it between batches.
+func (g *Generator) Reload(cfg GeneratorConfig) {
+	g.noise = noiseByType(cfg.Noise)
+	g.alerts = alertsByType(cfg.Alerts)
+	if g.fleet == nil {
+		g.typeMix = nil
+		if cfg.TypeMix != nil {
+			g.typeMix = cumulative(cfg.TypeMix)
+		}
+	} else {
+		g.status = newStatusChain(cfg.Status)
+	}
+
+	if g.events != nil {
+		g.events.setRates(cfg.BackgroundEvents, cfg.Leaks/24, cfg.LeakImbalance)
+	} else if cfg.BackgroundEvents > 0 || cfg.Leaks > 0 {
+		g.events = newEventScheduler(cfg.BackgroundEvents, cfg.Leaks/24, cfg.LeakImbalance, g.routes)
+	}
+
+	if g.fleet == nil {
+		return
+	}
+	var schedule []FailureSpec
+	for _, f := range cfg.ScheduledFailures {
+		if g.epoch.Add(time.Duration(f.At)).After(g.last) {
+			schedule = append(schedule, f)
+		}
+	}
+	if g.failures == nil {
+		if g.failures = newFailureInjector(cfg.Failures, cfg.FailureModes, schedule, g.fleet); g.failures != nil {
+			g.failures.start = g.epoch
+		}
+		return
+	}
+	g.failures.perDay = cfg.Failures
+	g.failures.schedule = slices.SortedStableFunc(slices.Values(schedule), func(a, b FailureSpec) int { return cmp.Compare(a.At, b.At) })
+}
+
+// setRates changes the scheduler's event rates. Events already under way
+// run their course; the next of each kind is drawn again at the new rate.
+func (s *eventScheduler) setRates(perHour, leaksPerHour, leakImbalance float64) {
+	if perHour != s.perHour {
+		clear(s.next)
+	}
+	if leaksPerHour != s.leaksPerHour {
+		clear(s.nextLeak)
+	}
+	s.perHour, s.leaksPerHour, s.leakImbalance = perHour, leaksPerHour, leakImbalance
+}
+
+// checkReload checks that a configuration read again on SIGHUP only uses
+// what the run supports.
+func checkReload(c *Config, fleet bool, points []SensorPoint) error {
+	if !fleet {
+		a := c.Anomalies
+		if len(c.Failures) > 0 || len(c.Status) > 0 || (a != nil && ((a.Leaks != nil && *a.Leaks > 0) || (a.Failures != nil && *a.Failures > 0))) {
+			return errors.New("failures, leaks and a status chain require -fleet")
+		}
+	}
+	return checkFailureSensors(c.Failures, points)
+}
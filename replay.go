@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// replayBatch is the most records replay hands the sinks at once.
+const replayBatch = 1000
+
+// replayMain implements "sensor-gen replay": it reads a JSONL file of
+// readings, from an earlier run or real anonymized data, and writes it to
+// the sinks again. By default records go out with the spacing of their
+// timestamps; -retime moves the timestamps to the time of the replay.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	outputFile := fs.String("o", "output.jsonl", "Output file path")
+	appendMode := fs.Bool("append", false, "Append to existing file instead of overwriting")
+	var sinkURLs sinkList
+	fs.Var(&sinkURLs, "sink", "Output sink URL, e.g. s3://bucket/prefix; repeat to write to several sinks (default: write to the -o file)")
+	layoutFlags := fileLayoutFlags(fs)
+	retryFlags := sinkRetryFlags(fs)
+	bpFlags := backpressureFlags(fs)
+	speed := fs.Float64("speed", 1, "Replay speed relative to the records' timestamps, e.g. 10 for ten times faster (0 = as fast as possible)")
+	retime := fs.Bool("retime", false, "Shift timestamps (and ingested_at) so the first record is stamped now, keeping their spacing (scaled by -speed)")
+	cloudEvents := fs.String("cloudevents", "", "Wrap readings in CloudEvents 1.0 envelopes: structured, or binary (attributes as headers on HTTP and NATS sinks)")
+	ceSource := fs.String("ce-source", "/sensor-gen/{pipeline_id}", "CloudEvents source attribute; accepts {sensor_id}, {pipeline_id}, {type}, {unit} and {status}")
+	ceType := fs.String("ce-type", "io.sensorgen.reading", "CloudEvents type attribute; accepts the -ce-source placeholders")
+	runID := fs.String("run-id", "", "Send this run ID with every message on sinks with message metadata (default: none; records keep any run_id field they have)")
+	verbose := fs.Bool("v", false, "Verbose output with stats")
+	statsJSON := fs.String("stats-json", "", "Also write the final stats as JSON to this file (- = stderr)")
+	drainTimeout := fs.Duration("drain-timeout", shutdownTimeout, "On stopping (end of input, SIGINT or SIGTERM), how long to wait for sinks to write buffered and in-flight batches before dropping them")
+	maxErrors := fs.Int("max-errors", 0, "Abort once more than this many errors occur, unreadable lines included (-1 = never abort)")
+	setupLogs := logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sensor-gen replay [flags] FILE.jsonl[.gz]  (- reads standard input)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupLogs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *speed < 0 {
+		slog.Error("-speed must not be negative")
+		return 1
+	}
+	layout, err := layoutFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	retry, err := retryFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	bp, err := bpFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	ce, err := newCEWrapper(*cloudEvents, *ceSource, *ceType)
+	if err != nil {
+		slog.Error(fmt.Sprintf("-cloudevents: %v", err))
+		return 1
+	}
+	if *runID != "" {
+		if err := checkRunID(*runID); err != nil {
+			slog.Error(fmt.Sprintf("-run-id: %v", err))
+			return 1
+		}
+	}
+	in, err := openReadings("replay", fs.Arg(0))
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	defer in.Close()
+
+	sinks, sinkNames, err := openSinks(sinkURLs, *outputFile, *appendMode, layout, *runID)
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	target := strings.Join(sinkURLs, ", ")
+	if target == "" {
+		target = layout.describe(*outputFile, *appendMode)
+	}
+	pace := "as fast as possible"
+	if *speed > 0 {
+		pace = fmt.Sprintf("at %gx the original spacing", *speed)
+	}
+	slog.Info(fmt.Sprintf("Replaying %s to %s %s", fs.Arg(0), target, pace), "input", fs.Arg(0), "target", target, "speed", *speed)
+	slog.Info("Press Ctrl+C to stop...")
+
+	errs := newErrorBudget(*maxErrors)
+	out := newFanOut(sinks, sinkNames, errs, retry, bp)
+	r := &replayer{speed: *speed, retime: *retime, start: time.Now()}
+	var totalEntries, totalBytes int64
+	lastReport := r.start
+	var records []Record
+	flush := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		if err := out.Write(ctx, records); err != nil {
+			return err
+		}
+		totalEntries += int64(len(records))
+		records = records[:0]
+		if *verbose && time.Since(lastReport) >= 5*time.Second {
+			elapsed := time.Since(r.start).Seconds()
+			slog.Info(fmt.Sprintf("  %d entries written (%.0f/sec avg)", totalEntries, float64(totalEntries)/elapsed), "entries", totalEntries, "rate", float64(totalEntries)/elapsed)
+			lastReport = time.Now()
+		}
+		return errs.Err()
+	}
+
+	runErr := scanReadings(in, errs, func(reading *SensorReading, data []byte) error {
+		due, ok := r.due(reading)
+		if wait := time.Until(due); ok && wait > 0 {
+			// Hand over what is ready before waiting for the next record.
+			if err := flush(); err != nil {
+				return err
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if r.retime {
+			r.shift(reading)
+			var err error
+			if data, err = marshalReading(reading); err != nil {
+				if errs.Record(errClassMarshal, err) {
+					return errs.Err()
+				}
+				return nil
+			}
+		} else {
+			data = bytes.Clone(data)
+		}
+		records = append(records, Record{Reading: reading, Data: data})
+		if ce != nil {
+			ce.wrap(&records[len(records)-1])
+		}
+		totalBytes += int64(len(records[len(records)-1].Data) + 1)
+		if len(records) >= replayBatch {
+			return flush()
+		}
+		return nil
+	})
+	if runErr == nil {
+		runErr = flush()
+	} else {
+		runErr = fmt.Errorf("replay %s: %w", fs.Arg(0), runErr)
+	}
+
+	// Flush whatever is queued, bounded so a stuck sink cannot hang exit.
+	// Once a signal has stopped the replay, a second one exits at once.
+	stopped := ctx.Err() != nil
+	stop()
+	if stopped {
+		slog.Info(fmt.Sprintf("Stopping: flushing output (up to %v; signal again to quit now)", *drainTimeout), "drain_timeout", drainTimeout.String())
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	out.Close(drainCtx)
+	if drainCtx.Err() != nil {
+		slog.Warn(fmt.Sprintf("Drain deadline of %v reached; output not yet written was dropped", *drainTimeout), "drain_timeout", drainTimeout.String())
+	}
+
+	statsFile := ""
+	if len(sinkURLs) == 0 && layout.singleFile() {
+		statsFile = *outputFile
+	}
+	stats := newFinalStats(totalEntries, totalBytes, r.start, statsFile, sinkNames, errs)
+	stats.addDeliveries(out.Deliveries(), out.Health())
+	stats.RunID = *runID
+	stats.print(errs)
+	if *statsJSON != "" {
+		if err := stats.write(*statsJSON); err != nil {
+			slog.Error(fmt.Sprintf("-stats-json: %v", err))
+			return 1
+		}
+	}
+	if err := errs.Err(); err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	if runErr != nil && !stopped {
+		slog.Error(runErr.Error())
+		return 1
+	}
+	return 0
+}
+
+// openReadings opens a JSONL file of readings for the cmd subcommand, "-"
+// for standard input, and decompresses it if its name ends in .gz.
+func openReadings(cmd, path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cmd, err)
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s %s: %w", cmd, path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// scanReadings calls fn with each reading in a JSONL stream and the line
+// it was decoded from, which fn must copy to keep. Blank lines are
+// skipped; lines that are not readings are counted as parse errors, and
+// scanning stops once they exceed the error budget.
+func scanReadings(in io.Reader, errs *errorBudget, fn func(r *SensorReading, line []byte) error) error {
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		r := new(SensorReading)
+		if err := unmarshalReading(line, r); err != nil {
+			if errs.Record(errClassParse, fmt.Errorf("line %d: %w", n, err)) {
+				return errs.Err()
+			}
+			continue
+		}
+		if err := fn(r, line); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// replayer times replayed records from their timestamps, relative to the
+// first record: at speed s a record t after the first is due t/s after
+// the replay started.
+type replayer struct {
+	speed  float64
+	retime bool
+	start  time.Time // wall time the replay started
+	first  time.Time // timestamp of the first record
+}
+
+// due returns when reading should be written, and false if it should go
+// out straight away: when replaying as fast as possible, or when its
+// timestamp cannot be read.
+func (r *replayer) due(reading *SensorReading) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, reading.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if r.first.IsZero() {
+		r.first = t
+	}
+	if r.speed == 0 {
+		return time.Time{}, false
+	}
+	return r.start.Add(r.offset(t)), true
+}
+
+// offset returns how long after the start of the replay a record stamped
+// t is stamped with -retime: its distance from the first record, scaled
+// by the speed when pacing.
+func (r *replayer) offset(t time.Time) time.Duration {
+	d := t.Sub(r.first)
+	if r.speed > 0 {
+		d = time.Duration(float64(d) / r.speed)
+	}
+	return d
+}
+
+// shift restamps reading for -retime. Timestamps that cannot be read are
+// left alone.
+func (r *replayer) shift(reading *SensorReading) {
+	if r.first.IsZero() {
+		return
+	}
+	for _, ts := range []*string{&reading.Timestamp, &reading.IngestedAt} {
+		t, err := time.Parse(time.RFC3339Nano, *ts)
+		if err != nil {
+			continue
+		}
+		*ts = r.start.Add(r.offset(t)).UTC().Format(time.RFC3339Nano)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Sink failure policies: what becomes of a batch a sink still rejects once
+// its retries are used up.
+const (
+	onFailureDrop       = "drop"        // count it as a write error; its records are lost
+	onFailureBlock      = "block"       // retry until it is written, holding up generation
+	onFailureDeadLetter = "dead-letter" // append its records to a dead-letter file
+)
+
+// maxSinkBackoff caps the doubling wait between a sink's retries.
+const maxSinkBackoff = 30 * time.Second
+
+// rejectedError is returned by a sink that wrote a batch but refused some
+// of its records one by one, such as documents an index rejected. They
+// would be refused again, so the batch is not retried: the refused
+// records are counted as dropped and the error as a write error.
+type rejectedError struct {
+	records int
+	err     error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// sinkRetry is how the writers deal with batches their sink rejects:
+// retried up to retries times, waiting backoff before the first retry and
+// twice as long before each further one, then settled by the onFailure
+// policy, with a circuit breaker opening once breakerFailures writes have
+// failed within breakerWindow. The zero value tries once and drops,
+// without a breaker.
+type sinkRetry struct {
+	retries         int
+	backoff         time.Duration
+	onFailure       string
+	deadLetter      string // file for onFailureDeadLetter
+	breakerFailures int    // 0 = no breaker
+	breakerWindow   time.Duration
+	breakerProbe    time.Duration
+}
+
+// sinkRetryFlags defines the flags for sink retries, failure policy and
+// circuit breakers on fs. The returned function builds and checks them once fs is parsed.
+func sinkRetryFlags(fs *flag.FlagSet) func() (sinkRetry, error) {
+	retries := fs.Int("sink-retries", 0, "Retry a batch a sink rejects up to this many times, with exponential backoff, before -on-sink-failure applies")
+	backoff := fs.Duration("sink-backoff", 500*time.Millisecond, "Wait before a sink's first retry of a batch, doubling for each further retry up to 30s")
+	onFailure := fs.String("on-sink-failure", onFailureDrop, "What becomes of a batch a sink still rejects after its retries: drop (counted as a write error), block (retry until written, holding up generation) or dead-letter (append it to -dead-letter)")
+	breakerFailures := fs.Int("breaker-failures", 0, "Open a sink's circuit breaker once this many of its writes, retries included, fail within -breaker-window: its batches then go straight to -on-sink-failure (drop or dead-letter, block dropping too) until a probe succeeds (0 = no breaker)")
+	breakerWindow := fs.Duration("breaker-window", time.Minute, "Span within which -breaker-failures failed writes open the breaker; a failing sink also counts as ok again only once it has gone this long without failing")
+	breakerProbe := fs.Duration("breaker-probe", 30*time.Second, "While a sink's circuit breaker is open, time between probes letting one batch through to test for recovery")
+	deadLetter := fs.String("dead-letter", "", "With -on-sink-failure dead-letter, append the records of failed batches to this JSONL file, for sensor-gen replay (with several sinks, one file per sink: out-0.jsonl, out-1.jsonl, ...)")
+
+	return func() (sinkRetry, error) {
+		r := sinkRetry{retries: *retries, backoff: *backoff, onFailure: *onFailure, deadLetter: *deadLetter,
+			breakerFailures: *breakerFailures, breakerWindow: *breakerWindow, breakerProbe: *breakerProbe}
+		switch {
+		case r.breakerFailures < 0:
+			return r, errors.New("-breaker-failures must not be negative")
+		case r.breakerWindow <= 0 || r.breakerProbe <= 0:
+			return r, errors.New("-breaker-window and -breaker-probe must be positive")
+		case r.retries < 0:
+			return r, errors.New("-sink-retries must not be negative")
+		case r.backoff <= 0:
+			return r, errors.New("-sink-backoff must be positive")
+		case r.onFailure != onFailureDrop && r.onFailure != onFailureBlock && r.onFailure != onFailureDeadLetter:
+			return r, fmt.Errorf("-on-sink-failure: unknown policy %q (want %s, %s or %s)", r.onFailure, onFailureDrop, onFailureBlock, onFailureDeadLetter)
+		case r.onFailure == onFailureDeadLetter && r.deadLetter == "":
+			return r, errors.New("-on-sink-failure dead-letter needs -dead-letter")
+		case r.onFailure != onFailureDeadLetter && r.deadLetter != "":
+			return r, errors.New("-dead-letter needs -on-sink-failure dead-letter")
+		}
+		return r, nil
+	}
+}
+
+// deliveryStats counts the outcomes of a sink's batches, and the records
+// shed when it fell behind. It is safe for concurrent use.
+type deliveryStats struct {
+	retries      atomic.Int64
+	recovered    atomic.Int64
+	dropped      atomic.Int64
+	deadLettered atomic.Int64
+	shed         atomic.Int64
+}
+
+// deliveryCounts is a snapshot of deliveryStats, as the final stats and
+// /debug/vars report it.
+type deliveryCounts struct {
+	Retries      int64 `json:"retries,omitempty"`               // writes retried
+	Recovered    int64 `json:"recovered,omitempty"`             // batches written on a retry
+	Dropped      int64 `json:"dropped_records,omitempty"`       // records lost
+	DeadLettered int64 `json:"dead_lettered_records,omitempty"` // records appended to the dead-letter file
+	Shed         int64 `json:"shed_records,omitempty"`          // records left out with -backpressure drop
+}
+
+func (s *deliveryStats) counts() deliveryCounts {
+	return deliveryCounts{
+		Retries:      s.retries.Load(),
+		Recovered:    s.recovered.Load(),
+		Dropped:      s.dropped.Load(),
+		DeadLettered: s.deadLettered.Load(),
+		Shed:         s.shed.Load(),
+	}
+}
+
+// deadLetter appends the records of batches a sink failed to write to a
+// JSONL file, one line each as the sink would have received it. The file
+// is created on the first failure, so a run without any leaves none.
+type deadLetter struct {
+	path string
+	file *os.File
+	w    *bufio.Writer
+}
+
+func (d *deadLetter) write(batch []Record) error {
+	if d.file == nil {
+		f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("dead letter: %w", err)
+		}
+		d.file, d.w = f, bufio.NewWriterSize(f, 256*1024)
+	}
+	for _, rec := range batch {
+		d.w.Write(rec.Data)
+		d.w.WriteByte('\n')
+	}
+	if err := d.w.Flush(); err != nil {
+		return fmt.Errorf("dead letter: %w", err)
+	}
+	return nil
+}
+
+func (d *deadLetter) close() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+	if err := d.file.Close(); err != nil {
+		return fmt.Errorf("dead letter: %w", err)
+	}
+	return nil
+}
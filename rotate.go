@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rotateTimeFormat stamps rotated files with the time they were started.
+const rotateTimeFormat = "20060102T150405.000Z"
+
+// rotatingSink writes to a series of files named after path with the time
+// each was started, out-20240501T120000.000Z.jsonl, moving on to a new file
+// once the current one reaches the size or age limit.
+type rotatingSink struct {
+	base, ext string
+	maxSize   int64
+	maxAge    time.Duration
+	atomic    bool
+	disk      *diskCap // nil without -max-disk
+
+	cur     *fileSink
+	path    string
+	started time.Time
+	written int64
+}
+
+func newRotatingSink(path string, l fileLayout, disk *diskCap) *rotatingSink {
+	ext := filepath.Ext(path)
+	return &rotatingSink{
+		base:    strings.TrimSuffix(path, ext),
+		ext:     ext,
+		maxSize: l.rotateSize,
+		maxAge:  l.rotateEvery,
+		atomic:  l.atomic,
+		disk:    disk,
+	}
+}
+
+func (s *rotatingSink) Write(ctx context.Context, batch []Record) error {
+	for _, rec := range batch {
+		n := int64(len(rec.Data) + 1)
+		if s.cur == nil || s.due(n) {
+			if err := s.rotate(ctx); err != nil {
+				return err
+			}
+		}
+		s.cur.writer.Write(rec.Data)
+		s.cur.writer.WriteByte('\n')
+		s.written += n
+		if s.disk != nil {
+			s.disk.used += n
+		}
+	}
+	if err := s.cur.writer.Flush(); err != nil {
+		return err
+	}
+	if s.disk != nil {
+		return s.disk.prune()
+	}
+	return nil
+}
+
+// due reports whether the current file is full or old enough to rotate
+// before writing n more bytes.
+func (s *rotatingSink) due(n int64) bool {
+	if s.maxSize > 0 && s.written > 0 && s.written+n > s.maxSize {
+		return true
+	}
+	return s.maxAge > 0 && time.Since(s.started) >= s.maxAge
+}
+
+// rotate closes the current file and starts the next.
+func (s *rotatingSink) rotate(ctx context.Context) error {
+	if err := s.closeCurrent(ctx); err != nil {
+		return err
+	}
+	s.started = time.Now()
+	path := s.base + "-" + s.started.UTC().Format(rotateTimeFormat) + s.ext
+	for n := 2; ; n++ {
+		if !exists(path) && !exists(path+tmpSuffix) {
+			break
+		}
+		path = fmt.Sprintf("%s-%s-%d%s", s.base, s.started.UTC().Format(rotateTimeFormat), n, s.ext)
+	}
+	f, err := newFileSink(path, false, s.atomic)
+	if err != nil {
+		return err
+	}
+	s.cur, s.path, s.written = f, path, 0
+	return nil
+}
+
+// exists reports whether a file exists at path.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+func (s *rotatingSink) closeCurrent(ctx context.Context) error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close(ctx)
+	if s.disk != nil {
+		s.disk.done(s.path, s.written)
+	}
+	s.cur = nil
+	return err
+}
+
+func (s *rotatingSink) Close(ctx context.Context) error {
+	return s.closeCurrent(ctx)
+}
+
+// diskCap keeps the files of rotating sinks under a total size by deleting
+// the oldest finished files. Files left by earlier runs count too.
+type diskCap struct {
+	max      int64
+	used     int64 // bytes in finished and current files
+	finished []capFile
+}
+
+type capFile struct {
+	path string
+	size int64
+}
+
+// newDiskCap returns a cap of max bytes for rotating sinks writing after
+// paths, adopting the rotated files of those paths already on disk.
+func newDiskCap(max int64, paths []string) (*diskCap, error) {
+	c := &diskCap{max: max}
+	type found struct {
+		capFile
+		mod time.Time
+	}
+	var existing []found
+	for _, path := range paths {
+		ext := filepath.Ext(path)
+		pattern := strings.TrimSuffix(path, ext) + "-[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T*Z*" + ext
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			existing = append(existing, found{capFile{m, fi.Size()}, fi.ModTime()})
+		}
+	}
+	slices.SortFunc(existing, func(a, b found) int { return a.mod.Compare(b.mod) })
+	for _, f := range existing {
+		c.finished = append(c.finished, f.capFile)
+		c.used += f.size
+	}
+	return c, c.prune()
+}
+
+// done records a finished file, whose bytes are already counted in used.
+func (c *diskCap) done(path string, size int64) {
+	c.finished = append(c.finished, capFile{path, size})
+}
+
+// prune deletes the oldest finished files until the total fits the cap.
+// The files being written are never deleted.
+func (c *diskCap) prune() error {
+	for c.used > c.max && len(c.finished) > 0 {
+		f := c.finished[0]
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("pruning: %w", err)
+		}
+		c.finished = c.finished[1:]
+		c.used -= f.size
+	}
+	return nil
+}
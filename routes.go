@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+)
+
+// pipelineLength is the span of mile posts sensors are placed along on a
+// pipeline without a route.
+const pipelineLength = 500
+
+// route is a pipeline's path: a polyline of lon/lat points and the
+// distance along it, in miles, to each point.
+type route struct {
+	points [][2]float64 // lon, lat
+	miles  []float64
+}
+
+// routeSet maps pipeline IDs to their routes. Pipelines without one keep
+// sensors scattered over the region; a nil set has no routes.
+type routeSet map[string]*route
+
+// length returns the length of pipeline in miles.
+func (rs routeSet) length(pipeline string) float64 {
+	if r := rs[pipeline]; r != nil {
+		return r.miles[len(r.miles)-1]
+	}
+	return pipelineLength
+}
+
+// place returns a random location on pipeline: a point on its route, or
+// without one a point scattered over the region with an unrelated mile
+// post.
+func (rs routeSet) place(pipeline string, rng *rand.Rand) Location {
+	r := rs[pipeline]
+	if r == nil {
+		return Location{
+			Lat:      25.0 + rng.Float64()*20, // Roughly US oil/gas regions
+			Lon:      -105.0 + rng.Float64()*15,
+			MilePost: rng.Float64() * pipelineLength,
+		}
+	}
+	mp := rng.Float64() * r.miles[len(r.miles)-1]
+	lon, lat := r.at(mp)
+	return Location{Lat: lat, Lon: lon, MilePost: mp}
+}
+
+// placeAt returns the location of mile post mp on pipeline: a point on
+// its route, or without one a point scattered over the region.
+func (rs routeSet) placeAt(pipeline string, mp float64, rng *rand.Rand) Location {
+	r := rs[pipeline]
+	if r == nil {
+		return Location{Lat: 25.0 + rng.Float64()*20, Lon: -105.0 + rng.Float64()*15, MilePost: mp}
+	}
+	lon, lat := r.at(mp)
+	return Location{Lat: lat, Lon: lon, MilePost: mp}
+}
+
+// at returns the point mp miles along the route.
+func (r *route) at(mp float64) (lon, lat float64) {
+	i := sort.SearchFloat64s(r.miles, mp)
+	if i == 0 {
+		return r.points[0][0], r.points[0][1]
+	}
+	if i == len(r.miles) {
+		p := r.points[len(r.points)-1]
+		return p[0], p[1]
+	}
+	a, b := r.points[i-1], r.points[i]
+	f := (mp - r.miles[i-1]) / (r.miles[i] - r.miles[i-1])
+	return a[0] + f*(b[0]-a[0]), a[1] + f*(b[1]-a[1])
+}
+
+// newRoute measures a polyline of lon/lat points.
+func newRoute(points [][2]float64) (*route, error) {
+	if len(points) < 2 {
+		return nil, fmt.Errorf("a route needs at least two points")
+	}
+	r := &route{points: points, miles: make([]float64, len(points))}
+	for i := 1; i < len(points); i++ {
+		r.miles[i] = r.miles[i-1] + haversineMiles(points[i-1], points[i])
+	}
+	if r.miles[len(r.miles)-1] == 0 {
+		return nil, fmt.Errorf("route has zero length")
+	}
+	return r, nil
+}
+
+// haversineMiles returns the great-circle distance between two lon/lat
+// points.
+func haversineMiles(a, b [2]float64) float64 {
+	const earthRadius = 3958.8 // miles
+	rad := math.Pi / 180
+	dLat := (b[1] - a[1]) * rad
+	dLon := (b[0] - a[0]) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a[1]*rad)*math.Cos(b[1]*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// geoJSON is the subset of GeoJSON that route files use.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Properties  map[string]any  `json:"properties"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// loadRoutes reads pipeline routes from a GeoJSON file: a
+// FeatureCollection of LineString or MultiLineString features, a single
+// such feature, or a bare geometry. A feature's "pipeline_id" property
+// names its pipeline; features without one take the pipelines in order.
+// A MultiLineString's parts are joined end to end.
+func loadRoutes(path string) (routeSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("routes: %w", err)
+	}
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("routes %s: %w", path, err)
+	}
+	features := []geoJSON{doc}
+	switch doc.Type {
+	case "FeatureCollection":
+		features = doc.Features
+	case "Feature", "LineString", "MultiLineString":
+	default:
+		return nil, fmt.Errorf("routes %s: unsupported GeoJSON type %q", path, doc.Type)
+	}
+	rs := make(routeSet)
+	next := 0 // next pipeline for features that do not name one
+	for i, f := range features {
+		geom := &f
+		if f.Type == "Feature" {
+			if f.Geometry == nil {
+				return nil, fmt.Errorf("routes %s: feature %d has no geometry", path, i)
+			}
+			geom = f.Geometry
+		}
+		points, err := lineCoordinates(geom)
+		if err != nil {
+			return nil, fmt.Errorf("routes %s: feature %d: %w", path, i, err)
+		}
+		r, err := newRoute(points)
+		if err != nil {
+			return nil, fmt.Errorf("routes %s: feature %d: %w", path, i, err)
+		}
+		id, _ := f.Properties["pipeline_id"].(string)
+		if id == "" {
+			for next < len(pipelineIDs) && rs[pipelineIDs[next]] != nil {
+				next++
+			}
+			if next == len(pipelineIDs) {
+				return nil, fmt.Errorf("routes %s: more routes than the %d pipelines", path, len(pipelineIDs))
+			}
+			id = pipelineIDs[next]
+		} else if !slices.Contains(pipelineIDs, id) {
+			return nil, fmt.Errorf("routes %s: feature %d: unknown pipeline %q", path, i, id)
+		}
+		if rs[id] != nil {
+			return nil, fmt.Errorf("routes %s: pipeline %s has two routes", path, id)
+		}
+		rs[id] = r
+	}
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("routes %s: no routes", path)
+	}
+	return rs, nil
+}
+
+// lineCoordinates returns the points of a LineString, or of a
+// MultiLineString's parts joined in order.
+func lineCoordinates(g *geoJSON) ([][2]float64, error) {
+	var lines [][][]float64
+	switch g.Type {
+	case "LineString":
+		var line [][]float64
+		if err := json.Unmarshal(g.Coordinates, &line); err != nil {
+			return nil, err
+		}
+		lines = [][][]float64{line}
+	case "MultiLineString":
+		if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("geometry is %q, not a LineString", g.Type)
+	}
+	var points [][2]float64
+	for _, line := range lines {
+		for _, p := range line {
+			if len(p) < 2 {
+				return nil, fmt.Errorf("position with fewer than two coordinates")
+			}
+			pt := [2]float64{p[0], p[1]}
+			if len(points) > 0 && points[len(points)-1] == pt {
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+	return points, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// runIDHeader carries the run ID on sinks with message headers.
+const runIDHeader = "Sensor-Gen-Run-Id"
+
+// newRunID returns a random run ID in the form of a version 4 UUID. It
+// comes from the system's random source rather than the seed, so runs
+// with the same seed are still told apart.
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// checkRunID checks that id can go in message headers and attributes.
+func checkRunID(id string) error {
+	if id == "" || len(id) > 128 {
+		return fmt.Errorf("run ID must be 1-128 characters")
+	}
+	if i := strings.IndexFunc(id, func(c rune) bool { return c < 0x20 || c >= 0x7f }); i >= 0 {
+		return fmt.Errorf("run ID %q: only printable ASCII allowed", id)
+	}
+	return nil
+}
+
+// setRunID passes the run ID to a sink through its URL as the run-id
+// option, which sinks with message metadata send with every message. A
+// run-id option in the URL itself takes precedence, and an empty one
+// leaves the run ID out.
+func setRunID(u *url.URL, id string) {
+	q := u.Query()
+	if id == "" || q.Has("run-id") {
+		return
+	}
+	q.Set("run-id", id)
+	u.RawQuery = q.Encode()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Kinds of low-level background event.
+const (
+	eventPressureExcursion = "pressure_excursion"
+	eventCommsHiccup       = "comms_hiccup"
+	eventLeak              = "leak"
+)
+
+// backgroundEvent is a minor, short-lived disturbance on one pipeline: the
+// everyday noise of real operations rather than an incident.
+type backgroundEvent struct {
+	kind     string
+	pipeline string
+	start    time.Time
+	end      time.Time
+	peak     float64 // excursion peak as a signed fraction of the pressure range; leak loss as a fraction of throughput
+	milePost float64 // leak location
+}
+
+// eventScheduler starts background events on each pipeline as a Poisson
+// process with perHour events per pipeline per hour, and leaks as a
+// separate Poisson process with leaksPerHour.
+type eventScheduler struct {
+	perHour       float64
+	leaksPerHour  float64
+	leakImbalance float64
+	routes        routeSet             // for pipeline lengths
+	next          map[string]time.Time // next background event start per pipeline
+	nextLeak      map[string]time.Time // next leak start per pipeline
+	active        []backgroundEvent
+}
+
+func newEventScheduler(perHour, leaksPerHour, leakImbalance float64, routes routeSet) *eventScheduler {
+	return &eventScheduler{
+		perHour:       perHour,
+		leaksPerHour:  leaksPerHour,
+		leakImbalance: leakImbalance,
+		routes:        routes,
+		next:          make(map[string]time.Time),
+		nextLeak:      make(map[string]time.Time),
+	}
+}
+
+// advance starts events that are due at now and retires finished ones,
+// returning the retired events.
+func (s *eventScheduler) advance(now time.Time, rng *rand.Rand) []backgroundEvent {
+	var ended []backgroundEvent
+	kept := s.active[:0]
+	for _, ev := range s.active {
+		if now.Before(ev.end) {
+			kept = append(kept, ev)
+		} else {
+			ended = append(ended, ev)
+		}
+	}
+	s.active = kept
+
+	if s.leaksPerHour > 0 {
+		s.startLeaks(now, rng)
+	}
+	if s.perHour <= 0 {
+		return ended
+	}
+	for _, p := range pipelineIDs {
+		next, ok := s.next[p]
+		if !ok {
+			s.next[p] = now.Add(interarrival(s.perHour, rng))
+			continue
+		}
+		if now.Before(next) {
+			continue
+		}
+		ev := backgroundEvent{pipeline: p, start: now}
+		if rng.Float64() < 0.7 {
+			ev.kind = eventPressureExcursion
+			ev.end = now.Add(30*time.Second + time.Duration(rng.Int63n(int64(150*time.Second))))
+			ev.peak = 0.02 + rng.Float64()*0.04
+			if rng.Intn(2) == 0 {
+				ev.peak = -ev.peak
+			}
+		} else {
+			ev.kind = eventCommsHiccup
+			ev.end = now.Add(2*time.Second + time.Duration(rng.Int63n(int64(13*time.Second))))
+		}
+		s.active = append(s.active, ev)
+		s.next[p] = now.Add(interarrival(s.perHour, rng))
+	}
+	return ended
+}
+
+// startLeaks starts leaks that are due at now. A leak lasts 15-90 minutes
+// at a random mile post, losing up to leakImbalance of the throughput.
+func (s *eventScheduler) startLeaks(now time.Time, rng *rand.Rand) {
+	for _, p := range pipelineIDs {
+		next, ok := s.nextLeak[p]
+		if !ok {
+			s.nextLeak[p] = now.Add(interarrival(s.leaksPerHour, rng))
+			continue
+		}
+		if now.Before(next) {
+			continue
+		}
+		s.active = append(s.active, backgroundEvent{
+			kind:     eventLeak,
+			pipeline: p,
+			start:    now,
+			end:      now.Add(15*time.Minute + time.Duration(rng.Int63n(int64(75*time.Minute)))),
+			peak:     s.leakImbalance * (0.5 + rng.Float64()*0.5),
+			milePost: rng.Float64() * s.routes.length(p),
+		})
+		s.nextLeak[p] = now.Add(interarrival(s.leaksPerHour, rng))
+	}
+}
+
+// interarrival draws an exponentially distributed gap between events of a
+// Poisson process with perHour events per hour.
+func interarrival(perHour float64, rng *rand.Rand) time.Duration {
+	return time.Duration(rng.ExpFloat64() / perHour * float64(time.Hour))
+}
+
+// silenced reports whether pipeline is in a comms hiccup at now.
+func (s *eventScheduler) silenced(pipeline string, now time.Time) bool {
+	for _, ev := range s.active {
+		if ev.kind == eventCommsHiccup && ev.pipeline == pipeline && !now.Before(ev.start) {
+			return true
+		}
+	}
+	return false
+}
+
+// excursion returns the pressure offset on pipeline at now, as a fraction
+// of the pressure range. Excursions rise and fall smoothly (half sine).
+func (s *eventScheduler) excursion(pipeline string, now time.Time) float64 {
+	offset := 0.0
+	for _, ev := range s.active {
+		if ev.kind != eventPressureExcursion || ev.pipeline != pipeline || now.Before(ev.start) {
+			continue
+		}
+		phase := float64(now.Sub(ev.start)) / float64(ev.end.Sub(ev.start))
+		offset += ev.peak * math.Sin(math.Pi*phase)
+	}
+	return offset
+}
+
+// A leak's effects spread from it as a pressure wave, at roughly the
+// speed of sound in a liquid-filled line. Its pressure drop fades with
+// distance from the leak; the lost flow does not, as everything
+// downstream carries the same reduced throughput.
+const (
+	leakWaveSpeed    = 0.6 // mile posts per second
+	leakDecay        = 50  // mile posts over which the pressure drop falls by 1/e
+	leakPressureDrop = 1.5 // pressure drop at the leak, as a fraction of the pressure range per unit of throughput lost
+)
+
+// leakOpening returns how far ev has developed at milePost at now, from 0
+// to 1: nothing until the wave from the leak arrives, then rising over two
+// minutes as the leak opens.
+func leakOpening(ev backgroundEvent, milePost float64, now time.Time) float64 {
+	travel := time.Duration(math.Abs(milePost-ev.milePost) / leakWaveSpeed * float64(time.Second))
+	arrived := now.Sub(ev.start.Add(travel))
+	if arrived < 0 {
+		return 0
+	}
+	return min(1, arrived.Minutes()/2)
+}
+
+// leakLoss returns the fraction of pipeline throughput lost upstream of
+// milePost at now.
+func (s *eventScheduler) leakLoss(pipeline string, milePost float64, now time.Time) float64 {
+	loss := 0.0
+	for _, ev := range s.active {
+		if ev.kind != eventLeak || ev.pipeline != pipeline || ev.milePost >= milePost || now.Before(ev.start) {
+			continue
+		}
+		loss += ev.peak * leakOpening(ev, milePost, now)
+	}
+	return loss
+}
+
+// leakPressure returns the pressure drop leaks cause at milePost on
+// pipeline at now, as a fraction of the pressure range. Sensors nearest
+// a leak see it first and most strongly.
+func (s *eventScheduler) leakPressure(pipeline string, milePost float64, now time.Time) float64 {
+	drop := 0.0
+	for _, ev := range s.active {
+		if ev.kind != eventLeak || ev.pipeline != pipeline || now.Before(ev.start) {
+			continue
+		}
+		d := math.Abs(milePost - ev.milePost)
+		drop += ev.peak * leakPressureDrop * math.Exp(-d/leakDecay) * leakOpening(ev, milePost, now)
+	}
+	return drop
+}
+
+// Anomaly is a disturbance in progress: a background event, a leak, a
+// pump trip or a sensor failure.
+type Anomaly struct {
+	Kind    string // event kind, or failure_<mode>
+	Subject string // pipeline ID for events, station ID for pump trips, sensor ID for failures
+	Detail  string
+}
+
+// Anomalies returns the events, pump trips and sensor failures in
+// progress at the latest sample, in that order.
+func (g *Generator) Anomalies() []Anomaly {
+	var as []Anomaly
+	if g.events != nil {
+		for _, ev := range g.events.active {
+			a := Anomaly{Kind: ev.kind, Subject: ev.pipeline}
+			switch ev.kind {
+			case eventPressureExcursion:
+				a.Detail = fmt.Sprintf("%+.1f%% of pressure range until %s", ev.peak*100, ev.end.UTC().Format(time.TimeOnly))
+			case eventCommsHiccup:
+				a.Detail = "silent until " + ev.end.UTC().Format(time.TimeOnly)
+			case eventLeak:
+				a.Detail = fmt.Sprintf("at mile %.1f, losing up to %.1f%% of throughput", ev.milePost, ev.peak*100)
+			}
+			as = append(as, a)
+		}
+	}
+	if g.fleet != nil {
+		for _, st := range g.fleet.stations {
+			if !st.running {
+				as = append(as, Anomaly{Kind: eventPumpTrip, Subject: st.ID, Detail: "restarting at " + st.tripEnd.UTC().Format(time.TimeOnly)})
+			}
+		}
+		if g.gateways != nil {
+			for _, gw := range g.gateways.gateways {
+				if gw.down(g.last) {
+					as = append(as, Anomaly{Kind: eventGatewayOutage, Subject: gw.ID, Detail: fmt.Sprintf("buffering %d readings until %s", len(gw.buffer), gw.outageEnd.UTC().Format(time.TimeOnly))})
+				}
+			}
+		}
+		for _, s := range g.fleet.sensors {
+			f := s.failure
+			if f == nil || !f.end.IsZero() && !g.last.Before(f.end) {
+				continue
+			}
+			a := Anomaly{Kind: "failure_" + f.mode, Subject: s.ID, Detail: "for the rest of the run"}
+			if !f.end.IsZero() {
+				a.Detail = "until " + f.end.UTC().Format(time.TimeOnly)
+			}
+			as = append(as, a)
+		}
+	}
+	return as
+}
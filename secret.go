@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// secret is a sink credential kept out of the sink's URL, and so out of
+// process listings and logs: read from a file named by a URL option, or
+// taken from an environment variable. A file is read again once its
+// contents are a minute old, so a long run picks up tokens rotated on
+// disk, such as Kubernetes service account tokens or an OAuth token a
+// sidecar refreshes.
+type secret struct {
+	option string
+	path   string
+	value  string
+	read   time.Time
+}
+
+// newSecret returns the secret in the file named by option, or else in the
+// environment variable env; nil if neither is set.
+func newSecret(q url.Values, option, env string) (*secret, error) {
+	if path := q.Get(option); path != "" {
+		s := &secret{option: option, path: path}
+		if _, err := s.get(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if v := os.Getenv(env); v != "" {
+		return &secret{value: v}, nil
+	}
+	return nil, nil
+}
+
+// get returns the secret, reading its file again if it is due.
+func (s *secret) get() (string, error) {
+	if s.path != "" && time.Since(s.read) >= time.Minute {
+		b, err := os.ReadFile(s.path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", s.option, err)
+		}
+		s.value, s.read = strings.TrimSpace(string(b)), time.Now()
+	}
+	return s.value, nil
+}
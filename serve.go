@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// hub is the sink used by serve mode. It fans each generated batch out to
+// the subscribers of every server it runs (WebSocket clients, gRPC
+// streams, the OPC UA address space). A subscriber that falls behind loses whole batches rather than
+// slowing generation for everyone else.
+type hub struct {
+	wg sync.WaitGroup // one per subscriber still streaming
+
+	mu      sync.Mutex
+	subs    map[*subscriber]struct{}
+	servers []*http.Server
+	closers []io.Closer // non-HTTP servers, closed once subscribers are done
+	closed  bool
+}
+
+// subscriber is one connected client of a hub.
+type subscriber struct {
+	addr    string
+	filter  readingFilter
+	send    chan []Record
+	dropped int64  // batches dropped because the client was slow; guarded by hub.mu
+	abort   func() // cuts the connection once the shutdown deadline passes; may be nil
+}
+
+// readingFilter selects readings by pipeline and sensor type; a nil set
+// matches everything.
+type readingFilter struct {
+	pipelines map[string]bool
+	types     map[string]bool
+}
+
+func (f readingFilter) match(r *SensorReading) bool {
+	return (f.pipelines == nil || f.pipelines[r.PipelineID]) && (f.types == nil || f.types[r.Type])
+}
+
+func newHub() *hub {
+	return &hub{subs: make(map[*subscriber]struct{})}
+}
+
+// listen starts serving handler on addr. Listening happens up front so a
+// busy port is reported before generation starts.
+func (h *hub) listen(addr string, srv *http.Server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	h.servers = append(h.servers, srv)
+	go srv.Serve(ln)
+	return nil
+}
+
+// subscribe registers a subscriber, returning false once the hub is
+// closing. The caller streams from sub.send and calls h.wg.Done when done.
+func (h *hub) subscribe(sub *subscriber, desc string) bool {
+	if !h.register(sub) {
+		return false
+	}
+	slog.Info(fmt.Sprintf("Client connected: %s %s", sub.addr, desc), "client", sub.addr)
+	return true
+}
+
+// register is subscribe without the announcement, for subscribers that
+// are part of a server rather than a client connection.
+func (h *hub) register(sub *subscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	sub.send = make(chan []Record, 16)
+	h.subs[sub] = struct{}{}
+	h.wg.Add(1)
+	return true
+}
+
+// unsubscribe stops sending to sub. It is safe to call more than once.
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; !ok {
+		return
+	}
+	delete(h.subs, sub)
+	close(sub.send)
+	if sub.dropped > 0 {
+		slog.Info(fmt.Sprintf("Client disconnected: %s (%d batches dropped)", sub.addr, sub.dropped), "client", sub.addr, "dropped", sub.dropped)
+	} else {
+		slog.Info(fmt.Sprintf("Client disconnected: %s", sub.addr), "client", sub.addr)
+	}
+}
+
+func (h *hub) Write(ctx context.Context, batch []Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return nil
+	}
+	// The batch buffer is reused once Write returns; the records it points
+	// to are not.
+	shared := append([]Record(nil), batch...)
+	for sub := range h.subs {
+		select {
+		case sub.send <- shared:
+		default:
+			sub.dropped++
+		}
+	}
+	return nil
+}
+
+// Close ends every subscription, waiting for queued batches to be sent
+// until ctx is done; then connections still catching up are cut.
+func (h *hub) Close(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	var aborts []func()
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.send)
+		if sub.abort != nil {
+			aborts = append(aborts, sub.abort)
+		}
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, abort := range aborts {
+			abort()
+		}
+		for _, srv := range h.servers {
+			srv.Close()
+		}
+		<-done
+		err = ctx.Err()
+	}
+	for _, srv := range h.servers {
+		srv.Shutdown(ctx)
+	}
+	for _, c := range h.closers {
+		c.Close()
+	}
+	return err
+}
+
+// filterSet builds a set from comma-separated or repeated values; nil
+// means no filter.
+func filterSet(values []string) map[string]bool {
+	var set map[string]bool
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				if set == nil {
+					set = make(map[string]bool)
+				}
+				set[item] = true
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoAP message types and codes (RFC 7252), as class<<5 | detail.
+const (
+	coapCON = 0
+	coapNON = 1
+	coapACK = 2
+	coapRST = 3
+
+	coapGET                = 0x01
+	coapContent            = 0x45 // 2.05
+	coapBadOption          = 0x82 // 4.02
+	coapNotFound           = 0x84 // 4.04
+	coapMethodNotAllowed   = 0x85 // 4.05
+	coapNotAcceptable      = 0x86 // 4.06
+	coapServiceUnavailable = 0xA3 // 5.03
+)
+
+// CoAP option numbers.
+const (
+	coapOptObserve       = 6
+	coapOptURIPath       = 11
+	coapOptContentFormat = 12
+	coapOptURIQuery      = 15
+	coapOptAccept        = 17
+	coapOptBlock2        = 23
+	coapOptSize2         = 28
+)
+
+// Content formats.
+const (
+	coapFormatLinks = 40 // application/link-format
+	coapFormatJSON  = 50
+)
+
+const (
+	coapExchangeLifetime = 247 * time.Second // how long CON requests are deduplicated
+	coapMaxObservers     = 10000
+	coapConfirmEvery     = 20               // every n-th notification is confirmable, to detect departed observers
+	coapAckTimeout       = 10 * time.Second // how long a confirmable notification may go unacknowledged
+)
+
+// serveCoAP adds a CoAP server (UDP) on addr to h. Clients GET or observe
+// (RFC 7641):
+//
+//	/readings          every reading as it is generated, filtered with
+//	                   ?pipeline=...&type=... query options
+//	/sensors/<id>      a fleet sensor's latest reading
+//	/.well-known/core  the resource directory in link format
+//
+// Representations are JSON, one reading per message. Notifications are
+// non-confirmable, with every 20th confirmable: an observer that leaves
+// one unacknowledged for 10s, or that answers with a reset, is dropped.
+func serveCoAP(h *hub, addr string, points []SensorPoint) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	s := &coapServer{
+		conn:      conn,
+		points:    points,
+		latest:    make(map[string][]byte, len(points)),
+		observers: make(map[string]*coapObserver),
+		bySensor:  make(map[string][]*coapObserver),
+		dedup:     make(map[string]coapCached),
+	}
+	for _, p := range points {
+		s.latest[p.ID] = nil
+	}
+	sub := &subscriber{addr: "coap"}
+	if !h.register(sub) {
+		conn.Close()
+		return fmt.Errorf("serve: hub closed")
+	}
+	h.closers = append(h.closers, s)
+	go s.update(h, sub)
+	go s.readLoop()
+	return nil
+}
+
+// coapServer is the CoAP server. One mutex guards observers and state;
+// handling a request or a batch only formats and sends datagrams.
+type coapServer struct {
+	conn   net.PacketConn
+	points []SensorPoint
+
+	mu        sync.Mutex
+	latest    map[string][]byte        // JSON of each fleet sensor's latest reading; nil until it reports
+	observers map[string]*coapObserver // by address and token
+	bySensor  map[string][]*coapObserver
+	stream    []*coapObserver // observers of /readings
+	dedup     map[string]coapCached
+	lastSweep time.Time
+	nextID    uint16
+}
+
+// coapObserver is one observation: a client endpoint and token watching a
+// resource.
+type coapObserver struct {
+	key     string
+	addr    net.Addr
+	token   []byte
+	path    string
+	sensor  string        // for /sensors/<id>
+	filter  readingFilter // for /readings
+	seq     uint32
+	sent    int
+	recent  [8]uint16 // message IDs of the latest notifications, for matching resets
+	pending bool      // a confirmable notification awaits its ACK
+	conID   uint16
+	conSent time.Time
+}
+
+// coapCached is the response to a confirmable request, resent if the
+// request is retransmitted.
+type coapCached struct {
+	resp    []byte
+	expires time.Time
+}
+
+// coapMessage is a parsed CoAP message. Options are kept in order.
+type coapMessage struct {
+	typ     byte
+	code    byte
+	id      uint16
+	token   []byte
+	opts    []coapOption
+	payload []byte
+}
+
+type coapOption struct {
+	num   uint16
+	value []byte
+}
+
+var errCoAPFormat = errors.New("malformed CoAP message")
+
+func parseCoAP(b []byte) (*coapMessage, error) {
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return nil, errCoAPFormat
+	}
+	m := &coapMessage{typ: b[0] >> 4 & 3, code: b[1], id: binary.BigEndian.Uint16(b[2:])}
+	tkl := int(b[0] & 0x0F)
+	if tkl > 8 || len(b) < 4+tkl {
+		return nil, errCoAPFormat
+	}
+	m.token = b[4 : 4+tkl]
+	b = b[4+tkl:]
+	var num uint16
+	for len(b) > 0 {
+		if b[0] == 0xFF {
+			if len(b) == 1 {
+				return nil, errCoAPFormat
+			}
+			m.payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+		var ok bool
+		if delta, b, ok = coapExtended(delta, b); !ok {
+			return nil, errCoAPFormat
+		}
+		if length, b, ok = coapExtended(length, b); !ok || length > len(b) {
+			return nil, errCoAPFormat
+		}
+		num += uint16(delta)
+		m.opts = append(m.opts, coapOption{num, b[:length]})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+// coapExtended decodes an option delta or length nibble and its extension
+// bytes.
+func coapExtended(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, nil, false
+	}
+	return v, b, true
+}
+
+func (m *coapMessage) marshal() []byte {
+	b := make([]byte, 4, 4+len(m.token)+16+len(m.payload))
+	b[0] = 1<<6 | m.typ<<4 | byte(len(m.token))
+	b[1] = m.code
+	binary.BigEndian.PutUint16(b[2:], m.id)
+	b = append(b, m.token...)
+	slices.SortStableFunc(m.opts, func(a, b coapOption) int { return int(a.num) - int(b.num) })
+	var prev uint16
+	for _, o := range m.opts {
+		delta, length := int(o.num-prev), len(o.value)
+		prev = o.num
+		i := len(b)
+		b = append(b, 0)
+		var dn, ln byte
+		b, dn = coapAppendExtended(b, delta)
+		b, ln = coapAppendExtended(b, length)
+		// The length extension follows the delta extension.
+		b[i] = dn<<4 | ln
+		b = append(b, o.value...)
+	}
+	if len(m.payload) > 0 {
+		b = append(b, 0xFF)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+func coapAppendExtended(b []byte, v int) ([]byte, byte) {
+	switch {
+	case v < 13:
+		return b, byte(v)
+	case v < 269:
+		return append(b, byte(v-13)), 13
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(v-269)), 14
+}
+
+// option returns the first value of option num.
+func (m *coapMessage) option(num uint16) ([]byte, bool) {
+	for _, o := range m.opts {
+		if o.num == num {
+			return o.value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *coapMessage) strings(num uint16) []string {
+	var out []string
+	for _, o := range m.opts {
+		if o.num == num {
+			out = append(out, string(o.value))
+		}
+	}
+	return out
+}
+
+func (m *coapMessage) addUint(num uint16, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	i := 0
+	for i < 4 && b[i] == 0 {
+		i++
+	}
+	m.opts = append(m.opts, coapOption{num, slices.Clone(b[i:])})
+}
+
+func coapUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func (s *coapServer) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		m, err := parseCoAP(buf[:n])
+		if err != nil {
+			continue // silently ignored, as RFC 7252 section 4.2 allows
+		}
+		s.mu.Lock()
+		s.handle(m, addr)
+		s.mu.Unlock()
+	}
+}
+
+// handle processes one message. Called with mu held.
+func (s *coapServer) handle(m *coapMessage, addr net.Addr) {
+	now := time.Now()
+	if now.Sub(s.lastSweep) > 10*time.Second {
+		for k, c := range s.dedup {
+			if now.After(c.expires) {
+				delete(s.dedup, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	switch m.typ {
+	case coapACK, coapRST:
+		s.acknowledged(m, addr)
+		return
+	}
+	if m.code == 0 {
+		// Empty CON is a ping, answered with a reset.
+		if m.typ == coapCON {
+			s.send(&coapMessage{typ: coapRST, id: m.id}, addr)
+		}
+		return
+	}
+	if m.code>>5 != 0 {
+		return // a response; we send no requests
+	}
+	dedupKey := addr.String() + "/" + strconv.Itoa(int(m.id))
+	if m.typ == coapCON {
+		if c, ok := s.dedup[dedupKey]; ok {
+			s.conn.WriteTo(c.resp, addr)
+			return
+		}
+	}
+
+	resp := s.respond(m, addr)
+	if m.typ == coapCON {
+		resp.typ, resp.id = coapACK, m.id
+	} else {
+		resp.typ, resp.id = coapNON, s.messageID()
+	}
+	b := resp.marshal()
+	if m.typ == coapCON {
+		s.dedup[dedupKey] = coapCached{resp: b, expires: now.Add(coapExchangeLifetime)}
+	}
+	s.conn.WriteTo(b, addr)
+}
+
+// respond answers request m from addr.
+func (s *coapServer) respond(m *coapMessage, addr net.Addr) *coapMessage {
+	resp := &coapMessage{token: m.token}
+	fail := func(code byte, diag string) *coapMessage {
+		resp.code, resp.payload = code, []byte(diag)
+		return resp
+	}
+	for _, o := range m.opts {
+		switch o.num {
+		case coapOptObserve, coapOptURIPath, coapOptURIQuery, coapOptAccept, coapOptBlock2, coapOptSize2:
+		default:
+			if o.num&1 == 1 { // critical
+				return fail(coapBadOption, fmt.Sprintf("unsupported critical option %d", o.num))
+			}
+		}
+	}
+	if m.code != coapGET {
+		return fail(coapMethodNotAllowed, "only GET is supported")
+	}
+	path := strings.Join(m.strings(coapOptURIPath), "/")
+	format := uint32(coapFormatJSON)
+	if path == ".well-known/core" {
+		format = coapFormatLinks
+	}
+	if accept, ok := m.option(coapOptAccept); ok && coapUint(accept) != format {
+		return fail(coapNotAcceptable, "")
+	}
+
+	var payload []byte
+	var sensor string
+	switch {
+	case path == ".well-known/core":
+		return s.block(m, resp, s.links())
+	case path == "readings":
+	case strings.HasPrefix(path, "sensors/"):
+		sensor = strings.TrimPrefix(path, "sensors/")
+		latest, ok := s.latest[sensor]
+		if !ok {
+			return fail(coapNotFound, "")
+		}
+		payload = latest
+		if payload == nil {
+			payload = []byte("null")
+		}
+	default:
+		return fail(coapNotFound, "")
+	}
+
+	key := addr.String() + "/" + string(m.token)
+	if obs, ok := m.option(coapOptObserve); ok {
+		switch coapUint(obs) {
+		case 0:
+			o := s.observers[key]
+			if o == nil {
+				if len(s.observers) >= coapMaxObservers {
+					return fail(coapServiceUnavailable, "too many observers")
+				}
+				o = &coapObserver{key: key, addr: addr, token: slices.Clone(m.token), seq: 1}
+				slog.Info(fmt.Sprintf("Client connected: %s (CoAP observe /%s)", addr, path), "client", addr.String(), "path", path)
+			} else {
+				s.unlink(o)
+			}
+			o.path, o.sensor = path, sensor
+			if path == "readings" {
+				q := map[string][]string{}
+				for _, kv := range m.strings(coapOptURIQuery) {
+					k, v, _ := strings.Cut(kv, "=")
+					q[k] = append(q[k], v)
+				}
+				o.filter = readingFilter{pipelines: filterSet(q["pipeline"]), types: filterSet(q["type"])}
+			}
+			s.observers[key] = o
+			if sensor != "" {
+				s.bySensor[sensor] = append(s.bySensor[sensor], o)
+			} else {
+				s.stream = append(s.stream, o)
+			}
+			resp.addUint(coapOptObserve, o.seq)
+		case 1:
+			if o := s.observers[key]; o != nil {
+				s.remove(o, "deregistered")
+			}
+		}
+	}
+	if path == "readings" && payload == nil {
+		// The stream has no state of its own: registration is answered
+		// with an empty JSON object and readings follow as notifications.
+		payload = []byte("{}")
+	}
+	resp.code = coapContent
+	resp.addUint(coapOptContentFormat, coapFormatJSON)
+	resp.payload = payload
+	return resp
+}
+
+// block answers with the requested Block2 slice of content (RFC 7959).
+func (s *coapServer) block(m *coapMessage, resp *coapMessage, content []byte) *coapMessage {
+	num, szx := uint32(0), uint32(6) // 1024-byte blocks
+	if v, ok := m.option(coapOptBlock2); ok {
+		b := coapUint(v)
+		num, szx = b>>4, min(b&7, 6)
+	}
+	size := 1 << (szx + 4)
+	start := int(num) * size
+	if start > len(content) || (start == len(content) && start > 0) {
+		resp.code, resp.payload = coapBadOption, []byte("block out of range")
+		return resp
+	}
+	end := min(start+size, len(content))
+	more := uint32(0)
+	if end < len(content) {
+		more = 8
+	}
+	resp.code = coapContent
+	resp.addUint(coapOptContentFormat, coapFormatLinks)
+	if more != 0 || num > 0 {
+		resp.addUint(coapOptBlock2, num<<4|more|szx)
+		if num == 0 {
+			resp.addUint(coapOptSize2, uint32(len(content)))
+		}
+	}
+	resp.payload = content[start:end]
+	return resp
+}
+
+// links lists the resources in CoRE link format (RFC 6690).
+func (s *coapServer) links() []byte {
+	var b bytes.Buffer
+	b.WriteString(`</readings>;rt="sensor-gen.readings";obs;ct=50`)
+	for _, p := range s.points {
+		fmt.Fprintf(&b, `,</sensors/%s>;rt="%s";if="sensor";obs;ct=50;title="%s %s"`, p.ID, p.Type, p.PipelineID, p.Unit)
+	}
+	return b.Bytes()
+}
+
+// acknowledged handles an ACK or RST for a notification.
+func (s *coapServer) acknowledged(m *coapMessage, addr net.Addr) {
+	prefix := addr.String() + "/"
+	for key, o := range s.observers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if m.typ == coapACK && o.pending && o.conID == m.id {
+			o.pending = false
+			return
+		}
+		if m.typ == coapRST && slices.Contains(o.recent[:min(o.sent, len(o.recent))], m.id) {
+			s.remove(o, "reset")
+			return
+		}
+	}
+}
+
+// unlink detaches o from the resource it observes.
+func (s *coapServer) unlink(o *coapObserver) {
+	del := func(list []*coapObserver) []*coapObserver {
+		return slices.DeleteFunc(list, func(x *coapObserver) bool { return x == o })
+	}
+	if o.sensor != "" {
+		if s.bySensor[o.sensor] = del(s.bySensor[o.sensor]); len(s.bySensor[o.sensor]) == 0 {
+			delete(s.bySensor, o.sensor)
+		}
+	} else {
+		s.stream = del(s.stream)
+	}
+}
+
+func (s *coapServer) remove(o *coapObserver, why string) {
+	s.unlink(o)
+	delete(s.observers, o.key)
+	slog.Info(fmt.Sprintf("Client disconnected: %s (CoAP observe /%s %s)", o.addr, o.path, why), "client", o.addr.String(), "path", o.path)
+}
+
+func (s *coapServer) messageID() uint16 {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *coapServer) send(m *coapMessage, addr net.Addr) {
+	s.conn.WriteTo(m.marshal(), addr)
+}
+
+// notify sends a notification with payload to o, dropping o if its last
+// confirmable notification went unacknowledged. Only one confirmable
+// notification is outstanding at a time (RFC 7641 section 4.5.1).
+func (s *coapServer) notify(o *coapObserver, payload []byte) {
+	o.sent++
+	typ := byte(coapNON)
+	if o.pending && time.Since(o.conSent) > coapAckTimeout {
+		s.remove(o, "timed out")
+		return
+	}
+	if o.sent%coapConfirmEvery == 0 && !o.pending {
+		typ = coapCON
+	}
+	o.seq = (o.seq + 1) & 0xFFFFFF
+	m := &coapMessage{typ: typ, code: coapContent, id: s.messageID(), token: o.token, payload: payload}
+	m.addUint(coapOptObserve, o.seq)
+	m.addUint(coapOptContentFormat, coapFormatJSON)
+	if typ == coapCON {
+		o.pending, o.conID, o.conSent = true, m.id, time.Now()
+	}
+	o.recent[o.sent%len(o.recent)] = m.id
+	s.send(m, o.addr)
+}
+
+// update applies readings from the hub and notifies observers.
+func (s *coapServer) update(h *hub, sub *subscriber) {
+	defer h.wg.Done()
+	for batch := range sub.send {
+		s.mu.Lock()
+		for _, rec := range batch {
+			r := rec.Reading
+			for _, o := range slices.Clone(s.stream) {
+				if o.filter.match(r) {
+					s.notify(o, rec.Data)
+				}
+			}
+			if _, ok := s.latest[r.SensorID]; !ok || r.Backfilled {
+				continue
+			}
+			s.latest[r.SensorID] = rec.Data
+			for _, o := range slices.Clone(s.bySensor[r.SensorID]) {
+				s.notify(o, rec.Data)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close stops the server.
+func (s *coapServer) Close() error {
+	return s.conn.Close()
+}
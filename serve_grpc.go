@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcSubscribePath is the HTTP/2 path of SensorStream.Subscribe (see
+// proto/sensorgen.proto).
+const grpcSubscribePath = "/sensorgen.v1.SensorStream/Subscribe"
+
+// gRPC status codes returned by the server.
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+)
+
+// serveGRPC adds a gRPC endpoint on addr to h, speaking gRPC over
+// cleartext HTTP/2 (h2c). Subscribe streams every reading matching the
+// request's filter as a SensorReading message.
+func serveGRPC(h *hub, addr string) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return h.listen(addr, &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handleGRPC(h, w, r) }),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+	})
+}
+
+func handleGRPC(h *hub, w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 required", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.Method != http.MethodPost || r.URL.Path != grpcSubscribePath {
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	filter, err := decodeSubscribeRequest(msg)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	sub := &subscriber{addr: r.RemoteAddr, filter: filter}
+	if !h.subscribe(sub, "grpc "+describeFilter(filter)) {
+		grpcStatus(w, grpcUnavailable, "server shutting down")
+		return
+	}
+	defer h.wg.Done()
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	var buf, scratch []byte
+	for {
+		select {
+		case batch, ok := <-sub.send:
+			if !ok {
+				// Generation has stopped: end the stream cleanly.
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+				return
+			}
+			buf = buf[:0]
+			for _, rec := range batch {
+				if !filter.match(rec.Reading) {
+					continue
+				}
+				scratch = appendReadingProto(scratch[:0], rec.Reading)
+				buf = append(buf, 0)
+				buf = binary.BigEndian.AppendUint32(buf, uint32(len(scratch)))
+				buf = append(buf, scratch...)
+			}
+			if len(buf) == 0 {
+				continue
+			}
+			if _, err := w.Write(buf); err != nil {
+				h.unsubscribe(sub)
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				h.unsubscribe(sub)
+				return
+			}
+		case <-r.Context().Done():
+			h.unsubscribe(sub)
+			return
+		}
+	}
+}
+
+// grpcStatus sends a trailers-only response carrying a gRPC status.
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEscape percent-encodes a status message as the gRPC spec requires.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readGRPCMessage reads one length-prefixed request message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed requests are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > 4<<20 {
+		return nil, fmt.Errorf("request too large (%d bytes)", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	return msg, nil
+}
+
+// decodeSubscribeRequest parses a SubscribeRequest, skipping unknown
+// fields.
+func decodeSubscribeRequest(b []byte) (readingFilter, error) {
+	var pipelines, types []string
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return readingFilter{}, errors.New("malformed SubscribeRequest")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return readingFilter{}, errors.New("malformed SubscribeRequest")
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return readingFilter{}, errors.New("malformed SubscribeRequest")
+			}
+			b = b[8:]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return readingFilter{}, errors.New("malformed SubscribeRequest")
+			}
+			b = b[4:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return readingFilter{}, errors.New("malformed SubscribeRequest")
+			}
+			v := string(b[n : n+int(l)])
+			b = b[n+int(l):]
+			switch tag >> 3 {
+			case 1:
+				pipelines = append(pipelines, v)
+			case 2:
+				types = append(types, v)
+			}
+		default:
+			return readingFilter{}, errors.New("malformed SubscribeRequest")
+		}
+	}
+	return readingFilter{pipelines: filterSet(pipelines), types: filterSet(types)}, nil
+}
+
+// describeFilter formats a filter for connection logs.
+func describeFilter(f readingFilter) string {
+	var parts []string
+	for _, set := range []struct {
+		name string
+		m    map[string]bool
+	}{{"pipeline", f.pipelines}, {"type", f.types}} {
+		if set.m == nil {
+			continue
+		}
+		var items []string
+		for item := range set.m {
+			items = append(items, item)
+		}
+		parts = append(parts, set.name+"="+strings.Join(items, ","))
+	}
+	if len(parts) == 0 {
+		return "(all readings)"
+	}
+	return strings.Join(parts, " ")
+}
+
+// appendReadingProto appends the protobuf encoding of r as a
+// sensorgen.v1.SensorReading. Zero values are omitted, as in proto3.
+func appendReadingProto(b []byte, r *SensorReading) []byte {
+	b = appendProtoString(b, 1, r.SensorID)
+	b = appendProtoString(b, 2, r.Timestamp)
+	b = appendProtoString(b, 3, r.Type)
+	b = appendProtoDouble(b, 4, r.Value)
+	b = appendProtoString(b, 5, r.Unit)
+
+	var loc [3 * 9]byte
+	l := appendProtoDouble(loc[:0], 1, r.Location.Lat)
+	l = appendProtoDouble(l, 2, r.Location.Lon)
+	l = appendProtoDouble(l, 3, r.Location.MilePost)
+	b = appendProtoBytes(b, 6, l)
+
+	b = appendProtoString(b, 7, r.PipelineID)
+	b = appendProtoString(b, 8, r.Status)
+	b = appendProtoDouble(b, 9, r.Quality)
+	b = appendProtoString(b, 10, r.AlertLevel)
+	b = appendProtoString(b, 11, r.PairID)
+	if r.Backfilled {
+		b = binary.AppendUvarint(b, 12<<3|0)
+		b = append(b, 1)
+	}
+	b = appendProtoString(b, 13, r.Cohort)
+	b = appendProtoString(b, 14, r.IngestedAt)
+	if r.Sequence != 0 {
+		b = binary.AppendUvarint(b, 15<<3|0)
+		b = binary.AppendUvarint(b, r.Sequence)
+	}
+	for _, k := range slices.Sorted(maps.Keys(r.Components)) {
+		e := appendProtoString(nil, 1, k)
+		e = appendProtoDouble(e, 2, r.Components[k])
+		b = appendProtoBytes(b, 16, e)
+	}
+	b = appendProtoString(b, 17, r.TerminalID)
+	b = appendProtoString(b, 18, r.TankID)
+	b = appendProtoString(b, 19, r.StationID)
+	b = appendProtoString(b, 20, r.GatewayID)
+	b = appendProtoString(b, 21, r.TransmittedAt)
+	b = appendProtoDouble(b, 22, r.BatteryPct)
+	b = appendProtoDouble(b, 23, r.RSSI)
+	if r.Uptime != 0 {
+		b = binary.AppendUvarint(b, 24<<3|0)
+		b = binary.AppendUvarint(b, uint64(r.Uptime))
+	}
+	b = appendProtoString(b, 25, r.Firmware)
+	b = appendProtoString(b, 26, r.RunID)
+	return b
+}
+
+func appendProtoString(b []byte, field uint64, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoBytes(b []byte, field uint64, v []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoDouble(b []byte, field uint64, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
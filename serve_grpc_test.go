@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// protoValue is a decoded protobuf field value.
+type protoValue struct {
+	wire   int
+	varint uint64 // wire types 0 and 1
+	bytes  []byte // wire type 2
+}
+
+// walkProto calls f for each field of a protobuf message, in order.
+func walkProto(b []byte, f func(field int, v protoValue) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad tag")
+		}
+		b = b[n:]
+		v := protoValue{wire: int(tag & 7)}
+		switch v.wire {
+		case 0:
+			if v.varint, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("short fixed64")
+			}
+			v.varint, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("bad length")
+			}
+			v.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("unexpected wire type %d", v.wire)
+		}
+		if err := f(int(tag>>3), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readingWireTypes are the wire types of the SensorReading fields in
+// proto/sensorgen.proto.
+var readingWireTypes = map[int]int{
+	1: 2, 2: 2, 3: 2, 4: 1, 5: 2, 6: 2, 7: 2, 8: 2, 9: 1, 10: 2, 11: 2, 12: 0, 13: 2, 14: 2, 15: 0,
+	16: 2, 17: 2, 18: 2, 19: 2, 20: 2, 21: 2, 22: 1, 23: 1, 24: 0, 25: 2, 26: 2,
+}
+
+// decodeReadingProto decodes a sensorgen.v1.SensorReading, following
+// proto/sensorgen.proto rather than appendReadingProto.
+func decodeReadingProto(b []byte) (SensorReading, error) {
+	var r SensorReading
+	err := walkProto(b, func(field int, v protoValue) error {
+		if want, ok := readingWireTypes[field]; !ok {
+			return fmt.Errorf("unknown field %d", field)
+		} else if v.wire != want {
+			return fmt.Errorf("field %d: wire type %d, want %d", field, v.wire, want)
+		}
+		double := math.Float64frombits(v.varint)
+		switch field {
+		case 1:
+			r.SensorID = string(v.bytes)
+		case 2:
+			r.Timestamp = string(v.bytes)
+		case 3:
+			r.Type = string(v.bytes)
+		case 4:
+			r.Value = double
+		case 5:
+			r.Unit = string(v.bytes)
+		case 6:
+			return walkProto(v.bytes, func(field int, v protoValue) error {
+				double := math.Float64frombits(v.varint)
+				switch field {
+				case 1:
+					r.Location.Lat = double
+				case 2:
+					r.Location.Lon = double
+				case 3:
+					r.Location.MilePost = double
+				default:
+					return fmt.Errorf("unknown location field %d", field)
+				}
+				return nil
+			})
+		case 7:
+			r.PipelineID = string(v.bytes)
+		case 8:
+			r.Status = string(v.bytes)
+		case 9:
+			r.Quality = double
+		case 10:
+			r.AlertLevel = string(v.bytes)
+		case 11:
+			r.PairID = string(v.bytes)
+		case 12:
+			r.Backfilled = v.varint != 0
+		case 13:
+			r.Cohort = string(v.bytes)
+		case 14:
+			r.IngestedAt = string(v.bytes)
+		case 15:
+			r.Sequence = v.varint
+		case 16:
+			var key string
+			var value float64
+			err := walkProto(v.bytes, func(field int, v protoValue) error {
+				switch field {
+				case 1:
+					key = string(v.bytes)
+				case 2:
+					value = math.Float64frombits(v.varint)
+				default:
+					return fmt.Errorf("unknown map entry field %d", field)
+				}
+				return nil
+			})
+			if r.Components == nil {
+				r.Components = make(map[string]float64)
+			}
+			r.Components[key] = value
+			return err
+		case 17:
+			r.TerminalID = string(v.bytes)
+		case 18:
+			r.TankID = string(v.bytes)
+		case 19:
+			r.StationID = string(v.bytes)
+		case 20:
+			r.GatewayID = string(v.bytes)
+		case 21:
+			r.TransmittedAt = string(v.bytes)
+		case 22:
+			r.BatteryPct = double
+		case 23:
+			r.RSSI = double
+		case 24:
+			r.Uptime = int64(v.varint)
+		case 25:
+			r.Firmware = string(v.bytes)
+		case 26:
+			r.RunID = string(v.bytes)
+		}
+		return nil
+	})
+	return r, err
+}
+
+func TestReadingProto(t *testing.T) {
+	for _, r := range allFieldsReadings(t) {
+		got, err := decodeReadingProto(appendReadingProto(nil, &r))
+		if err != nil {
+			t.Fatalf("%s: %v", r.SensorID, err)
+		}
+		// Sprint, as NaN values are never DeepEqual.
+		if fmt.Sprint(got) != fmt.Sprint(r) {
+			t.Fatalf("decoded %+v, want %+v", got, r)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Modbus function codes and exception codes.
+const (
+	mbReadHoldingRegisters = 0x03
+	mbReadInputRegisters   = 0x04
+
+	mbIllegalFunction    = 0x01
+	mbIllegalDataAddress = 0x02
+	mbIllegalDataValue   = 0x03
+)
+
+// Register layout: each fleet sensor occupies mbStride registers starting
+// at stride*index, in fleet order.
+const (
+	mbStride       = 4
+	mbOffsetValue  = 0 // float32, big-endian, high word first
+	mbOffsetStatus = 2 // 0 normal, 1 warning, 2 maintenance, 0xFFFF no reading yet
+	mbOffsetAge    = 3 // seconds since the latest reading, saturating at 65535
+
+	mbNoReading   = 0xFFFF
+	mbMaxQuantity = 125 // registers per read (Modbus application protocol 6.3)
+	mbMaxADU      = 260
+)
+
+// serveModbus adds a Modbus TCP server on addr to h, answering Read
+// Holding Registers and Read Input Registers from the same register map:
+// every fleet sensor's latest value, status and age (see mbStride). Any
+// unit identifier is answered, so gateways configured with unit 1 or 255
+// alike see the fleet. If mapFile is set the register map is written there
+// as CSV for importing into gateway configurations.
+func serveModbus(h *hub, addr string, points []SensorPoint, mapFile string) error {
+	if len(points) == 0 {
+		return fmt.Errorf("serve: Modbus needs a fleet (-fleet) for its register map")
+	}
+	if len(points)*mbStride > 1<<16 {
+		return fmt.Errorf("serve: Modbus register map holds at most %d sensors, fleet has %d", 1<<16/mbStride, len(points))
+	}
+	if mapFile != "" {
+		if err := writeModbusMap(mapFile, points); err != nil {
+			return fmt.Errorf("serve: %w", err)
+		}
+		slog.Info(fmt.Sprintf("Modbus register map written to %s", mapFile), "file", mapFile)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	s := &modbusServer{
+		ln:      ln,
+		index:   make(map[string]int, len(points)),
+		sensors: make([]mbSensor, len(points)),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	for i, p := range points {
+		s.index[p.ID] = i
+		s.sensors[i].status = mbNoReading
+	}
+	sub := &subscriber{addr: "modbus"}
+	if !h.register(sub) {
+		ln.Close()
+		return fmt.Errorf("serve: hub closed")
+	}
+	h.closers = append(h.closers, s)
+	go s.update(h, sub)
+	go s.accept()
+	return nil
+}
+
+// modbusServer is the Modbus TCP server.
+type modbusServer struct {
+	ln    net.Listener
+	index map[string]int // sensor ID to position in sensors
+
+	mu      sync.Mutex
+	sensors []mbSensor
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// mbSensor is the latest state of one sensor.
+type mbSensor struct {
+	value   float32
+	status  uint16
+	updated time.Time
+}
+
+// update applies readings from the hub to the register map.
+func (s *modbusServer) update(h *hub, sub *subscriber) {
+	defer h.wg.Done()
+	for batch := range sub.send {
+		now := time.Now()
+		s.mu.Lock()
+		for _, rec := range batch {
+			r := rec.Reading
+			i, ok := s.index[r.SensorID]
+			if !ok || r.Backfilled {
+				continue
+			}
+			s.sensors[i] = mbSensor{value: float32(r.Value), status: mbReadingStatus(r.Status), updated: now}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// mbReadingStatus maps a reading's status to its status register value.
+func mbReadingStatus(status string) uint16 {
+	switch status {
+	case "warning":
+		return 1
+	case "maintenance":
+		return 2
+	}
+	return 0
+}
+
+// register returns the value of holding register addr.
+func (s *modbusServer) register(addr int, now time.Time) uint16 {
+	sensor := &s.sensors[addr/mbStride]
+	bits := math.Float32bits(sensor.value)
+	if sensor.status == mbNoReading {
+		bits = math.Float32bits(float32(math.NaN()))
+	}
+	switch addr % mbStride {
+	case mbOffsetValue:
+		return uint16(bits >> 16)
+	case mbOffsetValue + 1:
+		return uint16(bits)
+	case mbOffsetStatus:
+		return sensor.status
+	case mbOffsetAge:
+		if sensor.status == mbNoReading {
+			return math.MaxUint16
+		}
+		return uint16(min(now.Sub(sensor.updated)/time.Second, math.MaxUint16))
+	}
+	return 0
+}
+
+func (s *modbusServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers requests on conn until the client hangs up or sends
+// something that is not Modbus TCP.
+func (s *modbusServer) serveConn(conn net.Conn) {
+	slog.Info(fmt.Sprintf("Client connected: %s (Modbus TCP)", conn.RemoteAddr()), "client", conn.RemoteAddr().String())
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		slog.Info(fmt.Sprintf("Client disconnected: %s (Modbus TCP)", conn.RemoteAddr()), "client", conn.RemoteAddr().String())
+	}()
+
+	r := bufio.NewReader(conn)
+	var header [7]byte
+	buf := make([]byte, mbMaxADU)
+	for {
+		// MBAP header: transaction ID, protocol ID (0), length of unit ID
+		// plus PDU, unit ID.
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > mbMaxADU-6 {
+			return
+		}
+		pdu := buf[:length-1]
+		if _, err := io.ReadFull(r, pdu); err != nil {
+			return
+		}
+		resp := s.handle(pdu)
+		out := make([]byte, 7, 7+len(resp))
+		copy(out, header[:])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(resp)+1))
+		out = append(out, resp...)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle executes one request PDU and returns the response PDU.
+func (s *modbusServer) handle(pdu []byte) []byte {
+	fn := pdu[0]
+	exception := func(code byte) []byte { return []byte{fn | 0x80, code} }
+	switch fn {
+	case mbReadHoldingRegisters, mbReadInputRegisters:
+	default:
+		return exception(mbIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(mbIllegalDataValue)
+	}
+	start := int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:]))
+	if quantity < 1 || quantity > mbMaxQuantity {
+		return exception(mbIllegalDataValue)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if start+quantity > len(s.sensors)*mbStride {
+		return exception(mbIllegalDataAddress)
+	}
+	now := time.Now()
+	resp := make([]byte, 2, 2+2*quantity)
+	resp[0], resp[1] = fn, byte(2*quantity)
+	for addr := start; addr < start+quantity; addr++ {
+		resp = binary.BigEndian.AppendUint16(resp, s.register(addr, now))
+	}
+	return resp
+}
+
+// Close stops the server and drops every connection.
+func (s *modbusServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.ln.Close()
+}
+
+// writeModbusMap writes the register map as CSV, one row per register
+// group: tag, zero-based protocol address, 4xxxxx reference, register
+// count, data type and the sensor it belongs to.
+func writeModbusMap(path string, points []SensorPoint) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"tag", "address", "reference", "registers", "data_type", "unit", "sensor_id", "pipeline_id", "type", "min", "max", "description"})
+	for i, p := range points {
+		base := i * mbStride
+		row := func(tag string, offset, count int, dataType, unit, desc string) {
+			addr := base + offset
+			w.Write([]string{
+				tag, strconv.Itoa(addr), strconv.Itoa(400001 + addr), strconv.Itoa(count), dataType, unit,
+				p.ID, p.PipelineID, p.Type,
+				strconv.FormatFloat(p.Min, 'f', -1, 64), strconv.FormatFloat(p.Max, 'f', -1, 64), desc,
+			})
+		}
+		row(p.ID, mbOffsetValue, 2, "float32_be", p.Unit, fmt.Sprintf("%s (%s) at mile post %.1f; NaN until the first reading", p.Type, p.Unit, p.MilePost))
+		row(p.ID+".status", mbOffsetStatus, 1, "uint16", "", "0 normal, 1 warning, 2 maintenance, 65535 no reading yet")
+		row(p.ID+".age", mbOffsetAge, 1, "uint16", "s", "seconds since the latest reading, 65535 if none or older")
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
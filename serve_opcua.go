@@ -0,0 +1,1139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// OPC UA status codes used by the server.
+const (
+	uaGood                          = 0
+	uaUncertain                     = 0x40000000
+	uaBadDecodingError              = 0x80070000
+	uaBadServiceUnsupported         = 0x800B0000
+	uaBadNothingToDo                = 0x800F0000
+	uaBadTooManyOperations          = 0x80100000
+	uaBadIdentityTokenInvalid       = 0x80200000
+	uaBadSecureChannelIDInvalid     = 0x80220000
+	uaBadSessionIDInvalid           = 0x80250000
+	uaBadSessionNotActivated        = 0x80270000
+	uaBadSubscriptionIDInvalid      = 0x80280000
+	uaBadTimestampsToReturnInvalid  = 0x802B0000
+	uaBadWaitingForInitialData      = 0x80320000
+	uaBadNodeIDUnknown              = 0x80340000
+	uaBadAttributeIDInvalid         = 0x80350000
+	uaBadNotWritable                = 0x803B0000
+	uaBadMonitoringModeInvalid      = 0x80410000
+	uaBadMonitoredItemIDInvalid     = 0x80420000
+	uaBadMonitoredItemFilterInvalid = 0x80430000
+	uaBadContinuationPointInvalid   = 0x804A0000
+	uaBadNoContinuationPoints       = 0x804B0000
+	uaBadReferenceTypeIDInvalid     = 0x804C0000
+	uaBadBrowseDirectionInvalid     = 0x804D0000
+	uaBadSecurityPolicyRejected     = 0x80550000
+	uaBadNoMatch                    = 0x806F0000
+	uaBadTooManyPublishRequests     = 0x80780000
+	uaBadNoSubscription             = 0x80790000
+	uaBadSequenceNumberUnknown      = 0x807A0000
+	uaBadMessageNotAvailable        = 0x807B0000
+	uaBadTCPMessageTypeInvalid      = 0x807E0000
+	uaBadTCPMessageTooLarge         = 0x80800000
+	uaBadOutOfService               = 0x808D0000
+	uaBadDeadbandFilterInvalid      = 0x808E0000
+)
+
+// Request and response encodings of the supported services.
+const (
+	uaServiceFault           = 397
+	uaFindServers            = 422
+	uaGetEndpoints           = 428
+	uaOpenSecureChannel      = 446
+	uaCloseSecureChannel     = 452
+	uaCreateSession          = 461
+	uaActivateSession        = 467
+	uaCloseSession           = 473
+	uaCancel                 = 479
+	uaBrowse                 = 527
+	uaBrowseNext             = 533
+	uaTranslateBrowsePaths   = 554
+	uaRegisterNodes          = 560
+	uaUnregisterNodes        = 566
+	uaRead                   = 631
+	uaWrite                  = 673
+	uaCreateMonitoredItems   = 751
+	uaModifyMonitoredItems   = 763
+	uaSetMonitoringMode      = 769
+	uaDeleteMonitoredItems   = 781
+	uaCreateSubscription     = 787
+	uaModifySubscription     = 793
+	uaSetPublishingMode      = 799
+	uaPublish                = 826
+	uaRepublish              = 832
+	uaDeleteSubscriptions    = 847
+	uaDataChangeNotification = 811
+	uaDataChangeFilter       = 724
+	uaAnonymousIdentityToken = 321
+)
+
+// uaResponse maps a request encoding to its response encoding; all are
+// three apart.
+func uaResponse(req uint32) uint32 { return req + 3 }
+
+const (
+	uaSecurityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	uaTransportProfile   = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+
+	uaChunkSize       = 65535    // largest chunk the server sends or accepts
+	uaMaxMessageSize  = 16 << 20 // largest request the server reassembles
+	uaMaxContinuation = 16       // browse continuation points per session
+	uaMaxPublishQueue = 32       // publish requests held per session
+	uaMaxRetransmit   = 64       // unacknowledged notifications kept for Republish
+	uaMinInterval     = 50 * time.Millisecond
+)
+
+// serveOPCUA adds an OPC UA server (opc.tcp, binary encoding) on addr to
+// h. The fleet's sensors are Double variables under Objects/Pipelines that
+// clients can browse, read and subscribe to; each holds the sensor's latest
+// reading, with the reading's status mapped to the OPC UA status code
+// (normal: Good, warning: Uncertain, maintenance: Bad_OutOfService).
+//
+// Only SecurityPolicy None with anonymous sessions is offered, which is
+// what test benches and most connectors accept on a trusted network.
+func serveOPCUA(h *hub, addr string, points []SensorPoint) error {
+	if len(points) == 0 {
+		return fmt.Errorf("serve: OPC UA needs a fleet (-fleet) for its address space")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	s := &opcuaServer{
+		ln:       ln,
+		start:    time.Now(),
+		channels: make(map[*uaChannel]struct{}),
+		sessions: make(map[uaNodeID]*uaSession),
+		done:     make(chan struct{}),
+	}
+	s.space = newUASpace(points, s.start)
+	s.services = s.sessionServices()
+	sub := &subscriber{addr: "opcua"}
+	if !h.register(sub) {
+		ln.Close()
+		return fmt.Errorf("serve: hub closed")
+	}
+	h.closers = append(h.closers, s)
+	go s.update(h, sub)
+	go s.accept()
+	go s.run()
+	return nil
+}
+
+// opcuaServer is the OPC UA server. A single mutex guards the address
+// space values, sessions and subscriptions; services and publishing cycles
+// are short.
+type opcuaServer struct {
+	ln    net.Listener
+	start time.Time
+	done  chan struct{}
+
+	mu          sync.Mutex
+	space       *uaSpace
+	channels    map[*uaChannel]struct{}
+	sessions    map[uaNodeID]*uaSession // by authentication token
+	lastChannel uint32
+	lastSession uint32
+	lastSub     uint32
+	lastItem    uint32
+	services    map[uint32]func(*uaRequest, *uaSession)
+}
+
+// update applies readings from the hub to the sensor variables.
+func (s *opcuaServer) update(h *hub, sub *subscriber) {
+	defer h.wg.Done()
+	for batch := range sub.send {
+		now := time.Now()
+		s.mu.Lock()
+		for _, rec := range batch {
+			r := rec.Reading
+			n := s.space.points[r.SensorID]
+			if n == nil || r.Backfilled {
+				continue
+			}
+			source, _ := time.Parse(time.RFC3339Nano, r.Timestamp)
+			dv := uaDataValue{Value: r.Value, Status: uaReadingStatus(r.Status), Source: source, Server: now}
+			n.current = dv
+			for _, item := range n.watchers {
+				item.offer(dv)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// uaReadingStatus maps a reading's status to an OPC UA status code.
+func uaReadingStatus(status string) uint32 {
+	switch status {
+	case "warning":
+		return uaUncertain
+	case "maintenance":
+		return uaBadOutOfService
+	}
+	return uaGood
+}
+
+func (s *opcuaServer) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and drops every connection.
+func (s *opcuaServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	for c := range s.channels {
+		c.close()
+	}
+	return s.ln.Close()
+}
+
+// run drives the publishing cycles of every subscription and expires idle
+// sessions.
+func (s *opcuaServer) run() {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-tick.C:
+			s.mu.Lock()
+			for token, sess := range s.sessions {
+				if now.Sub(sess.lastSeen) > sess.timeout {
+					s.closeSession(token, sess, "timed out")
+					continue
+				}
+				for _, sub := range sess.subs {
+					if now.Before(sub.next) {
+						continue
+					}
+					sub.next = sub.next.Add(sub.interval)
+					if sub.next.Before(now) {
+						sub.next = now.Add(sub.interval)
+					}
+					s.publishCycle(sub, now)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// uaChannel is a client connection with its secure channel. Outgoing
+// messages are queued to a writer goroutine, which splits them into chunks,
+// so publishing never blocks on a slow client; one that lets the queue
+// fill up is disconnected.
+type uaChannel struct {
+	conn     net.Conn
+	endpoint string // endpoint URL from the client's Hello
+	sendSize int    // chunk size the client accepts
+	out      chan uaOutgoing
+	done     chan struct{}
+	once     sync.Once
+
+	// Guarded by opcuaServer.mu.
+	id        uint32
+	token     uint32
+	prevToken uint32
+	expires   time.Time
+}
+
+type uaOutgoing struct {
+	typ       string // "MSG" or "OPN"
+	requestID uint32
+	body      []byte
+}
+
+func (c *uaChannel) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// send queues a message, disconnecting the client if it is not keeping up.
+func (c *uaChannel) send(typ string, requestID uint32, body []byte) {
+	select {
+	case c.out <- uaOutgoing{typ, requestID, body}:
+	case <-c.done:
+	default:
+		c.close()
+	}
+}
+
+func (c *uaChannel) writeLoop() {
+	w := bufio.NewWriter(c.conn)
+	var seq uint32
+	for {
+		var msg uaOutgoing
+		select {
+		case msg = <-c.out:
+		case <-c.done:
+			return
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		var hdr uaBuf
+		if msg.typ == "OPN" {
+			hdr.u32(c.id)
+			hdr.str(uaSecurityPolicyNone)
+			hdr.nullStr() // SenderCertificate
+			hdr.nullStr() // ReceiverCertificateThumbprint
+			seq++
+			hdr.u32(seq)
+			hdr.u32(msg.requestID)
+			writeUAChunk(w, "OPNF", hdr.Bytes(), msg.body)
+		} else {
+			// 24 bytes of headers per chunk: message header, channel,
+			// token, sequence number and request ID.
+			room := c.sendSize - 24
+			for body := msg.body; ; {
+				n := min(len(body), room)
+				final := n == len(body)
+				seq++
+				hdr.Reset()
+				hdr.u32(c.id)
+				hdr.u32(c.token)
+				hdr.u32(seq)
+				hdr.u32(msg.requestID)
+				typ := "MSGC"
+				if final {
+					typ = "MSGF"
+				}
+				writeUAChunk(w, typ, hdr.Bytes(), body[:n])
+				body = body[n:]
+				if final {
+					break
+				}
+			}
+		}
+		if err := w.Flush(); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// writeUAChunk writes a message chunk: type and chunk flag, size, headers
+// and body.
+func writeUAChunk(w *bufio.Writer, typ string, hdr, body []byte) {
+	w.WriteString(typ)
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(8+len(hdr)+len(body))))
+	w.Write(hdr)
+	w.Write(body)
+}
+
+// readUAChunk reads one message chunk, returning its 4-byte type (message
+// type and chunk flag) and everything after the size.
+func readUAChunk(r *bufio.Reader, limit int) (string, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(hdr[4:]))
+	if size < 8 || size > limit {
+		return string(hdr[:4]), nil, errUATooLarge
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, err
+	}
+	return string(hdr[:4]), body, nil
+}
+
+var errUATooLarge = fmt.Errorf("opcua: chunk too large")
+
+// uaError sends an ERR message and gives up on the connection.
+func uaError(conn net.Conn, code uint32, reason string) {
+	var b uaBuf
+	b.u32(code)
+	b.str(reason)
+	w := bufio.NewWriter(conn)
+	writeUAChunk(w, "ERRF", nil, b.Bytes())
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	w.Flush()
+}
+
+// serveConn runs the UA-TCP handshake (Hello/Acknowledge) and then
+// processes secure channel and service messages until the client leaves.
+func (s *opcuaServer) serveConn(conn net.Conn) {
+	c := &uaChannel{conn: conn, out: make(chan uaOutgoing, 64), done: make(chan struct{})}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	s.channels[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		c.close()
+		s.mu.Lock()
+		delete(s.channels, c)
+		for _, sess := range s.sessions {
+			if sess.ch == c {
+				sess.ch = nil
+				sess.publishQ = nil
+			}
+		}
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	typ, body, err := readUAChunk(r, uaChunkSize)
+	if err != nil || typ != "HELF" {
+		uaError(conn, uaBadTCPMessageTypeInvalid, "expected Hello")
+		return
+	}
+	hello := &uaReader{b: body}
+	hello.u32() // ProtocolVersion
+	recvSize := hello.u32()
+	sendSize := hello.u32()
+	hello.u32() // MaxMessageSize
+	hello.u32() // MaxChunkCount
+	c.endpoint = hello.str()
+	if hello.err != nil || recvSize < 8192 {
+		uaError(conn, uaBadDecodingError, "invalid Hello")
+		return
+	}
+	c.sendSize = int(min(recvSize, uaChunkSize))
+	var ack uaBuf
+	ack.u32(0)
+	ack.u32(uint32(min(sendSize, uaChunkSize)))
+	ack.u32(uint32(c.sendSize))
+	ack.u32(uaMaxMessageSize)
+	ack.u32(0)
+	w := bufio.NewWriter(conn)
+	writeUAChunk(w, "ACKF", nil, ack.Bytes())
+	if w.Flush() != nil {
+		return
+	}
+	go c.writeLoop()
+
+	partial := make(map[uint32][]byte)
+	for {
+		s.mu.Lock()
+		deadline := c.expires
+		s.mu.Unlock()
+		if deadline.IsZero() {
+			deadline = time.Now().Add(10 * time.Second)
+		}
+		conn.SetReadDeadline(deadline)
+		typ, body, err := readUAChunk(r, uaChunkSize)
+		if err == errUATooLarge {
+			uaError(conn, uaBadTCPMessageTooLarge, "chunk too large")
+			return
+		}
+		if err != nil {
+			return
+		}
+		switch typ[:3] {
+		case "OPN":
+			if !s.openChannel(c, body) {
+				return
+			}
+		case "CLO":
+			return
+		case "MSG":
+			m := &uaReader{b: body}
+			id, token := m.u32(), m.u32()
+			m.u32() // SequenceNumber
+			reqID := m.u32()
+			s.mu.Lock()
+			valid := c.id != 0 && id == c.id && (token == c.token || token == c.prevToken)
+			s.mu.Unlock()
+			if m.err != nil || !valid {
+				uaError(conn, uaBadSecureChannelIDInvalid, "unknown secure channel or token")
+				return
+			}
+			switch typ[3] {
+			case 'A':
+				delete(partial, reqID)
+			case 'C':
+				if len(partial[reqID])+len(m.b) > uaMaxMessageSize {
+					uaError(conn, uaBadTCPMessageTooLarge, "request too large")
+					return
+				}
+				partial[reqID] = append(partial[reqID], m.b...)
+			default:
+				msg := m.b
+				if p, ok := partial[reqID]; ok {
+					msg = append(p, msg...)
+					delete(partial, reqID)
+				}
+				s.dispatch(c, reqID, msg)
+			}
+		default:
+			uaError(conn, uaBadTCPMessageTypeInvalid, "unexpected message type")
+			return
+		}
+	}
+}
+
+// openChannel handles OpenSecureChannel, issuing or renewing the channel's
+// security token. It reports false if the connection should be dropped.
+func (s *opcuaServer) openChannel(c *uaChannel, body []byte) bool {
+	r := &uaReader{b: body}
+	r.u32() // SecureChannelId
+	policy := r.str()
+	r.byteStr() // SenderCertificate
+	r.byteStr() // ReceiverCertificateThumbprint
+	r.u32()     // SequenceNumber
+	reqID := r.u32()
+	typeID := r.nodeID()
+	_, handle, _ := r.requestHeader()
+	r.u32() // ClientProtocolVersion
+	renew := r.i32() == 1
+	mode := r.i32()
+	r.byteStr() // ClientNonce
+	lifetime := time.Duration(r.u32()) * time.Millisecond
+	if r.err != nil || !typeID.is(uaOpenSecureChannel) {
+		uaError(c.conn, uaBadDecodingError, "invalid OpenSecureChannel")
+		return false
+	}
+	if policy != uaSecurityPolicyNone || mode != 1 {
+		uaError(c.conn, uaBadSecurityPolicyRejected, "only SecurityPolicy None is supported")
+		return false
+	}
+	if lifetime < 10*time.Second || lifetime > time.Hour {
+		lifetime = 10 * time.Minute
+	}
+
+	s.mu.Lock()
+	if renew && c.id != 0 {
+		c.prevToken = c.token
+		c.token++
+	} else if c.id == 0 {
+		s.lastChannel++
+		c.id, c.token = s.lastChannel, 1
+	}
+	c.expires = time.Now().Add(lifetime * 5 / 4)
+	id, token := c.id, c.token
+	s.mu.Unlock()
+
+	var b uaBuf
+	b.nodeID(uaNum(0, uaResponse(uaOpenSecureChannel)))
+	b.responseHeader(handle, uaGood)
+	b.u32(0) // ServerProtocolVersion
+	b.u32(id)
+	b.u32(token)
+	b.dateTime(time.Now())
+	b.u32(uint32(lifetime / time.Millisecond))
+	b.byteStr([]byte{}) // ServerNonce
+	c.send("OPN", reqID, b.Bytes())
+	return true
+}
+
+// uaRequest is a decoded service request awaiting its response.
+type uaRequest struct {
+	c      *uaChannel
+	id     uint32 // request ID from the sequence header
+	handle uint32 // request handle from the request header
+	typ    uint32
+	r      *uaReader
+}
+
+// reply sends the response to req with the given body after the header.
+func (req *uaRequest) reply(body *uaBuf) {
+	var b uaBuf
+	b.nodeID(uaNum(0, uaResponse(req.typ)))
+	b.responseHeader(req.handle, uaGood)
+	b.Write(body.Bytes())
+	req.c.send("MSG", req.id, b.Bytes())
+}
+
+// fault answers req with a ServiceFault.
+func (req *uaRequest) fault(status uint32) {
+	var b uaBuf
+	b.nodeID(uaNum(0, uaServiceFault))
+	b.responseHeader(req.handle, status)
+	req.c.send("MSG", req.id, b.Bytes())
+}
+
+// dispatch decodes a request and runs its service.
+func (s *opcuaServer) dispatch(c *uaChannel, reqID uint32, msg []byte) {
+	r := &uaReader{b: msg}
+	typeID := r.nodeID()
+	token, handle, _ := r.requestHeader()
+	typ, _ := typeID.numeric()
+	req := &uaRequest{c: c, id: reqID, handle: handle, typ: typ, r: r}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch typ {
+	case uaCloseSecureChannel:
+		c.close()
+		return
+	case uaFindServers:
+		s.findServers(req)
+		return
+	case uaGetEndpoints:
+		s.getEndpoints(req)
+		return
+	case uaCreateSession:
+		s.createSession(req)
+		return
+	}
+
+	sess := s.sessions[token]
+	switch {
+	case sess == nil:
+		req.fault(uaBadSessionIDInvalid)
+		return
+	case typ == uaActivateSession:
+		s.activateSession(req, sess)
+		return
+	case !sess.activated || sess.ch != c:
+		req.fault(uaBadSessionNotActivated)
+		return
+	}
+	sess.lastSeen = time.Now()
+
+	service, ok := s.services[typ]
+	if !ok {
+		req.fault(uaBadServiceUnsupported)
+		return
+	}
+	service(req, sess)
+}
+
+// sessionServices returns the services that run within an activated
+// session, by request encoding.
+func (s *opcuaServer) sessionServices() map[uint32]func(*uaRequest, *uaSession) {
+	return map[uint32]func(*uaRequest, *uaSession){
+		uaCloseSession:         s.closeSessionService,
+		uaCancel:               s.cancel,
+		uaBrowse:               s.browse,
+		uaBrowseNext:           s.browseNext,
+		uaTranslateBrowsePaths: s.translateBrowsePaths,
+		uaRegisterNodes:        s.registerNodes,
+		uaUnregisterNodes:      s.unregisterNodes,
+		uaRead:                 s.read,
+		uaWrite:                s.write,
+		uaCreateSubscription:   s.createSubscription,
+		uaModifySubscription:   s.modifySubscription,
+		uaSetPublishingMode:    s.setPublishingMode,
+		uaDeleteSubscriptions:  s.deleteSubscriptions,
+		uaCreateMonitoredItems: s.createMonitoredItems,
+		uaModifyMonitoredItems: s.modifyMonitoredItems,
+		uaSetMonitoringMode:    s.setMonitoringMode,
+		uaDeleteMonitoredItems: s.deleteMonitoredItems,
+		uaPublish:              s.publish,
+		uaRepublish:            s.republish,
+	}
+}
+
+// endpointURL is the URL the client used to reach the server, which is
+// what it expects to find among the endpoints.
+func (s *opcuaServer) endpointURL(c *uaChannel, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if c.endpoint != "" {
+		return c.endpoint
+	}
+	return "opc.tcp://" + s.ln.Addr().String()
+}
+
+func (s *opcuaServer) applicationDescription(b *uaBuf, url string) {
+	b.str("urn:sensor-gen")
+	b.str("https://github.com/aronchick/sensor-gen")
+	b.text("sensor-gen")
+	b.i32(0) // Server
+	b.nullStr()
+	b.nullStr()
+	b.strs([]string{url})
+}
+
+func (s *opcuaServer) endpointDescription(b *uaBuf, url string) {
+	b.str(url)
+	s.applicationDescription(b, url)
+	b.nullStr() // ServerCertificate
+	b.i32(1)    // MessageSecurityMode None
+	b.str(uaSecurityPolicyNone)
+	b.i32(1) // one UserTokenPolicy
+	b.str("anonymous")
+	b.i32(0) // Anonymous
+	b.nullStr()
+	b.nullStr()
+	b.nullStr()
+	b.str(uaTransportProfile)
+	b.WriteByte(0) // SecurityLevel
+}
+
+func (s *opcuaServer) findServers(req *uaRequest) {
+	url := s.endpointURL(req.c, req.r.str())
+	var b uaBuf
+	b.i32(1)
+	s.applicationDescription(&b, url)
+	req.reply(&b)
+}
+
+func (s *opcuaServer) getEndpoints(req *uaRequest) {
+	url := s.endpointURL(req.c, req.r.str())
+	var b uaBuf
+	b.i32(1)
+	s.endpointDescription(&b, url)
+	req.reply(&b)
+}
+
+// uaSession is a client session. Its subscriptions publish through the
+// channel the session was last activated on.
+type uaSession struct {
+	id        uaNodeID
+	name      string
+	addr      string
+	ch        *uaChannel
+	activated bool
+	timeout   time.Duration
+	lastSeen  time.Time
+
+	subs          map[uint32]*uaSubscription
+	publishQ      []*uaPublishRequest
+	continuations map[string]uaContinuation
+}
+
+// uaContinuation holds the rest of a Browse result for BrowseNext.
+type uaContinuation struct {
+	results []uaBrowseResult
+	maxRefs int
+}
+
+func (s *opcuaServer) createSession(req *uaRequest) {
+	r := req.r
+	r.applicationDescription() // ClientDescription
+	r.str()                    // ServerUri
+	endpoint := r.str()
+	name := r.str()
+	r.byteStr() // ClientNonce
+	r.byteStr() // ClientCertificate
+	timeout := time.Duration(r.f64() * float64(time.Millisecond))
+	r.u32() // MaxResponseMessageSize
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	timeout = min(max(timeout, 10*time.Second), time.Hour)
+
+	s.lastSession++
+	token := uaNodeID{NS: 1, Kind: uaIDOpaque, Str: string(uaRandom(16))}
+	sess := &uaSession{
+		id:            uaNum(1, s.lastSession),
+		name:          name,
+		addr:          req.c.conn.RemoteAddr().String(),
+		timeout:       timeout,
+		lastSeen:      time.Now(),
+		subs:          make(map[uint32]*uaSubscription),
+		continuations: make(map[string]uaContinuation),
+	}
+	s.sessions[token] = sess
+
+	url := s.endpointURL(req.c, endpoint)
+	var b uaBuf
+	b.nodeID(sess.id)
+	b.nodeID(token)
+	b.f64(float64(timeout / time.Millisecond))
+	b.byteStr(uaRandom(32)) // ServerNonce
+	b.nullStr()             // ServerCertificate
+	b.i32(1)
+	s.endpointDescription(&b, url)
+	b.i32(0)    // ServerSoftwareCertificates
+	b.nullStr() // ServerSignature.Algorithm
+	b.nullStr() // ServerSignature.Signature
+	b.u32(uaMaxMessageSize)
+	req.reply(&b)
+}
+
+func (s *opcuaServer) activateSession(req *uaRequest, sess *uaSession) {
+	r := req.r
+	r.str()     // ClientSignature.Algorithm
+	r.byteStr() // ClientSignature.Signature
+	for range r.length() {
+		r.byteStr() // ClientSoftwareCertificates
+		r.byteStr()
+	}
+	r.strs() // LocaleIds
+	identity, _ := r.extObj()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if !identity.isNull() && !identity.is(uaAnonymousIdentityToken) {
+		req.fault(uaBadIdentityTokenInvalid)
+		return
+	}
+	if sess.ch != req.c {
+		sess.publishQ = nil
+	}
+	if !sess.activated {
+		slog.Info(fmt.Sprintf("Client connected: %s (OPC UA session %q)", sess.addr, sess.name), "client", sess.addr, "session", sess.name)
+	}
+	sess.ch = req.c
+	sess.activated = true
+	sess.lastSeen = time.Now()
+
+	var b uaBuf
+	b.byteStr(uaRandom(32)) // ServerNonce
+	b.i32(0)                // Results
+	b.nullStr()             // DiagnosticInfos
+	req.reply(&b)
+}
+
+func (s *opcuaServer) closeSessionService(req *uaRequest, sess *uaSession) {
+	for token, other := range s.sessions {
+		if other == sess {
+			s.closeSession(token, sess, "closed")
+		}
+	}
+	req.reply(&uaBuf{})
+}
+
+// closeSession ends a session and its subscriptions.
+func (s *opcuaServer) closeSession(token uaNodeID, sess *uaSession, why string) {
+	for _, sub := range sess.subs {
+		sub.delete()
+	}
+	delete(s.sessions, token)
+	if sess.activated {
+		slog.Info(fmt.Sprintf("Client disconnected: %s (OPC UA session %q %s)", sess.addr, sess.name, why), "client", sess.addr, "session", sess.name)
+	}
+}
+
+func (s *opcuaServer) cancel(req *uaRequest, sess *uaSession) {
+	var b uaBuf
+	b.u32(0) // CancelCount
+	req.reply(&b)
+}
+
+// uaBrowseResult is a reference returned by Browse with the result mask
+// that selects its fields.
+type uaBrowseResult struct {
+	ref  uaRef
+	mask uint32
+}
+
+func (s *opcuaServer) browse(req *uaRequest, sess *uaSession) {
+	r := req.r
+	r.nodeID()   // View.ViewId
+	r.dateTime() // View.Timestamp
+	r.u32()      // View.ViewVersion
+	maxRefs := int(r.u32())
+	n := r.length()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if n == 0 {
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		id := r.nodeID()
+		dir := r.i32()
+		refType := r.nodeID()
+		subtypes := r.boolean()
+		classMask := r.u32()
+		resultMask := r.u32()
+		node := s.space.nodes[id]
+		var status uint32
+		switch {
+		case node == nil:
+			status = uaBadNodeIDUnknown
+		case dir < 0 || dir > 2:
+			status = uaBadBrowseDirectionInvalid
+		case !refType.isNull() && s.space.nodes[refType] == nil && !uaKnownRefType(refType):
+			status = uaBadReferenceTypeIDInvalid
+		}
+		if status != uaGood {
+			b.u32(status)
+			b.nullStr()
+			b.nullStr()
+			continue
+		}
+		var results []uaBrowseResult
+		for _, ref := range node.refs {
+			if (dir == 0 && !ref.forward) || (dir == 1 && ref.forward) {
+				continue
+			}
+			if !uaRefMatches(ref.typ, refType, subtypes) {
+				continue
+			}
+			if classMask != 0 && uint32(ref.target.class)&classMask == 0 {
+				continue
+			}
+			results = append(results, uaBrowseResult{ref, resultMask})
+		}
+		sess.browseResult(&b, results, maxRefs)
+	}
+	b.nullStr() // DiagnosticInfos
+	req.reply(&b)
+}
+
+// uaKnownRefType reports whether id is one of the reference types the
+// server knows.
+func uaKnownRefType(id uaNodeID) bool {
+	n, ok := id.numeric()
+	if !ok {
+		return false
+	}
+	_, known := uaRefParents[n]
+	return known || n == uaRefReferences
+}
+
+// browseResult encodes a BrowseResult holding up to maxRefs (0 for no
+// limit) of results, keeping the rest behind a continuation point.
+func (sess *uaSession) browseResult(b *uaBuf, results []uaBrowseResult, maxRefs int) {
+	var cp []byte
+	if maxRefs > 0 && len(results) > maxRefs {
+		if len(sess.continuations) >= uaMaxContinuation {
+			b.u32(uaBadNoContinuationPoints)
+			b.nullStr()
+			b.nullStr()
+			return
+		}
+		cp = uaRandom(8)
+		sess.continuations[string(cp)] = uaContinuation{results[maxRefs:], maxRefs}
+		results = results[:maxRefs]
+	}
+	b.u32(uaGood)
+	b.byteStr(cp)
+	b.i32(int32(len(results)))
+	for _, res := range results {
+		ref, mask, target := res.ref, res.mask, res.ref.target
+		if mask&0x01 != 0 {
+			b.nodeID(uaNum(0, ref.typ))
+		} else {
+			b.nodeID(uaNodeID{})
+		}
+		b.boolean(ref.forward)
+		b.expandedNodeID(target.id)
+		if mask&0x08 != 0 {
+			b.qname(target.browseName)
+		} else {
+			b.qname(uaQName{})
+		}
+		if mask&0x10 != 0 {
+			b.text(target.displayName)
+		} else {
+			b.text("")
+		}
+		if mask&0x04 != 0 {
+			b.i32(target.class)
+		} else {
+			b.i32(0)
+		}
+		if td := target.typeDefinition(); mask&0x20 != 0 && td != nil {
+			b.expandedNodeID(td.id)
+		} else {
+			b.expandedNodeID(uaNodeID{})
+		}
+	}
+}
+
+func (s *opcuaServer) browseNext(req *uaRequest, sess *uaSession) {
+	r := req.r
+	release := r.boolean()
+	n := r.length()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if n == 0 {
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		cp := string(r.byteStr())
+		cont, ok := sess.continuations[cp]
+		delete(sess.continuations, cp)
+		switch {
+		case !ok:
+			b.u32(uaBadContinuationPointInvalid)
+			b.nullStr()
+			b.nullStr()
+		case release:
+			b.u32(uaGood)
+			b.nullStr()
+			b.nullStr()
+		default:
+			sess.browseResult(&b, cont.results, cont.maxRefs)
+		}
+	}
+	b.nullStr()
+	req.reply(&b)
+}
+
+func (s *opcuaServer) translateBrowsePaths(req *uaRequest, sess *uaSession) {
+	r := req.r
+	n := r.length()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		start := s.space.nodes[r.nodeID()]
+		current := []*uaNode{start}
+		if start == nil {
+			current = nil
+		}
+		for range r.length() {
+			refType := r.nodeID()
+			inverse := r.boolean()
+			subtypes := r.boolean()
+			name := r.qname()
+			var next []*uaNode
+			for _, node := range current {
+				for _, ref := range node.refs {
+					if ref.forward != inverse && uaRefMatches(ref.typ, refType, subtypes) && ref.target.browseName == name {
+						next = append(next, ref.target)
+					}
+				}
+			}
+			current = next
+		}
+		switch {
+		case start == nil:
+			b.u32(uaBadNodeIDUnknown)
+			b.nullStr()
+		case len(current) == 0:
+			b.u32(uaBadNoMatch)
+			b.nullStr()
+		default:
+			b.u32(uaGood)
+			b.i32(int32(len(current)))
+			for _, node := range current {
+				b.expandedNodeID(node.id)
+				b.u32(math.MaxUint32) // RemainingPathIndex
+			}
+		}
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	b.nullStr()
+	req.reply(&b)
+}
+
+// registerNodes hands the node IDs back unchanged: lookups are already
+// cheap.
+func (s *opcuaServer) registerNodes(req *uaRequest, sess *uaSession) {
+	r := req.r
+	var b uaBuf
+	n := r.length()
+	b.i32(int32(n))
+	for range n {
+		b.nodeID(r.nodeID())
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	req.reply(&b)
+}
+
+func (s *opcuaServer) unregisterNodes(req *uaRequest, sess *uaSession) {
+	req.reply(&uaBuf{})
+}
+
+func (s *opcuaServer) read(req *uaRequest, sess *uaSession) {
+	r := req.r
+	r.f64() // MaxAge: values are always current
+	ts := r.i32()
+	n := r.length()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if ts < 0 || ts > uaTimestampsNeither {
+		req.fault(uaBadTimestampsToReturnInvalid)
+		return
+	}
+	if n == 0 {
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		id := r.nodeID()
+		attr := r.u32()
+		r.str()   // IndexRange
+		r.qname() // DataEncoding
+		if node := s.space.nodes[id]; node != nil {
+			b.dataValue(node.read(attr), ts)
+		} else {
+			b.dataValue(uaDataValue{Status: uaBadNodeIDUnknown}, ts)
+		}
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	b.nullStr()
+	req.reply(&b)
+}
+
+// write rejects every write: the sensors are driven by the simulation.
+func (s *opcuaServer) write(req *uaRequest, sess *uaSession) {
+	n := req.r.length()
+	if n == 0 {
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.statuses(slices.Repeat([]uint32{uaBadNotWritable}, n))
+	b.nullStr()
+	req.reply(&b)
+}
+
+// uaRandom returns n random bytes.
+func uaRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// OPC UA binary encoding (Part 6, section 5.2) of the built-in types the
+// server uses. Everything is little-endian; strings and arrays carry an
+// Int32 length where -1 means null.
+
+// uaNodeID is a NodeId. It is comparable, so it can key maps.
+type uaNodeID struct {
+	NS   uint16
+	Kind byte   // uaIDNumeric, uaIDString, uaIDGUID or uaIDOpaque
+	Num  uint32 // numeric identifier
+	Str  string // string identifier, or the raw bytes of a GUID or opaque one
+}
+
+// NodeId identifier types.
+const (
+	uaIDNumeric = iota
+	uaIDString
+	uaIDGUID
+	uaIDOpaque
+)
+
+func uaNum(ns uint16, n uint32) uaNodeID    { return uaNodeID{NS: ns, Num: n} }
+func uaStr(ns uint16, s string) uaNodeID    { return uaNodeID{NS: ns, Kind: uaIDString, Str: s} }
+func (id uaNodeID) isNull() bool            { return id == uaNodeID{} }
+func (id uaNodeID) is(ns0 uint32) bool      { return id == uaNum(0, ns0) }
+func (id uaNodeID) numeric() (uint32, bool) { return id.Num, id.NS == 0 && id.Kind == uaIDNumeric }
+
+// uaQName is a QualifiedName.
+type uaQName struct {
+	NS   uint16
+	Name string
+}
+
+// uaText is a LocalizedText without a locale.
+type uaText string
+
+// uaExtObj is an ExtensionObject holding a binary-encoded structure,
+// identified by the NodeId of its DefaultBinary encoding.
+type uaExtObj struct {
+	TypeID uint32
+	Body   []byte
+}
+
+// uaStatus is a StatusCode carried in a Variant.
+type uaStatus uint32
+
+// uaDataValue is a value with its status and timestamps.
+type uaDataValue struct {
+	Value  any // nil for no value
+	Status uint32
+	Source time.Time
+	Server time.Time
+}
+
+// TimestampsToReturn values.
+const (
+	uaTimestampsSource = iota
+	uaTimestampsServer
+	uaTimestampsBoth
+	uaTimestampsNeither
+)
+
+// uaEpochOffset is the number of 100 ns intervals between 1601-01-01, the
+// OPC UA epoch, and the Unix epoch.
+const uaEpochOffset = 116444736000000000
+
+// uaBuf encodes OPC UA built-in types.
+type uaBuf struct{ bytes.Buffer }
+
+func (b *uaBuf) u16(v uint16) { b.Write(binary.LittleEndian.AppendUint16(nil, v)) }
+func (b *uaBuf) u32(v uint32) { b.Write(binary.LittleEndian.AppendUint32(nil, v)) }
+func (b *uaBuf) i32(v int32)  { b.u32(uint32(v)) }
+func (b *uaBuf) i64(v int64)  { b.Write(binary.LittleEndian.AppendUint64(nil, uint64(v))) }
+func (b *uaBuf) f64(v float64) {
+	b.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func (b *uaBuf) boolean(v bool) {
+	if v {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+}
+
+func (b *uaBuf) str(s string) {
+	b.i32(int32(len(s)))
+	b.WriteString(s)
+}
+
+// nullStr encodes a null String, also used for empty arrays of any type.
+func (b *uaBuf) nullStr() { b.i32(-1) }
+
+func (b *uaBuf) byteStr(v []byte) {
+	if v == nil {
+		b.nullStr()
+		return
+	}
+	b.i32(int32(len(v)))
+	b.Write(v)
+}
+
+func (b *uaBuf) strs(v []string) {
+	b.i32(int32(len(v)))
+	for _, s := range v {
+		b.str(s)
+	}
+}
+
+func (b *uaBuf) statuses(v []uint32) {
+	b.i32(int32(len(v)))
+	for _, s := range v {
+		b.u32(s)
+	}
+}
+
+func (b *uaBuf) dateTime(t time.Time) {
+	if t.IsZero() {
+		b.i64(0)
+		return
+	}
+	b.i64(t.UnixNano()/100 + uaEpochOffset)
+}
+
+func (b *uaBuf) nodeID(id uaNodeID) {
+	switch {
+	case id.Kind == uaIDNumeric && id.NS == 0 && id.Num <= 0xff:
+		b.WriteByte(0x00)
+		b.WriteByte(byte(id.Num))
+	case id.Kind == uaIDNumeric && id.NS <= 0xff && id.Num <= 0xffff:
+		b.WriteByte(0x01)
+		b.WriteByte(byte(id.NS))
+		b.u16(uint16(id.Num))
+	case id.Kind == uaIDNumeric:
+		b.WriteByte(0x02)
+		b.u16(id.NS)
+		b.u32(id.Num)
+	case id.Kind == uaIDString:
+		b.WriteByte(0x03)
+		b.u16(id.NS)
+		b.str(id.Str)
+	case id.Kind == uaIDGUID:
+		b.WriteByte(0x04)
+		b.u16(id.NS)
+		b.WriteString(id.Str)
+	default:
+		b.WriteByte(0x05)
+		b.u16(id.NS)
+		b.str(id.Str)
+	}
+}
+
+// expandedNodeID encodes id as an ExpandedNodeId without namespace URI or
+// server index.
+func (b *uaBuf) expandedNodeID(id uaNodeID) { b.nodeID(id) }
+
+func (b *uaBuf) qname(q uaQName) {
+	b.u16(q.NS)
+	b.str(q.Name)
+}
+
+func (b *uaBuf) text(s uaText) {
+	if s == "" {
+		b.WriteByte(0)
+		return
+	}
+	b.WriteByte(0x02)
+	b.str(string(s))
+}
+
+func (b *uaBuf) extObj(e uaExtObj) {
+	if e.TypeID == 0 {
+		b.nullExtObj()
+		return
+	}
+	b.nodeID(uaNum(0, e.TypeID))
+	b.WriteByte(0x01)
+	b.byteStr(e.Body)
+}
+
+func (b *uaBuf) nullExtObj() {
+	b.nodeID(uaNodeID{})
+	b.WriteByte(0)
+}
+
+// Variant built-in type IDs.
+const (
+	uaTypeBoolean       = 1
+	uaTypeByte          = 3
+	uaTypeInt32         = 6
+	uaTypeUInt32        = 7
+	uaTypeDouble        = 11
+	uaTypeString        = 12
+	uaTypeDateTime      = 13
+	uaTypeByteString    = 15
+	uaTypeNodeID        = 17
+	uaTypeStatusCode    = 19
+	uaTypeQualifiedName = 20
+	uaTypeLocalizedText = 21
+	uaTypeExtObj        = 22
+)
+
+// variant encodes v, which must be one of the Go types the server uses
+// for values; nil is the empty variant.
+func (b *uaBuf) variant(v any) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0)
+	case bool:
+		b.WriteByte(uaTypeBoolean)
+		b.boolean(v)
+	case byte:
+		b.WriteByte(uaTypeByte)
+		b.WriteByte(v)
+	case int32:
+		b.WriteByte(uaTypeInt32)
+		b.i32(v)
+	case uint32:
+		b.WriteByte(uaTypeUInt32)
+		b.u32(v)
+	case float64:
+		b.WriteByte(uaTypeDouble)
+		b.f64(v)
+	case string:
+		b.WriteByte(uaTypeString)
+		b.str(v)
+	case []string:
+		b.WriteByte(uaTypeString | 0x80)
+		b.strs(v)
+	case time.Time:
+		b.WriteByte(uaTypeDateTime)
+		b.dateTime(v)
+	case uaNodeID:
+		b.WriteByte(uaTypeNodeID)
+		b.nodeID(v)
+	case uaStatus:
+		b.WriteByte(uaTypeStatusCode)
+		b.u32(uint32(v))
+	case uaQName:
+		b.WriteByte(uaTypeQualifiedName)
+		b.qname(v)
+	case uaText:
+		b.WriteByte(uaTypeLocalizedText)
+		b.text(v)
+	case uaExtObj:
+		b.WriteByte(uaTypeExtObj)
+		b.extObj(v)
+	default:
+		panic("opcua: no variant encoding for value")
+	}
+}
+
+// dataValue encodes dv with the timestamps selected by ts.
+func (b *uaBuf) dataValue(dv uaDataValue, ts int32) {
+	var mask byte
+	if dv.Value != nil {
+		mask |= 0x01
+	}
+	if dv.Status != 0 {
+		mask |= 0x02
+	}
+	source := !dv.Source.IsZero() && (ts == uaTimestampsSource || ts == uaTimestampsBoth)
+	server := !dv.Server.IsZero() && (ts == uaTimestampsServer || ts == uaTimestampsBoth)
+	if source {
+		mask |= 0x04
+	}
+	if server {
+		mask |= 0x08
+	}
+	b.WriteByte(mask)
+	if dv.Value != nil {
+		b.variant(dv.Value)
+	}
+	if dv.Status != 0 {
+		b.u32(dv.Status)
+	}
+	if source {
+		b.dateTime(dv.Source)
+	}
+	if server {
+		b.dateTime(dv.Server)
+	}
+}
+
+// responseHeader encodes a ResponseHeader without diagnostics.
+func (b *uaBuf) responseHeader(handle, status uint32) {
+	b.dateTime(time.Now())
+	b.u32(handle)
+	b.u32(status)
+	b.WriteByte(0) // ServiceDiagnostics
+	b.nullStr()    // StringTable
+	b.nullExtObj() // AdditionalHeader
+}
+
+var errUADecoding = errors.New("opcua: malformed message")
+
+// uaReader decodes OPC UA built-in types. The first error sticks: later
+// reads return zero values and err reports what went wrong.
+type uaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *uaReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.b) {
+		r.err = errUADecoding
+		return make([]byte, max(n, 0))
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *uaReader) u8() byte        { return r.take(1)[0] }
+func (r *uaReader) boolean() bool   { return r.u8() != 0 }
+func (r *uaReader) u16() uint16     { return binary.LittleEndian.Uint16(r.take(2)) }
+func (r *uaReader) u32() uint32     { return binary.LittleEndian.Uint32(r.take(4)) }
+func (r *uaReader) i32() int32      { return int32(r.u32()) }
+func (r *uaReader) i64() int64      { return int64(binary.LittleEndian.Uint64(r.take(8))) }
+func (r *uaReader) f64() float64    { return math.Float64frombits(binary.LittleEndian.Uint64(r.take(8))) }
+func (r *uaReader) dateTime() int64 { return r.i64() }
+
+// length reads an array or string length, treating null as empty and
+// rejecting lengths the rest of the message cannot hold.
+func (r *uaReader) length() int {
+	n := r.i32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(r.b) {
+		r.err = errUADecoding
+		return 0
+	}
+	return int(n)
+}
+
+func (r *uaReader) str() string     { return string(r.take(r.length())) }
+func (r *uaReader) byteStr() []byte { return r.take(r.length()) }
+
+func (r *uaReader) strs() []string {
+	n := r.length()
+	var v []string
+	for range n {
+		v = append(v, r.str())
+	}
+	return v
+}
+
+func (r *uaReader) u32s() []uint32 {
+	n := r.length()
+	var v []uint32
+	for range n {
+		v = append(v, r.u32())
+	}
+	return v
+}
+
+func (r *uaReader) nodeID() uaNodeID {
+	switch enc := r.u8(); enc & 0x3f {
+	case 0x00:
+		return uaNum(0, uint32(r.u8()))
+	case 0x01:
+		ns := uint16(r.u8())
+		return uaNum(ns, uint32(r.u16()))
+	case 0x02:
+		ns := r.u16()
+		return uaNum(ns, r.u32())
+	case 0x03:
+		ns := r.u16()
+		return uaStr(ns, r.str())
+	case 0x04:
+		ns := r.u16()
+		return uaNodeID{NS: ns, Kind: uaIDGUID, Str: string(r.take(16))}
+	case 0x05:
+		ns := r.u16()
+		return uaNodeID{NS: ns, Kind: uaIDOpaque, Str: string(r.byteStr())}
+	default:
+		r.err = errUADecoding
+		return uaNodeID{}
+	}
+}
+
+// expandedNodeID reads an ExpandedNodeId, discarding any namespace URI and
+// server index.
+func (r *uaReader) expandedNodeID() uaNodeID {
+	if len(r.b) == 0 {
+		r.err = errUADecoding
+		return uaNodeID{}
+	}
+	flags := r.b[0]
+	id := r.nodeID()
+	if flags&0x80 != 0 {
+		r.str()
+	}
+	if flags&0x40 != 0 {
+		r.u32()
+	}
+	return id
+}
+
+func (r *uaReader) qname() uaQName {
+	ns := r.u16()
+	return uaQName{NS: ns, Name: r.str()}
+}
+
+func (r *uaReader) text() string {
+	mask := r.u8()
+	if mask&0x01 != 0 {
+		r.str() // locale
+	}
+	if mask&0x02 != 0 {
+		return r.str()
+	}
+	return ""
+}
+
+// extObj reads an ExtensionObject, returning its encoding's NodeId and,
+// for binary bodies, the body.
+func (r *uaReader) extObj() (uaNodeID, []byte) {
+	id := r.nodeID()
+	switch r.u8() {
+	case 0x00:
+		return id, nil
+	case 0x01, 0x02:
+		return id, r.byteStr()
+	default:
+		r.err = errUADecoding
+		return id, nil
+	}
+}
+
+// requestHeader reads a RequestHeader, returning the authentication token,
+// request handle and timeout hint.
+func (r *uaReader) requestHeader() (token uaNodeID, handle uint32, timeout time.Duration) {
+	token = r.nodeID()
+	r.dateTime()
+	handle = r.u32()
+	r.u32() // ReturnDiagnostics
+	r.str() // AuditEntryId
+	timeout = time.Duration(r.u32()) * time.Millisecond
+	r.extObj() // AdditionalHeader
+	return token, handle, timeout
+}
+
+// applicationDescription skips an ApplicationDescription.
+func (r *uaReader) applicationDescription() {
+	r.str()  // ApplicationUri
+	r.str()  // ProductUri
+	r.text() // ApplicationName
+	r.i32()  // ApplicationType
+	r.str()  // GatewayServerUri
+	r.str()  // DiscoveryProfileUri
+	r.strs() // DiscoveryUrls
+}
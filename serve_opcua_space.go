@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Node classes.
+const (
+	uaClassObject       = 1
+	uaClassVariable     = 2
+	uaClassObjectType   = 8
+	uaClassVariableType = 16
+)
+
+// Standard reference types (namespace 0).
+const (
+	uaRefReferences        = 31
+	uaRefNonHierarchical   = 32
+	uaRefHierarchical      = 33
+	uaRefHasChild          = 34
+	uaRefOrganizes         = 35
+	uaRefHasTypeDefinition = 40
+	uaRefAggregates        = 44
+	uaRefHasSubtype        = 45
+	uaRefHasProperty       = 46
+	uaRefHasComponent      = 47
+)
+
+// uaRefParents gives each reference type's supertype, for matching
+// references against a type and its subtypes.
+var uaRefParents = map[uint32]uint32{
+	uaRefNonHierarchical:   uaRefReferences,
+	uaRefHierarchical:      uaRefReferences,
+	uaRefHasChild:          uaRefHierarchical,
+	uaRefOrganizes:         uaRefHierarchical,
+	uaRefHasTypeDefinition: uaRefNonHierarchical,
+	uaRefAggregates:        uaRefHasChild,
+	uaRefHasSubtype:        uaRefHasChild,
+	uaRefHasProperty:       uaRefAggregates,
+	uaRefHasComponent:      uaRefAggregates,
+}
+
+// uaRefMatches reports whether a reference of type ref satisfies a filter
+// on want (null matches everything), optionally including subtypes.
+func uaRefMatches(ref uint32, want uaNodeID, subtypes bool) bool {
+	if want.isNull() {
+		return true
+	}
+	w, ok := want.numeric()
+	if !ok {
+		return false
+	}
+	for ref != 0 {
+		if ref == w {
+			return true
+		}
+		if !subtypes {
+			return false
+		}
+		ref = uaRefParents[ref]
+	}
+	return false
+}
+
+// Attribute IDs.
+const (
+	uaAttrNodeID                  = 1
+	uaAttrNodeClass               = 2
+	uaAttrBrowseName              = 3
+	uaAttrDisplayName             = 4
+	uaAttrDescription             = 5
+	uaAttrWriteMask               = 6
+	uaAttrUserWriteMask           = 7
+	uaAttrIsAbstract              = 8
+	uaAttrEventNotifier           = 12
+	uaAttrValue                   = 13
+	uaAttrDataType                = 14
+	uaAttrValueRank               = 15
+	uaAttrArrayDimensions         = 16
+	uaAttrAccessLevel             = 17
+	uaAttrUserAccessLevel         = 18
+	uaAttrMinimumSamplingInterval = 19
+	uaAttrHistorizing             = 20
+)
+
+// uaNamespace is the URI of the namespace (index 1) holding the sensors.
+const uaNamespace = "urn:sensor-gen:pipelines"
+
+// uaNode is a node of the address space. Variables either compute their
+// value on demand (server diagnostics) or hold the latest reading of a
+// sensor.
+type uaNode struct {
+	id          uaNodeID
+	class       int32
+	browseName  uaQName
+	displayName uaText
+	description uaText
+	refs        []uaRef
+
+	dataType  uaNodeID
+	valueRank int32 // -1 scalar, 1 one-dimensional array
+	value     func() any
+	current   uaDataValue  // latest reading, for sensor points
+	point     *SensorPoint // the sensor, for sensor points
+	watchers  []*uaItem    // monitored items sampling this node
+}
+
+// uaRef is a reference from a node to target.
+type uaRef struct {
+	typ     uint32
+	forward bool
+	target  *uaNode
+}
+
+// typeDefinition returns the node's type definition, or nil.
+func (n *uaNode) typeDefinition() *uaNode {
+	for _, ref := range n.refs {
+		if ref.typ == uaRefHasTypeDefinition && ref.forward {
+			return ref.target
+		}
+	}
+	return nil
+}
+
+// uaSpace is the server's address space: the standard Root, Objects and
+// Server nodes, and under Objects/Pipelines a folder per pipeline holding
+// an AnalogItem variable per sensor (ns=1;s=<sensor ID>).
+type uaSpace struct {
+	nodes  map[uaNodeID]*uaNode
+	points map[string]*uaNode // by sensor ID
+}
+
+func newUASpace(points []SensorPoint, start time.Time) *uaSpace {
+	s := &uaSpace{nodes: make(map[uaNodeID]*uaNode), points: make(map[string]*uaNode)}
+
+	// Type definitions referenced by the nodes below.
+	for _, t := range []struct {
+		id    uint32
+		class int32
+		name  string
+	}{
+		{58, uaClassObjectType, "BaseObjectType"},
+		{61, uaClassObjectType, "FolderType"},
+		{2004, uaClassObjectType, "ServerType"},
+		{63, uaClassVariableType, "BaseDataVariableType"},
+		{68, uaClassVariableType, "PropertyType"},
+		{2138, uaClassVariableType, "ServerStatusType"},
+		{3051, uaClassVariableType, "BuildInfoType"},
+		{2368, uaClassVariableType, "AnalogItemType"},
+	} {
+		s.add(nil, 0, 0, &uaNode{id: uaNum(0, t.id), class: t.class, browseName: uaQName{0, t.name}, displayName: uaText(t.name)})
+	}
+
+	root := s.folder(nil, 0, uaNum(0, 84), uaQName{0, "Root"})
+	objects := s.folder(root, uaRefOrganizes, uaNum(0, 85), uaQName{0, "Objects"})
+	s.folder(root, uaRefOrganizes, uaNum(0, 86), uaQName{0, "Types"})
+	s.folder(root, uaRefOrganizes, uaNum(0, 87), uaQName{0, "Views"})
+
+	server := s.add(objects, uaRefOrganizes, 2004, &uaNode{id: uaNum(0, 2253), class: uaClassObject, browseName: uaQName{0, "Server"}})
+	s.variable(server, uaRefHasProperty, 68, uaNum(0, 2254), "ServerArray", 12, 1, func() any { return []string{"urn:sensor-gen"} })
+	s.variable(server, uaRefHasProperty, 68, uaNum(0, 2255), "NamespaceArray", 12, 1, func() any {
+		return []string{"http://opcfoundation.org/UA/", uaNamespace}
+	})
+	s.variable(server, uaRefHasComponent, 63, uaNum(0, 2267), "ServiceLevel", 3, -1, func() any { return byte(255) })
+
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	buildInfo := func() []byte {
+		var b uaBuf
+		b.str("https://github.com/aronchick/sensor-gen")
+		b.str("sensor-gen")
+		b.str("sensor-gen")
+		b.str(version)
+		b.str(version)
+		b.dateTime(start)
+		return b.Bytes()
+	}
+	status := s.variable(server, uaRefHasComponent, 2138, uaNum(0, 2256), "ServerStatus", 862, -1, func() any {
+		var b uaBuf
+		b.dateTime(start)
+		b.dateTime(time.Now())
+		b.i32(0) // Running
+		b.Write(buildInfo())
+		b.u32(0)
+		b.text("")
+		return uaExtObj{TypeID: 864, Body: b.Bytes()}
+	})
+	s.variable(status, uaRefHasComponent, 63, uaNum(0, 2257), "StartTime", 13, -1, func() any { return start })
+	s.variable(status, uaRefHasComponent, 63, uaNum(0, 2258), "CurrentTime", 13, -1, func() any { return time.Now() })
+	s.variable(status, uaRefHasComponent, 63, uaNum(0, 2259), "State", 852, -1, func() any { return int32(0) })
+	build := s.variable(status, uaRefHasComponent, 3051, uaNum(0, 2260), "BuildInfo", 338, -1, func() any {
+		return uaExtObj{TypeID: 340, Body: buildInfo()}
+	})
+	for _, f := range []struct {
+		id   uint32
+		name string
+		v    any
+	}{
+		{2261, "ProductName", "sensor-gen"},
+		{2262, "ProductUri", "https://github.com/aronchick/sensor-gen"},
+		{2263, "ManufacturerName", "sensor-gen"},
+		{2264, "SoftwareVersion", version},
+		{2265, "BuildNumber", version},
+		{2266, "BuildDate", start},
+	} {
+		dataType := uint32(12)
+		if f.id == 2266 {
+			dataType = 13
+		}
+		s.variable(build, uaRefHasComponent, 63, uaNum(0, f.id), f.name, dataType, -1, func() any { return f.v })
+	}
+	s.variable(status, uaRefHasComponent, 63, uaNum(0, 2992), "SecondsTillShutdown", 7, -1, func() any { return uint32(0) })
+	s.variable(status, uaRefHasComponent, 63, uaNum(0, 2993), "ShutdownReason", 21, -1, func() any { return uaText("") })
+
+	pipelines := s.folder(objects, uaRefOrganizes, uaStr(1, "Pipelines"), uaQName{1, "Pipelines"})
+	folders := make(map[string]*uaNode)
+	for i := range points {
+		p := &points[i]
+		folder := folders[p.PipelineID]
+		if folder == nil {
+			folder = s.folder(pipelines, uaRefOrganizes, uaStr(1, p.PipelineID), uaQName{1, p.PipelineID})
+			folders[p.PipelineID] = folder
+		}
+		n := s.add(folder, uaRefOrganizes, 2368, &uaNode{
+			id:          uaStr(1, p.ID),
+			class:       uaClassVariable,
+			browseName:  uaQName{1, p.ID},
+			description: uaText(fmt.Sprintf("%s (%s) at mile post %.1f", p.Type, p.Unit, p.MilePost)),
+			dataType:    uaNum(0, 11),
+			valueRank:   -1,
+			current:     uaDataValue{Status: uaBadWaitingForInitialData},
+			point:       p,
+		})
+		s.points[p.ID] = n
+
+		var eu uaBuf
+		eu.f64(p.Min)
+		eu.f64(p.Max)
+		euRange := uaExtObj{TypeID: 886, Body: eu.Bytes()}
+		s.variable(n, uaRefHasProperty, 68, uaStr(1, p.ID+".EURange"), "EURange", 884, -1, func() any { return euRange })
+		var units uaBuf
+		units.str("http://www.opcfoundation.org/UA/units/un/cefact")
+		units.i32(-1)
+		units.text(uaText(p.Unit))
+		units.text(uaText(p.Unit))
+		engUnits := uaExtObj{TypeID: 889, Body: units.Bytes()}
+		s.variable(n, uaRefHasProperty, 68, uaStr(1, p.ID+".EngineeringUnits"), "EngineeringUnits", 887, -1, func() any { return engUnits })
+	}
+	return s
+}
+
+// add inserts n, referenced from parent with refType and typed by the
+// type definition typeDef (0 for none).
+func (s *uaSpace) add(parent *uaNode, refType, typeDef uint32, n *uaNode) *uaNode {
+	if n.displayName == "" {
+		n.displayName = uaText(n.browseName.Name)
+	}
+	s.nodes[n.id] = n
+	if parent != nil {
+		parent.refs = append(parent.refs, uaRef{refType, true, n})
+		n.refs = append(n.refs, uaRef{refType, false, parent})
+	}
+	if typeDef != 0 {
+		n.refs = append(n.refs, uaRef{uaRefHasTypeDefinition, true, s.nodes[uaNum(0, typeDef)]})
+	}
+	return n
+}
+
+func (s *uaSpace) folder(parent *uaNode, refType uint32, id uaNodeID, name uaQName) *uaNode {
+	return s.add(parent, refType, 61, &uaNode{id: id, class: uaClassObject, browseName: name})
+}
+
+// variable adds a read-only variable computing its value with value.
+// Standard properties and components have names in namespace 0.
+func (s *uaSpace) variable(parent *uaNode, refType, typeDef uint32, id uaNodeID, name string, dataType uint32, rank int32, value func() any) *uaNode {
+	return s.add(parent, refType, typeDef, &uaNode{
+		id:         id,
+		class:      uaClassVariable,
+		browseName: uaQName{0, name},
+		dataType:   uaNum(0, dataType),
+		valueRank:  rank,
+		value:      value,
+	})
+}
+
+// read returns the given attribute of n as a DataValue.
+func (n *uaNode) read(attr uint32) uaDataValue {
+	if attr == uaAttrValue && n.class == uaClassVariable {
+		if n.value == nil {
+			return n.current
+		}
+		now := time.Now()
+		return uaDataValue{Value: n.value(), Source: now, Server: now}
+	}
+	var v any
+	switch attr {
+	case uaAttrNodeID:
+		v = n.id
+	case uaAttrNodeClass:
+		v = n.class
+	case uaAttrBrowseName:
+		v = n.browseName
+	case uaAttrDisplayName:
+		v = n.displayName
+	case uaAttrDescription:
+		v = n.description
+	case uaAttrWriteMask, uaAttrUserWriteMask:
+		v = uint32(0)
+	}
+	switch {
+	case v != nil:
+	case n.class == uaClassObject && attr == uaAttrEventNotifier:
+		v = byte(0)
+	case (n.class == uaClassObjectType || n.class == uaClassVariableType) && attr == uaAttrIsAbstract:
+		v = false
+	case n.class == uaClassVariable:
+		switch attr {
+		case uaAttrDataType:
+			v = n.dataType
+		case uaAttrValueRank:
+			v = n.valueRank
+		case uaAttrArrayDimensions:
+			// Null: no fixed dimensions.
+			return uaDataValue{}
+		case uaAttrAccessLevel, uaAttrUserAccessLevel:
+			v = byte(1) // CurrentRead
+		case uaAttrMinimumSamplingInterval:
+			v = float64(0) // values are reported as they change
+		case uaAttrHistorizing:
+			v = false
+		}
+	}
+	if v == nil {
+		return uaDataValue{Status: uaBadAttributeIDInvalid}
+	}
+	return uaDataValue{Value: v}
+}
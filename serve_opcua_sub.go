@@ -0,0 +1,681 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// Monitoring modes.
+const (
+	uaModeDisabled  = 0
+	uaModeSampling  = 1
+	uaModeReporting = 2
+)
+
+// uaSubscription publishes data changes of its monitored items once per
+// publishing interval, answering the session's queued Publish requests,
+// and sends a keep-alive after maxKeepAlive quiet intervals. It expires
+// after lifetimeCount intervals without a Publish request to answer.
+type uaSubscription struct {
+	id               uint32
+	sess             *uaSession
+	interval         time.Duration
+	lifetimeCount    uint32
+	maxKeepAlive     uint32
+	maxNotifications uint32 // per Publish response, 0 for no limit
+	enabled          bool
+	items            map[uint32]*uaItem
+
+	next       time.Time // start of the next publishing cycle
+	seq        uint32    // sequence number of the next notification message
+	keepAlive  uint32    // cycles since the last message
+	lifetime   uint32    // cycles without a Publish request to answer
+	late       bool      // a message is due but no Publish request was queued
+	retransmit map[uint32][]byte
+}
+
+// uaItem is a monitored item: one attribute of one node, with the values
+// waiting to be reported.
+type uaItem struct {
+	id            uint32
+	sub           *uaSubscription
+	node          *uaNode
+	attr          uint32
+	clientHandle  uint32
+	mode          int32
+	ts            int32 // TimestampsToReturn
+	queueSize     uint32
+	discardOldest bool
+	trigger       int32   // DataChangeTrigger: 0 status, 1 status/value, 2 status/value/timestamp
+	deadbandType  uint32  // 0 none, 1 absolute, 2 percent of EURange
+	deadband      float64 // in the units given by deadbandType
+
+	last     uaDataValue
+	reported bool
+	queue    []uaDataValue
+}
+
+// uaPublishRequest is a queued Publish request with the results of the
+// acknowledgements it carried.
+type uaPublishRequest struct {
+	req  *uaRequest
+	acks []uint32
+}
+
+// offer samples a new value, queueing it if it passes the item's filter.
+func (item *uaItem) offer(dv uaDataValue) {
+	if item.mode == uaModeDisabled || (item.reported && !item.changed(dv)) {
+		return
+	}
+	item.last, item.reported = dv, true
+	if len(item.queue) >= int(item.queueSize) {
+		if !item.discardOldest {
+			item.queue[len(item.queue)-1] = dv
+			return
+		}
+		item.queue = item.queue[1:]
+	}
+	item.queue = append(item.queue, dv)
+}
+
+// changed applies the item's DataChangeFilter to dv.
+func (item *uaItem) changed(dv uaDataValue) bool {
+	last := item.last
+	if dv.Status != last.Status {
+		return true
+	}
+	if item.trigger == 0 {
+		return false
+	}
+	if item.trigger == 2 && !dv.Source.Equal(last.Source) {
+		return true
+	}
+	v, ok := dv.Value.(float64)
+	lv, lok := last.Value.(float64)
+	if !ok || !lok {
+		return !reflect.DeepEqual(dv.Value, last.Value)
+	}
+	diff := math.Abs(v - lv)
+	switch item.deadbandType {
+	case 1:
+		return diff > item.deadband
+	case 2:
+		return diff > item.deadband/100*(item.node.point.Max-item.node.point.Min)
+	}
+	return diff != 0
+}
+
+// reporting reports whether the item has values to publish.
+func (item *uaItem) reporting() bool {
+	return item.mode == uaModeReporting && len(item.queue) > 0
+}
+
+func (sub *uaSubscription) hasNotifications() bool {
+	for _, item := range sub.items {
+		if item.reporting() {
+			return true
+		}
+	}
+	return false
+}
+
+// revise applies requested subscription parameters within the server's
+// limits.
+func (sub *uaSubscription) revise(intervalMs float64, lifetime, keepAlive uint32) {
+	interval := uaMinInterval
+	if !math.IsNaN(intervalMs) && intervalMs > 0 {
+		interval = min(max(time.Duration(intervalMs*float64(time.Millisecond)), uaMinInterval), time.Hour)
+	}
+	if keepAlive == 0 {
+		keepAlive = 10
+	}
+	keepAlive = min(keepAlive, 10000)
+	sub.interval = interval
+	sub.maxKeepAlive = keepAlive
+	sub.lifetimeCount = max(lifetime, 3*keepAlive)
+}
+
+// publishCycle runs one publishing interval of sub.
+func (s *opcuaServer) publishCycle(sub *uaSubscription, now time.Time) {
+	// Computed values (server time, status) are sampled each cycle;
+	// sensor values arrive with the readings.
+	for _, item := range sub.items {
+		if item.node.value != nil && item.attr == uaAttrValue {
+			item.offer(item.node.read(uaAttrValue))
+		}
+	}
+
+	sess := sub.sess
+	if sub.enabled && sub.hasNotifications() {
+		if len(sess.publishQ) == 0 {
+			sub.starved()
+			return
+		}
+		for sub.hasNotifications() && len(sess.publishQ) > 0 {
+			sub.sendNotifications(sess.nextPublish(), now)
+		}
+		return
+	}
+	sub.keepAlive++
+	if sub.keepAlive < sub.maxKeepAlive {
+		return
+	}
+	if len(sess.publishQ) == 0 {
+		sub.starved()
+		return
+	}
+	sub.sendKeepAlive(sess.nextPublish(), now)
+}
+
+// starved notes a cycle in which a message was due but the client had no
+// Publish request outstanding, expiring the subscription once its lifetime
+// runs out.
+func (sub *uaSubscription) starved() {
+	sub.late = true
+	sub.lifetime++
+	if sub.lifetime >= sub.lifetimeCount {
+		sub.delete()
+	}
+}
+
+func (sess *uaSession) nextPublish() *uaPublishRequest {
+	pr := sess.publishQ[0]
+	sess.publishQ = sess.publishQ[1:]
+	return pr
+}
+
+// sendNotifications answers pr with the queued values of sub's items, up
+// to maxNotifications.
+func (sub *uaSubscription) sendNotifications(pr *uaPublishRequest, now time.Time) {
+	var items uaBuf
+	count := 0
+	for _, item := range sub.items {
+		for item.reporting() && (sub.maxNotifications == 0 || count < int(sub.maxNotifications)) {
+			items.u32(item.clientHandle)
+			items.dataValue(item.queue[0], item.ts)
+			item.queue = item.queue[1:]
+			count++
+		}
+		if len(item.queue) == 0 {
+			item.queue = nil
+		}
+	}
+	var dcn uaBuf
+	dcn.i32(int32(count))
+	dcn.Write(items.Bytes())
+	dcn.nullStr() // DiagnosticInfos
+
+	var msg uaBuf
+	msg.u32(sub.seq)
+	msg.dateTime(now)
+	msg.i32(1)
+	msg.extObj(uaExtObj{TypeID: uaDataChangeNotification, Body: dcn.Bytes()})
+	sub.retransmit[sub.seq] = msg.Bytes()
+	if len(sub.retransmit) > uaMaxRetransmit {
+		delete(sub.retransmit, slices.Min(sub.available()))
+	}
+	sub.seq++
+	if sub.seq == 0 {
+		sub.seq = 1
+	}
+	sub.respond(pr, sub.hasNotifications(), msg.Bytes())
+}
+
+// sendKeepAlive answers pr with an empty notification message carrying the
+// next sequence number.
+func (sub *uaSubscription) sendKeepAlive(pr *uaPublishRequest, now time.Time) {
+	var msg uaBuf
+	msg.u32(sub.seq)
+	msg.dateTime(now)
+	msg.i32(0)
+	sub.respond(pr, false, msg.Bytes())
+}
+
+func (sub *uaSubscription) respond(pr *uaPublishRequest, more bool, msg []byte) {
+	sub.keepAlive, sub.lifetime, sub.late = 0, 0, false
+	var b uaBuf
+	b.u32(sub.id)
+	available := sub.available()
+	slices.Sort(available)
+	b.i32(int32(len(available)))
+	for _, seq := range available {
+		b.u32(seq)
+	}
+	b.boolean(more)
+	b.Write(msg)
+	b.statuses(pr.acks)
+	b.nullStr() // DiagnosticInfos
+	pr.req.reply(&b)
+}
+
+// available lists the sequence numbers kept for Republish.
+func (sub *uaSubscription) available() []uint32 {
+	seqs := make([]uint32, 0, len(sub.retransmit))
+	for seq := range sub.retransmit {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// delete removes sub from its session, failing queued Publish requests
+// once the session has no subscriptions left.
+func (sub *uaSubscription) delete() {
+	for _, item := range sub.items {
+		item.unwatch()
+	}
+	sess := sub.sess
+	delete(sess.subs, sub.id)
+	if len(sess.subs) == 0 {
+		for _, pr := range sess.publishQ {
+			pr.req.fault(uaBadNoSubscription)
+		}
+		sess.publishQ = nil
+	}
+}
+
+func (item *uaItem) unwatch() {
+	item.node.watchers = slices.DeleteFunc(item.node.watchers, func(w *uaItem) bool { return w == item })
+}
+
+func (s *opcuaServer) publish(req *uaRequest, sess *uaSession) {
+	r := req.r
+	n := r.length()
+	acks := make([]uint32, 0, n)
+	for range n {
+		sub := sess.subs[r.u32()]
+		seq := r.u32()
+		switch {
+		case sub == nil:
+			acks = append(acks, uaBadSubscriptionIDInvalid)
+		case sub.retransmit[seq] != nil:
+			delete(sub.retransmit, seq)
+			acks = append(acks, uaGood)
+		default:
+			acks = append(acks, uaBadSequenceNumberUnknown)
+		}
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	if len(sess.subs) == 0 {
+		req.fault(uaBadNoSubscription)
+		return
+	}
+	sess.publishQ = append(sess.publishQ, &uaPublishRequest{req, acks})
+	if len(sess.publishQ) > uaMaxPublishQueue {
+		sess.nextPublish().req.fault(uaBadTooManyPublishRequests)
+	}
+
+	// Subscriptions that were waiting for a request are served now.
+	ids := make([]uint32, 0, len(sess.subs))
+	for id := range sess.subs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	now := time.Now()
+	for _, id := range ids {
+		sub := sess.subs[id]
+		if !sub.late || len(sess.publishQ) == 0 {
+			continue
+		}
+		if sub.enabled && sub.hasNotifications() {
+			sub.sendNotifications(sess.nextPublish(), now)
+		} else {
+			sub.sendKeepAlive(sess.nextPublish(), now)
+		}
+	}
+}
+
+func (s *opcuaServer) republish(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	seq := r.u32()
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+	case sub.retransmit[seq] == nil:
+		req.fault(uaBadMessageNotAvailable)
+	default:
+		var b uaBuf
+		b.Write(sub.retransmit[seq])
+		req.reply(&b)
+	}
+}
+
+func (s *opcuaServer) createSubscription(req *uaRequest, sess *uaSession) {
+	r := req.r
+	interval := r.f64()
+	lifetime := r.u32()
+	keepAlive := r.u32()
+	maxNotifications := r.u32()
+	enabled := r.boolean()
+	r.u8() // Priority
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	s.lastSub++
+	sub := &uaSubscription{
+		id:               s.lastSub,
+		sess:             sess,
+		maxNotifications: maxNotifications,
+		enabled:          enabled,
+		items:            make(map[uint32]*uaItem),
+		seq:              1,
+		retransmit:       make(map[uint32][]byte),
+	}
+	sub.revise(interval, lifetime, keepAlive)
+	// The first cycle sends a keep-alive if there is nothing to report.
+	sub.keepAlive = sub.maxKeepAlive
+	sub.next = time.Now().Add(sub.interval)
+	sess.subs[sub.id] = sub
+
+	var b uaBuf
+	b.u32(sub.id)
+	b.f64(float64(sub.interval) / float64(time.Millisecond))
+	b.u32(sub.lifetimeCount)
+	b.u32(sub.maxKeepAlive)
+	req.reply(&b)
+}
+
+func (s *opcuaServer) modifySubscription(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	interval := r.f64()
+	lifetime := r.u32()
+	keepAlive := r.u32()
+	maxNotifications := r.u32()
+	r.u8() // Priority
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+		return
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	sub.revise(interval, lifetime, keepAlive)
+	sub.maxNotifications = maxNotifications
+	var b uaBuf
+	b.f64(float64(sub.interval) / float64(time.Millisecond))
+	b.u32(sub.lifetimeCount)
+	b.u32(sub.maxKeepAlive)
+	req.reply(&b)
+}
+
+func (s *opcuaServer) setPublishingMode(req *uaRequest, sess *uaSession) {
+	r := req.r
+	enabled := r.boolean()
+	ids := r.u32s()
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		if sub := sess.subs[id]; sub != nil {
+			sub.enabled = enabled
+		} else {
+			results[i] = uaBadSubscriptionIDInvalid
+		}
+	}
+	s.replyResults(req, results)
+}
+
+func (s *opcuaServer) deleteSubscriptions(req *uaRequest, sess *uaSession) {
+	ids := req.r.u32s()
+	if req.r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		if sub := sess.subs[id]; sub != nil {
+			sub.delete()
+		} else {
+			results[i] = uaBadSubscriptionIDInvalid
+		}
+	}
+	s.replyResults(req, results)
+}
+
+// replyResults answers a request whose response is a list of status codes
+// and diagnostics.
+func (s *opcuaServer) replyResults(req *uaRequest, results []uint32) {
+	if len(results) == 0 {
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.statuses(results)
+	b.nullStr()
+	req.reply(&b)
+}
+
+// parameters reads MonitoringParameters into item, returning a bad
+// status if they cannot be applied.
+func (item *uaItem) parameters(r *uaReader) uint32 {
+	item.clientHandle = r.u32()
+	r.f64() // SamplingInterval: values are reported as they change
+	filterType, filter := r.extObj()
+	queueSize := r.u32()
+	item.discardOldest = r.boolean()
+	item.queueSize = min(max(queueSize, 1), 1000)
+	if len(item.queue) > int(item.queueSize) {
+		item.queue = item.queue[len(item.queue)-int(item.queueSize):]
+	}
+
+	item.trigger, item.deadbandType, item.deadband = 1, 0, 0
+	switch {
+	case filterType.isNull():
+		return uaGood
+	case !filterType.is(uaDataChangeFilter) || item.attr != uaAttrValue:
+		return uaBadMonitoredItemFilterInvalid
+	}
+	f := &uaReader{b: filter}
+	item.trigger = f.i32()
+	item.deadbandType = f.u32()
+	item.deadband = f.f64()
+	switch {
+	case f.err != nil || item.trigger < 0 || item.trigger > 2:
+		return uaBadMonitoredItemFilterInvalid
+	case item.deadbandType > 2 || item.deadband < 0 || math.IsNaN(item.deadband):
+		return uaBadDeadbandFilterInvalid
+	case item.deadbandType == 2 && (item.node.point == nil || item.deadband > 100):
+		return uaBadDeadbandFilterInvalid
+	}
+	return uaGood
+}
+
+// samplingInterval is the revised sampling interval reported for item in
+// milliseconds: sensor values are reported as they change, computed ones
+// every publishing cycle.
+func (item *uaItem) samplingInterval() float64 {
+	if item.node.value != nil {
+		return float64(item.sub.interval) / float64(time.Millisecond)
+	}
+	return 0
+}
+
+func (s *opcuaServer) createMonitoredItems(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	ts := r.i32()
+	n := r.length()
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+		return
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+		return
+	case ts < 0 || ts > uaTimestampsNeither:
+		req.fault(uaBadTimestampsToReturnInvalid)
+		return
+	case n == 0:
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		id := r.nodeID()
+		item := &uaItem{sub: sub, node: s.space.nodes[id], attr: r.u32(), ts: ts}
+		r.str()   // IndexRange
+		r.qname() // DataEncoding
+		item.mode = r.i32()
+		var status uint32
+		switch {
+		case item.node == nil:
+			status = uaBadNodeIDUnknown
+			item.node = &uaNode{}
+		case item.node.read(item.attr).Status == uaBadAttributeIDInvalid:
+			status = uaBadAttributeIDInvalid
+		case item.mode < uaModeDisabled || item.mode > uaModeReporting:
+			status = uaBadMonitoringModeInvalid
+		}
+		if st := item.parameters(r); status == uaGood {
+			status = st
+		}
+		if status != uaGood {
+			b.u32(status)
+			b.u32(0)
+			b.f64(0)
+			b.u32(0)
+			b.nullExtObj()
+			continue
+		}
+		s.lastItem++
+		item.id = s.lastItem
+		sub.items[item.id] = item
+		if item.node.value == nil && item.attr == uaAttrValue {
+			item.node.watchers = append(item.node.watchers, item)
+		}
+		// The current value is always reported first.
+		item.offer(item.node.read(item.attr))
+
+		b.u32(uaGood)
+		b.u32(item.id)
+		b.f64(item.samplingInterval())
+		b.u32(item.queueSize)
+		b.nullExtObj() // FilterResult
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	b.nullStr()
+	req.reply(&b)
+}
+
+func (s *opcuaServer) modifyMonitoredItems(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	ts := r.i32()
+	n := r.length()
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+		return
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+		return
+	case ts < 0 || ts > uaTimestampsNeither:
+		req.fault(uaBadTimestampsToReturnInvalid)
+		return
+	case n == 0:
+		req.fault(uaBadNothingToDo)
+		return
+	}
+	var b uaBuf
+	b.i32(int32(n))
+	for range n {
+		item := sub.items[r.u32()]
+		status := uint32(uaBadMonitoredItemIDInvalid)
+		if item != nil {
+			item.ts = ts
+			status = item.parameters(r)
+		} else {
+			(&uaItem{node: &uaNode{}}).parameters(r)
+		}
+		b.u32(status)
+		if item != nil {
+			b.f64(item.samplingInterval())
+			b.u32(item.queueSize)
+		} else {
+			b.f64(0)
+			b.u32(0)
+		}
+		b.nullExtObj()
+	}
+	if r.err != nil {
+		req.fault(uaBadDecodingError)
+		return
+	}
+	b.nullStr()
+	req.reply(&b)
+}
+
+func (s *opcuaServer) setMonitoringMode(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	mode := r.i32()
+	ids := r.u32s()
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+		return
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+		return
+	case mode < uaModeDisabled || mode > uaModeReporting:
+		req.fault(uaBadMonitoringModeInvalid)
+		return
+	}
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		item := sub.items[id]
+		if item == nil {
+			results[i] = uaBadMonitoredItemIDInvalid
+			continue
+		}
+		if mode == uaModeDisabled {
+			item.queue, item.reported = nil, false
+		} else if item.mode == uaModeDisabled {
+			item.mode = mode
+			item.offer(item.node.read(item.attr))
+		}
+		item.mode = mode
+	}
+	s.replyResults(req, results)
+}
+
+func (s *opcuaServer) deleteMonitoredItems(req *uaRequest, sess *uaSession) {
+	r := req.r
+	sub := sess.subs[r.u32()]
+	ids := r.u32s()
+	switch {
+	case r.err != nil:
+		req.fault(uaBadDecodingError)
+		return
+	case sub == nil:
+		req.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	results := make([]uint32, len(ids))
+	for i, id := range ids {
+		item := sub.items[id]
+		if item == nil {
+			results[i] = uaBadMonitoredItemIDInvalid
+			continue
+		}
+		item.unwatch()
+		delete(sub.items, id)
+	}
+	s.replyResults(req, results)
+}
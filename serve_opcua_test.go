@@ -0,0 +1,730 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readUAVariant decodes the variant types the server encodes.
+func readUAVariant(r *uaReader) any {
+	switch typ := r.u8(); typ {
+	case 0:
+		return nil
+	case uaTypeBoolean:
+		return r.boolean()
+	case uaTypeByte:
+		return r.u8()
+	case uaTypeInt32:
+		return r.i32()
+	case uaTypeUInt32:
+		return r.u32()
+	case uaTypeDouble:
+		return r.f64()
+	case uaTypeString:
+		return r.str()
+	case uaTypeString | 0x80:
+		return r.strs()
+	case uaTypeDateTime:
+		return uaTime(r.dateTime())
+	case uaTypeNodeID:
+		return r.nodeID()
+	case uaTypeStatusCode:
+		return uaStatus(r.u32())
+	case uaTypeQualifiedName:
+		return r.qname()
+	case uaTypeLocalizedText:
+		return uaText(r.text())
+	case uaTypeExtObj:
+		id, body := r.extObj()
+		n, _ := id.numeric()
+		return uaExtObj{TypeID: n, Body: body}
+	default:
+		r.err = fmt.Errorf("variant type %d", typ)
+		return nil
+	}
+}
+
+func readUADataValue(r *uaReader) uaDataValue {
+	var dv uaDataValue
+	mask := r.u8()
+	if mask&0x01 != 0 {
+		dv.Value = readUAVariant(r)
+	}
+	if mask&0x02 != 0 {
+		dv.Status = r.u32()
+	}
+	if mask&0x04 != 0 {
+		dv.Source = uaTime(r.dateTime())
+	}
+	if mask&0x08 != 0 {
+		dv.Server = uaTime(r.dateTime())
+	}
+	return dv
+}
+
+func uaTime(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (v-uaEpochOffset)*100)
+}
+
+func TestUANodeIDEncoding(t *testing.T) {
+	tests := []struct {
+		id   uaNodeID
+		want []byte
+	}{
+		{uaNum(0, 85), []byte{0x00, 85}},
+		{uaNum(1, 1000), []byte{0x01, 1, 0xe8, 0x03}},
+		{uaNum(2, 70000), []byte{0x02, 2, 0, 0x70, 0x11, 0x01, 0}},
+		{uaNum(300, 5), []byte{0x02, 0x2c, 0x01, 5, 0, 0, 0}},
+		{uaStr(1, "P1"), []byte{0x03, 1, 0, 2, 0, 0, 0, 'P', '1'}},
+		{uaNodeID{NS: 1, Kind: uaIDGUID, Str: "0123456789abcdef"}, append([]byte{0x04, 1, 0}, "0123456789abcdef"...)},
+		{uaNodeID{NS: 1, Kind: uaIDOpaque, Str: "\x01\x02"}, []byte{0x05, 1, 0, 2, 0, 0, 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		var b uaBuf
+		b.nodeID(tt.id)
+		if !bytes.Equal(b.Bytes(), tt.want) {
+			t.Errorf("nodeID(%v) = % x, want % x", tt.id, b.Bytes(), tt.want)
+		}
+		r := &uaReader{b: b.Bytes()}
+		if got := r.nodeID(); got != tt.id || r.err != nil || len(r.b) != 0 {
+			t.Errorf("decoded %v (err %v, %d bytes left), want %v", got, r.err, len(r.b), tt.id)
+		}
+	}
+}
+
+func TestUAVariantRoundTrip(t *testing.T) {
+	now := time.Unix(1768368162, 123456700)
+	for _, v := range []any{
+		nil, true, byte(255), int32(-7), uint32(7), 1.5, "psi", []string{"a", "b"},
+		now, uaStr(1, "P1-PT-001"), uaStatus(uaUncertain), uaQName{1, "Pipelines"},
+		uaText("sensor-gen"), uaExtObj{TypeID: 886, Body: []byte{1, 2, 3}},
+	} {
+		var b uaBuf
+		b.variant(v)
+		r := &uaReader{b: b.Bytes()}
+		got := readUAVariant(r)
+		if tm, ok := v.(time.Time); ok {
+			if gt, _ := got.(time.Time); !gt.Equal(tm) {
+				t.Errorf("variant %v decoded as %v", v, got)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, v) || r.err != nil || len(r.b) != 0 {
+			t.Errorf("variant %#v decoded as %#v (err %v, %d bytes left)", v, got, r.err, len(r.b))
+		}
+	}
+}
+
+func TestUADataValueTimestamps(t *testing.T) {
+	src, srv := time.Unix(100, 0), time.Unix(200, 0)
+	dv := uaDataValue{Value: 1.5, Status: uaUncertain, Source: src, Server: srv}
+	for _, tt := range []struct {
+		ts           int32
+		mask         byte
+		source, serv bool
+	}{
+		{uaTimestampsSource, 0x07, true, false},
+		{uaTimestampsServer, 0x0b, false, true},
+		{uaTimestampsBoth, 0x0f, true, true},
+		{uaTimestampsNeither, 0x03, false, false},
+	} {
+		var b uaBuf
+		b.dataValue(dv, tt.ts)
+		if b.Bytes()[0] != tt.mask {
+			t.Errorf("ts %d: mask %#x, want %#x", tt.ts, b.Bytes()[0], tt.mask)
+		}
+		got := readUADataValue(&uaReader{b: b.Bytes()})
+		if got.Value != 1.5 || got.Status != uaUncertain || got.Source.Equal(src) != tt.source || got.Server.Equal(srv) != tt.serv {
+			t.Errorf("ts %d: decoded %+v", tt.ts, got)
+		}
+	}
+}
+
+func TestUAReaderErrors(t *testing.T) {
+	r := &uaReader{b: []byte{5, 0, 0, 0, 'a'}}
+	if s := r.str(); s != "" || r.err == nil {
+		t.Errorf("string longer than the message: %q, %v", s, r.err)
+	}
+	r.b = []byte{1, 2, 3, 4}
+	if v := r.u32(); v != 0 || r.err == nil {
+		t.Errorf("read after an error: %d, %v", v, r.err)
+	}
+	r = &uaReader{b: []byte{0xff, 0xff, 0xff, 0xff}}
+	if n := r.length(); n != 0 || r.err != nil {
+		t.Errorf("null length: %d, %v", n, r.err)
+	}
+	r = &uaReader{b: []byte{0x3f}}
+	if r.nodeID(); r.err == nil {
+		t.Error("unknown NodeId encoding decoded without error")
+	}
+}
+
+func TestUAChunks(t *testing.T) {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	writeUAChunk(w, "MSGF", []byte{1, 2}, []byte("abc"))
+	w.Flush()
+	want := []byte{'M', 'S', 'G', 'F', 13, 0, 0, 0, 1, 2, 'a', 'b', 'c'}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("chunk % x, want % x", out.Bytes(), want)
+	}
+	typ, body, err := readUAChunk(bufio.NewReader(bytes.NewReader(want)), 64)
+	if typ != "MSGF" || string(body) != "\x01\x02abc" || err != nil {
+		t.Errorf("readUAChunk = %q, %q, %v", typ, body, err)
+	}
+	if _, _, err := readUAChunk(bufio.NewReader(bytes.NewReader(want)), 12); err != errUATooLarge {
+		t.Errorf("oversized chunk: %v, want %v", err, errUATooLarge)
+	}
+}
+
+// uaClient is a minimal OPC UA client: one secure channel with
+// SecurityPolicy None and, once session is called, an anonymous session.
+type uaClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	id     uint32
+	token  uint32
+	seq    uint32
+	reqID  uint32
+	auth   uaNodeID
+	chunks int // chunks of the last response
+}
+
+// dialUA connects to addr, announcing recvSize as the largest chunk the
+// client accepts, and opens a secure channel.
+func dialUA(t *testing.T, addr string, recvSize uint32) *uaClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &uaClient{t: t, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var hello uaBuf
+	hello.u32(0)
+	hello.u32(recvSize)
+	hello.u32(65535)
+	hello.u32(0)
+	hello.u32(0)
+	hello.str("opc.tcp://" + addr)
+	writeUAChunk(c.w, "HELF", nil, hello.Bytes())
+	c.w.Flush()
+	if typ, _, err := readUAChunk(c.r, 1<<20); typ != "ACKF" || err != nil {
+		t.Fatalf("Hello answered with %q: %v", typ, err)
+	}
+
+	var hdr, b uaBuf
+	hdr.u32(0)
+	hdr.str(uaSecurityPolicyNone)
+	hdr.nullStr()
+	hdr.nullStr()
+	c.seq++
+	hdr.u32(c.seq)
+	c.reqID++
+	hdr.u32(c.reqID)
+	b.nodeID(uaNum(0, uaOpenSecureChannel))
+	c.requestHeader(&b)
+	b.u32(0) // ClientProtocolVersion
+	b.i32(0) // Issue
+	b.i32(1) // MessageSecurityMode None
+	b.nullStr()
+	b.u32(60000)
+	writeUAChunk(c.w, "OPNF", hdr.Bytes(), b.Bytes())
+	c.w.Flush()
+	typ, body, err := readUAChunk(c.r, 1<<20)
+	if typ != "OPNF" || err != nil {
+		t.Fatalf("OpenSecureChannel answered with %q: %v", typ, err)
+	}
+	r := &uaReader{b: body}
+	r.u32()
+	r.str()
+	r.byteStr()
+	r.byteStr()
+	r.u32()
+	r.u32()
+	if status := c.responseHeader(r, uaOpenSecureChannel); status != uaGood {
+		t.Fatalf("OpenSecureChannel: status %#x", status)
+	}
+	r.u32()
+	c.id, c.token = r.u32(), r.u32()
+	if r.err != nil || c.id == 0 {
+		t.Fatalf("OpenSecureChannel response: %v", r.err)
+	}
+	return c
+}
+
+func (c *uaClient) requestHeader(b *uaBuf) {
+	b.nodeID(c.auth)
+	b.dateTime(time.Now())
+	b.u32(c.reqID) // RequestHandle
+	b.u32(0)
+	b.nullStr()
+	b.u32(5000)
+	b.nullExtObj()
+}
+
+// responseHeader reads the type and header of a response to the request
+// typ, returning its service result.
+func (c *uaClient) responseHeader(r *uaReader, typ uint32) uint32 {
+	c.t.Helper()
+	id := r.nodeID()
+	r.dateTime()
+	r.u32() // RequestHandle
+	status := r.u32()
+	r.u8()   // ServiceDiagnostics
+	r.strs() // StringTable
+	r.extObj()
+	switch {
+	case r.err != nil:
+		c.t.Fatalf("response header: %v", r.err)
+	case id.is(uaServiceFault):
+	case !id.is(uaResponse(typ)):
+		c.t.Fatalf("response type %v to request %d", id, typ)
+	}
+	return status
+}
+
+// call sends a request of type typ with the given body after the request
+// header, returning the service result and a reader positioned after the
+// response header.
+func (c *uaClient) call(typ uint32, body []byte) (uint32, *uaReader) {
+	c.t.Helper()
+	var hdr, b uaBuf
+	c.seq++
+	c.reqID++
+	hdr.u32(c.id)
+	hdr.u32(c.token)
+	hdr.u32(c.seq)
+	hdr.u32(c.reqID)
+	b.nodeID(uaNum(0, typ))
+	c.requestHeader(&b)
+	b.Write(body)
+	writeUAChunk(c.w, "MSGF", hdr.Bytes(), b.Bytes())
+	if err := c.w.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+	var msg []byte
+	for c.chunks = 0; ; {
+		chunk, body, err := readUAChunk(c.r, 1<<20)
+		if err != nil {
+			c.t.Fatalf("request %d: %v", typ, err)
+		}
+		r := &uaReader{b: body}
+		if chunk == "ERRF" {
+			c.t.Fatalf("request %d: error %#x %q", typ, r.u32(), r.str())
+		}
+		r.u32()
+		r.u32()
+		r.u32()
+		if id := r.u32(); id != c.reqID {
+			c.t.Fatalf("response to request %d, want %d", id, c.reqID)
+		}
+		msg = append(msg, r.b...)
+		c.chunks++
+		if chunk == "MSGF" {
+			break
+		}
+	}
+	r := &uaReader{b: msg}
+	return c.responseHeader(r, typ), r
+}
+
+// session creates and activates an anonymous session.
+func (c *uaClient) session() {
+	c.t.Helper()
+	var b uaBuf
+	b.str("urn:test")
+	b.nullStr()
+	b.text("test")
+	b.i32(1) // Client
+	b.nullStr()
+	b.nullStr()
+	b.nullStr()
+	b.nullStr() // ServerUri
+	b.nullStr() // EndpointUrl
+	b.str("test session")
+	b.nullStr()
+	b.nullStr()
+	b.f64(60000)
+	b.u32(0)
+	status, r := c.call(uaCreateSession, b.Bytes())
+	r.nodeID() // SessionId
+	c.auth = r.nodeID()
+	if status != uaGood || r.err != nil {
+		c.t.Fatalf("CreateSession: status %#x, %v", status, r.err)
+	}
+
+	b.Reset()
+	b.nullStr()
+	b.nullStr()
+	b.nullStr() // ClientSoftwareCertificates
+	b.nullStr() // LocaleIds
+	var token uaBuf
+	token.str("anonymous")
+	b.extObj(uaExtObj{TypeID: uaAnonymousIdentityToken, Body: token.Bytes()})
+	if status, _ := c.call(uaActivateSession, b.Bytes()); status != uaGood {
+		c.t.Fatalf("ActivateSession: status %#x", status)
+	}
+}
+
+// read reads one attribute of each node.
+func (c *uaClient) read(attr uint32, ids ...uaNodeID) []uaDataValue {
+	c.t.Helper()
+	var b uaBuf
+	b.f64(0)
+	b.i32(uaTimestampsBoth)
+	b.i32(int32(len(ids)))
+	for _, id := range ids {
+		b.nodeID(id)
+		b.u32(attr)
+		b.nullStr()
+		b.qname(uaQName{})
+	}
+	status, r := c.call(uaRead, b.Bytes())
+	if status != uaGood {
+		c.t.Fatalf("Read: status %#x", status)
+	}
+	values := make([]uaDataValue, r.length())
+	for i := range values {
+		values[i] = readUADataValue(r)
+	}
+	if r.err != nil {
+		c.t.Fatalf("Read response: %v", r.err)
+	}
+	return values
+}
+
+// browse browses the forward hierarchical references of id, returning
+// their targets' browse names and the continuation point.
+func (c *uaClient) browse(id uaNodeID, maxRefs uint32) ([]string, []byte) {
+	c.t.Helper()
+	var b uaBuf
+	b.nodeID(uaNodeID{})
+	b.i64(0)
+	b.u32(0)
+	b.u32(maxRefs)
+	b.i32(1)
+	b.nodeID(id)
+	b.i32(0) // Forward
+	b.nodeID(uaNum(0, uaRefHierarchical))
+	b.boolean(true)
+	b.u32(0)
+	b.u32(0x3f)
+	status, r := c.call(uaBrowse, b.Bytes())
+	if status != uaGood || r.length() != 1 {
+		c.t.Fatalf("Browse: status %#x", status)
+	}
+	return c.browseResult(r)
+}
+
+func (c *uaClient) browseResult(r *uaReader) ([]string, []byte) {
+	c.t.Helper()
+	if status := r.u32(); status != uaGood {
+		c.t.Fatalf("browse result: status %#x", status)
+	}
+	cp := r.byteStr()
+	var names []string
+	for range r.length() {
+		r.nodeID()
+		r.boolean()
+		r.expandedNodeID()
+		names = append(names, r.qname().Name)
+		r.text()
+		r.i32()
+		r.expandedNodeID()
+	}
+	if r.err != nil {
+		c.t.Fatalf("browse result: %v", r.err)
+	}
+	return names, cp
+}
+
+// newTestOPCUA starts an OPC UA server for points, returning the hub that
+// feeds it and its address.
+func newTestOPCUA(t *testing.T, points []SensorPoint) (*hub, string) {
+	h := newHub()
+	if err := serveOPCUA(h, "127.0.0.1:0", points); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close(context.Background()) })
+	return h, h.closers[0].(*opcuaServer).ln.Addr().String()
+}
+
+var uaTestPoints = []SensorPoint{
+	{ID: "P1-PT-001", Type: "pressure", Unit: "psi", PipelineID: "P1", Min: 0, Max: 1500},
+	{ID: "P1-TT-001", Type: "temperature", Unit: "F", PipelineID: "P1", Min: -40, Max: 200},
+	{ID: "P1-FT-001", Type: "flow_rate", Unit: "bbl/h", PipelineID: "P1", Min: 0, Max: 5000},
+	{ID: "P2-PT-001", Type: "pressure", Unit: "psi", PipelineID: "P2", Min: 0, Max: 1500},
+}
+
+func uaReading(id string, value float64, status string) []Record {
+	return []Record{{Reading: &SensorReading{
+		SensorID: id, Value: value, Status: status, Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}}}
+}
+
+func TestOPCUASession(t *testing.T) {
+	h, addr := newTestOPCUA(t, uaTestPoints)
+	c := dialUA(t, addr, 65535)
+
+	// Services other than discovery need a session.
+	if status, _ := c.call(uaRead, nil); status != uaBadSessionIDInvalid {
+		t.Errorf("Read without a session: status %#x, want Bad_SessionIdInvalid", status)
+	}
+	c.session()
+
+	pt := uaStr(1, "P1-PT-001")
+	if dv := c.read(uaAttrValue, pt)[0]; dv.Status != uaBadWaitingForInitialData {
+		t.Errorf("value before the first reading: %+v", dv)
+	}
+	h.Write(context.Background(), uaReading("P1-PT-001", 812.5, "warning"))
+	deadline := time.Now().Add(5 * time.Second)
+	var dv uaDataValue
+	for dv = c.read(uaAttrValue, pt)[0]; dv.Value == nil && time.Now().Before(deadline); dv = c.read(uaAttrValue, pt)[0] {
+		time.Sleep(time.Millisecond)
+	}
+	if dv.Value != 812.5 || dv.Status != uaUncertain || dv.Source.IsZero() || dv.Server.IsZero() {
+		t.Errorf("value after a warning reading: %+v", dv)
+	}
+
+	values := c.read(uaAttrBrowseName, pt, uaStr(1, "nope"), uaNum(0, 2254))
+	if values[0].Value != (uaQName{1, "P1-PT-001"}) || values[1].Status != uaBadNodeIDUnknown || values[2].Value != (uaQName{0, "ServerArray"}) {
+		t.Errorf("browse names: %+v", values)
+	}
+	if ns := c.read(uaAttrValue, uaNum(0, 2255))[0].Value; !reflect.DeepEqual(ns, []string{"http://opcfoundation.org/UA/", uaNamespace}) {
+		t.Errorf("NamespaceArray = %v", ns)
+	}
+
+	if names, _ := c.browse(uaStr(1, "Pipelines"), 0); !reflect.DeepEqual(names, []string{"P1", "P2"}) {
+		t.Errorf("Pipelines holds %q", names)
+	}
+	names, cp := c.browse(uaStr(1, "P1"), 2)
+	if !reflect.DeepEqual(names, []string{"P1-PT-001", "P1-TT-001"}) || len(cp) == 0 {
+		t.Errorf("first page of P1: %q, continuation %x", names, cp)
+	}
+	var b uaBuf
+	b.boolean(false)
+	b.i32(1)
+	b.byteStr(cp)
+	status, r := c.call(uaBrowseNext, b.Bytes())
+	if status != uaGood || r.length() != 1 {
+		t.Fatalf("BrowseNext: status %#x", status)
+	}
+	if names, cp := c.browseResult(r); !reflect.DeepEqual(names, []string{"P1-FT-001"}) || len(cp) != 0 {
+		t.Errorf("second page of P1: %q, continuation %x", names, cp)
+	}
+
+	b.Reset()
+	b.i32(1)
+	b.nodeID(pt)
+	b.u32(uaAttrValue)
+	b.nullStr()
+	b.WriteByte(0x01)
+	b.variant(1.0)
+	status, r = c.call(uaWrite, b.Bytes())
+	if results := r.u32s(); status != uaGood || len(results) != 1 || results[0] != uaBadNotWritable {
+		t.Errorf("Write: status %#x, results %#x", status, results)
+	}
+}
+
+func TestOPCUASubscription(t *testing.T) {
+	h, addr := newTestOPCUA(t, uaTestPoints)
+	c := dialUA(t, addr, 65535)
+	c.session()
+	h.Write(context.Background(), uaReading("P1-TT-001", 61.5, "normal"))
+	for deadline := time.Now().Add(5 * time.Second); c.read(uaAttrValue, uaStr(1, "P1-TT-001"))[0].Value == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("reading never applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var b uaBuf
+	b.f64(50)
+	b.u32(100)
+	b.u32(10)
+	b.u32(0)
+	b.boolean(true)
+	b.WriteByte(0)
+	status, r := c.call(uaCreateSubscription, b.Bytes())
+	subID := r.u32()
+	if status != uaGood || r.f64() != 50 {
+		t.Fatalf("CreateSubscription: status %#x", status)
+	}
+
+	b.Reset()
+	b.u32(subID)
+	b.i32(uaTimestampsSource)
+	b.i32(1)
+	b.nodeID(uaStr(1, "P1-TT-001"))
+	b.u32(uaAttrValue)
+	b.nullStr()
+	b.qname(uaQName{})
+	b.i32(uaModeReporting)
+	b.u32(7) // ClientHandle
+	b.f64(0)
+	b.nullExtObj()
+	b.u32(10)
+	b.boolean(true)
+	status, r = c.call(uaCreateMonitoredItems, b.Bytes())
+	if n := r.length(); status != uaGood || n != 1 || r.u32() != uaGood {
+		t.Fatalf("CreateMonitoredItems: status %#x", status)
+	}
+
+	// publish sends a Publish request acknowledging acks, returning the
+	// message's sequence number, the values it carried and the results of
+	// the acknowledgements.
+	publish := func(acks ...uint32) (uint32, []float64, []uint32) {
+		t.Helper()
+		var b uaBuf
+		b.i32(int32(len(acks)))
+		for _, seq := range acks {
+			b.u32(subID)
+			b.u32(seq)
+		}
+		status, r := c.call(uaPublish, b.Bytes())
+		if id := r.u32(); status != uaGood || id != subID {
+			t.Fatalf("Publish: status %#x, subscription %d", status, id)
+		}
+		r.u32s() // AvailableSequenceNumbers
+		r.boolean()
+		seq := r.u32()
+		r.dateTime()
+		var values []float64
+		for range r.length() {
+			typ, body := r.extObj()
+			if !typ.is(uaDataChangeNotification) {
+				t.Fatalf("notification %v", typ)
+			}
+			n := &uaReader{b: body}
+			for range n.length() {
+				if handle := n.u32(); handle != 7 {
+					t.Errorf("client handle %d", handle)
+				}
+				v, _ := readUADataValue(n).Value.(float64)
+				values = append(values, v)
+			}
+		}
+		results := r.u32s()
+		if r.err != nil {
+			t.Fatalf("Publish response: %v", r.err)
+		}
+		return seq, values, results
+	}
+
+	seq1, values, _ := publish()
+	if seq1 != 1 || !reflect.DeepEqual(values, []float64{61.5}) {
+		t.Errorf("first notification %d: %v, want 1: [61.5]", seq1, values)
+	}
+	h.Write(context.Background(), uaReading("P1-TT-001", 62.25, "normal"))
+	seq2, values, results := publish(seq1, 99)
+	if seq2 != 2 || !reflect.DeepEqual(values, []float64{62.25}) {
+		t.Errorf("second notification %d: %v, want 2: [62.25]", seq2, values)
+	}
+	if !reflect.DeepEqual(results, []uint32{uaGood, uaBadSequenceNumberUnknown}) {
+		t.Errorf("acknowledgement results %#x", results)
+	}
+
+	// Only the unacknowledged message can be republished.
+	for _, tt := range []struct {
+		seq    uint32
+		status uint32
+	}{{seq2, uaGood}, {seq1, uaBadMessageNotAvailable}} {
+		b.Reset()
+		b.u32(subID)
+		b.u32(tt.seq)
+		status, r := c.call(uaRepublish, b.Bytes())
+		if status != tt.status || status == uaGood && r.u32() != seq2 {
+			t.Errorf("Republish %d: status %#x, want %#x", tt.seq, status, tt.status)
+		}
+	}
+}
+
+func TestOPCUAChunkedResponse(t *testing.T) {
+	var points []SensorPoint
+	for i := range 300 {
+		points = append(points, SensorPoint{ID: fmt.Sprintf("P1-PT-%03d", i), Type: "pressure", Unit: "psi", PipelineID: "P1", Max: 1500})
+	}
+	_, addr := newTestOPCUA(t, points)
+	c := dialUA(t, addr, 8192)
+	c.session()
+	names, _ := c.browse(uaStr(1, "P1"), 0)
+	if len(names) != 300 || names[299] != "P1-PT-299" {
+		t.Errorf("browsed %d sensors", len(names))
+	}
+	if c.chunks < 2 {
+		t.Errorf("response in %d chunks, want several of at most 8192 bytes", c.chunks)
+	}
+}
+
+func TestOPCUARejectsBadChannels(t *testing.T) {
+	_, addr := newTestOPCUA(t, uaTestPoints)
+	tests := []struct {
+		name string
+		send func(c *uaClient)
+		want uint32
+	}{
+		{
+			name: "unknown secure channel",
+			send: func(c *uaClient) {
+				var hdr uaBuf
+				hdr.u32(c.id + 1)
+				hdr.u32(c.token)
+				hdr.u32(99)
+				hdr.u32(99)
+				writeUAChunk(c.w, "MSGF", hdr.Bytes(), nil)
+			},
+			want: uaBadSecureChannelIDInvalid,
+		},
+		{
+			name: "unknown message type",
+			send: func(c *uaClient) { writeUAChunk(c.w, "XYZF", nil, nil) },
+			want: uaBadTCPMessageTypeInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialUA(t, addr, 65535)
+			tt.send(c)
+			c.w.Flush()
+			typ, body, err := readUAChunk(c.r, 1<<20)
+			if r := (&uaReader{b: body}); typ != "ERRF" || err != nil || r.u32() != tt.want {
+				t.Errorf("answered with %q % x, %v; want ERRF %#x", typ, body, err, tt.want)
+			}
+		})
+	}
+
+	// A Hello offering chunks too small for the server is refused.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var hello uaBuf
+	hello.u32(0)
+	hello.u32(1024)
+	hello.u32(1024)
+	hello.u32(0)
+	hello.u32(0)
+	hello.nullStr()
+	w := bufio.NewWriter(conn)
+	writeUAChunk(w, "HELF", nil, hello.Bytes())
+	w.Flush()
+	typ, body, err := readUAChunk(bufio.NewReader(conn), 1<<20)
+	if r := (&uaReader{b: body}); typ != "ERRF" || err != nil || r.u32() != uaBadDecodingError {
+		t.Errorf("small Hello answered with %q % x, %v", typ, body, err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsGUID is appended to the client key to derive Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// serveWebSocket adds a WebSocket endpoint on addr to h. Each connected
+// client receives every reading as a JSON text message, optionally
+// filtered with query parameters, comma-separated or repeated:
+//
+//	ws://host:8080/?pipeline=PIPE-TX-001,PIPE-OK-001&type=pressure
+func serveWebSocket(h *hub, addr string) error {
+	return h.listen(addr, &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handleWebSocket(h, w, r) }),
+		ReadHeaderTimeout: 10 * time.Second,
+	})
+}
+
+// wsConn is the server side of an upgraded WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	w    *bufio.Writer
+	wmu  sync.Mutex // serialises frames from the broadcast and read loops
+}
+
+func handleWebSocket(h *hub, w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "WebSocket connection required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	q := r.URL.Query()
+	c := &wsConn{conn: conn, w: rw.Writer}
+	sub := &subscriber{
+		addr:   conn.RemoteAddr().String(),
+		filter: readingFilter{pipelines: filterSet(q["pipeline"]), types: filterSet(q["type"])},
+		abort:  func() { conn.Close() },
+	}
+	if !h.subscribe(sub, "websocket "+r.URL.RequestURI()) {
+		return
+	}
+	go c.writeLoop(h, sub)
+	c.readLoop(rw.Reader)
+	h.unsubscribe(sub)
+}
+
+// writeLoop sends queued batches until the client is unsubscribed or the
+// hub closes, then sends a close frame.
+func (c *wsConn) writeLoop(h *hub, sub *subscriber) {
+	defer h.wg.Done()
+	defer c.conn.Close()
+	for batch := range sub.send {
+		if err := c.writeBatch(batch, sub.filter); err != nil {
+			h.unsubscribe(sub)
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE9}) // 1001 going away
+	c.w.Flush()
+}
+
+func (c *wsConn) writeBatch(batch []Record, filter readingFilter) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	for _, rec := range batch {
+		if !filter.match(rec.Reading) {
+			continue
+		}
+		if err := c.writeFrame(wsOpText, rec.Data); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// writeFrame buffers a single unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	var hdr [10]byte
+	hdr[0] = 0x80 | op
+	n := 2
+	switch {
+	case len(payload) < 126:
+		hdr[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+		n = 10
+	}
+	c.w.Write(hdr[:n])
+	_, err := c.w.Write(payload)
+	return err
+}
+
+// readLoop consumes client frames, answering pings and close frames. Data
+// from clients is ignored. It returns when the connection ends.
+func (c *wsConn) readLoop(r *bufio.Reader) {
+	for {
+		op, payload, err := readWSFrame(r)
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsOpPing:
+			c.wmu.Lock()
+			c.writeFrame(wsOpPong, payload)
+			c.w.Flush()
+			c.wmu.Unlock()
+		case wsOpClose:
+			c.wmu.Lock()
+			c.writeFrame(wsOpClose, payload[:min(len(payload), 2)])
+			c.w.Flush()
+			c.wmu.Unlock()
+			return
+		}
+	}
+}
+
+// readWSFrame reads one client frame and unmasks its payload.
+func readWSFrame(r *bufio.Reader) (op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op = hdr[0] & 0x0F
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("client frame too large (%d bytes)", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// headerContains reports whether a comma-separated header lists token,
+// ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
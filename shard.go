@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+)
+
+// Shard assignments for -shard-by.
+const (
+	shardRoundRobin = "round-robin" // records dealt out in turn: evenly sized files
+	shardSensor     = "sensor"      // by sensor ID hash: each sensor in one file
+)
+
+// shardPath returns the path of shard i of n for the output path, with the
+// shard number zero-padded before the extension: out.jsonl becomes
+// out-07.jsonl.
+func shardPath(path string, i, n int) string {
+	ext := filepath.Ext(path)
+	width := len(fmt.Sprint(n - 1))
+	return fmt.Sprintf("%s-%0*d%s", strings.TrimSuffix(path, ext), width, i, ext)
+}
+
+// shardedSink spreads records over several sinks, one per shard file.
+type shardedSink struct {
+	shards   []Sink
+	bySensor bool
+	next     int        // shard of the next record when dealing round-robin
+	split    [][]Record // per-shard part of the batch being written
+}
+
+func newShardedSink(shards []Sink, by string) *shardedSink {
+	return &shardedSink{shards: shards, bySensor: by == shardSensor, split: make([][]Record, len(shards))}
+}
+
+func (s *shardedSink) Write(ctx context.Context, batch []Record) error {
+	for i := range s.split {
+		s.split[i] = s.split[i][:0]
+	}
+	for _, rec := range batch {
+		i := s.next
+		if s.bySensor {
+			h := fnv.New32a()
+			h.Write([]byte(rec.Reading.SensorID))
+			i = int(h.Sum32() % uint32(len(s.shards)))
+		} else {
+			s.next = (s.next + 1) % len(s.shards)
+		}
+		s.split[i] = append(s.split[i], rec)
+	}
+	for i, part := range s.split {
+		if len(part) == 0 {
+			continue
+		}
+		if err := s.shards[i].Write(ctx, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedSink) Close(ctx context.Context) error {
+	var errs []error
+	for _, shard := range s.shards {
+		errs = append(errs, shard.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Record is a single generated reading together with its encoded form.
+// Sinks write Data and may use Reading for routing (keys, partitions, subjects).
+type Record struct {
+	Reading *SensorReading
+	Data    []byte      // JSON encoding, without trailing newline
+	Event   *cloudEvent // CloudEvents attributes with -cloudevents, else nil
+}
+
+// Sink is a destination for generated records.
+type Sink interface {
+	// Write delivers a batch of records. Sinks may buffer internally.
+	// Cancelling ctx aborts in-flight network I/O.
+	Write(ctx context.Context, batch []Record) error
+	// Close flushes any buffered data and releases resources, giving up
+	// when ctx is done.
+	Close(ctx context.Context) error
+}
+
+// sinkFactories maps a sink URL scheme to its constructor.
+var sinkFactories = map[string]func(u *url.URL) (Sink, error){
+	"s3":            newS3Sink,
+	"pubsub":        newPubSubSink,
+	"nats":          newNATSSink,
+	"amqp":          newAMQPSink,
+	"redis":         newRedisSink,
+	"tcp":           newTCPSink,
+	"udp":           newUDPSink,
+	"syslog":        newSyslogSink,
+	"splunk":        newSplunkSink,
+	"prometheus":    newPromSink,
+	"otlp":          newOTLPSink,
+	"http":          newHTTPSink,
+	"https":         newHTTPSink,
+	"elasticsearch": newElasticsearchSink,
+	"opensearch":    newElasticsearchSink,
+	"sparkplug":     newSparkplugSink,
+	"shm":           newShmSink,
+	"null":          newNullSink,
+	"exec":          newExecSink,
+}
+
+// openSink builds the sink described by spec. An empty spec selects the
+// local file sink writing to outputFile. File sinks write records in order.
+// Sinks that send message metadata label messages with runID, if set.
+func openSink(spec, outputFile string, appendMode bool, layout fileLayout, runID string) (Sink, error) {
+	if spec == "" {
+		return openFileSink(outputFile, appendMode, layout)
+	}
+	if spec == "null" {
+		return nullSink{}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink %q: %w", spec, err)
+	}
+	if u.Scheme == "file" {
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		return openFileSink(path, appendMode, layout)
+	}
+	factory, ok := sinkFactories[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q", u.Scheme)
+	}
+	setRunID(u, runID)
+	return factory(u)
+}
+
+// openSinks opens every sink in specs, or the -o file when there are none,
+// and names each for error reporting. If one fails the others are closed.
+func openSinks(specs []string, outputFile string, appendMode bool, layout fileLayout, runID string) ([]Sink, []string, error) {
+	if len(specs) == 0 {
+		specs = []string{""}
+	}
+	var sinks []Sink
+	var names []string
+	for _, spec := range specs {
+		sink, err := openSink(spec, outputFile, appendMode, layout, runID)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close(context.Background())
+			}
+			return nil, nil, err
+		}
+		name := sinkName(spec, outputFile)
+		for n := 2; slices.Contains(names, name); n++ {
+			name = fmt.Sprintf("%s #%d", sinkName(spec, outputFile), n)
+		}
+		sinks = append(sinks, sink)
+		names = append(names, name)
+	}
+	return sinks, names, nil
+}
+
+// sinkName describes the sink spec refers to without credentials or
+// options: the file path, or the URL's scheme, host and path.
+func sinkName(spec, outputFile string) string {
+	u, err := url.Parse(spec)
+	switch {
+	case spec == "":
+		return outputFile
+	case err != nil:
+		return spec
+	case spec == "null" || u.Scheme == "null":
+		return "null"
+	case u.Scheme == "file" && u.Opaque != "":
+		return u.Opaque
+	case u.Scheme == "file":
+		return u.Path
+	}
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// sinkList collects repeated -sink flags.
+type sinkList []string
+
+func (l *sinkList) String() string { return strings.Join(*l, ", ") }
+
+func (l *sinkList) Set(spec string) error {
+	*l = append(*l, spec)
+	return nil
+}
+
+// fileSink writes newline-delimited JSON to a local file. With atomic set
+// it writes to path.tmp and renames it to path on Close, so nothing
+// watching for path ever sees it half written.
+type fileSink struct {
+	file   *os.File
+	writer *bufio.Writer
+	final  string // name to rename the file to on Close ("" = not atomic)
+}
+
+func newFileSink(path string, appendMode, atomic bool) (*fileSink, error) {
+	if atomic {
+		f, err := os.Create(path + tmpSuffix)
+		if err != nil {
+			return nil, fmt.Errorf("creating file: %w", err)
+		}
+		return &fileSink{file: f, writer: bufio.NewWriterSize(f, 1024*1024), final: path}, nil
+	}
+	// Open file in truncate (default) or append mode
+	var file *os.File
+	var err error
+	if appendMode {
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening file: %w", err)
+		}
+	} else {
+		file, err = os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("creating file: %w", err)
+		}
+	}
+	// Buffered writer for performance
+	return &fileSink{file: file, writer: bufio.NewWriterSize(file, 1024*1024)}, nil // 1MB buffer
+}
+
+// writeLines writes event records or operator actions to sink, one JSON
+// line each, counting a failure against errs as a write error of name.
+func writeLines[T any](ctx context.Context, sink *fileSink, name string, items []T, errs *errorBudget) {
+	batch := make([]Record, len(items))
+	for i := range items {
+		data, err := json.Marshal(&items[i])
+		if err != nil {
+			errs.Record(sinkErrClass(errClassMarshal, name), err)
+			return
+		}
+		batch[i] = Record{Data: data}
+	}
+	if err := sink.Write(ctx, batch); err != nil {
+		errs.Record(sinkErrClass(errClassWrite, name), err)
+	}
+}
+
+// tmpSuffix marks a file still being written by an atomic file sink.
+const tmpSuffix = ".tmp"
+
+// finalize renames a finished temporary file to its final name.
+func finalize(tmp, final string) error {
+	if err := os.Rename(tmp, final); err != nil {
+		return fmt.Errorf("finalizing file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSink) Write(ctx context.Context, batch []Record) error {
+	for _, rec := range batch {
+		s.writer.Write(rec.Data)
+		s.writer.WriteByte('\n')
+	}
+	// Flush after each batch for real-time observability (tail -f)
+	return s.writer.Flush()
+}
+
+func (s *fileSink) Close(ctx context.Context) error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if err := s.file.Close(); err != nil || s.final == "" {
+		return err
+	}
+	return finalize(s.file.Name(), s.final)
+}
+
+// openFileSink opens a file sink that writes records in the layout's
+// order, sharded across several files, rotated or partitioned into
+// directories if it asks for that. A partitioned sink writes under path
+// without its .jsonl extension.
+func openFileSink(path string, appendMode bool, layout fileLayout) (Sink, error) {
+	if layout.atomic && appendMode {
+		return nil, errors.New("-atomic cannot be combined with -append: the finished file is replaced, not extended")
+	}
+	if len(layout.partitionBy) > 0 {
+		dir := strings.TrimSuffix(path, ".jsonl")
+		return newOrderedSink(newPartitionedSink(dir, layout.partitionBy, layout.atomic), layout.order), nil
+	}
+	paths := []string{path}
+	if layout.shards > 1 {
+		paths = make([]string, layout.shards)
+		for i := range paths {
+			paths[i] = shardPath(path, i, layout.shards)
+		}
+	}
+	var disk *diskCap
+	if layout.maxDisk > 0 {
+		var err error
+		if disk, err = newDiskCap(layout.maxDisk, paths); err != nil {
+			return nil, err
+		}
+	}
+	files := make([]Sink, len(paths))
+	for i, p := range paths {
+		var s Sink
+		if layout.rotates() {
+			s = newRotatingSink(p, layout, disk)
+		} else {
+			f, err := newFileSink(p, appendMode, layout.atomic)
+			if err != nil {
+				for _, opened := range files[:i] {
+					opened.Close(context.Background())
+				}
+				return nil, err
+			}
+			s = f
+		}
+		files[i] = newOrderedSink(s, layout.order)
+	}
+	if len(files) == 1 {
+		return files[0], nil
+	}
+	return newShardedSink(files, layout.shardBy), nil
+}
+
+// expandTemplate substitutes {sensor_id}, {pipeline_id}, {type}, {unit} and
+// {status} placeholders in tmpl with the reading's fields. It is used for
+// subjects, routing keys and stream names.
+func expandTemplate(tmpl string, r *SensorReading) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	return strings.NewReplacer(
+		"{sensor_id}", r.SensorID,
+		"{pipeline_id}", r.PipelineID,
+		"{type}", r.Type,
+		"{unit}", r.Unit,
+		"{status}", r.Status,
+	).Replace(tmpl)
+}
+
+// queryBytes parses a size option such as "128MB" or "5MiB" from a sink URL
+// query, returning def when the option is absent.
+func queryBytes(q url.Values, key string, def int64) (int64, error) {
+	v := q.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := parseBytes(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+// parseBytes parses a byte count with an optional KB/MB/GB suffix
+// (binary multiples; "KiB" style suffixes are accepted too).
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	mult := int64(1)
+	for _, suf := range []struct {
+		s string
+		m int64
+	}{
+		{"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	} {
+		if strings.HasSuffix(s, suf.s) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, suf.s)), suf.m
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readAMQPFrame reads one frame the way a broker would, independently of
+// amqpConn.readFrame.
+func readAMQPFrame(r io.Reader) (typ byte, channel uint16, payload []byte, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	payload = make([]byte, binary.BigEndian.Uint32(hdr[3:])+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[len(payload)-1] != amqpFrameEnd {
+		return 0, 0, nil, fmt.Errorf("frame end %#x", payload[len(payload)-1])
+	}
+	return hdr[0], binary.BigEndian.Uint16(hdr[1:]), payload[:len(payload)-1], nil
+}
+
+func writeAMQPMethod(w io.Writer, channel uint16, id amqpMethod, args []byte) error {
+	frame := []byte{amqpFrameMethod}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(args)))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(id))
+	frame = append(frame, args...)
+	_, err := w.Write(append(frame, amqpFrameEnd))
+	return err
+}
+
+// decodeAMQPTable decodes a field table of the types amqpBuf.table writes,
+// returning what follows it.
+func decodeAMQPTable(b []byte) (map[string]any, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("short table")
+	}
+	n := binary.BigEndian.Uint32(b)
+	if int(n) > len(b)-4 {
+		return nil, nil, fmt.Errorf("table length %d overruns %d bytes", n, len(b)-4)
+	}
+	t, rest := map[string]any{}, b[4+n:]
+	for b = b[4 : 4+n]; len(b) > 0; {
+		k := string(b[1 : 1+b[0]])
+		b = b[1+b[0]:]
+		switch typ := b[0]; typ {
+		case 'S':
+			l := binary.BigEndian.Uint32(b[1:])
+			t[k] = string(b[5 : 5+l])
+			b = b[5+l:]
+		case 't':
+			t[k] = b[1] != 0
+			b = b[2:]
+		case 'F':
+			v, after, err := decodeAMQPTable(b[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			t[k], b = v, after
+		default:
+			return nil, nil, fmt.Errorf("field %q: unknown type %q", k, typ)
+		}
+	}
+	return t, rest, nil
+}
+
+func TestAMQPFrameEncoding(t *testing.T) {
+	var out bytes.Buffer
+	c := &amqpConn{w: bufio.NewWriter(&out)}
+	c.writeMethod(amqpPublishChannel, amqpConfirmSelect, []byte{0})
+	c.writeFrame(amqpFrameBody, amqpPublishChannel, []byte("hi"))
+	c.w.Flush()
+	want := []byte{
+		amqpFrameMethod, 0, 1, 0, 0, 0, 5, 0, 85, 0, 10, 0, amqpFrameEnd,
+		amqpFrameBody, 0, 1, 0, 0, 0, 2, 'h', 'i', amqpFrameEnd,
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("frames % x, want % x", out.Bytes(), want)
+	}
+
+	c = &amqpConn{r: bufio.NewReader(bytes.NewReader(want))}
+	for _, w := range []struct {
+		typ     byte
+		payload string
+	}{{amqpFrameMethod, "\x00\x55\x00\x0a\x00"}, {amqpFrameBody, "hi"}} {
+		typ, channel, payload, err := c.readFrame()
+		if err != nil || typ != w.typ || channel != amqpPublishChannel || string(payload) != w.payload {
+			t.Errorf("readFrame = %d, %d, %q, %v; want %d, 1, %q", typ, channel, payload, err, w.typ, w.payload)
+		}
+	}
+	bad := slices.Clone(want[:13])
+	bad[12] = 0
+	c = &amqpConn{r: bufio.NewReader(bytes.NewReader(bad))}
+	if _, _, _, err := c.readFrame(); err == nil {
+		t.Error("frame without a frame-end byte read without error")
+	}
+}
+
+func TestAMQPTable(t *testing.T) {
+	in := map[string]any{
+		"product":      "sensor-gen",
+		"capabilities": map[string]any{"publisher_confirms": true, "basic.nack": false},
+	}
+	var b amqpBuf
+	b.table(in)
+	b.shortstr("PLAIN")
+	got, rest, err := decodeAMQPTable(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("table = %v, want %v", got, in)
+	}
+	if string(rest) != "\x05PLAIN" {
+		t.Errorf("after table: %q", rest)
+	}
+}
+
+func TestAMQPReplyText(t *testing.T) {
+	var b amqpBuf
+	b.u16(404)
+	b.shortstr("NOT_FOUND - no exchange 'sensors'")
+	b.u16(60)
+	b.u16(40)
+	tests := []struct {
+		args []byte
+		want string
+	}{
+		{b.Bytes(), "404 NOT_FOUND - no exchange 'sensors'"},
+		{[]byte{0x01, 0x38, 9, 'N', 'O'}, "312 "}, // text cut short
+		{[]byte{0x01}, "no reason given"},
+	}
+	for _, tt := range tests {
+		if got := amqpReplyText(tt.args); got != tt.want {
+			t.Errorf("amqpReplyText(% x) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// fakeAMQP is a broker with publisher confirms answering each publish as
+// replies gives for its index, counting from 0 across connections: "ack",
+// "nack", "none" (no answer), "multi" (a multiple ack of everything
+// published on the connection), "return" (returned as unroutable, then
+// acked), "close" (the channel closed with an error) or "drop" (close the
+// connection unanswered). Publishes past the end of replies are acked.
+type fakeAMQP struct {
+	ln       net.Listener
+	frameMax int
+	replies  []string
+
+	mu      sync.Mutex
+	conns   int
+	auth    string // SASL PLAIN response
+	vhost   string
+	pubs    []string // bodies in the order they were published
+	keys    []string // routing key of each publish
+	headers []map[string]any
+	frames  []int // body frames of each publish
+}
+
+func newFakeAMQP(t *testing.T, replies ...string) *fakeAMQP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeAMQP{ln: ln, frameMax: 131072, replies: replies}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// expect reads the next frame, which must be the method want.
+func (f *fakeAMQP) expect(r io.Reader, want amqpMethod) ([]byte, error) {
+	typ, _, payload, err := readAMQPFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != amqpFrameMethod || len(payload) < 4 || amqpMethod(binary.BigEndian.Uint32(payload)) != want {
+		return nil, fmt.Errorf("got frame type %d % x, want method %d.%d", typ, payload, want>>16, want&0xffff)
+	}
+	return payload[4:], nil
+}
+
+func (f *fakeAMQP) handshake(conn net.Conn, r io.Reader) error {
+	proto := make([]byte, 8)
+	if _, err := io.ReadFull(r, proto); err != nil || string(proto) != "AMQP\x00\x00\x09\x01" {
+		return fmt.Errorf("protocol header %q: %v", proto, err)
+	}
+	var b amqpBuf
+	b.WriteByte(0)
+	b.WriteByte(9)
+	b.table(nil)
+	b.longstr("PLAIN")
+	b.longstr("en_US")
+	writeAMQPMethod(conn, 0, amqpConnectionStart, b.Bytes())
+	args, err := f.expect(r, amqpConnectionStartOk)
+	if err != nil {
+		return err
+	}
+	_, rest, err := decodeAMQPTable(args)
+	if err != nil {
+		return err
+	}
+	rest = rest[1+rest[0]:] // mechanism
+	auth := string(rest[4 : 4+binary.BigEndian.Uint32(rest)])
+
+	b.Reset()
+	b.u16(0)
+	b.u32(uint32(f.frameMax))
+	b.u16(0)
+	writeAMQPMethod(conn, 0, amqpConnectionTune, b.Bytes())
+	if _, err := f.expect(r, amqpConnectionTuneOk); err != nil {
+		return err
+	}
+	args, err = f.expect(r, amqpConnectionOpen)
+	if err != nil {
+		return err
+	}
+	vhost := string(args[1 : 1+args[0]])
+	writeAMQPMethod(conn, 0, amqpConnectionOpenOk, []byte{0})
+	if _, err := f.expect(r, amqpChannelOpen); err != nil {
+		return err
+	}
+	writeAMQPMethod(conn, amqpPublishChannel, amqpChannelOpenOk, []byte{0, 0, 0, 0})
+	if _, err := f.expect(r, amqpConfirmSelect); err != nil {
+		return err
+	}
+	writeAMQPMethod(conn, amqpPublishChannel, amqpConfirmSelectOk, nil)
+	f.mu.Lock()
+	f.auth, f.vhost = auth, vhost
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeAMQP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := f.handshake(conn, r); err != nil {
+		return
+	}
+	var (
+		tag     uint64 // delivery tag of the last publish on the connection
+		key     string
+		headers map[string]any
+		size    uint64
+		body    []byte
+		frames  int
+	)
+	for {
+		typ, _, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case amqpFrameMethod:
+			switch amqpMethod(binary.BigEndian.Uint32(payload)) {
+			case amqpBasicPublish:
+				args := payload[4+2:] // reserved
+				args = args[1+args[0]:]
+				key = string(args[1 : 1+args[0]])
+			case amqpConnectionClose:
+				writeAMQPMethod(conn, 0, amqpConnectionCloseOk, nil)
+				return
+			}
+			continue
+		case amqpFrameHeader:
+			// class, weight, body size, flags, content-type, [headers,]
+			// delivery-mode
+			size = binary.BigEndian.Uint64(payload[4:])
+			flags := binary.BigEndian.Uint16(payload[12:])
+			props := payload[14:]
+			props = props[1+props[0]:]
+			headers = nil
+			if flags&0x2000 != 0 {
+				if headers, _, err = decodeAMQPTable(props); err != nil {
+					return
+				}
+			}
+			body, frames = nil, 0
+			if size > 0 {
+				continue
+			}
+		case amqpFrameBody:
+			body = append(body, payload...)
+			frames++
+			if uint64(len(body)) < size {
+				continue
+			}
+		default:
+			continue
+		}
+
+		tag++
+		f.mu.Lock()
+		n := len(f.pubs)
+		f.pubs = append(f.pubs, string(body))
+		f.keys = append(f.keys, key)
+		f.headers = append(f.headers, headers)
+		f.frames = append(f.frames, frames)
+		f.mu.Unlock()
+		reply := "ack"
+		if n < len(f.replies) {
+			reply = f.replies[n]
+		}
+		var b amqpBuf
+		switch reply {
+		case "ack", "nack", "multi":
+			b.u64(tag)
+			id := amqpBasicAck
+			switch reply {
+			case "nack":
+				id = amqpBasicNack
+			case "multi":
+				b.WriteByte(1)
+			}
+			if b.Len() == 8 {
+				b.WriteByte(0)
+			}
+			writeAMQPMethod(conn, amqpPublishChannel, id, b.Bytes())
+		case "return":
+			b.u16(312)
+			b.shortstr("NO_ROUTE")
+			b.shortstr("sensors")
+			b.shortstr(key)
+			writeAMQPMethod(conn, amqpPublishChannel, amqpBasicReturn, b.Bytes())
+			b.Reset()
+			b.u64(tag)
+			b.WriteByte(0)
+			writeAMQPMethod(conn, amqpPublishChannel, amqpBasicAck, b.Bytes())
+		case "close":
+			b.u16(404)
+			b.shortstr("NOT_FOUND - no exchange 'sensors'")
+			b.u16(60)
+			b.u16(40)
+			writeAMQPMethod(conn, amqpPublishChannel, amqpChannelClose, b.Bytes())
+		case "drop":
+			return
+		}
+	}
+}
+
+func (f *fakeAMQP) published() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.pubs)
+}
+
+// waitAMQP waits until every publish is confirmed, the broker reported an
+// error or the connection is lost.
+func waitAMQP(s *amqpSink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.unconfirmed) > 0 && s.fatal == nil && !s.conn.failed() {
+		s.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		s.mu.Lock()
+	}
+}
+
+func TestAMQPSinkConfirms(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		replies  []string
+		batches  [][]string
+		errs     []string // expected in each write's error, "" for none
+		closeErr string
+		pubs     []string
+		conns    int
+	}{
+		{
+			name:    "acked",
+			batches: [][]string{{"a", "b"}, {"c"}},
+			errs:    []string{"", ""},
+			pubs:    []string{"a", "b", "c"},
+			conns:   1,
+		},
+		{
+			name:    "multiple ack",
+			replies: []string{"none", "none", "multi"},
+			batches: [][]string{{"a", "b", "c"}},
+			errs:    []string{""},
+			pubs:    []string{"a", "b", "c"},
+			conns:   1,
+		},
+		{
+			name:     "nack fails the run",
+			replies:  []string{"ack", "nack"},
+			batches:  [][]string{{"a", "b"}, {"c"}},
+			errs:     []string{"", "broker rejected message 2"},
+			closeErr: "broker rejected message 2",
+			pubs:     []string{"a", "b"},
+			conns:    1,
+		},
+		{
+			name:    "reconnect republishes unconfirmed",
+			replies: []string{"ack", "drop"},
+			batches: [][]string{{"a", "b"}, {"c"}},
+			errs:    []string{"", ""},
+			pubs:    []string{"a", "b", "b", "c"},
+			conns:   2,
+		},
+		{
+			name:     "unroutable with mandatory",
+			query:    "&mandatory=true",
+			replies:  []string{"return"},
+			batches:  [][]string{{"a"}, {"b"}},
+			errs:     []string{"", "message returned as unroutable: 312 NO_ROUTE"},
+			closeErr: "message returned as unroutable",
+			pubs:     []string{"a"},
+			conns:    1,
+		},
+		{
+			name:     "channel closed by the broker",
+			replies:  []string{"close"},
+			batches:  [][]string{{"a"}, {"b"}},
+			errs:     []string{"", "closed by broker: 404 NOT_FOUND"},
+			closeErr: "closed by broker: 404 NOT_FOUND - no exchange 'sensors' (1 messages unconfirmed)",
+			pubs:     []string{"a"},
+			conns:    1,
+		},
+		{
+			name:    "full window waits for confirms",
+			query:   "&max-pending=2",
+			batches: [][]string{{"a", "b", "c", "d", "e"}},
+			errs:    []string{""},
+			pubs:    []string{"a", "b", "c", "d", "e"},
+			conns:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeAMQP(t, tt.replies...)
+			u, _ := url.Parse("amqp://" + srv.ln.Addr().String() + "?exchange=sensors" + tt.query)
+			sink, err := newAMQPSink(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := sink.(*amqpSink)
+			ctx := context.Background()
+			for i, ids := range tt.batches {
+				err := s.Write(ctx, sinkRecords(ids...))
+				if got := fmt.Sprint(err); tt.errs[i] == "" && err != nil || tt.errs[i] != "" && !strings.Contains(got, tt.errs[i]) {
+					t.Errorf("write %d: err = %v, want %q", i, err, tt.errs[i])
+				}
+				waitAMQP(s)
+			}
+			err = s.Close(ctx)
+			if got := fmt.Sprint(err); tt.closeErr == "" && err != nil || tt.closeErr != "" && !strings.Contains(got, tt.closeErr) {
+				t.Errorf("close: err = %v, want %q", err, tt.closeErr)
+			}
+			if got := srv.published(); !slices.Equal(got, tt.pubs) {
+				t.Errorf("published %q, want %q", got, tt.pubs)
+			}
+			srv.mu.Lock()
+			if srv.conns != tt.conns {
+				t.Errorf("%d connections, want %d", srv.conns, tt.conns)
+			}
+			srv.mu.Unlock()
+		})
+	}
+}
+
+func TestAMQPSinkPublish(t *testing.T) {
+	srv := newFakeAMQP(t)
+	srv.frameMax = 4096
+	u, _ := url.Parse("amqp://user:secret@" + srv.ln.Addr().String() + "/plant?exchange=sensors&run-id=run-7")
+	sink, err := newAMQPSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 10000)
+	ctx := context.Background()
+	if err := sink.Write(ctx, sinkRecords("a", big)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.auth != "\x00user\x00secret" || srv.vhost != "plant" {
+		t.Errorf("auth %q, vhost %q", srv.auth, srv.vhost)
+	}
+	if !slices.Equal(srv.pubs, []string{"a", big}) {
+		t.Errorf("published %d messages, want a and a %d-byte body", len(srv.pubs), len(big))
+	}
+	if want := []int{1, 3}; !slices.Equal(srv.frames, want) {
+		t.Errorf("body frames %v, want %v", srv.frames, want)
+	}
+	if want := []string{"sensors.p1.pressure", "sensors.p1.pressure"}; !slices.Equal(srv.keys, want) {
+		t.Errorf("routing keys %q, want %q", srv.keys, want)
+	}
+	for _, h := range srv.headers {
+		if h["run_id"] != "run-7" {
+			t.Errorf("headers %v, want run_id run-7", h)
+		}
+	}
+}
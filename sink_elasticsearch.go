@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// elasticsearchSink indexes readings into Elasticsearch or OpenSearch with
+// the _bulk API. The index name is a template: besides the usual reading
+// fields it accepts date patterns in braces, taken from the reading's
+// timestamp, e.g. sensors-{yyyy.MM.dd}. When the cluster pushes back with
+// 429 (for the whole request or individual items) the rejected documents
+// are retried with exponential backoff. Documents rejected for any other
+// reason, such as a mapping conflict, would be rejected again, so they are
+// dropped and reported instead.
+//
+// URL form: elasticsearch://[user:pass@]host:9200?index=sensors-{yyyy.MM.dd}&batch-bytes=5MB
+// opensearch:// is accepted as an alias. ES_API_KEY, if set, is sent as an
+// API key instead of basic auth.
+type elasticsearchSink struct {
+	client   *http.Client
+	url      string
+	user     *url.Userinfo
+	apiKey   string
+	index    string
+	action   string
+	maxBytes int64
+	maxDelay time.Duration
+	backoff  time.Duration // before the first retry of rejected documents
+
+	body     []byte              // the pending action+document pairs
+	pending  pendingRecords[int] // where each pair starts in body
+	rejected int                 // documents rejected for good, not yet reported
+	firstErr string              // the first of their errors
+}
+
+func newElasticsearchSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	s := &elasticsearchSink{
+		client:   &http.Client{Timeout: time.Minute},
+		user:     u.User,
+		apiKey:   os.Getenv("ES_API_KEY"),
+		index:    q.Get("index"),
+		action:   "index",
+		maxBytes: 5 << 20,
+		maxDelay: time.Second,
+		backoff:  500 * time.Millisecond,
+	}
+	if s.index == "" {
+		s.index = "sensors-{yyyy.MM.dd}"
+	}
+	switch op := q.Get("op"); op {
+	case "", "index":
+	case "create":
+		// Data streams only accept create.
+		s.action = "create"
+	default:
+		return nil, fmt.Errorf("elasticsearch sink: op must be index or create, not %q", op)
+	}
+	var err error
+	if s.maxBytes, err = queryBytes(q, "batch-bytes", s.maxBytes); err != nil {
+		return nil, fmt.Errorf("elasticsearch sink: %w", err)
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("elasticsearch sink: batch-delay: %w", err)
+		}
+	}
+	tc, err := tlsConfig(q)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch sink: %w", err)
+	}
+	if tc != nil {
+		s.client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+	scheme := "http"
+	if q.Get("tls") == "true" {
+		scheme = "https"
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":9200"
+	}
+	s.url = fmt.Sprintf("%s://%s/_bulk", scheme, host)
+	return s, nil
+}
+
+func (s *elasticsearchSink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		if len(s.body) > 0 && int64(len(s.body)+len(rec.Data)+128) > s.maxBytes {
+			if err := s.flush(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+		s.pending.add(len(s.body))
+		index, _ := json.Marshal(s.indexName(rec.Reading))
+		s.body = fmt.Appendf(s.body, `{%q:{"_index":%s}}`+"\n", s.action, index)
+		s.body = append(s.body, rec.Data...)
+		s.body = append(s.body, '\n')
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.flush(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return s.rejections()
+}
+
+// unbuffer takes a document of a failed batch, starting at start, back
+// out of the pending request.
+func (s *elasticsearchSink) unbuffer(start int) {
+	s.body = s.body[:start]
+}
+
+func (s *elasticsearchSink) Close(ctx context.Context) error {
+	if s.pending.len() > 0 {
+		if err := s.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return s.rejections()
+}
+
+// rejections reports the documents rejected for good since it was last
+// called, as a rejectedError.
+func (s *elasticsearchSink) rejections() error {
+	if s.rejected == 0 {
+		return nil
+	}
+	err := &rejectedError{s.rejected, fmt.Errorf("elasticsearch sink: %d documents rejected, first: %s", s.rejected, s.firstErr)}
+	s.rejected, s.firstErr = 0, ""
+	return err
+}
+
+// indexName expands the index template for r. Index names must be lower
+// case, so pipeline IDs and the like are folded.
+func (s *elasticsearchSink) indexName(r *SensorReading) string {
+	name := expandTemplate(s.index, r)
+	if strings.Contains(name, "{") {
+		if t, err := time.Parse(time.RFC3339Nano, r.Timestamp); err == nil {
+			name = expandDatePattern(name, t.UTC())
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// expandDatePattern replaces brace-delimited date patterns written with
+// yyyy, MM, dd and HH (as in Elasticsearch date math) with t formatted
+// accordingly.
+func expandDatePattern(s string, t time.Time) string {
+	layout := strings.NewReplacer("yyyy", "2006", "MM", "01", "dd", "02", "HH", "15")
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			break
+		}
+		b.WriteString(s[:open])
+		b.WriteString(t.Format(layout.Replace(s[open+1 : open+end])))
+		s = s[open+end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// bulkResponse is the part of a _bulk response the sink inspects.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// flush sends the pending documents, retrying those rejected with 429
+// with backoff. Each response settles the documents it accepted or
+// rejected for good, so they are not sent again. If a request fails, or
+// documents are still rejected with 429 after the last attempt, those
+// not settled stay pending.
+func (s *elasticsearchSink) flush(ctx context.Context) error {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := s.post(ctx, s.body)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			s.settle(resp)
+		}
+		if s.pending.len() == 0 {
+			s.body = s.body[:0]
+			s.pending.sent()
+			return nil
+		}
+		if attempt == 6 {
+			return fmt.Errorf("elasticsearch sink: %d documents still rejected after %d attempts", s.pending.len(), attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// settle drops the pending documents resp accepted, and those it rejected
+// for good, counting them as rejected. Documents rejected with 429 stay
+// pending, moved up in body.
+func (s *elasticsearchSink) settle(resp *bulkResponse) {
+	body, starts := s.body, s.pending.items
+	s.body = s.body[:0]
+	// retain compacts starts in place, but never past the item it is at,
+	// so the next item's start can still be read.
+	s.pending.retain(func(i, start int) (int, bool) {
+		end := len(body)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		var status int
+		var reason json.RawMessage
+		if i < len(resp.Items) {
+			for _, res := range resp.Items[i] {
+				status, reason = res.Status, res.Error
+			}
+		}
+		switch {
+		case status == http.StatusTooManyRequests:
+			s.body = append(s.body, body[start:end]...)
+			return len(s.body) - (end - start), true
+		case status >= 300:
+			s.rejected++
+			if s.firstErr == "" {
+				s.firstErr = fmt.Sprintf("%d %s", status, reason)
+			}
+		}
+		return 0, false
+	})
+}
+
+// post sends one bulk request. It returns a nil response when the whole
+// request was rejected with 429.
+func (s *elasticsearchSink) post(ctx context.Context, body []byte) (*bulkResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+	} else if s.user != nil {
+		pass, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch sink: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		io.Copy(io.Discard, resp.Body)
+		return nil, nil
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("elasticsearch sink: bulk: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var br bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return nil, fmt.Errorf("elasticsearch sink: bulk response: %w", err)
+	}
+	if !br.Errors {
+		br.Items = nil
+	}
+	return &br, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBulk is a _bulk endpoint answering each document with the status
+// its id is given in statuses, taking one per request it appears in and
+// repeating the last (201 if none is given).
+type fakeBulk struct {
+	mu       sync.Mutex
+	statuses map[string][]int
+	sent     []string // ids in the order they were sent
+	indexed  []string // ids accepted
+}
+
+func (f *fakeBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []map[string]any
+	failed := false
+	sc := bufio.NewScanner(r.Body)
+	for sc.Scan() {
+		if !sc.Scan() {
+			http.Error(w, "action without document", http.StatusBadRequest)
+			return
+		}
+		var doc struct{ ID string }
+		json.Unmarshal(sc.Bytes(), &doc)
+		f.sent = append(f.sent, doc.ID)
+		status := http.StatusCreated
+		if st := f.statuses[doc.ID]; len(st) > 0 {
+			status = st[0]
+			if len(st) > 1 {
+				f.statuses[doc.ID] = st[1:]
+			}
+		}
+		item := map[string]any{"status": status}
+		if status >= 300 {
+			failed = true
+			item["error"] = map[string]string{"type": fmt.Sprintf("status_%d", status)}
+		} else {
+			f.indexed = append(f.indexed, doc.ID)
+		}
+		items = append(items, map[string]any{"index": item})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"errors": failed, "items": items})
+}
+
+func esRecords(ids ...string) []Record {
+	var batch []Record
+	for _, id := range ids {
+		batch = append(batch, Record{
+			Reading: &SensorReading{SensorID: id, Timestamp: "2026-01-14T05:22:42Z"},
+			Data:    fmt.Appendf(nil, `{"id":%q}`, id),
+		})
+	}
+	return batch
+}
+
+func TestElasticsearchSinkItemStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses map[string][]int
+		batches  [][]string
+		delays   []time.Duration // batch-delay for each write
+		errs     []string        // expected in each write's error, "" for none
+		sent     []string
+		indexed  []string
+	}{
+		{
+			name:     "permanent item errors are dropped",
+			statuses: map[string][]int{"b": {400}, "d": {409}},
+			batches:  [][]string{{"a", "b", "c", "d"}, {"e"}},
+			errs:     []string{"2 documents rejected, first: 400", ""},
+			sent:     []string{"a", "b", "c", "d", "e"},
+			indexed:  []string{"a", "c", "e"},
+		},
+		{
+			name:     "only 429s are retried",
+			statuses: map[string][]int{"b": {429, 201}, "c": {400}},
+			batches:  [][]string{{"a", "b", "c", "d"}},
+			errs:     []string{"1 documents rejected"},
+			sent:     []string{"a", "b", "c", "d", "b"},
+			indexed:  []string{"a", "d", "b"},
+		},
+		{
+			name:     "429s left after the last attempt",
+			statuses: map[string][]int{"b": {429, 429, 429, 429, 429, 429, 201}, "d": {429}},
+			batches:  [][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+			delays:   []time.Duration{time.Hour, 0, 0},
+			errs:     []string{"", "2 documents still rejected after 6 attempts", ""},
+			// The failed batch's d is taken out; b, buffered before it,
+			// goes with the next one.
+			sent:    []string{"a", "b", "c", "d", "b", "d", "b", "d", "b", "d", "b", "d", "b", "d", "b", "e"},
+			indexed: []string{"a", "c", "b", "e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bulk := &fakeBulk{statuses: tt.statuses}
+			srv := httptest.NewServer(bulk)
+			defer srv.Close()
+			u, _ := url.Parse("elasticsearch://" + strings.TrimPrefix(srv.URL, "http://") + "?batch-delay=0s")
+			sink, err := newElasticsearchSink(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := sink.(*elasticsearchSink)
+			s.backoff = time.Millisecond
+			for i, ids := range tt.batches {
+				if tt.delays != nil {
+					s.maxDelay = tt.delays[i]
+				}
+				err := s.Write(context.Background(), esRecords(ids...))
+				switch {
+				case tt.errs[i] == "" && err != nil:
+					t.Errorf("write %d: %v", i, err)
+				case tt.errs[i] != "" && (err == nil || !strings.Contains(err.Error(), tt.errs[i])):
+					t.Errorf("write %d: error %v, want %q", i, err, tt.errs[i])
+				}
+			}
+			if err := s.Close(context.Background()); err != nil {
+				t.Errorf("close: %v", err)
+			}
+			if !slices.Equal(bulk.sent, tt.sent) {
+				t.Errorf("sent %v, want %v", bulk.sent, tt.sent)
+			}
+			if !slices.Equal(bulk.indexed, tt.indexed) {
+				t.Errorf("indexed %v, want %v", bulk.indexed, tt.indexed)
+			}
+		})
+	}
+}
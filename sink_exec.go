@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+)
+
+// execSink is a sink plugin: it starts a program and writes records to its
+// standard input as newline-delimited JSON, for sinks sensor-gen has no
+// client for. The program's output goes to sensor-gen's stderr. Closing
+// the sink closes its input and waits for it to exit; a program that
+// exits early or fails fails the sink. The program finds the run ID in
+// SENSOR_GEN_RUN_ID.
+//
+// URL form: exec:///path/to/program?arg=--topic&arg=sensors
+type execSink struct {
+	name string
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	w    *bufio.Writer
+}
+
+func newExecSink(u *url.URL) (Sink, error) {
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("exec sink: missing program")
+	}
+	cmd := exec.Command(path, u.Query()["arg"]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if id := u.Query().Get("run-id"); id != "" {
+		cmd.Env = append(os.Environ(), "SENSOR_GEN_RUN_ID="+id)
+	}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("exec sink %s: %w", path, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("exec sink %s: %w", path, err)
+	}
+	return &execSink{name: "exec sink " + path, cmd: cmd, in: in, w: bufio.NewWriterSize(in, 256*1024)}, nil
+}
+
+func (s *execSink) Write(ctx context.Context, batch []Record) error {
+	for _, rec := range batch {
+		s.w.Write(rec.Data)
+		s.w.WriteByte('\n')
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	return nil
+}
+
+func (s *execSink) Close(ctx context.Context) error {
+	err := s.w.Flush()
+	s.in.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.cmd.Wait() }()
+	select {
+	case werr := <-done:
+		if err == nil {
+			err = werr
+		}
+	case <-ctx.Done():
+		s.cmd.Process.Kill()
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	return nil
+}
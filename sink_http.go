@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpSink posts readings to an HTTP endpoint such as a webhook, a Knative
+// broker or an Event Grid topic. Plain readings are batched as
+// newline-delimited JSON by size and age. With -cloudevents, each event is
+// its own request, in structured mode (application/cloudevents+json) or in
+// binary mode (ce- headers, the reading as the body); ce-batch=true batches
+// structured events as application/cloudevents-batch+json instead. Requests
+// the endpoint rejects as busy (429, 503) are retried with backoff.
+//
+// URL credentials are sent as basic auth, the password from password-file
+// or HTTP_PASSWORD if set. token-file or HTTP_BEARER_TOKEN sends a bearer
+// token, such as an OAuth access token. Requests carry the run ID in a
+// Sensor-Gen-Run-Id header.
+//
+// URL form: https://host/path?header=aeg-sas-key:KEY&batch-bytes=1MB&batch-delay=100ms
+type httpSink struct {
+	client   *http.Client
+	url      string
+	user     *url.Userinfo
+	password *secret // overrides the URL's password
+	token    *secret // bearer token
+	headers  http.Header
+	ceBatch  bool
+	maxBytes int64
+	maxDelay time.Duration
+
+	body    []byte              // the pending readings or events
+	events  bool                // body holds structured events, not plain readings
+	pending pendingRecords[int] // where each starts in body
+}
+
+func newHTTPSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	s := &httpSink{
+		client:   &http.Client{Timeout: time.Minute},
+		user:     u.User,
+		headers:  make(http.Header),
+		ceBatch:  q.Get("ce-batch") == "true",
+		maxBytes: 1 << 20,
+		maxDelay: 100 * time.Millisecond,
+	}
+	var err error
+	if s.maxBytes, err = queryBytes(q, "batch-bytes", s.maxBytes); err != nil {
+		return nil, fmt.Errorf("http sink: %w", err)
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("http sink: batch-delay: %w", err)
+		}
+	}
+	for _, h := range q["header"] {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("http sink: header %q: want Name:value", h)
+		}
+		s.headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if id := q.Get("run-id"); id != "" {
+		s.headers.Set(runIDHeader, id)
+	}
+	tc, err := tlsConfig(q)
+	if err != nil {
+		return nil, fmt.Errorf("http sink: %w", err)
+	}
+	if s.token, err = newSecret(q, "token-file", "HTTP_BEARER_TOKEN"); err != nil {
+		return nil, fmt.Errorf("http sink: %w", err)
+	}
+	if u.User != nil {
+		if s.password, err = newSecret(q, "password-file", "HTTP_PASSWORD"); err != nil {
+			return nil, fmt.Errorf("http sink: %w", err)
+		}
+	} else if q.Get("password-file") != "" {
+		return nil, fmt.Errorf("http sink: password-file needs a user name in the URL")
+	}
+	if tc != nil {
+		s.client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+
+	// The sink's own options are not part of the endpoint's URL.
+	for _, opt := range []string{"ce-batch", "batch-bytes", "batch-delay", "header", "insecure", "ca", "cert", "key", "token-file", "password-file", "run-id"} {
+		q.Del(opt)
+	}
+	target := *u
+	target.User = nil
+	target.RawQuery = q.Encode()
+	s.url = target.String()
+	return s, nil
+}
+
+func (s *httpSink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		if ev := rec.Event; ev != nil && (ev.binary || !s.ceBatch) {
+			if err := s.sendEvent(ctx, rec); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+			continue
+		}
+		if len(s.body) > 0 && int64(len(s.body)+len(rec.Data)+1) > s.maxBytes {
+			if err := s.flush(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+		s.pending.add(len(s.body))
+		if len(s.body) == 0 {
+			s.events = rec.Event != nil
+			if s.events {
+				s.body = append(s.body, '[')
+			}
+		} else if s.events {
+			s.body = append(s.body, ',')
+		}
+		s.body = append(s.body, rec.Data...)
+		if !s.events {
+			s.body = append(s.body, '\n')
+		}
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.flush(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return nil
+}
+
+// unbuffer takes a record of a failed batch back out of the body.
+func (s *httpSink) unbuffer(start int) {
+	s.body = s.body[:start]
+}
+
+func (s *httpSink) Close(ctx context.Context) error {
+	if s.pending.len() == 0 {
+		return nil
+	}
+	return s.flush(ctx)
+}
+
+// flush posts the pending batch, which stays pending if the post fails.
+func (s *httpSink) flush(ctx context.Context) error {
+	body, contentType := s.body, "application/x-ndjson"
+	if s.events {
+		body, contentType = append(body, ']'), "application/cloudevents-batch+json"
+	}
+	if err := s.send(ctx, body, contentType, nil); err != nil {
+		return err
+	}
+	s.body = s.body[:0]
+	s.pending.sent()
+	return nil
+}
+
+// sendEvent posts a single CloudEvent in its content mode.
+func (s *httpSink) sendEvent(ctx context.Context, rec Record) error {
+	ev := rec.Event
+	if !ev.binary {
+		return s.send(ctx, rec.Data, "application/cloudevents+json", nil)
+	}
+	h := http.Header{"Ce-Specversion": {"1.0"}}
+	for _, attr := range ev.attributes() {
+		h.Set("Ce-"+attr[0], attr[1])
+	}
+	return s.send(ctx, ev.Data, "application/json", h)
+}
+
+// send posts body, retrying while the endpoint is busy.
+func (s *httpSink) send(ctx context.Context, body []byte, contentType string, extra http.Header) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for name, values := range s.headers {
+			req.Header[name] = values
+		}
+		for name, values := range extra {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", contentType)
+		if s.user != nil {
+			pass, _ := s.user.Password()
+			if s.password != nil {
+				if pass, err = s.password.get(); err != nil {
+					return fmt.Errorf("http sink: %w", err)
+				}
+			}
+			req.SetBasicAuth(s.user.Username(), pass)
+		}
+		if s.token != nil {
+			token, err := s.token.get()
+			if err != nil {
+				return fmt.Errorf("http sink: %w", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("http sink: %w", err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode/100 == 2:
+			return nil
+		case resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable:
+			return fmt.Errorf("http sink: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		case attempt == 6:
+			return fmt.Errorf("http sink: endpoint busy after %d attempts: %s", attempt, resp.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
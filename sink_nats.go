@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsSink publishes readings to NATS, by default as JetStream publishes
+// whose acks are tracked so that a missing stream or a full stream surfaces
+// as a write error instead of silently dropping data.
+//
+// Errors and overdue acks are each reported once, by the next write, and
+// publishes whose ack is overdue stop counting against max-pending. A
+// lost connection is redialled by the next write; publishes it left
+// unacknowledged are reported as failed.
+//
+// URL form: nats://[user:pass@|token@]host:4222?subject=sensors.{pipeline_id}.{type}&max-pending=1024&ack-timeout=5s
+// Set jetstream=false for fire-and-forget core NATS publishing. Messages
+// carry the run ID in a Sensor-Gen-Run-Id header.
+type natsSink struct {
+	host      string
+	connect   []byte // CONNECT options
+	conn      net.Conn
+	w         *bufio.Writer
+	wmu       sync.Mutex // guards w; the reader goroutine answers PINGs
+	subject   string
+	jetstream bool
+	inbox     string
+	seq       uint64
+	hdr       []byte // header block of the message being published
+	runHdr    string // run ID header line, if any
+
+	slots      chan struct{} // one token per unacknowledged publish
+	ackTimeout time.Duration
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time // publish time of each unacked message
+	err     error                // first ack or protocol error since the last write
+	closed  chan struct{}        // closed when the connection is lost
+}
+
+func newNATSSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	s := &natsSink{
+		host:       host,
+		subject:    q.Get("subject"),
+		jetstream:  q.Get("jetstream") != "false",
+		inbox:      fmt.Sprintf("_INBOX.%x", rand.Uint64()),
+		ackTimeout: 5 * time.Second,
+		pending:    make(map[uint64]time.Time),
+	}
+	if s.subject == "" {
+		s.subject = "sensors.{pipeline_id}.{type}"
+	}
+	if id := q.Get("run-id"); id != "" {
+		s.runHdr = runIDHeader + ": " + id + "\r\n"
+	}
+	maxPending := 1024
+	if v := q.Get("max-pending"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("nats sink: invalid max-pending %q", v)
+		}
+		maxPending = n
+	}
+	s.slots = make(chan struct{}, maxPending)
+	if v := q.Get("ack-timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("nats sink: ack-timeout: %w", err)
+		}
+		s.ackTimeout = d
+	}
+	opts := map[string]any{
+		"verbose": false, "pedantic": false, "name": "sensor-gen", "lang": "go",
+		"protocol": 1, "headers": true, "no_responders": true,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	s.connect, _ = json.Marshal(opts)
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial connects to the server and starts the reader goroutine.
+func (s *natsSink) dial() error {
+	conn, err := net.DialTimeout("tcp", s.host, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("nats sink: %w", err)
+	}
+	w := bufio.NewWriterSize(conn, 256*1024)
+	r := bufio.NewReaderSize(conn, 64*1024)
+
+	// The server greets with INFO; answer with CONNECT and wait for the
+	// PONG to our PING to know the connection was accepted.
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats sink: unexpected greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	fmt.Fprintf(w, "CONNECT %s\r\nPING\r\n", s.connect)
+	if s.jetstream {
+		fmt.Fprintf(w, "SUB %s.* 1\r\n", s.inbox)
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats sink: %w", err)
+	}
+	if line, err = r.ReadString('\n'); err != nil || strings.TrimSpace(line) != "PONG" {
+		conn.Close()
+		return fmt.Errorf("nats sink: connect rejected: %q: %v", strings.TrimSpace(line), err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.conn, s.w, s.closed = conn, w, make(chan struct{})
+	go s.readLoop(r, s.closed)
+	return nil
+}
+
+// redial replaces a lost connection. Publishes still unacknowledged on
+// it are reported as failed, as they may not have been stored. Called
+// with wmu held.
+func (s *natsSink) redial() error {
+	s.conn.Close()
+	s.mu.Lock()
+	lost := len(s.pending)
+	clear(s.pending)
+	s.slots = make(chan struct{}, cap(s.slots))
+	s.err = nil
+	s.mu.Unlock()
+	if err := s.dial(); err != nil {
+		return err
+	}
+	if lost > 0 {
+		return fmt.Errorf("nats sink: reconnected; %d publishes unacknowledged on the lost connection", lost)
+	}
+	return nil
+}
+
+func (s *natsSink) Write(ctx context.Context, batch []Record) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	select {
+	case <-s.closed:
+		// Report why the connection was lost, and what was lost with it.
+		err := s.checkAcks()
+		if rerr := s.redial(); err == nil {
+			err = rerr
+		} else if rerr != nil {
+			err = fmt.Errorf("%w; %v", err, rerr)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+	}
+	if err := s.checkAcks(); err != nil {
+		return err
+	}
+	for _, rec := range batch {
+		subject := expandTemplate(s.subject, rec.Reading)
+		data := rec.Data
+		s.hdr = s.hdr[:0]
+		ev := rec.Event
+		if binary := ev != nil && ev.binary; binary || s.runHdr != "" {
+			s.hdr = append(s.hdr, "NATS/1.0\r\n"...)
+			s.hdr = append(s.hdr, s.runHdr...)
+			if binary {
+				// CloudEvents binary mode: attributes as message headers.
+				s.hdr = ev.appendHeaders(s.hdr)
+				data = ev.Data
+			}
+			s.hdr = append(s.hdr, "\r\n"...)
+		}
+		verb, sizes := "PUB", strconv.Itoa(len(data))
+		if len(s.hdr) > 0 {
+			verb, sizes = "HPUB", fmt.Sprintf("%d %d", len(s.hdr), len(s.hdr)+len(data))
+		}
+		if !s.jetstream {
+			fmt.Fprintf(s.w, "%s %s %s\r\n", verb, subject, sizes)
+		} else {
+			if err := s.acquire(ctx); err != nil {
+				return err
+			}
+			s.seq++
+			s.mu.Lock()
+			s.pending[s.seq] = time.Now()
+			s.mu.Unlock()
+			fmt.Fprintf(s.w, "%s %s %s.%d %s\r\n", verb, subject, s.inbox, s.seq, sizes)
+		}
+		s.w.Write(s.hdr)
+		s.w.Write(data)
+		s.w.WriteString("\r\n")
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("nats sink: %w", err)
+	}
+	return nil
+}
+
+// acquire reserves an ack slot, flushing first if the window is full so the
+// server can see (and acknowledge) what is already buffered. Called with
+// wmu held.
+func (s *natsSink) acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("nats sink: %w", err)
+	}
+	// Release the writer while waiting so the reader can still answer PINGs.
+	slots, closed := s.slots, s.closed
+	s.wmu.Unlock()
+	defer s.wmu.Lock()
+	timer := time.NewTimer(s.ackTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-closed:
+		if err := s.checkAcks(); err != nil {
+			return err
+		}
+		return fmt.Errorf("nats sink: connection lost")
+	case <-timer.C:
+		// The overdue publishes give up their slots, so the next
+		// write can carry on.
+		if err := s.checkAcks(); err != nil {
+			return err
+		}
+		return fmt.Errorf("nats sink: no publish ack within %v", s.ackTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkAcks reports the first ack or protocol error since it was last
+// called, and the publishes whose ack has become overdue since then,
+// which are given up on and release their slots.
+func (s *natsSink) checkAcks() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.err
+	s.err = nil
+	overdue := 0
+	for seq, sent := range s.pending {
+		if time.Since(sent) > s.ackTimeout {
+			delete(s.pending, seq)
+			<-s.slots
+			overdue++
+		}
+	}
+	if overdue > 0 {
+		oerr := fmt.Errorf("nats sink: %d publishes not acknowledged within %v", overdue, s.ackTimeout)
+		if err == nil {
+			return oerr
+		}
+		return fmt.Errorf("%w; %v", err, oerr)
+	}
+	return err
+}
+
+func (s *natsSink) Close(ctx context.Context) error {
+	defer s.conn.Close()
+	s.wmu.Lock()
+	err := s.w.Flush()
+	s.wmu.Unlock()
+	if err != nil {
+		return fmt.Errorf("nats sink: %w", err)
+	}
+	// Wait for outstanding acks, bounded by ctx and the ack timeout.
+	deadline := time.Now().Add(s.ackTimeout)
+	for {
+		s.mu.Lock()
+		n, err := len(s.pending), s.err
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nats sink: %d publishes unacknowledged after %v", n, s.ackTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("nats sink: %d publishes unacknowledged: %w", n, ctx.Err())
+		case <-s.closed:
+			if err := s.checkAcks(); err != nil {
+				return err
+			}
+			return fmt.Errorf("nats sink: connection lost with %d publishes unacknowledged", n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// readLoop handles server traffic: PINGs, errors and JetStream acks. It
+// closes closed when the connection is lost.
+func (s *natsSink) readLoop(r *bufio.Reader, closed chan struct{}) {
+	defer close(closed)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.fail(fmt.Errorf("nats sink: connection lost: %w", err))
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			s.wmu.Lock()
+			s.w.WriteString("PONG\r\n")
+			s.w.Flush()
+			s.wmu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			s.fail(fmt.Errorf("nats sink: server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			// MSG <subject> <sid> [reply] <size>
+			// HMSG <subject> <sid> [reply] <header size> <total size>
+			f := strings.Fields(line)
+			size, _ := strconv.Atoi(f[len(f)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				s.fail(fmt.Errorf("nats sink: connection lost: %w", err))
+				return
+			}
+			payload = payload[:size]
+			if f[0] == "HMSG" {
+				hdrSize, _ := strconv.Atoi(f[len(f)-2])
+				if strings.HasPrefix(string(payload[:hdrSize]), "NATS/1.0 503") {
+					s.fail(fmt.Errorf("nats sink: no JetStream stream matches the published subject"))
+				}
+				payload = payload[hdrSize:]
+			}
+			s.ack(f[1], payload)
+		}
+	}
+}
+
+// ack records a JetStream publish acknowledgement received on subject.
+func (s *natsSink) ack(subject string, payload []byte) {
+	id, err := strconv.ParseUint(subject[strings.LastIndexByte(subject, '.')+1:], 10, 64)
+	if err != nil {
+		return
+	}
+	var resp struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	json.Unmarshal(payload, &resp)
+	if resp.Error != nil {
+		s.fail(fmt.Errorf("nats sink: publish rejected: %s (%d)", resp.Error.Description, resp.Error.Code))
+	}
+	s.mu.Lock()
+	if _, ok := s.pending[id]; ok {
+		delete(s.pending, id)
+		<-s.slots
+	}
+	s.mu.Unlock()
+}
+
+func (s *natsSink) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a NATS server with JetStream answering each publish as
+// replies gives for its index, counting from 0 across connections:
+// "ack", "err" (an error ack), "503" (no responders), "none" (no answer)
+// or "drop" (close the connection unanswered). Publishes past the end of
+// replies are acked.
+type fakeNATS struct {
+	ln      net.Listener
+	replies []string
+
+	mu       sync.Mutex
+	conns    int
+	pubs     []string // payloads in the order they were published
+	subjects []string // subject of each publish
+	headers  []string // header block of each publish, "" for PUB
+}
+
+func newFakeNATS(t *testing.T, replies ...string) *fakeNATS {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{ln: ln, replies: replies}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"headers\":true}\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB", "HPUB":
+			// PUB <subject> <reply> <size>
+			// HPUB <subject> <reply> <header size> <total size>
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			msg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			msg = msg[:size]
+			hdr := 0
+			if fields[0] == "HPUB" {
+				hdr, _ = strconv.Atoi(fields[len(fields)-2])
+			}
+			if !f.publish(conn, fields[1], fields[2], string(msg[:hdr]), string(msg[hdr:])) {
+				return
+			}
+		}
+	}
+}
+
+// publish records a publish and answers it on reply, reporting false if
+// the connection is to be dropped.
+func (f *fakeNATS) publish(conn net.Conn, subject, reply, hdr, data string) bool {
+	f.mu.Lock()
+	n := len(f.pubs)
+	f.pubs = append(f.pubs, data)
+	f.subjects = append(f.subjects, subject)
+	f.headers = append(f.headers, hdr)
+	f.mu.Unlock()
+	answer := "ack"
+	if n < len(f.replies) {
+		answer = f.replies[n]
+	}
+	switch answer {
+	case "ack":
+		ack := fmt.Sprintf(`{"stream":"SENSORS","seq":%d}`, n+1)
+		fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+	case "err":
+		ack := `{"error":{"code":503,"err_code":10077,"description":"maximum messages exceeded"}}`
+		fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", reply, len(ack), ack)
+	case "503":
+		hdr := "NATS/1.0 503\r\n\r\n"
+		fmt.Fprintf(conn, "HMSG %s 1 %d %d\r\n%s\r\n", reply, len(hdr), len(hdr), hdr)
+	case "drop":
+		return false
+	}
+	return true
+}
+
+func (f *fakeNATS) published() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.pubs)
+}
+
+func sinkRecords(ids ...string) []Record {
+	var batch []Record
+	for _, id := range ids {
+		batch = append(batch, Record{
+			Reading: &SensorReading{SensorID: id, PipelineID: "p1", Type: "pressure"},
+			Data:    []byte(id),
+		})
+	}
+	return batch
+}
+
+// waitNATS waits until each publish is acknowledged or overdue, or the
+// connection is lost.
+func waitNATS(s *natsSink) {
+	for {
+		s.mu.Lock()
+		answered := true
+		for _, sent := range s.pending {
+			if time.Since(sent) <= s.ackTimeout {
+				answered = false
+			}
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+		if answered {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNATSSinkAcks(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		replies []string
+		batches [][]string
+		errs    []string // expected in each write's error, "" for none
+		pubs    []string
+		conns   int
+	}{
+		{
+			name:    "acked",
+			batches: [][]string{{"a", "b"}, {"c"}},
+			errs:    []string{"", ""},
+			pubs:    []string{"a", "b", "c"},
+			conns:   1,
+		},
+		{
+			name:    "error ack reported once",
+			replies: []string{"ack", "err"},
+			batches: [][]string{{"a", "b"}, {"c"}, {"d"}},
+			errs:    []string{"", "publish rejected: maximum messages exceeded (503)", ""},
+			pubs:    []string{"a", "b", "d"},
+			conns:   1,
+		},
+		{
+			name:    "no stream",
+			replies: []string{"503"},
+			batches: [][]string{{"a"}, {"b"}},
+			errs:    []string{"", "no JetStream stream matches"},
+			pubs:    []string{"a"},
+			conns:   1,
+		},
+		{
+			name:    "overdue ack expires",
+			query:   "&ack-timeout=50ms",
+			replies: []string{"none"},
+			batches: [][]string{{"a"}, {"b"}, {"c"}},
+			errs:    []string{"", "1 publishes not acknowledged within 50ms", ""},
+			pubs:    []string{"a", "c"},
+			conns:   1,
+		},
+		{
+			name:    "full window waits for acks",
+			query:   "&max-pending=2",
+			batches: [][]string{{"a", "b", "c", "d", "e"}},
+			errs:    []string{""},
+			pubs:    []string{"a", "b", "c", "d", "e"},
+			conns:   1,
+		},
+		{
+			name:    "redial after a lost connection",
+			replies: []string{"ack", "drop"},
+			batches: [][]string{{"a", "b"}, {"c"}, {"d"}},
+			errs:    []string{"", "reconnected; 1 publishes unacknowledged", ""},
+			pubs:    []string{"a", "b", "d"},
+			conns:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeNATS(t, tt.replies...)
+			u, _ := url.Parse("nats://" + srv.ln.Addr().String() + "?subject=sensors.{type}" + tt.query)
+			sink, err := newNATSSink(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := sink.(*natsSink)
+			ctx := context.Background()
+			for i, ids := range tt.batches {
+				err := s.Write(ctx, sinkRecords(ids...))
+				if got := fmt.Sprint(err); tt.errs[i] == "" && err != nil || tt.errs[i] != "" && !strings.Contains(got, tt.errs[i]) {
+					t.Errorf("write %d: err = %v, want %q", i, err, tt.errs[i])
+				}
+				waitNATS(s)
+			}
+			if err := s.Close(ctx); err != nil {
+				t.Errorf("close: %v", err)
+			}
+			if got := srv.published(); !slices.Equal(got, tt.pubs) {
+				t.Errorf("published %q, want %q", got, tt.pubs)
+			}
+			srv.mu.Lock()
+			if srv.conns != tt.conns {
+				t.Errorf("%d connections, want %d", srv.conns, tt.conns)
+			}
+			srv.mu.Unlock()
+		})
+	}
+}
+
+func TestNATSSinkSubjectAndHeaders(t *testing.T) {
+	srv := newFakeNATS(t)
+	u, _ := url.Parse("nats://" + srv.ln.Addr().String() + "?run-id=run-7")
+	sink, err := newNATSSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := sink.Write(ctx, sinkRecords("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.subjects) != 1 || srv.subjects[0] != "sensors.p1.pressure" {
+		t.Errorf("subjects %q, want sensors.p1.pressure", srv.subjects)
+	}
+	want := "NATS/1.0\r\n" + runIDHeader + ": run-7\r\n\r\n"
+	if len(srv.headers) != 1 || srv.headers[0] != want {
+		t.Errorf("headers %q, want %q", srv.headers, want)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"net/url"
+)
+
+// nullSink discards every batch once it has been encoded, so the generator
+// and encoders can be measured without disk or network I/O.
+//
+// URL form: null (or null://)
+type nullSink struct{}
+
+func newNullSink(*url.URL) (Sink, error) {
+	return nullSink{}, nil
+}
+
+func (nullSink) Write(context.Context, []Record) error { return nil }
+func (nullSink) Close(context.Context) error           { return nil }
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlpExportPath is the gRPC path of MetricsService.Export.
+const otlpExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpSink exports readings as OpenTelemetry gauge metrics over OTLP/gRPC,
+// e.g. to an OpenTelemetry Collector. Every sensor is a resource of its own
+// (service.name, sensor.id, sensor.type, pipeline.id, its location and
+// sensor_gen.run_id) with one gauge, sensor.<type>, whose data points
+// carry the reading's value, timestamp, status and quality. Requests are
+// batched by data points and age; those failing with a retryable gRPC
+// status are retried with backoff.
+//
+// URL form: otlp://host:4317?batch-points=1000&batch-delay=1s&compression=gzip
+// Headers (e.g. for authentication) come from OTEL_EXPORTER_OTLP_HEADERS,
+// as comma-separated key=value pairs.
+type otlpSink struct {
+	client    *http.Client
+	url       string
+	headers   http.Header
+	service   string
+	runID     string
+	gzip      bool
+	maxPoints int
+	maxDelay  time.Duration
+
+	sensors map[string]*otlpSensor
+	order   []*otlpSensor
+	pending pendingRecords[otlpPoint]
+	zbuf    bytes.Buffer
+}
+
+// otlpPoint is a pending data point: where it starts in its sensor's points.
+type otlpPoint struct {
+	sensor *otlpSensor
+	start  int
+}
+
+// otlpSensor is a sensor with data points pending.
+type otlpSensor struct {
+	id       string
+	resource []byte // encoded Resource
+	metric   []byte // encoded Metric fields before the gauge
+	points   []byte // encoded NumberDataPoint fields of the gauge
+}
+
+// otlpUnits maps the generator's units to UCUM, as OpenTelemetry expects.
+var otlpUnits = map[string]string{
+	"psi":        "[psi]",
+	"fahrenheit": "[degF]",
+	"bbl/hr":     "[bbl_us]/h",
+	"mpy":        "[mil_us]/a",
+	"percent":    "%",
+	"ppm":        "[ppm]",
+	"BTU/scf":    "[Btu_IT]/[cft_i]",
+	"ft":         "[ft_i]",
+	"rpm":        "{rev}/min",
+	"mV":         "mV",
+	"A":          "A",
+	"kPa":        "kPa",
+	"celsius":    "Cel",
+	"m3/h":       "m3/h",
+	"m":          "m",
+	"MJ/m3":      "MJ/m3",
+}
+
+// gRPC status codes the exporter retries, per the OTLP specification.
+var otlpRetryable = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+func newOTLPSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	s := &otlpSink{
+		headers:   make(http.Header),
+		service:   q.Get("service"),
+		runID:     q.Get("run-id"),
+		maxPoints: 1000,
+		maxDelay:  time.Second,
+		sensors:   make(map[string]*otlpSensor),
+	}
+	if s.service == "" {
+		s.service = "sensor-gen"
+	}
+	switch c := q.Get("compression"); c {
+	case "", "none":
+	case "gzip":
+		s.gzip = true
+	default:
+		return nil, fmt.Errorf("otlp sink: unknown compression %q (want gzip or none)", c)
+	}
+	if v := q.Get("batch-points"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("otlp sink: batch-points must be a positive integer")
+		}
+		s.maxPoints = n
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		var err error
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("otlp sink: batch-delay: %w", err)
+		}
+	}
+	if h := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); h != "" {
+		for _, kv := range strings.Split(h, ",") {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("otlp sink: OTEL_EXPORTER_OTLP_HEADERS: want key=value, got %q", kv)
+			}
+			v, _ = url.PathUnescape(strings.TrimSpace(v))
+			s.headers.Set(strings.TrimSpace(k), v)
+		}
+	}
+
+	// gRPC needs HTTP/2; without TLS that is cleartext HTTP/2 (h2c).
+	var protocols http.Protocols
+	transport := &http.Transport{Protocols: &protocols}
+	scheme := "http"
+	if q.Get("tls") == "true" {
+		scheme = "https"
+		protocols.SetHTTP2(true)
+		tc, err := tlsConfig(q)
+		if err != nil {
+			return nil, fmt.Errorf("otlp sink: %w", err)
+		}
+		transport.TLSClientConfig = tc
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	s.client = &http.Client{Transport: transport, Timeout: time.Minute}
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort += ":4317"
+	}
+	s.url = fmt.Sprintf("%s://%s%s", scheme, hostPort, otlpExportPath)
+	return s, nil
+}
+
+func (s *otlpSink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		r := rec.Reading
+		t, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+		if err != nil {
+			return s.pending.fail(fmt.Errorf("otlp sink: sensor %s: timestamp: %w", r.SensorID, err), s.unbuffer)
+		}
+		sensor, ok := s.sensors[r.SensorID]
+		if !ok {
+			sensor = s.newSensor(r)
+			s.sensors[r.SensorID] = sensor
+			s.order = append(s.order, sensor)
+		}
+		s.pending.add(otlpPoint{sensor, len(sensor.points)})
+		sensor.points = appendProtoBytes(sensor.points, 1, appendOTLPDataPoint(nil, r, t))
+		if s.pending.len() >= s.maxPoints {
+			if err := s.send(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.send(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return nil
+}
+
+// unbuffer takes a data point of a failed batch back out of its sensor.
+// A sensor left without points has only had points from this batch since
+// the last request, so it is the newest and is dropped too.
+func (s *otlpSink) unbuffer(p otlpPoint) {
+	p.sensor.points = p.sensor.points[:p.start]
+	if p.start == 0 {
+		delete(s.sensors, p.sensor.id)
+		s.order = s.order[:len(s.order)-1]
+	}
+}
+
+func (s *otlpSink) Close(ctx context.Context) error {
+	if s.pending.len() == 0 {
+		return nil
+	}
+	return s.send(ctx)
+}
+
+// newSensor encodes the resource and metric describing r's sensor.
+func (s *otlpSink) newSensor(r *SensorReading) *otlpSensor {
+	var res []byte
+	res = appendOTLPString(res, 1, "service.name", s.service)
+	res = appendOTLPString(res, 1, "sensor.id", r.SensorID)
+	res = appendOTLPString(res, 1, "sensor.type", r.Type)
+	res = appendOTLPString(res, 1, "pipeline.id", r.PipelineID)
+	res = appendOTLPDouble(res, 1, "geo.location.lat", r.Location.Lat)
+	res = appendOTLPDouble(res, 1, "geo.location.lon", r.Location.Lon)
+	res = appendOTLPDouble(res, 1, "pipeline.mile_post", r.Location.MilePost)
+	if r.Cohort != "" {
+		res = appendOTLPString(res, 1, "sensor.cohort", r.Cohort)
+	}
+	if s.runID != "" {
+		res = appendOTLPString(res, 1, "sensor_gen.run_id", s.runID)
+	}
+
+	unit := r.Unit
+	if ucum, ok := otlpUnits[unit]; ok {
+		unit = ucum
+	}
+	var m []byte
+	m = appendProtoString(m, 1, "sensor."+r.Type)
+	m = appendProtoString(m, 2, "Pipeline "+strings.ReplaceAll(r.Type, "_", " ")+" reading")
+	m = appendProtoString(m, 3, unit)
+	return &otlpSensor{id: r.SensorID, resource: res, metric: m}
+}
+
+// appendOTLPDataPoint appends r as NumberDataPoint fields: its value as a
+// double, time_unix_nano and the status, alert level, quality and backfill
+// attributes.
+func appendOTLPDataPoint(b []byte, r *SensorReading, t time.Time) []byte {
+	b = appendOTLPString(b, 7, "status", r.Status)
+	if r.AlertLevel != "" {
+		b = appendOTLPString(b, 7, "alert_level", r.AlertLevel)
+	}
+	b = appendOTLPDouble(b, 7, "quality_score", r.Quality)
+	if r.Backfilled {
+		var v [2]byte
+		kv := appendProtoString(nil, 1, "backfilled")
+		kv = appendProtoBytes(kv, 2, append(v[:0], 2<<3|0, 1)) // AnyValue.bool_value
+		b = appendProtoBytes(b, 7, kv)
+	}
+	b = binary.AppendUvarint(b, 3<<3|1)
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.UnixNano()))
+	// as_double is a oneof: it is written even when zero.
+	b = binary.AppendUvarint(b, 4<<3|1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(r.Value))
+}
+
+// appendOTLPString appends an attribute with a string value as field.
+func appendOTLPString(b []byte, field uint64, key, value string) []byte {
+	kv := appendProtoString(nil, 1, key)
+	kv = appendProtoBytes(kv, 2, appendProtoString(nil, 1, value))
+	return appendProtoBytes(b, field, kv)
+}
+
+// appendOTLPDouble appends an attribute with a double value as field.
+func appendOTLPDouble(b []byte, field uint64, key string, value float64) []byte {
+	v := binary.AppendUvarint(nil, 4<<3|1)
+	v = binary.LittleEndian.AppendUint64(v, math.Float64bits(value))
+	kv := appendProtoString(nil, 1, key)
+	kv = appendProtoBytes(kv, 2, v)
+	return appendProtoBytes(b, field, kv)
+}
+
+// encode returns the pending data points as an ExportMetricsServiceRequest
+// with one ResourceMetrics per sensor.
+func (s *otlpSink) encode() []byte {
+	var scope []byte
+	scope = appendProtoString(scope, 1, "sensor-gen")
+
+	var req []byte
+	for _, sensor := range s.order {
+		metric := append([]byte(nil), sensor.metric...)
+		metric = appendProtoBytes(metric, 5, sensor.points) // gauge
+		var sm []byte
+		sm = appendProtoBytes(sm, 1, scope)
+		sm = appendProtoBytes(sm, 2, metric)
+		var rm []byte
+		rm = appendProtoBytes(rm, 1, sensor.resource)
+		rm = appendProtoBytes(rm, 2, sm)
+		req = appendProtoBytes(req, 1, rm)
+	}
+	return req
+}
+
+// send exports the pending data points, retrying while the receiver
+// reports a retryable status. They stay pending if the export fails.
+func (s *otlpSink) send(ctx context.Context) error {
+	msg := s.encode()
+
+	flag := byte(0)
+	if s.gzip {
+		s.zbuf.Reset()
+		zw := gzip.NewWriter(&s.zbuf)
+		zw.Write(msg)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		msg, flag = s.zbuf.Bytes(), 1
+	}
+	body := append([]byte{flag}, binary.BigEndian.AppendUint32(nil, uint32(len(msg)))...)
+	body = append(body, msg...)
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		code, status, err := s.export(ctx, body)
+		switch {
+		case err != nil:
+			return fmt.Errorf("otlp sink: %w", err)
+		case code == grpcOK:
+			clear(s.sensors)
+			s.order = s.order[:0]
+			s.pending.sent()
+			return nil
+		case !otlpRetryable[code]:
+			return fmt.Errorf("otlp sink: export failed: code %d: %s", code, status)
+		case attempt == 6:
+			return fmt.Errorf("otlp sink: export failing after %d attempts: code %d: %s", attempt, code, status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// export makes one Export call, returning its gRPC status. Data points
+// the receiver reports as rejected in a partial success are an error.
+func (s *otlpSink) export(ctx context.Context, body []byte) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "sensor-gen")
+	if s.gzip {
+		req.Header.Set("Grpc-Encoding", "gzip")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return 0, "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, "", err
+	}
+	// A trailers-only response carries the status in its headers.
+	code, status := resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	if code == "" {
+		code, status = resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return 0, "", fmt.Errorf("response without a gRPC status")
+	}
+	status, _ = url.PathUnescape(status)
+	if n != grpcOK {
+		return n, status, nil
+	}
+	if len(reply) >= 5 && reply[0] == 0 {
+		rejected, msg, err := decodeOTLPPartialSuccess(reply[5:])
+		if err != nil {
+			return 0, "", err
+		}
+		if rejected > 0 {
+			return 0, "", fmt.Errorf("receiver rejected %d data points: %s", rejected, msg)
+		}
+	}
+	return grpcOK, "", nil
+}
+
+// decodeOTLPPartialSuccess returns the rejected data point count and error
+// message of an ExportMetricsServiceResponse.
+func decodeOTLPPartialSuccess(b []byte) (int64, string, error) {
+	var rejected int64
+	var msg string
+	malformed := errors.New("malformed ExportMetricsServiceResponse")
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag&7 != 2 {
+			return 0, "", malformed
+		}
+		l, m := binary.Uvarint(b[n:])
+		if m <= 0 || l > uint64(len(b)-n-m) {
+			return 0, "", malformed
+		}
+		v := b[n+m : n+m+int(l)]
+		b = b[n+m+int(l):]
+		if tag>>3 != 1 { // partial_success
+			continue
+		}
+		for len(v) > 0 {
+			tag, n := binary.Uvarint(v)
+			if n <= 0 {
+				return 0, "", malformed
+			}
+			v = v[n:]
+			switch tag {
+			case 1<<3 | 0: // rejected_data_points
+				x, n := binary.Uvarint(v)
+				if n <= 0 {
+					return 0, "", malformed
+				}
+				rejected, v = int64(x), v[n:]
+			case 2<<3 | 2: // error_message
+				l, n := binary.Uvarint(v)
+				if n <= 0 || l > uint64(len(v)-n) {
+					return 0, "", malformed
+				}
+				msg, v = string(v[n:n+int(l)]), v[n+int(l):]
+			default:
+				return 0, "", malformed
+			}
+		}
+	}
+	return rejected, msg, nil
+}
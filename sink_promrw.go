@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promSink pushes readings to a Prometheus remote-write receiver
+// (Prometheus, Mimir, Thanos, VictoriaMetrics, ...). Each reading is one
+// sample of the series named by the metric template and labelled with the
+// chosen reading fields, at the reading's timestamp. Samples are grouped by
+// series into snappy-compressed WriteRequests of up to batch-samples samples,
+// sent when full or when the oldest sample reaches batch-delay. Requests
+// the receiver fails with 429 or 5xx are retried with backoff, as the
+// protocol specifies.
+//
+// URL form: prometheus://host:9090/api/v1/write?metric=sensor_{type}&labels=sensor_id,pipeline_id&batch-samples=2000
+// Credentials in the URL are sent as basic auth; PROMETHEUS_BEARER_TOKEN, if
+// set, as a bearer token.
+type promSink struct {
+	client     *http.Client
+	url        string
+	user, pass string
+	token      string
+	tenant     string
+	metric     string
+	labels     []string // reading fields sent as labels
+	job        string
+	maxSamples int
+	maxDelay   time.Duration
+
+	series  map[string]*promSeries // keyed by encoded labels
+	order   []*promSeries
+	pending pendingRecords[*promSeries] // the series of each pending sample
+	sorted  []promSample
+	buf     []byte
+}
+
+// promSeries is a series with samples pending.
+type promSeries struct {
+	labels  []byte // encoded Label messages
+	samples []promSample
+}
+
+type promSample struct {
+	value float64
+	ts    int64 // milliseconds since the Unix epoch
+}
+
+// promLabelFields are the reading fields that can be sent as labels.
+var promLabelFields = map[string]func(r *SensorReading) string{
+	"sensor_id":   func(r *SensorReading) string { return r.SensorID },
+	"pipeline_id": func(r *SensorReading) string { return r.PipelineID },
+	"type":        func(r *SensorReading) string { return r.Type },
+	"unit":        func(r *SensorReading) string { return r.Unit },
+	"status":      func(r *SensorReading) string { return r.Status },
+	"alert_level": func(r *SensorReading) string { return r.AlertLevel },
+	"cohort":      func(r *SensorReading) string { return r.Cohort },
+}
+
+func newPromSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	s := &promSink{
+		client:     &http.Client{Timeout: time.Minute},
+		token:      os.Getenv("PROMETHEUS_BEARER_TOKEN"),
+		tenant:     q.Get("tenant"),
+		metric:     q.Get("metric"),
+		job:        q.Get("job"),
+		maxSamples: 2000,
+		maxDelay:   time.Second,
+		series:     make(map[string]*promSeries),
+	}
+	if s.metric == "" {
+		s.metric = "sensor_{type}"
+	}
+	if !q.Has("job") {
+		s.job = "sensor-gen"
+	}
+	fields := q.Get("labels")
+	if fields == "" {
+		fields = "sensor_id,pipeline_id,type,unit"
+	}
+	for _, f := range strings.Split(fields, ",") {
+		if _, ok := promLabelFields[f]; !ok {
+			return nil, fmt.Errorf("prometheus sink: unknown label field %q", f)
+		}
+		s.labels = append(s.labels, f)
+	}
+	if v := q.Get("batch-samples"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("prometheus sink: batch-samples must be a positive integer")
+		}
+		s.maxSamples = n
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		var err error
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("prometheus sink: batch-delay: %w", err)
+		}
+	}
+	tc, err := tlsConfig(q)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus sink: %w", err)
+	}
+	if tc != nil {
+		s.client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+	}
+
+	scheme := "http"
+	if q.Get("tls") == "true" {
+		scheme = "https"
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort += ":9090"
+	}
+	path := u.Path
+	if path == "" || path == "/" {
+		path = "/api/v1/write"
+	}
+	s.url = fmt.Sprintf("%s://%s%s", scheme, hostPort, path)
+	return s, nil
+}
+
+func (s *promSink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		r := rec.Reading
+		t, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+		if err != nil {
+			return s.pending.fail(fmt.Errorf("prometheus sink: sensor %s: timestamp: %w", r.SensorID, err), s.unbuffer)
+		}
+		s.buf = s.appendLabels(s.buf[:0], r)
+		ser, ok := s.series[string(s.buf)]
+		if !ok {
+			ser = &promSeries{labels: slices.Clone(s.buf)}
+			s.series[string(ser.labels)] = ser
+			s.order = append(s.order, ser)
+		}
+		ser.samples = append(ser.samples, promSample{r.Value, t.UnixMilli()})
+		s.pending.add(ser)
+		if s.pending.len() >= s.maxSamples {
+			if err := s.send(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.send(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return nil
+}
+
+// unbuffer takes a sample of a failed batch back out of its series. A
+// series left empty has only had samples from this batch since the last
+// request, so it is the newest and is dropped too.
+func (s *promSink) unbuffer(ser *promSeries) {
+	ser.samples = ser.samples[:len(ser.samples)-1]
+	if len(ser.samples) == 0 {
+		delete(s.series, string(ser.labels))
+		s.order = s.order[:len(s.order)-1]
+	}
+}
+
+func (s *promSink) Close(ctx context.Context) error {
+	if s.pending.len() == 0 {
+		return nil
+	}
+	return s.send(ctx)
+}
+
+// appendLabels appends r's labels as Label messages, sorted by name as the
+// protocol requires. Labels with empty values are left out, as Prometheus
+// treats them as absent.
+func (s *promSink) appendLabels(b []byte, r *SensorReading) []byte {
+	type label struct{ name, value string }
+	labels := make([]label, 0, len(s.labels)+2)
+	labels = append(labels, label{"__name__", promMetricName(expandTemplate(s.metric, r))})
+	if s.job != "" {
+		labels = append(labels, label{"job", s.job})
+	}
+	for _, f := range s.labels {
+		labels = append(labels, label{f, promLabelFields[f](r)})
+	}
+	slices.SortFunc(labels, func(a, b label) int { return strings.Compare(a.name, b.name) })
+	for _, l := range labels {
+		if l.value == "" {
+			continue
+		}
+		var m []byte
+		m = appendProtoString(m, 1, l.name)
+		m = appendProtoString(m, 2, l.value)
+		b = appendProtoBytes(b, 1, m)
+	}
+	return b
+}
+
+// promMetricName replaces the characters a metric name may not contain
+// with underscores.
+func promMetricName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// encode returns the pending samples as a WriteRequest, each series' samples
+// in timestamp order. The series keep theirs in the order they were added.
+func (s *promSink) encode() []byte {
+	var req, ts, sample []byte
+	for _, ser := range s.order {
+		s.sorted = append(s.sorted[:0], ser.samples...)
+		slices.SortStableFunc(s.sorted, func(a, b promSample) int { return cmp.Compare(a.ts, b.ts) })
+		ts = append(ts[:0], ser.labels...)
+		for _, smp := range s.sorted {
+			sample = appendProtoDouble(sample[:0], 1, smp.value)
+			if smp.ts != 0 {
+				sample = binary.AppendUvarint(sample, 2<<3)
+				sample = binary.AppendUvarint(sample, uint64(smp.ts))
+			}
+			ts = appendProtoBytes(ts, 2, sample)
+		}
+		req = appendProtoBytes(req, 1, ts)
+	}
+	return req
+}
+
+// send posts the pending samples, retrying while the receiver is
+// overloaded or failing. They stay pending if it keeps failing.
+func (s *promSink) send(ctx context.Context) error {
+	body := snappyEncode(nil, s.encode())
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("User-Agent", "sensor-gen")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if s.tenant != "" {
+			req.Header.Set("X-Scope-OrgID", s.tenant)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		} else if s.user != "" {
+			req.SetBasicAuth(s.user, s.pass)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("prometheus sink: %w", err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode/100 == 2:
+			clear(s.series)
+			s.order = s.order[:0]
+			s.pending.sent()
+			return nil
+		case resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode/100 != 5:
+			return fmt.Errorf("prometheus sink: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		case attempt == 6:
+			return fmt.Errorf("prometheus sink: receiver failing after %d attempts: %s: %s", attempt, resp.Status, bytes.TrimSpace(msg))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// snappyEncode appends src compressed in the snappy block format, which
+// remote write requires. Input is compressed in independent 64 KiB
+// fragments, as the reference encoder does, so every copy's offset fits
+// two bytes; matches are found with a hash table of 4-byte prefixes.
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << 14]uint16 // position+1 of the last prefix with each hash
+	for len(src) > 0 {
+		frag := src[:min(len(src), 1<<16)]
+		src = src[len(frag):]
+		clear(table[:])
+		lit := 0
+		for i := 0; i+4 <= len(frag); {
+			cur := binary.LittleEndian.Uint32(frag[i:])
+			h := (cur * 0x1e35a7bd) >> (32 - 14)
+			cand := int(table[h]) - 1
+			table[h] = uint16(i + 1)
+			if cand < 0 || binary.LittleEndian.Uint32(frag[cand:]) != cur {
+				i++
+				continue
+			}
+			n := 4
+			for i+n < len(frag) && frag[cand+n] == frag[i+n] {
+				n++
+			}
+			dst = snappyLiteral(dst, frag[lit:i])
+			for off, left := i-cand, n; left > 0; {
+				l := min(left, 64)
+				dst = append(dst, byte(l-1)<<2|2, byte(off), byte(off>>8))
+				left -= l
+			}
+			i += n
+			lit = i
+		}
+		dst = snappyLiteral(dst, frag[lit:])
+	}
+	return dst
+}
+
+// snappyLiteral appends lit as a snappy literal element.
+func snappyLiteral(dst, lit []byte) []byte {
+	n := len(lit)
+	switch {
+	case n == 0:
+		return dst
+	case n <= 60:
+		dst = append(dst, byte(n-1)<<2)
+	default:
+		size := (bits.Len(uint(n-1)) + 7) / 8 // bytes holding n-1
+		dst = append(dst, byte(59+size)<<2)
+		for i := 0; i < size; i++ {
+			dst = append(dst, byte((n-1)>>(8*i)))
+		}
+	}
+	return append(dst, lit...)
+}
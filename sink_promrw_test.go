@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// snappyDecode decodes a snappy block, following the format description
+// rather than snappyEncode, to check the encoder against.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errors.New("bad length")
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if length > 60 {
+				extra := length - 60
+				if len(src) < extra {
+					return nil, errors.New("short literal length")
+				}
+				length = 0
+				for i := range extra {
+					length |= int(src[i]) << (8 * i)
+				}
+				length++
+				src = src[extra:]
+			}
+			if len(src) < length {
+				return nil, errors.New("short literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errors.New("short copy")
+			}
+			length = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errors.New("short copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errors.New("short copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errors.New("bad copy offset")
+		}
+		for range length {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errors.New("length mismatch")
+	}
+	return dst, nil
+}
+
+func TestSnappyDecodeVectors(t *testing.T) {
+	tests := []struct {
+		name string
+		enc  []byte
+		want string
+	}{
+		{"empty", []byte{0x00}, ""},
+		{"literal", []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'}, "hello"},
+		// A 3-byte literal, then a 1-byte-offset copy of 9 bytes from 3 back.
+		{"copy1", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}, "abcabcabcabc"},
+		// A 2-byte-offset copy of 5 bytes from 4 back, overlapping itself.
+		{"copy2", []byte{0x09, 0x0c, 'w', 'x', 'y', 'z', 0x12, 0x04, 0x00}, "wxyzwxyzw"},
+		// A 4-byte-offset copy of 2 bytes from 2 back.
+		{"copy4", []byte{0x04, 0x04, 'o', 'k', 0x07, 0x02, 0x00, 0x00, 0x00}, "okok"},
+		// A 61-byte literal, its length in one extra byte.
+		{"long literal", append([]byte{0x3d, 60 << 2, 60}, strings.Repeat("z", 61)...), strings.Repeat("z", 61)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := snappyDecode(tt.enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnappyEncodeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rng.Read(random)
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"repeated", bytes.Repeat([]byte("sensor-gen "), 1000)},
+		{"long match", bytes.Repeat([]byte{'x'}, 70000)},
+		{"random", random},
+		{"mixed", append(bytes.Repeat([]byte(`{"sensor_id":"SNS-pre-0001","value":812.5}`), 3000), random[:5000]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := snappyEncode(nil, tt.src)
+			got, err := snappyDecode(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.src) {
+				t.Fatalf("round trip differs: %d bytes in, %d out", len(tt.src), len(got))
+			}
+			if tt.name == "repeated" && len(enc) > len(tt.src)/10 {
+				t.Errorf("repeated input compressed to only %d of %d bytes", len(enc), len(tt.src))
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publish request limits imposed by the Pub/Sub API.
+const (
+	pubsubMaxMessages = 1000
+	pubsubMaxBytes    = 10 << 20
+)
+
+// pubsubSink publishes readings to a Google Cloud Pub/Sub topic through the
+// REST API, batching messages by count, size and age. A timer publishes
+// messages that reach batch-delay between writes, so they do not wait for
+// the next reading at low rates.
+//
+// URL form: pubsub://project/topic?ordering=true&batch-messages=500&batch-bytes=1MB&batch-delay=50ms
+// When PUBSUB_EMULATOR_HOST is set the emulator is used without auth.
+// Messages carry pipeline_id, type and run_id attributes.
+type pubsubSink struct {
+	client   *http.Client
+	url      string
+	token    *gcpToken
+	ordering bool
+	runID    string
+
+	maxMessages int
+	maxBytes    int64
+	maxDelay    time.Duration
+
+	mu           sync.Mutex // guards everything below; the timer publishes too
+	timer        *time.Timer
+	pending      pendingRecords[pubsubMessage]
+	pendingBytes int64
+}
+
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+func newPubSubSink(u *url.URL) (Sink, error) {
+	project, topic := u.Host, strings.Trim(u.Path, "/")
+	if project == "" || topic == "" {
+		return nil, fmt.Errorf("pubsub sink: expected pubsub://project/topic")
+	}
+	q := u.Query()
+
+	s := &pubsubSink{
+		client:      &http.Client{Timeout: time.Minute},
+		ordering:    q.Get("ordering") == "true",
+		runID:       q.Get("run-id"),
+		maxMessages: 100,
+		maxBytes:    1 << 20,
+		maxDelay:    10 * time.Millisecond,
+	}
+	if v := q.Get("batch-messages"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > pubsubMaxMessages {
+			return nil, fmt.Errorf("pubsub sink: batch-messages must be 1-%d", pubsubMaxMessages)
+		}
+		s.maxMessages = n
+	}
+	var err error
+	if s.maxBytes, err = queryBytes(q, "batch-bytes", s.maxBytes); err != nil {
+		return nil, fmt.Errorf("pubsub sink: %w", err)
+	}
+	if s.maxBytes > pubsubMaxBytes*9/10 {
+		return nil, fmt.Errorf("pubsub sink: batch-bytes must be under 9MB")
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("pubsub sink: batch-delay: %w", err)
+		}
+	}
+
+	endpoint := "https://pubsub.googleapis.com"
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		endpoint = "http://" + host
+	} else {
+		s.token = &gcpToken{}
+	}
+	if v := q.Get("endpoint"); v != "" {
+		endpoint = strings.TrimRight(v, "/")
+	}
+	s.url = fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish", endpoint, project, topic)
+	return s, nil
+}
+
+func (s *pubsubSink) Write(ctx context.Context, batch []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending.begin()
+	for _, rec := range batch {
+		msg := pubsubMessage{
+			Data: rec.Data,
+			Attributes: map[string]string{
+				"pipeline_id": rec.Reading.PipelineID,
+				"type":        rec.Reading.Type,
+			},
+		}
+		if s.runID != "" {
+			msg.Attributes["run_id"] = s.runID
+		}
+		if s.ordering {
+			msg.OrderingKey = rec.Reading.SensorID
+		}
+		size := pubsubSize(msg)
+		if s.pending.len() > 0 && (s.pending.len() >= s.maxMessages || s.pendingBytes+size > s.maxBytes) {
+			if err := s.publish(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+		if s.pending.len() == 0 {
+			s.startTimer()
+		}
+		s.pending.add(msg)
+		s.pendingBytes += size
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.publish(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return nil
+}
+
+// unbuffer takes a message of a failed batch back out of the pending
+// request.
+func (s *pubsubSink) unbuffer(msg pubsubMessage) {
+	s.pendingBytes -= pubsubSize(msg)
+}
+
+// pubsubSize estimates the bytes msg adds to a publish request. Base64
+// inflates the payload by a third.
+func pubsubSize(msg pubsubMessage) int64 {
+	return int64(len(msg.Data)*4/3 + 128)
+}
+
+// startTimer has the pending messages published once they reach
+// batch-delay, should no write publish them first.
+func (s *pubsubSink) startTimer() {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.maxDelay, s.publishDue)
+	} else {
+		s.timer.Reset(s.maxDelay)
+	}
+}
+
+// publishDue publishes the pending messages if the oldest has reached
+// batch-delay. If that fails they stay pending, and the next write
+// publishes them and reports how that went.
+func (s *pubsubSink) publishDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending.failed || !s.pending.due(s.maxDelay) {
+		return
+	}
+	if err := s.publish(context.Background()); err != nil {
+		s.pending.failed = true
+	}
+}
+
+func (s *pubsubSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.pending.len() == 0 {
+		return nil
+	}
+	return s.publish(ctx)
+}
+
+// publish sends all pending messages in a single publish request, and
+// drops them once Pub/Sub has accepted it. Requests are issued one at a
+// time, which preserves per-ordering-key order.
+func (s *pubsubSink) publish(ctx context.Context) error {
+	body, err := json.Marshal(struct {
+		Messages []pubsubMessage `json:"messages"`
+	}{s.pending.items})
+	if err != nil {
+		return fmt.Errorf("pubsub sink: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != nil {
+		tok, err := s.token.get(ctx)
+		if err != nil {
+			return fmt.Errorf("pubsub sink: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pubsub sink: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("pubsub sink: publish: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	s.pending.sent()
+	s.pendingBytes = 0
+	return nil
+}
+
+// gcpToken supplies an OAuth access token, taken from
+// GOOGLE_OAUTH_ACCESS_TOKEN or, failing that, from the gcloud CLI
+// (refreshed before its one-hour lifetime runs out).
+type gcpToken struct {
+	value   string
+	fetched time.Time
+}
+
+func (t *gcpToken) get(ctx context.Context) (string, error) {
+	if tok := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); tok != "" {
+		return tok, nil
+	}
+	if t.value != "" && time.Since(t.fetched) < 45*time.Minute {
+		return t.value, nil
+	}
+	out, err := exec.CommandContext(ctx, "gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		return "", fmt.Errorf("obtaining access token (set GOOGLE_OAUTH_ACCESS_TOKEN or log in with gcloud): %w", err)
+	}
+	t.value, t.fetched = strings.TrimSpace(string(out)), time.Now()
+	return t.value, nil
+}
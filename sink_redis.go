@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisSink appends readings to Redis Streams with XADD, one stream per
+// key template (by default one per pipeline), trimming each stream with
+// MAXLEN. Each batch is pipelined: all commands are sent before any reply
+// is read.
+//
+// URL form: redis://[user:pass@]host:6379/0?stream=sensors:{pipeline_id}&maxlen=100000
+// Trimming is approximate (MAXLEN ~) unless exact-trim=true. Entries hold
+// the reading as data and the run ID as run_id.
+type redisSink struct {
+	u       *url.URL
+	conn    net.Conn // nil after an I/O error; redialled on the next write
+	r       *bufio.Reader
+	w       *bufio.Writer
+	stream  string
+	maxLen  string
+	trimOp  string
+	runID   string
+	timeout time.Duration
+}
+
+func newRedisSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	s := &redisSink{
+		u:       u,
+		stream:  q.Get("stream"),
+		maxLen:  q.Get("maxlen"),
+		trimOp:  "~",
+		runID:   q.Get("run-id"),
+		timeout: 30 * time.Second,
+	}
+	if s.stream == "" {
+		s.stream = "sensors:{pipeline_id}"
+	}
+	if s.maxLen != "" {
+		if n, err := strconv.ParseInt(s.maxLen, 10, 64); err != nil || n < 1 {
+			return nil, fmt.Errorf("redis sink: invalid maxlen %q", s.maxLen)
+		}
+	}
+	if q.Get("exact-trim") == "true" {
+		s.trimOp = "="
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect dials the server, authenticates and selects the database.
+func (s *redisSink) connect() error {
+	u := s.u
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("redis sink: %w", err)
+	}
+	s.conn = conn
+	s.r = bufio.NewReaderSize(conn, 64*1024)
+	s.w = bufio.NewWriterSize(conn, 256*1024)
+
+	if u.User != nil {
+		pass, hasPass := u.User.Password()
+		if hasPass && u.User.Username() != "" {
+			s.command("AUTH", u.User.Username(), pass)
+		} else if hasPass {
+			s.command("AUTH", pass)
+		} else {
+			s.command("AUTH", u.User.Username())
+		}
+		if err := s.flushAndRead(1); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		s.command("SELECT", db)
+		if err := s.flushAndRead(1); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisSink) Write(ctx context.Context, batch []Record) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	conn := s.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	for _, rec := range batch {
+		args := []string{"XADD", expandTemplate(s.stream, rec.Reading)}
+		if s.maxLen != "" {
+			args = append(args, "MAXLEN", s.trimOp, s.maxLen)
+		}
+		args = append(args, "*", "data", string(rec.Data))
+		if s.runID != "" {
+			args = append(args, "run_id", s.runID)
+		}
+		s.command(args...)
+	}
+	return s.flushAndRead(len(batch))
+}
+
+func (s *redisSink) Close(ctx context.Context) error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// command buffers one RESP command.
+func (s *redisSink) command(args ...string) {
+	fmt.Fprintf(s.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(s.w, "$%d\r\n", len(a))
+		s.w.WriteString(a)
+		s.w.WriteString("\r\n")
+	}
+}
+
+// flushAndRead sends buffered commands and consumes n replies, returning
+// the first error reply. On I/O errors the connection is dropped, since
+// replies can no longer be matched to commands.
+func (s *redisSink) flushAndRead(n int) error {
+	if err := s.w.Flush(); err != nil {
+		s.drop()
+		return fmt.Errorf("redis sink: %w", err)
+	}
+	var firstErr error
+	for range n {
+		if err := s.readReply(); err != nil {
+			if _, ok := err.(redisError); !ok {
+				s.drop()
+				return fmt.Errorf("redis sink: %w", err)
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("redis sink: %w", err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func (s *redisSink) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// readReply reads and discards one reply, returning a redisError for error
+// replies and other errors for I/O failures.
+func (s *redisSink) readReply() error {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		_, err := io.CopyN(io.Discard, s.r, int64(n+2))
+		return err
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		var firstErr error
+		for range max(n, 0) {
+			if err := s.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		return firstErr
+	}
+	return fmt.Errorf("unexpected reply %q", line)
+}
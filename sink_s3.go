@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3MinPartSize is the smallest part S3 accepts in a multipart upload
+// (every part except the last must be at least this large).
+const s3MinPartSize = 5 << 20
+
+// s3Sink accumulates records into objects of roughly targetSize bytes and
+// uploads them with multipart uploads under a Hive-style prefix:
+//
+//	<prefix>/dt=YYYY-MM-DD/pipeline_id=<id>/part-<run>-<n>.jsonl
+//
+// URL form: s3://bucket/prefix?region=us-east-1&target-size=128MB&part-size=16MB&partition-by=dt,pipeline_id
+// Set endpoint=http://host:9000 for MinIO and other S3-compatible stores
+// (path-style addressing is used whenever an endpoint is given). Objects
+// carry the run ID as run-id user metadata.
+type s3Sink struct {
+	client      *http.Client
+	bucket      string
+	prefix      string
+	region      string
+	endpoint    string // scheme://host, empty for AWS virtual-hosted style
+	creds       awsCredentials
+	targetSize  int64
+	partSize    int64
+	partitionBy []string // partition keys, dt,pipeline_id by default
+	runID       string   // of part names: the time the sink was opened
+	runMeta     string   // run ID for the objects' metadata
+	seq         int
+	objects     map[string]*s3Object // keyed by partition prefix
+	pending     pendingRecords[s3Record]
+}
+
+// s3Object is an object currently being assembled for one partition.
+type s3Object struct {
+	key      string
+	uploadID string
+	parts    []s3Part
+	buf      bytes.Buffer
+	size     int64 // bytes uploaded or buffered for this object
+}
+
+// s3Record is a record buffered in an object's next part.
+type s3Record struct {
+	obj *s3Object
+	n   int // bytes, with the newline
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func newS3Sink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 sink: bucket is required (s3://bucket/prefix)")
+	}
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 sink: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	region := q.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	targetSize, err := queryBytes(q, "target-size", 128<<20)
+	if err != nil {
+		return nil, fmt.Errorf("s3 sink: %w", err)
+	}
+	partSize, err := queryBytes(q, "part-size", 16<<20)
+	if err != nil {
+		return nil, fmt.Errorf("s3 sink: %w", err)
+	}
+	if partSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3 sink: part-size must be at least 5MB")
+	}
+	if targetSize < partSize {
+		partSize = max(targetSize, s3MinPartSize)
+	}
+	partitionBy := []string{"dt", "pipeline_id"}
+	if v := q.Get("partition-by"); v != "" {
+		if partitionBy, err = parsePartitionKeys(v); err != nil {
+			return nil, fmt.Errorf("s3 sink: partition-by: %w", err)
+		}
+	}
+	return &s3Sink{
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		bucket:      u.Host,
+		prefix:      strings.Trim(u.Path, "/"),
+		region:      region,
+		endpoint:    strings.TrimRight(q.Get("endpoint"), "/"),
+		creds:       creds,
+		targetSize:  targetSize,
+		partSize:    partSize,
+		partitionBy: partitionBy,
+		runID:       time.Now().UTC().Format("20060102T150405Z"),
+		runMeta:     q.Get("run-id"),
+		objects:     make(map[string]*s3Object),
+	}, nil
+}
+
+func (s *s3Sink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		obj := s.object(rec.Reading)
+		obj.buf.Write(rec.Data)
+		obj.buf.WriteByte('\n')
+		obj.size += int64(len(rec.Data) + 1)
+		s.pending.add(s3Record{obj, len(rec.Data) + 1})
+
+		if int64(obj.buf.Len()) >= s.partSize {
+			if err := s.uploadPart(ctx, obj); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+		if obj.size >= s.targetSize {
+			if err := s.finish(ctx, obj); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+	}
+	return nil
+}
+
+// unbuffer takes a record of a failed batch back out of its object's
+// next part. Records buffered by earlier batches stay, to be uploaded
+// with the part when the next batch fills it.
+func (s *s3Sink) unbuffer(r s3Record) {
+	r.obj.buf.Truncate(r.obj.buf.Len() - r.n)
+	r.obj.size -= int64(r.n)
+}
+
+// sent drops obj's buffered records from the pending ones once they have
+// been uploaded.
+func (s *s3Sink) sent(obj *s3Object) {
+	s.pending.retain(func(_ int, r s3Record) (s3Record, bool) { return r, r.obj != obj })
+}
+
+// Close finishes every object. Multipart uploads that cannot be finished
+// are aborted, so their parts do not linger in the bucket.
+func (s *s3Sink) Close(ctx context.Context) error {
+	var firstErr error
+	for _, obj := range s.objects {
+		err := s.finish(ctx, obj)
+		if err != nil && obj.uploadID != "" {
+			if aerr := s.abort(ctx, obj); aerr != nil {
+				err = fmt.Errorf("%w (and aborting the upload: %v)", err, aerr)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// object returns the in-progress object for the reading's partition,
+// starting a new one if needed.
+func (s *s3Sink) object(r *SensorReading) *s3Object {
+	partition := partitionPath(s.partitionBy, r)
+	obj, ok := s.objects[partition]
+	if !ok {
+		s.seq++
+		key := fmt.Sprintf("%s/part-%s-%05d.jsonl", partition, s.runID, s.seq)
+		if s.prefix != "" {
+			key = s.prefix + "/" + key
+		}
+		obj = &s3Object{key: key}
+		s.objects[partition] = obj
+	}
+	return obj
+}
+
+// uploadPart sends the buffered bytes as the next part, creating the
+// multipart upload on first use.
+func (s *s3Sink) uploadPart(ctx context.Context, obj *s3Object) error {
+	if obj.uploadID == "" {
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		resp, err := s.do(ctx, http.MethodPost, obj.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		if err := xml.Unmarshal(resp, &result); err != nil {
+			return fmt.Errorf("s3 sink: parsing CreateMultipartUpload response: %w", err)
+		}
+		obj.uploadID = result.UploadID
+	}
+	n := len(obj.parts) + 1
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {obj.uploadID}}
+	req, err := s.request(ctx, http.MethodPut, obj.key, q, obj.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	obj.parts = append(obj.parts, s3Part{Number: n, ETag: resp.Header.Get("ETag")})
+	obj.buf.Reset()
+	s.sent(obj)
+	return nil
+}
+
+// finish completes the object: small objects are sent with a single PUT,
+// multipart uploads get their final part and are completed. The object
+// stays in progress until it has been, so a failed finish can be retried.
+func (s *s3Sink) finish(ctx context.Context, obj *s3Object) error {
+	if obj.uploadID == "" {
+		if obj.buf.Len() > 0 {
+			if _, err := s.do(ctx, http.MethodPut, obj.key, nil, obj.buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		s.finished(obj)
+		return nil
+	}
+	if obj.buf.Len() > 0 {
+		if err := s.uploadPart(ctx, obj); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: obj.parts})
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(ctx, http.MethodPost, obj.key, url.Values{"uploadId": {obj.uploadID}}, body); err != nil {
+		return err
+	}
+	s.finished(obj)
+	return nil
+}
+
+// finished drops a completed object, so its partition's next record
+// starts a new one, and its records from the pending ones.
+func (s *s3Sink) finished(obj *s3Object) {
+	for partition, o := range s.objects {
+		if o == obj {
+			delete(s.objects, partition)
+		}
+	}
+	s.sent(obj)
+}
+
+// abort aborts obj's multipart upload, deleting the parts uploaded so far.
+// It has a deadline of its own, as ctx's may be what made the upload fail.
+func (s *s3Sink) abort(ctx context.Context, obj *s3Object) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	_, err := s.do(ctx, http.MethodDelete, obj.key, url.Values{"uploadId": {obj.uploadID}}, nil)
+	return err
+}
+
+// do performs a signed request and returns the response body.
+func (s *s3Sink) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := s.request(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Sink) send(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 sink: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 sink: %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// request builds a SigV4-signed request for key in the sink's bucket.
+func (s *s3Sink) request(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	var u string
+	if s.endpoint != "" {
+		u = s.endpoint + "/" + s.bucket + "/" + s3EscapePath(key)
+	} else {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, s3EscapePath(key))
+	}
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.runMeta != "" && (method == http.MethodPut && len(query) == 0 || query.Has("uploads")) {
+		// Metadata goes with the request that creates the object.
+		req.Header.Set("x-amz-meta-run-id", s.runMeta)
+	}
+	signSigV4(req, body, s.creds, s.region, "s3", time.Now().UTC())
+	return req, nil
+}
+
+// signSigV4 adds AWS Signature Version 4 headers to req.
+func signSigV4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath URI-encodes each segment of an object key as SigV4 requires.
+func s3EscapePath(key string) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key, as SigV4 requires.
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except the RFC 3986 unreserved set.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
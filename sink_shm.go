@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Shared-memory ring layout. All integers are little-endian; the header
+// is one 4 KiB page, followed by the data region.
+//
+//	offset  size  field
+//	0       8     magic "SGRING01"
+//	8       4     version (1)
+//	12      4     header size (4096): the data region starts here
+//	16      8     capacity: data region size in bytes, a multiple of 8
+//	24      8     producer start time, Unix nanoseconds; changes when the
+//	              producer restarts and reinitialises the ring
+//	32      4     closed: set to 1 when the producer exits cleanly
+//	64      8     committed position (atomic)
+//	128     8     reserved position (atomic)
+//
+// Positions count bytes written since the ring was created and never wrap;
+// a position p is at data offset p % capacity. Each record is a 16-byte
+// header (u32 payload length, u32 zero, i64 write time in Unix
+// nanoseconds) followed by the JSON payload, padded to 8 bytes. A record
+// never straddles the end of the data region: when it would not fit, a
+// header with length 0xFFFFFFFF marks the rest of the region as padding
+// and the record starts at offset 0.
+//
+// The producer never waits for consumers. Before writing a record it
+// advances the reserved position past it, and once the record is in place
+// it advances the committed position. A consumer keeps its own position,
+// polls the committed position for new records, and after copying a
+// record rereads the reserved position: if that has moved more than the
+// capacity past the record's start, the copy may be torn and the consumer
+// has fallen behind; it skips ahead to the committed position.
+const (
+	shmMagic        = "SGRING01"
+	shmVersion      = 1
+	shmHeaderSize   = 4096
+	shmRecordHeader = 16
+	shmPadding      = 0xFFFFFFFF
+
+	shmOffCapacity  = 16
+	shmOffStarted   = 24
+	shmOffClosed    = 32
+	shmOffCommitted = 64
+	shmOffReserved  = 128
+)
+
+// shmSink writes records into a ring buffer in a memory-mapped file, for
+// a consumer process on the same host to read with sub-millisecond latency
+// and no system calls. Put the file on tmpfs (/dev/shm on Linux) so the
+// ring stays in memory. The ring overwrites the oldest records when full;
+// consumers that fall behind lose data rather than slowing generation.
+//
+// URL form: shm:///dev/shm/sensor-gen.ring?size=64MB
+type shmSink struct {
+	mem   []byte // header page and data region
+	data  []byte
+	unmap func() error
+	pos   uint64 // committed position
+}
+
+func newShmSink(u *url.URL) (Sink, error) {
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("shm sink: missing file path")
+	}
+	size, err := queryBytes(u.Query(), "size", 64<<20)
+	if err != nil {
+		return nil, fmt.Errorf("shm sink: %w", err)
+	}
+	size &^= 7
+	if size < 64<<10 {
+		return nil, fmt.Errorf("shm sink: size must be at least 64KB")
+	}
+	mem, unmap, err := mapRingFile(path, shmHeaderSize+int(size))
+	if err != nil {
+		return nil, fmt.Errorf("shm sink: %w", err)
+	}
+	s := &shmSink{mem: mem, data: mem[shmHeaderSize:], unmap: unmap}
+	// The magic goes in last, so a consumer that finds it never pairs it
+	// with a previous run's positions.
+	clear(mem[:shmHeaderSize])
+	binary.LittleEndian.PutUint32(mem[8:], shmVersion)
+	binary.LittleEndian.PutUint32(mem[12:], shmHeaderSize)
+	binary.LittleEndian.PutUint64(mem[shmOffCapacity:], uint64(size))
+	binary.LittleEndian.PutUint64(mem[shmOffStarted:], uint64(time.Now().UnixNano()))
+	copy(mem, shmMagic)
+	return s, nil
+}
+
+// word returns the header field at off for atomic access. The mapping is
+// page-aligned, so every 8-byte offset is aligned.
+func (s *shmSink) word(off int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.mem[off]))
+}
+
+func (s *shmSink) Write(ctx context.Context, batch []Record) error {
+	capacity := uint64(len(s.data))
+	for _, rec := range batch {
+		n := uint64(shmRecordHeader+len(rec.Data)+7) &^ 7
+		if n > capacity {
+			return fmt.Errorf("shm sink: %d-byte record does not fit the %d-byte ring", len(rec.Data), capacity)
+		}
+		off := s.pos % capacity
+		start := s.pos
+		if off+n > capacity {
+			start += capacity - off // skip to the start of the region
+		}
+		atomic.StoreUint64(s.word(shmOffReserved), start+n)
+		if start != s.pos {
+			binary.LittleEndian.PutUint32(s.data[off:], shmPadding)
+			off = 0
+		}
+		binary.LittleEndian.PutUint32(s.data[off:], uint32(len(rec.Data)))
+		binary.LittleEndian.PutUint32(s.data[off+4:], 0)
+		binary.LittleEndian.PutUint64(s.data[off+8:], uint64(time.Now().UnixNano()))
+		copy(s.data[off+shmRecordHeader:], rec.Data)
+		s.pos = start + n
+		atomic.StoreUint64(s.word(shmOffCommitted), s.pos)
+	}
+	return nil
+}
+
+// Close marks the ring closed and unmaps it. The file is left in place
+// for consumers to finish reading.
+func (s *shmSink) Close(ctx context.Context) error {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&s.mem[shmOffClosed])), 1)
+	return s.unmap()
+}
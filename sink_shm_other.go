@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func mapRingFile(path string, size int) ([]byte, func() error, error) {
+	return nil, nil, errors.New("shared-memory rings are only supported on Unix systems")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// tcpSink streams records, by default as newline-delimited JSON, over a
+// TCP connection. When the connection fails the sink reconnects with
+// exponential backoff and resends the batch that was being written; records
+// already in flight when the peer went away may be lost or duplicated, as
+// with any plain socket feed.
+//
+// URL form: tcp://host:port
+type tcpSink struct {
+	name   string // for error messages
+	addr   string
+	encode recordEncoder
+	conn   net.Conn // nil until connected and after a failure
+	w      *bufio.Writer
+	dead   chan struct{} // closed when the peer closes the connection
+	buf    []byte
+}
+
+// recordEncoder appends the wire form of rec to dst.
+type recordEncoder func(dst []byte, rec Record) []byte
+
+// ndjsonLine encodes a record as a line of newline-delimited JSON.
+func ndjsonLine(dst []byte, rec Record) []byte {
+	return append(append(dst, rec.Data...), '\n')
+}
+
+func newTCPSink(u *url.URL) (Sink, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("tcp sink: missing port in %q", u.Host)
+	}
+	return dialTCPSink("tcp sink", u.Host, ndjsonLine)
+}
+
+func dialTCPSink(name, addr string, encode recordEncoder) (*tcpSink, error) {
+	s := &tcpSink{name: name, addr: addr, encode: encode}
+	if err := s.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *tcpSink) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	s.conn = conn
+	s.w = bufio.NewWriterSize(conn, 256*1024)
+	// Collectors never talk back; reading only detects the peer closing,
+	// which writes alone would not notice until the kernel buffer fills.
+	dead := make(chan struct{})
+	s.dead = dead
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(dead)
+	}()
+	return nil
+}
+
+func (s *tcpSink) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *tcpSink) Write(ctx context.Context, batch []Record) error {
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.send(ctx, batch)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt == 8 {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", s.name, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// send writes batch on the current connection, connecting first if needed.
+func (s *tcpSink) send(ctx context.Context, batch []Record) error {
+	if s.conn != nil {
+		select {
+		case <-s.dead:
+			s.drop()
+		default:
+		}
+	}
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	conn := s.conn
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+
+	for _, rec := range batch {
+		s.buf = s.encode(s.buf[:0], rec)
+		s.w.Write(s.buf)
+	}
+	if err := s.w.Flush(); err != nil {
+		s.drop()
+		return fmt.Errorf("%s: %w", s.name, err)
+	}
+	return nil
+}
+
+func (s *tcpSink) Close(ctx context.Context) error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// datagramSink sends each record as its own datagram, by default
+// newline-terminated JSON. Delivery is best effort: nothing is retried.
+//
+// URL form: udp://host:port
+type datagramSink struct {
+	name   string
+	conn   net.Conn
+	encode recordEncoder
+	buf    []byte
+}
+
+func newUDPSink(u *url.URL) (Sink, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("udp sink: missing port in %q", u.Host)
+	}
+	return dialDatagramSink("udp sink", "udp", u.Host, ndjsonLine)
+}
+
+func dialDatagramSink(name, network, addr string, encode recordEncoder) (*datagramSink, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &datagramSink{name: name, conn: conn, encode: encode}, nil
+}
+
+func (s *datagramSink) Write(ctx context.Context, batch []Record) error {
+	// Writes block when a local socket's receive queue is full.
+	conn := s.conn
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+
+	for _, rec := range batch {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.buf = s.encode(s.buf[:0], rec)
+		if _, err := s.conn.Write(s.buf); err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *datagramSink) Close(ctx context.Context) error {
+	return s.conn.Close()
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types (first byte, flags included).
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttSubscribe  = 0x82
+	mqttPingReq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+// Sparkplug B metric data types.
+const (
+	spInt32   = 3
+	spInt64   = 4
+	spDouble  = 10
+	spBoolean = 11
+	spString  = 12
+)
+
+// Sparkplug quality codes carried in the Quality property (the OPC
+// classic codes Ignition uses).
+const (
+	spQualityGood      = 192
+	spQualityUncertain = 64
+	spQualityBad       = 0
+)
+
+const (
+	spKeepalive = 30 * time.Second
+	spRebirth   = "Node Control/Rebirth"
+)
+
+// sparkplugSink publishes readings as a Sparkplug B edge node over MQTT
+// 3.1.1. Each sensor is a Double metric named <pipeline_id>/<sensor_id>
+// with an alias: the NBIRTH certificate lists every metric with its name,
+// alias, engineering unit and range, and NDATA messages then carry values
+// by alias with per-metric timestamps. The NDEATH certificate is the MQTT
+// will, so hosts see the node go offline if the connection drops, and is
+// also published on a clean shutdown.
+//
+// A sensor not yet in the birth certificate triggers a rebirth listing it,
+// as does a Node Control/Rebirth command (NCMD). With -fleet the metric set
+// settles once every sensor has reported; without it each reading comes
+// from a new random sensor, so use a fleet.
+//
+// URL form: sparkplug://[user:pass@]host:1883?group=sensors&node=sensor-gen
+// Options: client-id, tls=true (default port 8883), ca, cert, key,
+// insecure=true, password-file (or MQTT_PASSWORD) for the URL user's
+// password, e.g. a JWT for brokers that take tokens as passwords.
+type sparkplugSink struct {
+	addr      string
+	tls       *tls.Config // nil for plain TCP
+	user      *url.Userinfo
+	password  *secret // overrides the URL's password
+	clientID  string
+	topic     string // spBv1.0/<group>/%s/<node>
+	ncmdTopic string
+	rebirth   atomic.Bool // set by the reader on a rebirth command
+
+	mu       sync.Mutex // guards everything below; the pinger shares the connection
+	conn     net.Conn   // nil until connected and after a failure
+	w        *bufio.Writer
+	dead     chan struct{} // closed when the connection fails
+	sessions uint64        // connections made, for bdSeq
+	seq      uint64        // sequence number of the last message
+	born     bool          // NBIRTH sent on this connection
+	lastSent time.Time
+	metrics  map[string]*spMetric // by sensor ID
+	order    []*spMetric          // in alias order
+	buf      []byte
+	msg      []byte
+}
+
+// spMetric is the birth information and latest value of one sensor.
+type spMetric struct {
+	name      string
+	alias     uint64
+	unit      string
+	low, high float64
+	value     float64
+	timestamp uint64 // ms since the epoch
+	quality   int32
+}
+
+func newSparkplugSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	group, node := q.Get("group"), q.Get("node")
+	if group == "" {
+		group = "sensors"
+	}
+	if node == "" {
+		node = "sensor-gen"
+	}
+	for _, id := range []string{group, node} {
+		if strings.ContainsAny(id, "/+#") {
+			return nil, fmt.Errorf("sparkplug sink: group and node IDs may not contain /, + or #: %q", id)
+		}
+	}
+	s := &sparkplugSink{
+		addr:      u.Host,
+		user:      u.User,
+		clientID:  q.Get("client-id"),
+		topic:     "spBv1.0/" + group + "/%s/" + node,
+		ncmdTopic: "spBv1.0/" + group + "/NCMD/" + node,
+		metrics:   make(map[string]*spMetric),
+	}
+	if u.User != nil {
+		var err error
+		if s.password, err = newSecret(q, "password-file", "MQTT_PASSWORD"); err != nil {
+			return nil, fmt.Errorf("sparkplug sink: %w", err)
+		}
+	} else if q.Get("password-file") != "" {
+		return nil, fmt.Errorf("sparkplug sink: password-file needs a user name in the URL")
+	}
+	port := "1883"
+	if q.Get("tls") == "true" {
+		tc, err := tlsConfig(q)
+		if err != nil {
+			return nil, fmt.Errorf("sparkplug sink: %w", err)
+		}
+		if tc == nil {
+			tc = &tls.Config{}
+		}
+		tc.ServerName = u.Hostname()
+		s.tls, port = tc, "8883"
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if s.clientID == "" {
+		var b [4]byte
+		rand.Read(b[:])
+		s.clientID = "sensor-gen-" + hex.EncodeToString(b[:])
+	}
+	if err := s.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect opens an MQTT session with the NDEATH certificate as its will
+// and subscribes to node commands. Called with mu held, or before the sink
+// is shared.
+func (s *sparkplugSink) connect(ctx context.Context) error {
+	d := net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("sparkplug sink: %w", err)
+	}
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return fmt.Errorf("sparkplug sink: %w", err)
+		}
+		conn = tc
+	}
+	bdSeq := s.sessions % 256
+	s.sessions++
+
+	// CONNECT: clean session, will QoS 1 (as Sparkplug requires for
+	// NDEATH), credentials from the URL.
+	flags := byte(0x02 | 0x04 | 0x08)
+	var pass string
+	var hasPass bool
+	if s.user != nil {
+		flags |= 0x80
+		pass, hasPass = s.user.Password()
+		if s.password != nil {
+			if pass, err = s.password.get(); err != nil {
+				conn.Close()
+				return fmt.Errorf("sparkplug sink: %w", err)
+			}
+			hasPass = true
+		}
+		if hasPass {
+			flags |= 0x40
+		}
+	}
+	body := mqttAppendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(spKeepalive/time.Second))
+	body = mqttAppendString(body, s.clientID)
+	body = mqttAppendString(body, fmt.Sprintf(s.topic, "NDEATH"))
+	body = mqttAppendString(body, string(s.deathPayload(bdSeq)))
+	if s.user != nil {
+		body = mqttAppendString(body, s.user.Username())
+		if hasPass {
+			body = mqttAppendString(body, pass)
+		}
+	}
+	w := bufio.NewWriterSize(conn, 256*1024)
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	mqttWritePacket(w, mqttConnect, body)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("sparkplug sink: %w", err)
+	}
+	typ, ack, err := mqttReadPacket(r)
+	switch {
+	case err != nil:
+		conn.Close()
+		return fmt.Errorf("sparkplug sink: %w", err)
+	case typ&0xF0 != mqttConnAck || len(ack) != 2:
+		conn.Close()
+		return fmt.Errorf("sparkplug sink: expected CONNACK, got packet type %#x", typ)
+	case ack[1] != 0:
+		conn.Close()
+		return fmt.Errorf("sparkplug sink: connection refused (CONNACK code %d)", ack[1])
+	}
+
+	sub := binary.BigEndian.AppendUint16(nil, 1)
+	sub = mqttAppendString(sub, s.ncmdTopic)
+	sub = append(sub, 0)
+	mqttWritePacket(w, mqttSubscribe, sub)
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return fmt.Errorf("sparkplug sink: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.conn, s.w, s.born, s.lastSent = conn, w, false, time.Now()
+	dead := make(chan struct{})
+	s.dead = dead
+	go s.readLoop(r, dead)
+	go s.pingLoop(conn, dead)
+	return nil
+}
+
+// readLoop handles broker traffic: acknowledgements and node commands.
+func (s *sparkplugSink) readLoop(r *bufio.Reader, dead chan struct{}) {
+	defer close(dead)
+	for {
+		typ, body, err := mqttReadPacket(r)
+		if err != nil {
+			return
+		}
+		if typ&0xF0 != mqttPublish {
+			continue
+		}
+		topic, payload, ok := mqttParsePublish(typ, body)
+		if ok && topic == s.ncmdTopic && spRebirthRequested(payload) {
+			s.rebirth.Store(true)
+		}
+	}
+}
+
+// pingLoop keeps the session alive while no data flows, e.g. under
+// report-by-exception.
+func (s *sparkplugSink) pingLoop(conn net.Conn, dead chan struct{}) {
+	ticker := time.NewTicker(spKeepalive / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dead:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if s.conn == conn && time.Since(s.lastSent) >= spKeepalive/3 {
+			mqttWritePacket(s.w, mqttPingReq, nil)
+			s.flush()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *sparkplugSink) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *sparkplugSink) Write(ctx context.Context, batch []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.send(ctx, batch)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if attempt == 8 {
+			return fmt.Errorf("sparkplug sink: giving up after %d attempts: %w", attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// send publishes batch as one NDATA message, preceded by an NBIRTH when
+// the connection is new, the batch introduces sensors or a host asked for
+// a rebirth.
+func (s *sparkplugSink) send(ctx context.Context, batch []Record) error {
+	if s.conn != nil {
+		select {
+		case <-s.dead:
+			s.drop()
+		default:
+		}
+	}
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	conn := s.conn
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+
+	birth := !s.born || s.rebirth.Swap(false)
+	for _, rec := range batch {
+		r := rec.Reading
+		if s.metrics[r.SensorID] == nil {
+			m := &spMetric{name: r.PipelineID + "/" + r.SensorID, alias: uint64(len(s.order) + 1), unit: r.Unit, quality: -1}
+			if lo, hi, ok := typeRange(r); ok {
+				m.low, m.high = lo, hi
+			}
+			m.value, m.timestamp = r.Value, spTimestamp(r.Timestamp)
+			s.metrics[r.SensorID] = m
+			s.order = append(s.order, m)
+			birth = true
+		}
+	}
+	now := uint64(time.Now().UnixMilli())
+	if birth {
+		s.publish("NBIRTH", s.birthPayload(now))
+		s.born = true
+	}
+
+	s.seq = (s.seq + 1) % 256
+	b := spAppendVarint(s.msg[:0], 1, now)
+	for _, rec := range batch {
+		r := rec.Reading
+		m := s.metrics[r.SensorID]
+		m.value, m.timestamp = r.Value, spTimestamp(r.Timestamp)
+		quality := spQuality(r.Status)
+		s.buf = spAppendVarint(s.buf[:0], 2, m.alias)
+		s.buf = spAppendVarint(s.buf, 3, m.timestamp)
+		s.buf = spAppendVarint(s.buf, 4, spDouble)
+		if r.Backfilled {
+			s.buf = spAppendVarint(s.buf, 5, 1) // is_historical
+		}
+		if quality != m.quality {
+			s.buf = appendProtoBytes(s.buf, 9, spQualityProperty(nil, quality))
+			m.quality = quality
+		}
+		s.buf = spAppendDouble(s.buf, 13, m.value)
+		b = appendProtoBytes(b, 2, s.buf)
+	}
+	b = spAppendVarint(b, 3, s.seq)
+	s.msg = b
+	s.publish("NDATA", b)
+	if err := s.flush(); err != nil {
+		s.drop()
+		return err
+	}
+	return nil
+}
+
+// birthPayload encodes the NBIRTH certificate: bdSeq, the rebirth control
+// and every metric with its name, alias, properties and latest value.
+// It resets the message sequence.
+func (s *sparkplugSink) birthPayload(now uint64) []byte {
+	s.seq = 0
+	b := spAppendVarint(nil, 1, now)
+	m := appendProtoString(nil, 1, "bdSeq")
+	m = spAppendVarint(m, 3, now)
+	m = spAppendVarint(m, 4, spInt64)
+	m = spAppendVarint(m, 11, (s.sessions-1)%256)
+	b = appendProtoBytes(b, 2, m)
+	m = appendProtoString(m[:0], 1, spRebirth)
+	m = spAppendVarint(m, 3, now)
+	m = spAppendVarint(m, 4, spBoolean)
+	m = spAppendVarint(m, 14, 0)
+	b = appendProtoBytes(b, 2, m)
+
+	for _, metric := range s.order {
+		if metric.quality < 0 {
+			metric.quality = spQualityGood
+		}
+		var props []byte
+		props = appendProtoString(props, 1, "engUnit")
+		props = appendProtoString(props, 1, "engLow")
+		props = appendProtoString(props, 1, "engHigh")
+		props = appendProtoString(props, 1, "Quality")
+		v := spAppendVarint(nil, 1, spString)
+		v = appendProtoString(v, 8, metric.unit)
+		props = appendProtoBytes(props, 2, v)
+		for _, x := range []float64{metric.low, metric.high} {
+			v = spAppendVarint(v[:0], 1, spDouble)
+			v = spAppendDouble(v, 6, x)
+			props = appendProtoBytes(props, 2, v)
+		}
+		v = spAppendVarint(v[:0], 1, spInt32)
+		v = spAppendVarint(v, 3, uint64(metric.quality))
+		props = appendProtoBytes(props, 2, v)
+
+		m = appendProtoString(m[:0], 1, metric.name)
+		m = spAppendVarint(m, 2, metric.alias)
+		m = spAppendVarint(m, 3, metric.timestamp)
+		m = spAppendVarint(m, 4, spDouble)
+		m = appendProtoBytes(m, 9, props)
+		m = spAppendDouble(m, 13, metric.value)
+		b = appendProtoBytes(b, 2, m)
+	}
+	return spAppendVarint(b, 3, 0)
+}
+
+// deathPayload encodes the NDEATH certificate for session bdSeq.
+func (s *sparkplugSink) deathPayload(bdSeq uint64) []byte {
+	now := uint64(time.Now().UnixMilli())
+	b := spAppendVarint(nil, 1, now)
+	m := appendProtoString(nil, 1, "bdSeq")
+	m = spAppendVarint(m, 3, now)
+	m = spAppendVarint(m, 4, spInt64)
+	m = spAppendVarint(m, 11, bdSeq)
+	return appendProtoBytes(b, 2, m)
+}
+
+// publish queues a QoS 0 message of the given Sparkplug type.
+func (s *sparkplugSink) publish(msgType string, payload []byte) {
+	body := mqttAppendString(nil, fmt.Sprintf(s.topic, msgType))
+	s.w.WriteByte(mqttPublish)
+	s.w.Write(binary.AppendUvarint(nil, uint64(len(body)+len(payload))))
+	s.w.Write(body)
+	s.w.Write(payload)
+}
+
+func (s *sparkplugSink) flush() error {
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("sparkplug sink: %w", err)
+	}
+	s.lastSent = time.Now()
+	return nil
+}
+
+// Close publishes NDEATH and disconnects: a clean DISCONNECT discards the
+// will, so hosts would otherwise not learn the node went away.
+func (s *sparkplugSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	defer s.drop()
+	conn := s.conn
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	stop := context.AfterFunc(ctx, func() { conn.SetWriteDeadline(time.Now()) })
+	defer stop()
+	s.publish("NDEATH", s.deathPayload((s.sessions-1)%256))
+	mqttWritePacket(s.w, mqttDisconnect, nil)
+	return s.flush()
+}
+
+// spQuality maps a reading's status to a Sparkplug quality code.
+func spQuality(status string) int32 {
+	switch status {
+	case "warning":
+		return spQualityUncertain
+	case "maintenance":
+		return spQualityBad
+	}
+	return spQualityGood
+}
+
+// spQualityProperty appends a PropertySet holding only Quality.
+func spQualityProperty(b []byte, quality int32) []byte {
+	b = appendProtoString(b, 1, "Quality")
+	v := spAppendVarint(nil, 1, spInt32)
+	v = spAppendVarint(v, 3, uint64(quality))
+	return appendProtoBytes(b, 2, v)
+}
+
+// spTimestamp converts a reading timestamp to milliseconds since the epoch.
+func spTimestamp(ts string) uint64 {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return uint64(time.Now().UnixMilli())
+	}
+	return uint64(t.UnixMilli())
+}
+
+// spRebirthRequested reports whether an NCMD payload sets Node
+// Control/Rebirth to true.
+func spRebirthRequested(payload []byte) bool {
+	for field, value := range protoFields(payload) {
+		if field != 2 {
+			continue
+		}
+		var name string
+		var set bool
+		for f, v := range protoFields(value) {
+			switch f {
+			case 1:
+				name = string(v)
+			case 14:
+				x, _ := binary.Uvarint(v)
+				set = x != 0
+			}
+		}
+		if name == spRebirth && set {
+			return true
+		}
+	}
+	return false
+}
+
+// protoFields iterates over the fields of a protobuf message, yielding
+// each field number with its raw value: the varint bytes, the fixed-size
+// bytes or the length-delimited contents. Iteration stops at malformed
+// input.
+func protoFields(b []byte) func(yield func(uint64, []byte) bool) {
+	return func(yield func(uint64, []byte) bool) {
+		for len(b) > 0 {
+			tag, n := binary.Uvarint(b)
+			if n <= 0 {
+				return
+			}
+			b = b[n:]
+			var v []byte
+			switch tag & 7 {
+			case 0:
+				if _, n = binary.Uvarint(b); n <= 0 {
+					return
+				}
+				v, b = b[:n], b[n:]
+			case 1, 5:
+				size := 8
+				if tag&7 == 5 {
+					size = 4
+				}
+				if len(b) < size {
+					return
+				}
+				v, b = b[:size], b[size:]
+			case 2:
+				l, n := binary.Uvarint(b)
+				if n <= 0 || l > uint64(len(b)-n) {
+					return
+				}
+				v, b = b[n:n+int(l)], b[n+int(l):]
+			default:
+				return
+			}
+			if !yield(tag>>3, v) {
+				return
+			}
+		}
+	}
+}
+
+// spAppendVarint appends a varint field, zero included: Sparkplug
+// payloads are proto2, where set fields are always encoded.
+func spAppendVarint(b []byte, field, v uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func spAppendDouble(b []byte, field uint64, v float64) []byte {
+	b = binary.AppendUvarint(b, field<<3|1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttWritePacket writes a control packet; MQTT's remaining length uses
+// the same base-128 encoding as protobuf varints.
+func mqttWritePacket(w *bufio.Writer, typ byte, body []byte) {
+	w.WriteByte(typ)
+	w.Write(binary.AppendUvarint(nil, uint64(len(body))))
+	w.Write(body)
+}
+
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("mqtt packet too large")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// mqttParsePublish splits a PUBLISH packet into topic and payload.
+func mqttParsePublish(typ byte, body []byte) (string, []byte, bool) {
+	if len(body) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", nil, false
+	}
+	topic, rest := string(body[2:2+n]), body[2+n:]
+	if typ&0x06 != 0 { // QoS 1 or 2 carries a packet identifier
+		if len(rest) < 2 {
+			return "", nil, false
+		}
+		rest = rest[2:]
+	}
+	return topic, rest, true
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// splunkSink sends readings to a Splunk HTTP Event Collector. Events are
+// wrapped in HEC envelopes (time, host, source, sourcetype, index, event,
+// and the run ID as the indexed field run_id) and concatenated into
+// batched requests by size and age. Requests the collector rejects as busy
+// (429, 503) are retried with backoff.
+//
+// URL form: splunk://host:8088?index=sensors&sourcetype=_json&batch-bytes=1MB&batch-delay=100ms
+// The token comes from the token option or SPLUNK_HEC_TOKEN.
+type splunkSink struct {
+	client   *http.Client
+	url      string
+	token    string
+	envelope []byte // `{"host":...,"index":...,` shared by every event
+	maxBytes int64
+	maxDelay time.Duration
+
+	body    []byte              // the pending events
+	pending pendingRecords[int] // where each starts in body
+}
+
+func newSplunkSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("SPLUNK_HEC_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("splunk sink: set the token option or SPLUNK_HEC_TOKEN")
+	}
+
+	s := &splunkSink{
+		client:   &http.Client{Timeout: time.Minute},
+		token:    token,
+		maxBytes: 1 << 20,
+		maxDelay: 100 * time.Millisecond,
+	}
+	var err error
+	if s.maxBytes, err = queryBytes(q, "batch-bytes", s.maxBytes); err != nil {
+		return nil, fmt.Errorf("splunk sink: %w", err)
+	}
+	if v := q.Get("batch-delay"); v != "" {
+		if s.maxDelay, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("splunk sink: batch-delay: %w", err)
+		}
+	}
+	// HEC ships with a self-signed certificate; insecure=true accepts it.
+	tc, err := tlsConfig(q)
+	if err != nil {
+		return nil, fmt.Errorf("splunk sink: %w", err)
+	}
+	if tc != nil {
+		s.client.Transport = &http.Transport{TLSClientConfig: tc}
+	}
+
+	host := q.Get("host")
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	fields := []struct{ key, value string }{
+		{"host", host},
+		{"source", q.Get("source")},
+		{"sourcetype", q.Get("sourcetype")},
+		{"index", q.Get("index")},
+	}
+	if fields[1].value == "" {
+		fields[1].value = "sensor-gen"
+	}
+	if fields[2].value == "" {
+		fields[2].value = "_json"
+	}
+	s.envelope = []byte("{")
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		v, _ := json.Marshal(f.value)
+		s.envelope = fmt.Appendf(s.envelope, "%q:%s,", f.key, v)
+	}
+	if id := q.Get("run-id"); id != "" {
+		v, _ := json.Marshal(id)
+		s.envelope = fmt.Appendf(s.envelope, `"fields":{"run_id":%s},`, v)
+	}
+
+	scheme := "https"
+	if q.Get("tls") == "false" {
+		scheme = "http"
+	}
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort += ":8088"
+	}
+	s.url = fmt.Sprintf("%s://%s/services/collector/event", scheme, hostPort)
+	return s, nil
+}
+
+func (s *splunkSink) Write(ctx context.Context, batch []Record) error {
+	s.pending.begin()
+	for _, rec := range batch {
+		if len(s.body) > 0 && int64(len(s.body)+len(rec.Data)+len(s.envelope)+40) > s.maxBytes {
+			if err := s.send(ctx); err != nil {
+				return s.pending.fail(err, s.unbuffer)
+			}
+		}
+		s.pending.add(len(s.body))
+		s.body = append(s.body, s.envelope...)
+		if t, err := time.Parse(time.RFC3339Nano, rec.Reading.Timestamp); err == nil {
+			s.body = append(s.body, `"time":`...)
+			s.body = strconv.AppendFloat(s.body, float64(t.UnixMicro())/1e6, 'f', 6, 64)
+			s.body = append(s.body, ',')
+		}
+		s.body = append(s.body, `"event":`...)
+		s.body = append(s.body, rec.Data...)
+		s.body = append(s.body, "}\n"...)
+	}
+	if s.pending.due(s.maxDelay) {
+		if err := s.send(ctx); err != nil {
+			return s.pending.fail(err, s.unbuffer)
+		}
+	}
+	return nil
+}
+
+// unbuffer takes an event of a failed batch, starting at start, back out
+// of the pending request.
+func (s *splunkSink) unbuffer(start int) {
+	s.body = s.body[:start]
+}
+
+func (s *splunkSink) Close(ctx context.Context) error {
+	if s.pending.len() == 0 {
+		return nil
+	}
+	return s.send(ctx)
+}
+
+// send posts the pending events, retrying while the collector is busy.
+// They stay pending if it fails.
+func (s *splunkSink) send(ctx context.Context) error {
+	body := s.body
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Splunk "+s.token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("splunk sink: %w", err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			s.body = s.body[:0]
+			s.pending.sent()
+			return nil
+		case resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable:
+			return fmt.Errorf("splunk sink: %s: %s", resp.Status, bytes.TrimSpace(msg))
+		case attempt == 6:
+			return fmt.Errorf("splunk sink: collector busy after %d attempts: %s", attempt, resp.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
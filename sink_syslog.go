@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity maps a reading's alert level to a syslog severity.
+func syslogSeverity(alert string) int {
+	switch alert {
+	case alertCritical:
+		return 2 // critical
+	case alertWarning:
+		return 4 // warning
+	}
+	return 6 // informational
+}
+
+// syslogFormat encodes readings as RFC 5424 messages:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+//
+// The reading's timestamp becomes the message timestamp, its type the
+// MSGID and its alert level the severity. The JSON goes in the message body,
+// or with payload=sd in a structured data element as the json parameter.
+type syslogFormat struct {
+	facility      int
+	hostname      string
+	appName       string
+	procID        string
+	sdID          string
+	inSD          bool
+	octetCounting bool // RFC 6587 framing for stream transports
+	scratch       []byte
+}
+
+// newSyslogSink sends readings to a syslog server or the local syslog
+// socket.
+//
+// URL forms:
+//
+//	syslog://host:514                  UDP
+//	syslog://host:601?transport=tcp    TCP, octet-counting framing
+//	syslog:///dev/log                  local Unix datagram socket
+//
+// Options: facility (default local0), app-name (default sensor-gen),
+// hostname (default this host), payload=msg|sd, sd-id (default
+// reading@32473).
+func newSyslogSink(u *url.URL) (Sink, error) {
+	q := u.Query()
+	f := &syslogFormat{
+		facility: syslogFacilities["local0"],
+		hostname: q.Get("hostname"),
+		appName:  q.Get("app-name"),
+		procID:   strconv.Itoa(os.Getpid()),
+		sdID:     q.Get("sd-id"),
+	}
+	if name := q.Get("facility"); name != "" {
+		code, ok := syslogFacilities[name]
+		if !ok {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 0 || n > 23 {
+				return nil, fmt.Errorf("syslog sink: unknown facility %q", name)
+			}
+			code = n
+		}
+		f.facility = code
+	}
+	if f.hostname == "" {
+		f.hostname, _ = os.Hostname()
+	}
+	if f.appName == "" {
+		f.appName = "sensor-gen"
+	}
+	if f.sdID == "" {
+		f.sdID = "reading@32473"
+	}
+	switch q.Get("payload") {
+	case "", "msg":
+	case "sd":
+		f.inSD = true
+	default:
+		return nil, fmt.Errorf("syslog sink: payload must be msg or sd, not %q", q.Get("payload"))
+	}
+
+	if u.Host == "" {
+		if u.Path == "" {
+			return nil, fmt.Errorf("syslog sink: need host:port or a socket path")
+		}
+		return dialDatagramSink("syslog sink", "unixgram", u.Path, f.encode)
+	}
+	host := u.Host
+	switch transport := q.Get("transport"); transport {
+	case "", "udp":
+		if u.Port() == "" {
+			host += ":514"
+		}
+		return dialDatagramSink("syslog sink", "udp", host, f.encode)
+	case "tcp":
+		if u.Port() == "" {
+			host += ":601"
+		}
+		f.octetCounting = true
+		return dialTCPSink("syslog sink", host, f.encode)
+	default:
+		return nil, fmt.Errorf("syslog sink: transport must be udp or tcp, not %q", transport)
+	}
+}
+
+func (f *syslogFormat) encode(dst []byte, rec Record) []byte {
+	r := rec.Reading
+	m := f.scratch[:0]
+	m = append(m, '<')
+	m = strconv.AppendInt(m, int64(f.facility*8+syslogSeverity(r.AlertLevel)), 10)
+	m = append(m, ">1 "...)
+	// RFC 5424 allows at most microsecond precision.
+	if t, err := time.Parse(time.RFC3339Nano, r.Timestamp); err == nil {
+		m = t.AppendFormat(m, "2006-01-02T15:04:05.000000Z07:00")
+	} else {
+		m = append(m, '-')
+	}
+	m = append(m, ' ')
+	m = appendSyslogField(m, f.hostname)
+	m = appendSyslogField(m, f.appName)
+	m = appendSyslogField(m, f.procID)
+	m = appendSyslogField(m, r.Type)
+	if f.inSD {
+		m = append(m, '[')
+		m = append(m, f.sdID...)
+		m = append(m, ` json="`...)
+		for _, c := range rec.Data {
+			if c == '"' || c == '\\' || c == ']' {
+				m = append(m, '\\')
+			}
+			m = append(m, c)
+		}
+		m = append(m, `"]`...)
+	} else {
+		m = append(m, "- "...)
+		m = append(m, rec.Data...)
+	}
+	f.scratch = m
+
+	if f.octetCounting {
+		dst = strconv.AppendInt(dst, int64(len(m)), 10)
+		dst = append(dst, ' ')
+	}
+	return append(dst, m...)
+}
+
+// appendSyslogField appends a header field and its trailing space, using
+// the NILVALUE for empty fields and replacing characters the header does
+// not allow.
+func appendSyslogField(dst []byte, v string) []byte {
+	if v == "" {
+		return append(dst, "- "...)
+	}
+	return append(append(dst, strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, v)...), ' ')
+}
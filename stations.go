@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Pump station sensor types. Stations host one sensor of each, named
+// after the station: PS-TX-001-02-rpm is the speed of the second station
+// on PIPE-TX-001. They only exist with -stations, never through
+// -type-mix.
+const (
+	suctionPressureType    = "suction_pressure"
+	dischargePressureType  = "discharge_pressure"
+	pumpSpeedType          = "pump_speed"
+	motorCurrentType       = "motor_current"
+	bearingTemperatureType = "bearing_temperature"
+)
+
+// stationSensors are a station's sensor types and the suffixes of their
+// IDs, in the order they are added to the fleet.
+var stationSensors = []struct{ typ, suffix string }{
+	{suctionPressureType, "suc"},
+	{dischargePressureType, "dis"},
+	{pumpSpeedType, "rpm"},
+	{motorCurrentType, "amp"},
+	{bearingTemperatureType, "brg"},
+}
+
+// Pump dynamics.
+const (
+	pumpCoastDown = 8 * time.Second  // time constant of the spin-down after a trip
+	pumpRampUp    = 20 * time.Second // time constant of the restart
+	bearingLag    = 20 * time.Minute // time constant of the bearing temperature
+	bearingRise   = 90.0             // °F over ambient at full speed
+	eventPumpTrip = "pump_trip"
+)
+
+// pumpStation is a pump station on a pipeline. Its sensors all read one
+// state, so they agree: the pump adds head in proportion to the square
+// of its speed, the motor draws current in proportion to the power, and
+// the bearing warms with the speed. When the pump trips, the breaker
+// opens and the motor current drops at once, the pump coasts down, the
+// discharge pressure falls to the suction pressure while the suction
+// pressure rises as the line backs up, and the bearing cools. After the
+// trip the pump restarts and ramps back up.
+type pumpStation struct {
+	ID       string
+	Pipeline string
+	Location Location
+
+	flow       *pipelineFlow
+	ratedSpeed float64 // rpm
+	ratedHead  float64 // psi across the pump at rated speed
+	suction    float64 // suction pressure while running, psi
+	fullAmps   float64 // motor current at rated speed and flow
+	ambient    float64 // °F
+
+	setpoint float64 // speed the operator holds, as a fraction of rated
+	speed    float64 // as a fraction of rated
+	bearing  float64 // °F
+	running  bool    // motor energized
+
+	tripsPerHour float64
+	nextTrip     time.Time
+	tripStart    time.Time // start of the latest trip
+	tripEnd      time.Time // end of the latest trip
+	at           time.Time
+}
+
+// stationID returns the ID of station n on pipeline: PS-TX-001-02.
+func stationID(pipeline string, n int) string {
+	return fmt.Sprintf("PS-%s-%02d", strings.TrimPrefix(pipeline, "PIPE-"), n)
+}
+
+// addStations puts perPipeline pump stations on every pipeline, the
+// first at the inlet and the rest evenly spaced along it, each with a
+// sensor of every station type. Each station trips at random, tripsPerDay
+// times a day on average.
+func (f *fleet) addStations(perPipeline int, tripsPerDay float64, routes routeSet, rng *rand.Rand) {
+	for _, p := range pipelineIDs {
+		for i := range perPipeline {
+			mp := routes.length(p) * float64(i) / float64(perPipeline)
+			st := &pumpStation{
+				ID:           stationID(p, i+1),
+				Pipeline:     p,
+				Location:     routes.placeAt(p, mp, rng),
+				flow:         f.flows[p],
+				ratedSpeed:   3560,
+				ratedHead:    600 + rng.Float64()*300,
+				suction:      150 + rng.Float64()*150,
+				fullAmps:     250 + rng.Float64()*100,
+				ambient:      50 + rng.Float64()*40,
+				setpoint:     0.85 + rng.Float64()*0.15,
+				running:      true,
+				tripsPerHour: tripsPerDay / 24,
+			}
+			st.speed = st.setpoint
+			st.bearing = st.ambient + bearingRise*st.speed*st.speed
+			f.stations = append(f.stations, st)
+			for _, ss := range stationSensors {
+				f.add(&fleetSensor{
+					ID:       st.ID + "-" + ss.suffix,
+					Type:     sensorTypeIndex(ss.typ),
+					Pipeline: p,
+					Location: st.Location,
+					station:  st,
+				})
+			}
+		}
+	}
+}
+
+// update moves the station on to now, starting and ending trips.
+func (st *pumpStation) update(now time.Time, rng *rand.Rand) {
+	if st.at.IsZero() {
+		st.at = now
+		if st.tripsPerHour > 0 {
+			st.nextTrip = now.Add(interarrival(st.tripsPerHour, rng))
+		}
+		return
+	}
+	dt := now.Sub(st.at)
+	if dt <= 0 {
+		return
+	}
+	st.at = now
+	switch {
+	case st.running && st.tripsPerHour > 0 && !now.Before(st.nextTrip):
+		st.running = false
+		st.tripStart = now
+		st.tripEnd = now.Add(5*time.Minute + time.Duration(rng.Int63n(int64(25*time.Minute))))
+	case !st.running && !now.Before(st.tripEnd):
+		st.running = true
+		st.nextTrip = now.Add(interarrival(st.tripsPerHour, rng))
+	}
+	target, tau := st.setpoint, pumpRampUp
+	if !st.running {
+		target, tau = 0, pumpCoastDown
+	} else {
+		st.setpoint = min(max(st.setpoint+rng.NormFloat64()*0.01*math.Sqrt(dt.Hours()), 0.8), 1)
+	}
+	st.speed += (target - st.speed) * (1 - math.Exp(-float64(dt)/float64(tau)))
+	heat := st.ambient + bearingRise*st.speed*st.speed
+	st.bearing += (heat - st.bearing) * (1 - math.Exp(-float64(dt)/float64(bearingLag)))
+}
+
+// measure returns the reading of the station's sensor of type typ at now.
+func (st *pumpStation) measure(typ string, now time.Time, rng *rand.Rand) float64 {
+	st.update(now, rng)
+	head := st.ratedHead * st.speed * st.speed
+	// With the pump slowed or stopped, product backs up to the station.
+	suction := st.suction + 0.2*max(st.ratedHead*st.setpoint*st.setpoint-head, 0)
+	switch typ {
+	case suctionPressureType:
+		return suction + rng.NormFloat64()*0.5
+	case dischargePressureType:
+		return suction + head + rng.NormFloat64()*0.5
+	case pumpSpeedType:
+		return st.ratedSpeed*st.speed + rng.NormFloat64()*2
+	case motorCurrentType:
+		if !st.running {
+			return 0
+		}
+		load := st.flow.value / st.flow.baseline * st.speed * st.speed * st.speed
+		return st.fullAmps*(0.3+0.7*load) + rng.NormFloat64()*0.5
+	default:
+		return st.bearing + rng.NormFloat64()*0.2
+	}
+}
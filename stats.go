@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statsSample is how many values per sensor type stats keeps to estimate
+// percentiles.
+const statsSample = 10000
+
+// statsMain implements "sensor-gen stats": it scans a JSONL, CSV or
+// Parquet file of readings and profiles it: counts and value
+// distributions per sensor type, anomalies, and time coverage.
+func statsMain(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	format := fs.String("format", "", "Input format: jsonl, csv or parquet (default: from the file extension)")
+	asJSON := fs.Bool("json", false, "Write the profile as JSON")
+	gaps := fs.Int("gaps", 5, "Sensors with the longest silences to list")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sensor-gen stats [flags] FILE  (.jsonl, .csv, either gzipped, or .parquet; - reads JSONL from standard input)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		if *format = recordFormat(path); *format == "" {
+			fmt.Fprintf(os.Stderr, "Error: cannot tell the format of %s; set -format\n", path)
+			return 1
+		}
+	}
+	p := newProfiler()
+	err := readRecords(path, *format, func(where string, r *SensorReading, _ []byte, err error) {
+		if err != nil {
+			p.unreadable++
+			return
+		}
+		p.add(r)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: stats %s: %v\n", path, err)
+		return 1
+	}
+	prof := p.profile(path, *gaps)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(prof); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	prof.print(os.Stdout)
+	return 0
+}
+
+// Profile is what stats reports about a file.
+type Profile struct {
+	File       string           `json:"file"`
+	Records    int64            `json:"records"`
+	Unreadable int64            `json:"unreadable"`
+	Sensors    int              `json:"sensors"`
+	Pipelines  int              `json:"pipelines"`
+	First      string           `json:"first,omitempty"`
+	Last       string           `json:"last,omitempty"`
+	Span       Duration         `json:"span"`
+	Rate       float64          `json:"records_per_sec"`
+	Types      []TypeProfile    `json:"types"`
+	Status     map[string]int64 `json:"status"`
+	Backfilled int64            `json:"backfilled"`
+	// OutOfOrder counts readings older than their sensor's previous one.
+	OutOfOrder int64 `json:"out_of_order"`
+	// Silences lists the sensors with the longest gaps between readings.
+	Silences []Silence `json:"longest_silences"`
+}
+
+// TypeProfile profiles the readings of one sensor type. Value statistics
+// cover finite values; percentiles are estimated from a sample.
+type TypeProfile struct {
+	Type       string  `json:"type"`
+	Unit       string  `json:"unit"`
+	Records    int64   `json:"records"`
+	Sensors    int     `json:"sensors"`
+	Min        float64 `json:"min"`
+	Mean       float64 `json:"mean"`
+	StdDev     float64 `json:"stddev"`
+	P1         float64 `json:"p1"`
+	P50        float64 `json:"p50"`
+	P99        float64 `json:"p99"`
+	Max        float64 `json:"max"`
+	NonFinite  int64   `json:"non_finite"`
+	OutOfRange int64   `json:"out_of_range"`
+	Warning    int64   `json:"warning"`
+	Critical   int64   `json:"critical"`
+	First      string  `json:"first,omitempty"`
+	Last       string  `json:"last,omitempty"`
+}
+
+// Silence is a sensor's longest gap between consecutive readings.
+type Silence struct {
+	SensorID string   `json:"sensor_id"`
+	Gap      Duration `json:"gap"`
+	After    string   `json:"after"`
+}
+
+// profiler accumulates a Profile over the readings of a file.
+type profiler struct {
+	records    int64
+	unreadable int64
+	types      map[string]*typeAcc
+	sensors    map[string]*sensorAcc
+	pipelines  map[string]bool
+	status     map[string]int64
+	backfilled int64
+	outOfOrder int64
+	first      time.Time
+	last       time.Time
+	rng        *rand.Rand
+}
+
+type typeAcc struct {
+	count, finite int64
+	mean, m2      float64 // Welford's running mean and squared deviations
+	min, max      float64
+	sample        []float64
+	nonFinite     int64
+	outOfRange    int64
+	warning       int64
+	critical      int64
+	sensors       map[string]bool
+	first, last   time.Time
+	unit          string
+}
+
+type sensorAcc struct {
+	last     time.Time
+	gap      time.Duration
+	gapAfter time.Time
+}
+
+func newProfiler() *profiler {
+	return &profiler{
+		types:     make(map[string]*typeAcc),
+		sensors:   make(map[string]*sensorAcc),
+		pipelines: make(map[string]bool),
+		status:    make(map[string]int64),
+		rng:       rand.New(rand.NewSource(1)),
+	}
+}
+
+func (p *profiler) add(r *SensorReading) {
+	p.records++
+	p.pipelines[r.PipelineID] = true
+	p.status[r.Status]++
+	if r.Backfilled {
+		p.backfilled++
+	}
+	t := p.types[r.Type]
+	if t == nil {
+		t = &typeAcc{min: math.Inf(1), max: math.Inf(-1), sensors: make(map[string]bool), unit: r.Unit}
+		p.types[r.Type] = t
+	}
+	t.count++
+	t.sensors[r.SensorID] = true
+	switch r.AlertLevel {
+	case alertWarning:
+		t.warning++
+	case alertCritical:
+		t.critical++
+	}
+	if v := r.Value; !isFinite(v) {
+		t.nonFinite++
+	} else {
+		t.finite++
+		d := v - t.mean
+		t.mean += d / float64(t.finite)
+		t.m2 += d * (v - t.mean)
+		t.min, t.max = min(t.min, v), max(t.max, v)
+		// Reservoir sampling keeps a uniform sample of every value seen.
+		if len(t.sample) < statsSample {
+			t.sample = append(t.sample, v)
+		} else if i := p.rng.Int63n(t.finite); i < statsSample {
+			t.sample[i] = v
+		}
+		if lo, hi, ok := typeRange(r); ok && (v < lo || v > hi) {
+			t.outOfRange++
+		}
+	}
+
+	s := p.sensors[r.SensorID]
+	if s == nil {
+		s = &sensorAcc{}
+		p.sensors[r.SensorID] = s
+	}
+	ts, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if err != nil {
+		return
+	}
+	if p.first.IsZero() || ts.Before(p.first) {
+		p.first = ts
+	}
+	p.last = later(p.last, ts)
+	if t.first.IsZero() || ts.Before(t.first) {
+		t.first = ts
+	}
+	t.last = later(t.last, ts)
+	if s.last.IsZero() {
+		s.last = ts
+		return
+	}
+	if ts.Before(s.last) {
+		p.outOfOrder++
+		return
+	}
+	if gap := ts.Sub(s.last); gap > s.gap {
+		s.gap, s.gapAfter = gap, s.last
+	}
+	s.last = ts
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// profile summarises what has been added, listing the n longest
+// silences.
+func (p *profiler) profile(file string, n int) *Profile {
+	prof := &Profile{
+		File:       file,
+		Records:    p.records,
+		Unreadable: p.unreadable,
+		Sensors:    len(p.sensors),
+		Pipelines:  len(p.pipelines),
+		Status:     p.status,
+		Backfilled: p.backfilled,
+		OutOfOrder: p.outOfOrder,
+	}
+	if !p.first.IsZero() {
+		prof.First = p.first.Format(time.RFC3339Nano)
+		prof.Last = p.last.Format(time.RFC3339Nano)
+		prof.Span = Duration(p.last.Sub(p.first))
+		if span := p.last.Sub(p.first).Seconds(); span > 0 {
+			prof.Rate = float64(p.records) / span
+		}
+	}
+	names := make([]string, 0, len(p.types))
+	for name := range p.types {
+		names = append(names, name)
+	}
+	// Known types in their usual order, then any others by name.
+	rank := func(name string) int {
+		if i := sensorTypeIndex(name); i >= 0 {
+			return i
+		}
+		return len(sensorTypes)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := rank(names[i]), rank(names[j])
+		return a < b || a == b && names[i] < names[j]
+	})
+	for _, name := range names {
+		t := p.types[name]
+		tp := TypeProfile{
+			Type:       name,
+			Unit:       t.unit,
+			Records:    t.count,
+			Sensors:    len(t.sensors),
+			NonFinite:  t.nonFinite,
+			OutOfRange: t.outOfRange,
+			Warning:    t.warning,
+			Critical:   t.critical,
+		}
+		if t.finite > 0 {
+			sort.Float64s(t.sample)
+			tp.Min, tp.Max, tp.Mean = t.min, t.max, t.mean
+			tp.StdDev = math.Sqrt(t.m2 / float64(t.finite))
+			tp.P1, tp.P50, tp.P99 = percentile(t.sample, 0.01), percentile(t.sample, 0.5), percentile(t.sample, 0.99)
+		}
+		if !t.first.IsZero() {
+			tp.First, tp.Last = t.first.Format(time.RFC3339Nano), t.last.Format(time.RFC3339Nano)
+		}
+		prof.Types = append(prof.Types, tp)
+	}
+	for id, s := range p.sensors {
+		if s.gap > 0 {
+			prof.Silences = append(prof.Silences, Silence{SensorID: id, Gap: Duration(s.gap), After: s.gapAfter.Format(time.RFC3339Nano)})
+		}
+	}
+	sort.Slice(prof.Silences, func(i, j int) bool {
+		a, b := prof.Silences[i], prof.Silences[j]
+		return a.Gap > b.Gap || a.Gap == b.Gap && a.SensorID < b.SensorID
+	})
+	if len(prof.Silences) > n {
+		prof.Silences = prof.Silences[:max(n, 0)]
+	}
+	return prof
+}
+
+// percentile returns the q quantile of sorted values, by nearest rank.
+func percentile(sorted []float64, q float64) float64 {
+	return sorted[int(math.Round(q*float64(len(sorted)-1)))]
+}
+
+func (prof *Profile) print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d records from %d sensors on %d pipelines\n", prof.File, prof.Records, prof.Sensors, prof.Pipelines)
+	if prof.First != "" {
+		fmt.Fprintf(w, "Time: %s to %s (%v, %.1f records/sec)\n", prof.First, prof.Last, time.Duration(prof.Span), prof.Rate)
+	}
+	if prof.Unreadable > 0 {
+		fmt.Fprintf(w, "Unreadable records: %d\n", prof.Unreadable)
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Type\tUnit\tRecords\tSensors\tMin\tMean\tStd dev\tP1\tP50\tP99\tMax\tNon-finite\tOut of range\tWarning\tCritical\t")
+	for _, t := range prof.Types {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.4g\t%.4g\t%.4g\t%.4g\t%.4g\t%.4g\t%.4g\t%d\t%d\t%d\t%d\t\n",
+			t.Type, t.Unit, t.Records, t.Sensors, t.Min, t.Mean, t.StdDev, t.P1, t.P50, t.P99, t.Max,
+			t.NonFinite, t.OutOfRange, t.Warning, t.Critical)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Type\tFirst\tLast")
+	for _, t := range prof.Types {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Type, t.First, t.Last)
+	}
+	tw.Flush()
+
+	if prof.Records > 0 {
+		var parts []string
+		for _, s := range sortedKeys(prof.Status) {
+			parts = append(parts, fmt.Sprintf("%s %.1f%%", s, 100*float64(prof.Status[s])/float64(prof.Records)))
+		}
+		fmt.Fprintf(w, "\nStatus: %s\n", strings.Join(parts, ", "))
+	}
+	if prof.Backfilled > 0 {
+		fmt.Fprintf(w, "Backfilled: %d\n", prof.Backfilled)
+	}
+	if prof.OutOfOrder > 0 {
+		fmt.Fprintf(w, "Out of order: %d readings older than their sensor's previous one\n", prof.OutOfOrder)
+	}
+	if len(prof.Silences) > 0 {
+		fmt.Fprintln(w, "\nLongest silences:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, s := range prof.Silences {
+			fmt.Fprintf(tw, "  %s\t%v\tafter %s\n", s.SensorID, time.Duration(s.Gap), s.After)
+		}
+		tw.Flush()
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Device statuses, in the order the status chain indexes them.
+var statusNames = []string{"normal", "warning", "maintenance"}
+
+// StatusState configures one state of the fleet's status chain: how long
+// a sensor stays in it on average, and where it goes next.
+type StatusState struct {
+	// Dwell is the mean time spent in the state; the time is drawn from
+	// an exponential distribution, so transitions do not bunch up.
+	Dwell Duration `json:"dwell"`
+	// Next weights the states entered on leaving this one. Weights need
+	// not sum to 1.
+	Next map[string]float64 `json:"next"`
+}
+
+// defaultStatus is the chain of states the configuration file does not
+// override: a sensor runs normally for hours, occasionally warns for a
+// while and is sometimes taken out for maintenance, which always ends
+// back in normal operation.
+var defaultStatus = map[string]StatusState{
+	"normal":      {Dwell: Duration(6 * time.Hour), Next: map[string]float64{"warning": 0.8, "maintenance": 0.2}},
+	"warning":     {Dwell: Duration(20 * time.Minute), Next: map[string]float64{"normal": 0.75, "maintenance": 0.25}},
+	"maintenance": {Dwell: Duration(time.Hour), Next: map[string]float64{"normal": 1}},
+}
+
+func (s *StatusState) validate() error {
+	if s.Dwell <= 0 {
+		return fmt.Errorf("dwell must be positive")
+	}
+	total := 0.0
+	for name, w := range s.Next {
+		if !slices.Contains(statusNames, name) {
+			return fmt.Errorf("unknown next state %q", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("weight of %q must not be negative", name)
+		}
+		total += w
+	}
+	if total <= 0 {
+		return fmt.Errorf("no next state")
+	}
+	return nil
+}
+
+// statusChain is a semi-Markov chain over statusNames: each fleet sensor
+// moves between statuses with its own timing, instead of drawing a fresh
+// status for every reading.
+type statusChain struct {
+	dwell []time.Duration
+	next  [][]float64 // cumulative transition probabilities, per state
+	start []float64   // cumulative long-run share of time in each state
+}
+
+// newStatusChain builds the chain from the configured states, falling
+// back to defaultStatus for the rest.
+func newStatusChain(states map[string]StatusState) *statusChain {
+	n := len(statusNames)
+	c := &statusChain{dwell: make([]time.Duration, n), next: make([][]float64, n)}
+	p := make([][]float64, n)
+	for i, name := range statusNames {
+		s, ok := states[name]
+		if !ok {
+			s = defaultStatus[name]
+		}
+		c.dwell[i] = time.Duration(s.Dwell)
+		p[i] = make([]float64, n)
+		total := 0.0
+		for _, w := range s.Next {
+			total += w
+		}
+		for j, to := range statusNames {
+			p[i][j] = s.Next[to] / total
+		}
+		c.next[i] = cumulative(p[i])
+	}
+
+	// Sensors start in a state drawn from the chain's long-run
+	// distribution, so a run does not begin with the whole fleet normal:
+	// the stationary distribution of the jump chain, found by iteration,
+	// weighted by each state's dwell.
+	visits := make([]float64, n)
+	for i := range visits {
+		visits[i] = 1 / float64(n)
+	}
+	for range 1000 {
+		v := make([]float64, n)
+		for i := range n {
+			for j := range n {
+				v[j] += visits[i] * p[i][j]
+			}
+		}
+		for i := range v {
+			visits[i] = (visits[i] + v[i]) / 2 // damped, in case the chain is periodic
+		}
+	}
+	share := make([]float64, n)
+	total := 0.0
+	for i := range share {
+		share[i] = visits[i] * c.dwell[i].Seconds()
+		total += share[i]
+	}
+	for i := range share {
+		share[i] /= total
+	}
+	c.start = cumulative(share)
+	return c
+}
+
+// cumulative returns the running sums of p.
+func cumulative(p []float64) []float64 {
+	out := make([]float64, len(p))
+	sum := 0.0
+	for i, v := range p {
+		sum += v
+		out[i] = sum
+	}
+	return out
+}
+
+// pick returns the index whose cumulative probability range holds a
+// uniform draw.
+func pick(cum []float64, rng *rand.Rand) int {
+	u := rng.Float64() * cum[len(cum)-1]
+	for i, c := range cum {
+		if u < c {
+			return i
+		}
+	}
+	return len(cum) - 1
+}
+
+// status returns s's status at t, advancing it through every transition
+// due since it was last asked.
+func (c *statusChain) status(s *fleetSensor, t time.Time, rng *rand.Rand) string {
+	if s.statusUntil.IsZero() {
+		s.status = pick(c.start, rng)
+		s.statusUntil = t.Add(c.dwellTime(s.status, rng))
+	}
+	for !t.Before(s.statusUntil) {
+		s.status = pick(c.next[s.status], rng)
+		s.statusUntil = s.statusUntil.Add(c.dwellTime(s.status, rng))
+	}
+	return statusNames[s.status]
+}
+
+// dwellTime draws how long a sensor stays in state i.
+func (c *statusChain) dwellTime(i int, rng *rand.Rand) time.Duration {
+	return max(time.Duration(rng.ExpFloat64()*float64(c.dwell[i])), 1)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// finalStats sums up a run, for the final stats and -stats-json.
+type finalStats struct {
+	RunID      string      `json:"run_id,omitempty"`
+	Records    int64       `json:"records"`
+	Seconds    float64     `json:"duration_seconds"`
+	Rate       float64     `json:"rate"`                  // records per second achieved
+	TargetRate int         `json:"target_rate,omitempty"` // -rate, unless a profile set the pace
+	Bytes      int64       `json:"bytes"`                 // size of File, or bytes generated
+	File       string      `json:"file,omitempty"`
+	Errors     errorStats  `json:"errors"`
+	Sinks      []sinkStats `json:"sinks,omitempty"`
+}
+
+// sinkStats counts the errors of one sink, rejected batches and failures
+// to flush on shutdown, and what became of its failed batches.
+type sinkStats struct {
+	Name        string `json:"name"`
+	WriteErrors int64  `json:"write_errors"`
+	CloseErrors int64  `json:"close_errors"`
+	deliveryCounts
+	State        string `json:"state,omitempty"` // at the end, unless ok
+	BreakerTrips int64  `json:"breaker_trips,omitempty"`
+}
+
+// newFinalStats sums up a run of total records. When filename is set the
+// on-disk size of that file is reported; otherwise (or if the file cannot
+// be inspected) the number of bytes generated. The sinks' errors are
+// counted under names, as fanOut qualifies them.
+func newFinalStats(total, bytes int64, start time.Time, filename string, names []string, errs *errorBudget) *finalStats {
+	elapsed := time.Since(start)
+	s := &finalStats{Records: total, Seconds: elapsed.Seconds(), Rate: float64(total) / elapsed.Seconds(), Bytes: bytes}
+	if filename != "" {
+		if fi, err := os.Stat(filename); err != nil {
+			errs.Record(errClassStat, err)
+		} else {
+			s.Bytes, s.File = fi.Size(), filename
+		}
+	}
+	s.Errors = errs.Stats()
+	for _, name := range names {
+		qualifier := name
+		if len(names) == 1 {
+			qualifier = ""
+		}
+		s.Sinks = append(s.Sinks, sinkStats{
+			Name:        name,
+			WriteErrors: s.Errors.Classes[sinkErrClass(errClassWrite, qualifier)].Count,
+			CloseErrors: s.Errors.Classes[sinkErrClass(errClassClose, qualifier)].Count,
+		})
+	}
+	return s
+}
+
+// addDeliveries adds the outcomes of the sinks' batches and their health,
+// as fanOut.Deliveries and fanOut.Health report them.
+func (s *finalStats) addDeliveries(counts []deliveryCounts, health []sinkHealth) {
+	for i := range s.Sinks {
+		s.Sinks[i].deliveryCounts = counts[i]
+		if health[i].State != sinkOK {
+			s.Sinks[i].State = health[i].State
+		}
+		s.Sinks[i].BreakerTrips = health[i].Trips
+	}
+}
+
+// printFinalStats reports run totals and the error summary, as
+// newFinalStats counts them.
+func printFinalStats(total, bytes int64, start time.Time, filename string, errs *errorBudget) {
+	newFinalStats(total, bytes, start, filename, nil, errs).print(errs)
+}
+
+// print reports the totals and the error summary.
+func (s *finalStats) print(errs *errorBudget) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		return
+	}
+	if !humanLogs() {
+		attrs := []any{"entries", s.Records, "seconds", s.Seconds, "rate", s.Rate, "bytes", s.Bytes}
+		if s.File != "" {
+			attrs = append(attrs, "file", s.File)
+		}
+		var delivery []any
+		for _, sink := range s.Sinks {
+			if d := sink.deliveryCounts; d != (deliveryCounts{}) || sink.BreakerTrips > 0 {
+				delivery = append(delivery, slog.Group(sink.Name, "retries", d.Retries, "recovered", d.Recovered,
+					"dropped_records", d.Dropped, "dead_lettered_records", d.DeadLettered, "shed_records", d.Shed,
+					"breaker_trips", sink.BreakerTrips))
+			}
+		}
+		if len(delivery) > 0 {
+			attrs = append(attrs, slog.Group("delivery", delivery...))
+		}
+		slog.Info("Final stats", append(attrs, errs.Attr())...)
+		return
+	}
+	sizeMB := float64(s.Bytes) / (1024 * 1024)
+	fmt.Printf("\n--- Final Stats ---\n")
+	fmt.Printf("Total entries: %d\n", s.Records)
+	fmt.Printf("Duration: %v\n", time.Duration(s.Seconds*float64(time.Second)).Round(time.Millisecond))
+	fmt.Printf("Average rate: %.0f entries/sec\n", s.Rate)
+	if s.File != "" {
+		fmt.Printf("File size: %.2f MB\n", sizeMB)
+	} else {
+		fmt.Printf("Data written: %.2f MB\n", sizeMB)
+	}
+	if s.Records > 0 {
+		fmt.Printf("Avg entry size: %.0f bytes\n", float64(s.Bytes)/float64(s.Records))
+	}
+	errs.Print()
+	for _, sink := range s.Sinks {
+		if d := sink.deliveryCounts; d != (deliveryCounts{}) || sink.BreakerTrips > 0 {
+			fmt.Printf("Sink %s: %d retries (%d batches recovered), %d records dropped, %d dead-lettered, %d shed, %d breaker trips\n",
+				sink.Name, d.Retries, d.Recovered, d.Dropped, d.DeadLettered, d.Shed, sink.BreakerTrips)
+		}
+	}
+}
+
+// write saves the stats as JSON to path, or to stderr for "-".
+func (s *finalStats) write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stderr.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
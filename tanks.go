@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Tank farm sensor types. Their sensors belong to storage tanks at the
+// terminal at the delivery end of each pipeline rather than to the line,
+// and are named after their tank: TERM-TX-001-TK03-lvl is the level gauge
+// of tank 3 at the terminal of PIPE-TX-001. Like chromatographs, they are
+// only generated when -type-mix asks for them.
+const (
+	tankLevelType       = "tank_level"
+	tankTemperatureType = "tank_temperature"
+	roofPositionType    = "roof_position"
+)
+
+// tankSuffixes end the IDs of tank farm sensors, by type.
+var tankSuffixes = map[string]string{
+	tankLevelType:       "lvl",
+	tankTemperatureType: "tmp",
+	roofPositionType:    "roof",
+}
+
+// Tank geometry and operation, in feet and feet per hour.
+const (
+	tankHeight   = 48.0 // shell height
+	tankFill     = 44.0 // safe fill height, where filling stops
+	tankHeel     = 4.0  // product left in when a draw-down stops
+	roofLegs     = 6.0  // the floating roof lands on its legs below this
+	tankMinRate  = 0.5  // slowest fill or draw-down
+	tankMaxRate  = 3.0  // fastest
+	tanksPerFarm = 12   // tank numbers drawn without a fleet
+)
+
+// tank is a floating-roof storage tank. Its level rises while the
+// pipeline fills it and falls while it is drawn down for shipment,
+// turning at the fill and heel heights; the roof rides on the product
+// until it lands on its legs. The product temperature settles towards
+// the tank's own, a little warmer while fresh product comes in.
+type tank struct {
+	ID       string
+	Terminal string
+	Location Location
+
+	level  float64
+	rate   float64 // ft per hour, positive while filling
+	temp   float64 // °F
+	base   float64 // temperature the product settles at while stored
+	at     time.Time
+	gauged map[string]bool // sensor types fitted, see fleet.tankFor
+}
+
+// terminalID returns the ID of the terminal at the end of pipeline:
+// TERM-TX-001 for PIPE-TX-001.
+func terminalID(pipeline string) string {
+	return "TERM-" + strings.TrimPrefix(pipeline, "PIPE-")
+}
+
+// tankID returns the ID of tank n at the terminal of pipeline.
+func tankID(pipeline string, n int) string {
+	return fmt.Sprintf("%s-TK%02d", terminalID(pipeline), n)
+}
+
+// isTankType reports whether the sensor type at index t in sensorTypes
+// belongs to a tank.
+func isTankType(t int) bool {
+	_, ok := tankSuffixes[sensorTypes[t].Type]
+	return ok
+}
+
+// terminalLocation returns where the terminal of pipeline stands, at its
+// last mile post.
+func terminalLocation(routes routeSet, pipeline string, rng *rand.Rand) Location {
+	return routes.placeAt(pipeline, routes.length(pipeline), rng)
+}
+
+// newTank returns tank n at the terminal at loc, part full and filling or
+// drawing down.
+func newTank(pipeline string, n int, loc Location, rng *rand.Rand) *tank {
+	t := &tank{
+		ID:       tankID(pipeline, n),
+		Terminal: terminalID(pipeline),
+		Location: loc,
+		level:    tankHeel + rng.Float64()*(tankFill-tankHeel),
+		rate:     tankMinRate + rng.Float64()*(tankMaxRate-tankMinRate),
+		base:     50 + rng.Float64()*40,
+	}
+	if rng.Intn(2) == 0 {
+		t.rate = -t.rate
+	}
+	t.temp = t.base
+	t.gauged = make(map[string]bool)
+	// Tanks of a farm stand a few hundred feet apart.
+	t.Location.Lat += (rng.Float64() - 0.5) * 0.005
+	t.Location.Lon += (rng.Float64() - 0.5) * 0.005
+	return t
+}
+
+// update moves the tank on to now, reversing at the fill and heel
+// heights at a new rate.
+func (t *tank) update(now time.Time, rng *rand.Rand) {
+	if t.at.IsZero() {
+		t.at = now
+		return
+	}
+	h := now.Sub(t.at).Hours()
+	if h <= 0 {
+		return
+	}
+	t.at = now
+	t.level += t.rate * h
+	switch {
+	case t.level >= tankFill:
+		t.level = tankFill
+		t.rate = -(tankMinRate + rng.Float64()*(tankMaxRate-tankMinRate))
+	case t.level <= tankHeel:
+		t.level = tankHeel
+		t.rate = tankMinRate + rng.Float64()*(tankMaxRate-tankMinRate)
+	}
+	target := t.base
+	if t.rate > 0 {
+		target += 4
+	}
+	t.temp += (target - t.temp) * (1 - math.Exp(-h/6))
+}
+
+// measure returns the reading of the tank's sensor of type typ at now:
+// radar level and roof gauges good to about an eighth of an inch, and an
+// averaging thermometer to 0.1°F.
+func (t *tank) measure(typ string, now time.Time, rng *rand.Rand) float64 {
+	t.update(now, rng)
+	switch typ {
+	case tankLevelType:
+		return t.level + rng.NormFloat64()*0.01
+	case roofPositionType:
+		return math.Max(t.level, roofLegs) + rng.NormFloat64()*0.01
+	default:
+		return t.temp + rng.NormFloat64()*0.1
+	}
+}
+
+// tankFor returns a tank at the terminal of pipeline without a sensor of
+// type typ yet, adding one to the farm if every tank has one, so a
+// terminal's sensors of each type are spread one per tank.
+func (f *fleet) tankFor(pipeline, typ string, routes routeSet, rng *rand.Rand) *tank {
+	for _, t := range f.tanks[pipeline] {
+		if !t.gauged[typ] {
+			t.gauged[typ] = true
+			return t
+		}
+	}
+	loc, ok := f.terminals[pipeline]
+	if !ok {
+		loc = terminalLocation(routes, pipeline, rng)
+		f.terminals[pipeline] = loc
+	}
+	t := newTank(pipeline, len(f.tanks[pipeline])+1, loc, rng)
+	t.gauged[typ] = true
+	f.tanks[pipeline] = append(f.tanks[pipeline], t)
+	return t
+}
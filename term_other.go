@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func cbreak(f *os.File) (func() error, error) {
+	return nil, errors.New("single-key input is not supported on this system")
+}
@@ -0,0 +1,33 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbreak puts the terminal on f into cbreak mode: keys are delivered as
+// they are pressed, without echo, while Ctrl+C still sends SIGINT. The
+// returned function restores the previous mode.
+func cbreak(f *os.File) (func() error, error) {
+	var old syscall.Termios
+	if err := termios(f, ioctlGetTermios, &old); err != nil {
+		return nil, err
+	}
+	t := old
+	t.Lflag &^= syscall.ICANON | syscall.ECHO
+	t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+	if err := termios(f, ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	return func() error { return termios(f, ioctlSetTermios, &old) }, nil
+}
+
+func termios(f *os.File, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
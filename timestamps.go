@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // zones for -ts-zone on hosts without a zone database
+)
+
+// Timestamp formats for -ts-format.
+const (
+	tsRFC3339 = "rfc3339"
+	tsEpochMs = "epoch_ms"
+	tsEpochNs = "epoch_ns"
+	tsCustom  = "custom"
+)
+
+// tsPrecisions are the precisions -ts-precision truncates timestamps to,
+// with the fractional seconds RFC 3339 timestamps keep at each.
+var tsPrecisions = []struct {
+	name     string
+	unit     time.Duration
+	fraction string
+}{
+	{"second", time.Second, ""},
+	{"milli", time.Millisecond, ".000"},
+	{"micro", time.Microsecond, ".000000"},
+	{"nano", time.Nanosecond, ".999999999"},
+}
+
+// tsZonePipeline is the -ts-zone that stamps each reading in the local
+// time of its pipeline.
+const tsZonePipeline = "pipeline"
+
+// pipelineZones are the time zones the pipelines run through, by the state
+// in their IDs.
+var pipelineZones = map[string]string{
+	"TX": "America/Chicago",
+	"OK": "America/Chicago",
+	"LA": "America/Chicago",
+	"NM": "America/Denver",
+	"CO": "America/Denver",
+	"WY": "America/Denver",
+	"ND": "America/Chicago",
+}
+
+// timestampFormat is how the JSON encoding writes a reading's timestamps
+// (timestamp, ingested_at and transmitted_at): RFC 3339 strings, integer
+// milliseconds or nanoseconds since the Unix epoch, or strings in a Go
+// time layout, all truncated to a precision. Strings are in UTC, a zone
+// of choice, or the local time of each reading's pipeline. Readings
+// themselves keep UTC RFC 3339 timestamps, so outputs built from their
+// fields are unaffected.
+type timestampFormat struct {
+	format    string
+	layout    string // for rfc3339 and custom
+	precision time.Duration
+	zone      *time.Location
+	zones     map[string]*time.Location // by pipeline, with the pipeline zone
+}
+
+// newTimestampFormat returns the format named format at precision in
+// zone, nil for the full-precision UTC RFC 3339 readings carry. layout is
+// the Go time layout of the custom format; zone is an IANA zone name or
+// "pipeline".
+func newTimestampFormat(format, layout, precision, zone string) (*timestampFormat, error) {
+	f := &timestampFormat{format: format, layout: layout, zone: time.UTC}
+	fraction := ""
+	for _, p := range tsPrecisions {
+		if p.name == precision {
+			f.precision, fraction = p.unit, p.fraction
+		}
+	}
+	if f.precision == 0 {
+		return nil, fmt.Errorf("unknown precision %q (want second, milli, micro or nano)", precision)
+	}
+	if layout != "" && format != tsCustom {
+		return nil, fmt.Errorf("a layout needs the custom format")
+	}
+	switch zone {
+	case "UTC":
+	case tsZonePipeline:
+		f.zones = make(map[string]*time.Location)
+		for _, p := range pipelineIDs {
+			loc, err := time.LoadLocation(pipelineZones[strings.Split(p, "-")[1]])
+			if err != nil {
+				return nil, err
+			}
+			f.zones[p] = loc
+		}
+	default:
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("zone: %w", err)
+		}
+		f.zone = loc
+	}
+	switch format {
+	case tsRFC3339:
+		if f.precision == time.Nanosecond && zone == "UTC" {
+			return nil, nil
+		}
+		f.layout = "2006-01-02T15:04:05" + fraction + "Z07:00"
+	case tsEpochMs, tsEpochNs:
+		if zone != "UTC" {
+			return nil, fmt.Errorf("epoch timestamps have no zone")
+		}
+	case tsCustom:
+		if layout == "" {
+			return nil, fmt.Errorf("custom format needs a layout")
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q (want %s)", format, strings.Join([]string{tsRFC3339, tsEpochMs, tsEpochNs, tsCustom}, ", "))
+	}
+	return f, nil
+}
+
+// marshal encodes r as marshalReading does, with its timestamps in f.
+func (f *timestampFormat) marshal(r *SensorReading) ([]byte, error) {
+	data, err := marshalReading(r)
+	if f == nil || err != nil {
+		return data, err
+	}
+	loc := f.zone
+	if f.zones != nil {
+		if l, ok := f.zones[r.PipelineID]; ok {
+			loc = l
+		}
+	}
+	data = f.rewrite(data, "timestamp", r.Timestamp, loc)
+	data = f.rewrite(data, "ingested_at", r.IngestedAt, loc)
+	return f.rewrite(data, "transmitted_at", r.TransmittedAt, loc), nil
+}
+
+// rewrite replaces the RFC 3339 timestamp ts of field in the encoded
+// reading data with ts in f, in place of the field and in zone loc,
+// leaving data as it is if the field is absent or ts cannot be read.
+func (f *timestampFormat) rewrite(data []byte, field, ts string, loc *time.Location) []byte {
+	if ts == "" {
+		return data
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return data
+	}
+	old := `"` + field + `":"` + ts + `"`
+	i := bytes.Index(data, []byte(old))
+	if i < 0 {
+		return data
+	}
+	t = t.Truncate(f.precision)
+	b := make([]byte, 0, len(data)+8)
+	b = append(b, data[:i+len(field)+3]...)
+	switch f.format {
+	case tsEpochMs:
+		b = strconv.AppendInt(b, t.UnixMilli(), 10)
+	case tsEpochNs:
+		b = strconv.AppendInt(b, t.UnixNano(), 10)
+	default:
+		b = strconv.AppendQuote(b, t.In(loc).Format(f.layout))
+	}
+	return append(b, data[i+len(old):]...)
+}
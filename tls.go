@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// tlsConfig returns the client TLS configuration a network sink's URL
+// options ask for, the same for every sink:
+//
+//	ca=FILE         PEM certificates to verify the server with, in place
+//	                of the system roots, for a private CA
+//	cert=FILE       PEM client certificate, for mutual TLS
+//	key=FILE        its private key (default: cert, for a combined file)
+//	insecure=true   skip verifying the server's certificate
+//
+// It returns nil when none is set, for Go's defaults. Whether the sink
+// uses TLS at all is the sink's own option (tls=true, or an https URL).
+func tlsConfig(q url.Values) (*tls.Config, error) {
+	ca, cert, key := q.Get("ca"), q.Get("cert"), q.Get("key")
+	insecure := q.Get("insecure") == "true"
+	if ca == "" && cert == "" && key == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca %s: no PEM certificates", ca)
+		}
+	}
+	if key != "" && cert == "" {
+		return nil, fmt.Errorf("key needs cert")
+	}
+	if cert != "" {
+		if key == "" {
+			key = cert
+		}
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{c}
+	}
+	return cfg, nil
+}
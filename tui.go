@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dashboard layout limits.
+const (
+	tuiRefresh   = 250 * time.Millisecond // time between redraws and anomaly polls
+	tuiRateSpan  = 2 * time.Second        // span the live rate is averaged over
+	tuiWidth     = 79                     // lines are cut to fit a standard terminal
+	tuiAnomalies = 8                      // recent anomalies shown
+	tuiLogLines  = 5                      // recent status messages shown
+)
+
+// dashboard is the -tui terminal UI: the live and target rates, totals,
+// each sink's queue and errors, the latest anomalies and status messages,
+// redrawn on the terminal's alternate screen. Keys pause generation,
+// change the rate or quit.
+//
+// Generation calls count, poll, wait and takeRate between batches; the
+// redraw and the keyboard run in goroutines of their own.
+type dashboard struct {
+	mu       sync.Mutex
+	started  time.Time
+	rate     int    // target rate
+	rateSet  bool   // rate changed from the keyboard and not yet taken
+	fixed    string // why the rate cannot be changed; empty if it can
+	quit     func()
+	names    []string
+	queued   func() []int
+	slots    int // batch buffers a sink can queue
+	health   func() []sinkHealth
+	errs     *errorBudget
+	records  int64
+	bytes    int64
+	history  []rateSample
+	active   map[string]bool // anomalies at the latest poll, by kind and subject
+	nActive  int
+	recent   []seenAnomaly // newest last
+	polled   time.Time
+	logs     []string
+	held     []slog.Record // warnings and errors, shown again once closed
+	resume   chan struct{} // non-nil while paused; closed to resume
+	keysNote string        // how to enter keys when single-key input is unavailable
+
+	prevLog *slog.Logger
+	restore func() error // restores the terminal mode; nil if unchanged
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+type rateSample struct {
+	at      time.Time
+	records int64
+}
+
+type seenAnomaly struct {
+	at time.Duration // since the dashboard opened
+	Anomaly
+}
+
+// newDashboard returns a dashboard for a run at rate, 0 if a profile sets
+// it. fixed says why the rate cannot be changed, if it cannot; quit stops
+// generation.
+func newDashboard(rate int, fixed string, quit func()) *dashboard {
+	return &dashboard{rate: rate, fixed: fixed, quit: quit, active: make(map[string]bool)}
+}
+
+// checkTerminal reports whether the dashboard can be shown.
+func checkTerminal() error {
+	if fi, err := os.Stdout.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("-tui needs standard output to be a terminal")
+	}
+	if !humanLogs() {
+		return errors.New("-tui shows status messages itself; it cannot be combined with -log-format json")
+	}
+	return nil
+}
+
+// open switches to the alternate screen and starts redrawing. Status
+// messages go to the dashboard until it is closed.
+func (d *dashboard) open(names []string, queued func() []int, slots int, health func() []sinkHealth, errs *errorBudget) {
+	d.names, d.queued, d.slots, d.health, d.errs = names, queued, slots, health, errs
+	d.started = time.Now()
+	d.stop, d.done = make(chan struct{}), make(chan struct{})
+	if restore, err := cbreak(os.Stdin); err == nil {
+		d.restore = restore
+	} else {
+		d.keysNote = " (then Enter)"
+	}
+	d.prevLog = slog.Default()
+	slog.SetDefault(slog.New(&tuiHandler{d: d, next: d.prevLog.Handler()}))
+	fmt.Print("\x1b[?1049h\x1b[?25l") // alternate screen, hidden cursor
+	go d.redraw()
+	go d.keys()
+}
+
+// close stops redrawing, restores the terminal and the status output, and
+// repeats the warnings and errors logged while the dashboard was open.
+func (d *dashboard) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	if d.resume != nil {
+		close(d.resume)
+		d.resume = nil
+	}
+	d.mu.Unlock()
+	close(d.stop)
+	<-d.done
+	fmt.Print("\x1b[?25h\x1b[?1049l")
+	if d.restore != nil {
+		d.restore()
+	}
+	slog.SetDefault(d.prevLog)
+	for _, r := range d.held {
+		d.prevLog.Handler().Handle(context.Background(), r)
+	}
+}
+
+// count adds a written batch to the totals.
+func (d *dashboard) count(records, bytes int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records += records
+	d.bytes += bytes
+}
+
+// poll notes the anomalies in progress, at most once per refresh.
+func (d *dashboard) poll(gen *Generator) {
+	if time.Since(d.polled) < tuiRefresh {
+		return
+	}
+	d.polled = time.Now()
+	as := gen.Anomalies()
+	active := make(map[string]bool, len(as))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range as {
+		key := a.Kind + "/" + a.Subject
+		active[key] = true
+		if !d.active[key] {
+			d.recent = append(d.recent, seenAnomaly{time.Since(d.started), a})
+		}
+	}
+	if len(d.recent) > tuiAnomalies {
+		d.recent = d.recent[len(d.recent)-tuiAnomalies:]
+	}
+	d.active, d.nActive = active, len(as)
+}
+
+// wait blocks while generation is paused.
+func (d *dashboard) wait(ctx context.Context) error {
+	d.mu.Lock()
+	resume := d.resume
+	d.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// setRate shows a rate changed other than from the keyboard.
+func (d *dashboard) setRate(rate int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rate = rate
+}
+
+// takeRate returns the rate set from the keyboard since the last call.
+func (d *dashboard) takeRate() (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	set := d.rateSet
+	d.rateSet = false
+	return d.rate, set
+}
+
+// keys handles keypresses: p or space pauses and resumes, + and - change
+// the rate by about a fifth, q quits.
+func (d *dashboard) keys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range buf[:n] {
+			switch k {
+			case 'p', 'P', ' ':
+				d.togglePause()
+			case '+', '=':
+				d.changeRate(+1)
+			case '-', '_':
+				d.changeRate(-1)
+			case 'q', 'Q':
+				d.mu.Lock()
+				closed := d.closed
+				d.mu.Unlock()
+				if !closed {
+					slog.Info("Quitting")
+					d.quit()
+				}
+			}
+		}
+	}
+}
+
+func (d *dashboard) togglePause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.closed:
+	case d.resume == nil:
+		d.resume = make(chan struct{})
+	default:
+		close(d.resume)
+		d.resume = nil
+	}
+}
+
+// changeRate raises (dir > 0) or lowers the target rate by about a fifth.
+func (d *dashboard) changeRate(dir int) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	if d.fixed != "" {
+		d.mu.Unlock()
+		slog.Warn("Rate unchanged: " + d.fixed)
+		return
+	}
+	if dir > 0 {
+		d.rate = max(d.rate*6/5, d.rate+1)
+	} else {
+		d.rate = max(min(d.rate*5/6, d.rate-1), 1)
+	}
+	d.rateSet = true
+	rate := d.rate
+	d.mu.Unlock()
+	slog.Info(fmt.Sprintf("Target rate now ~%d entries/sec", rate), "rate", rate)
+}
+
+func (d *dashboard) redraw() {
+	defer close(d.done)
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		d.draw()
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// draw repaints the screen from the top, clearing what each line leaves
+// of the previous frame rather than the whole screen, so it does not
+// flicker.
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.history = append(d.history, rateSample{now, d.records})
+	for len(d.history) > 2 && now.Sub(d.history[1].at) >= tuiRateSpan {
+		d.history = d.history[1:]
+	}
+	live := 0.0
+	if first := d.history[0]; now.Sub(first.at) > 0 {
+		live = float64(d.records-first.records) / now.Sub(first.at).Seconds()
+	}
+
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		s := []rune(fmt.Sprintf(format, args...))
+		if len(s) > tuiWidth {
+			s = append(s[:tuiWidth-1], '…')
+		}
+		b.WriteString(string(s))
+		b.WriteString("\x1b[K\n")
+	}
+	state := "running"
+	if d.resume != nil {
+		state = "PAUSED"
+	}
+	elapsed := now.Sub(d.started).Truncate(time.Second)
+	line("sensor-gen  %-7s  %v", state, elapsed)
+	line("")
+	target := fmt.Sprintf("~%d/sec", d.rate)
+	switch {
+	case d.rate == 0:
+		target = "set by -profile"
+	case d.fixed != "":
+		target += " (fixed: " + d.fixed + ")"
+	}
+	line("Target rate  %s", target)
+	line("Live rate    %.0f/sec", live)
+	line("Records      %d", d.records)
+	line("Bytes        %.1fMB", float64(d.bytes)/(1<<20))
+	line("")
+
+	stats := d.errs.Stats()
+	line("Errors       %d", stats.Total)
+	line("%-24s %8s %8s  %s", "Sink", "queued", "errors", "state")
+	queued, health := d.queued(), d.health()
+	for i, name := range d.names {
+		class := name
+		if len(d.names) == 1 {
+			class = ""
+		}
+		n := stats.Classes[sinkErrClass(errClassWrite, class)].Count + stats.Classes[sinkErrClass(errClassClose, class)].Count
+		line("  %-22s %8s %8d  %s", name, fmt.Sprintf("%d/%d", queued[i], d.slots), n, health[i].State)
+	}
+	line("")
+
+	line("Anomalies    %d in progress", d.nActive)
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		a := d.recent[i]
+		line("  +%-8v %-20s %-14s %s", a.at.Truncate(time.Second), a.Kind, a.Subject, a.Detail)
+	}
+	line("")
+
+	line("Messages")
+	for _, msg := range d.logs {
+		line("  %s", msg)
+	}
+	line("")
+	line("p pause/resume   + faster   - slower   q quit%s", d.keysNote)
+	fmt.Print("\x1b[H" + b.String() + "\x1b[J")
+}
+
+// tuiHandler shows status messages on the dashboard, keeping warnings and
+// errors to repeat through next once it closes.
+type tuiHandler struct {
+	d    *dashboard
+	next slog.Handler
+}
+
+func (h *tuiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *tuiHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := r.Message
+	switch {
+	case r.Level >= slog.LevelError:
+		msg = "Error: " + msg
+	case r.Level >= slog.LevelWarn:
+		msg = "Warning: " + msg
+	}
+	h.d.mu.Lock()
+	defer h.d.mu.Unlock()
+	h.d.logs = append(h.d.logs, time.Now().Format(time.TimeOnly)+" "+msg)
+	if len(h.d.logs) > tuiLogLines {
+		h.d.logs = h.d.logs[len(h.d.logs)-tuiLogLines:]
+	}
+	if r.Level >= slog.LevelWarn {
+		h.d.held = append(h.d.held, r.Clone())
+	}
+	return nil
+}
+
+func (h *tuiHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *tuiHandler) WithGroup(string) slog.Handler      { return h }
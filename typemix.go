@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parseTypeMix parses a -type-mix value: comma-separated sensor types,
+// each with an optional =weight (default 1), e.g.
+// "pressure=60,flow_rate=20,corrosion=5". It returns the weights indexed
+// like sensorTypes, up to mixedTypes; types not listed get none.
+func parseTypeMix(spec string) ([]float64, error) {
+	names := make([]string, mixedTypes)
+	for i, st := range sensorTypes[:mixedTypes] {
+		names[i] = st.Type
+	}
+	return parseMix(spec, "sensor type", names)
+}
+
+// parsePipelineMix parses a -pipeline-mix value, as parseTypeMix does for
+// pipeline IDs, e.g. "PIPE-TX-001=40,*=10". It returns the weights indexed
+// like pipelineIDs.
+func parsePipelineMix(spec string) ([]float64, error) {
+	return parseMix(spec, "pipeline", pipelineIDs)
+}
+
+// parseMix parses comma-separated names, each with an optional =weight
+// (default 1), into weights indexed like names. "*" stands for every name
+// not listed; without it those get no weight. what names the kind of
+// name in errors.
+func parseMix(spec, what string, names []string) ([]float64, error) {
+	weights := make([]float64, len(names))
+	rest := 0.0
+	seen := false
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, weight, hasWeight := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		w := 1.0
+		if hasWeight {
+			var err error
+			w, err = strconv.ParseFloat(strings.TrimSpace(weight), 64)
+			if err != nil || !(w > 0) {
+				return nil, fmt.Errorf("%s %q: weight must be a positive number", what, name)
+			}
+		}
+		if name == "*" {
+			if rest != 0 {
+				return nil, errors.New("* listed twice")
+			}
+			rest, seen = w, true
+			continue
+		}
+		i := slices.Index(names, name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown %s %q", what, name)
+		}
+		if weights[i] != 0 {
+			return nil, fmt.Errorf("%s %q listed twice", what, name)
+		}
+		weights[i] = w
+		seen = true
+	}
+	if !seen {
+		return nil, fmt.Errorf("no %ss in %q", what, spec)
+	}
+	for i, w := range weights {
+		if w == 0 {
+			weights[i] = rest
+		}
+	}
+	return weights, nil
+}
+
+// mixer deals out indexes (sensor types, pipelines) in proportion to
+// their weights.
+type mixer struct {
+	weights []float64
+	cum     []float64
+	counts  []int
+	total   int
+}
+
+// newMixer returns a mixer for weights, or nil for a uniform mix.
+func newMixer(weights []float64) *mixer {
+	if weights == nil {
+		return nil
+	}
+	return &mixer{weights: weights, cum: cumulative(weights), counts: make([]int, len(weights))}
+}
+
+// next returns the index for the next fleet sensor: the one furthest
+// below its share of the sensors so far, so a fleet of any size follows
+// the mix as closely as whole sensors allow.
+func (m *mixer) next() int {
+	m.total++
+	sum := m.cum[len(m.cum)-1]
+	best, deficit := 0, 0.0
+	for t, w := range m.weights {
+		if w <= 0 {
+			continue
+		}
+		if d := w/sum*float64(m.total) - float64(m.counts[t]); d > deficit {
+			best, deficit = t, d
+		}
+	}
+	m.counts[best]++
+	return best
+}
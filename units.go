@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+
+// Unit systems for -units. The generator works in the US customary units
+// of sensorTypes; metric output converts readings as they go out.
+const (
+	unitsImperial = "imperial"
+	unitsMetric   = "metric"
+)
+
+// unitConversion converts a value into unit: v*scale + offset, reported
+// to resolution when quantizing.
+type unitConversion struct {
+	unit       string
+	scale      float64
+	offset     float64
+	resolution float64
+}
+
+// metricUnits are the metric counterparts of the units in sensorTypes
+// that have one. The rest (percent, ppm, mV, A, rpm, mm/s, mpy) are the
+// same in both systems.
+var metricUnits = map[string]unitConversion{
+	"psi":        {"kPa", 6.894757, 0, 1},
+	"fahrenheit": {"celsius", 5.0 / 9, -32 * 5.0 / 9, 0.1},
+	"bbl/hr":     {"m3/h", 0.1589873, 0, 0.1},
+	"ft":         {"m", 0.3048, 0, 0.001},
+	"BTU/scf":    {"MJ/m3", 0.0372589, 0, 0.001},
+}
+
+func (c unitConversion) apply(v float64) float64 {
+	return v*c.scale + c.offset
+}
+
+// parseUnits returns the conversions of the unit system named s, nil for
+// the generator's own.
+func parseUnits(s string) (map[string]unitConversion, error) {
+	switch s {
+	case "", unitsImperial:
+		return nil, nil
+	case unitsMetric:
+		return metricUnits, nil
+	}
+	return nil, fmt.Errorf("unknown unit system %q (want %s or %s)", s, unitsMetric, unitsImperial)
+}
+
+// unitOf returns the conversion from the unit of sensor type typ to unit,
+// in either system, reporting false if unit is not one of them.
+func unitOf(typ int, unit string) (unitConversion, bool) {
+	st := sensorTypes[typ]
+	if unit == st.Unit {
+		return unitConversion{unit: st.Unit, scale: 1, resolution: st.Resolution}, true
+	}
+	c, ok := metricUnits[st.Unit]
+	return c, ok && c.unit == unit
+}
+
+// validUnit reports whether sensor type typ is reported in unit in either
+// unit system.
+func validUnit(typ int, unit string) bool {
+	_, ok := unitOf(typ, unit)
+	return ok
+}
+
+// typeRange returns the range of r's sensor type in r's unit, reporting
+// false for an unknown type or a unit it is never reported in.
+func typeRange(r *SensorReading) (lo, hi float64, ok bool) {
+	typ := sensorTypeIndex(r.Type)
+	if typ < 0 {
+		return 0, 0, false
+	}
+	c, ok := unitOf(typ, r.Unit)
+	if !ok {
+		return 0, 0, false
+	}
+	return c.apply(sensorTypes[typ].Min), c.apply(sensorTypes[typ].Max), true
+}
+
+// convertUnits converts r into the output unit system.
+func (g *Generator) convertUnits(r *SensorReading) {
+	c, ok := g.units[r.Unit]
+	if !ok {
+		return
+	}
+	r.Value = c.apply(r.Value)
+	if g.quantize {
+		r.Value = quantize(r.Value, c.resolution)
+	}
+	r.Unit = c.unit
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Checks validate runs, in report order.
+const (
+	checkSchema     = "schema"     // fields, types and allowed values
+	checkTimestamps = "timestamps" // each sensor's timestamps never go back
+	checkRanges     = "ranges"     // values within their type's range
+	checkFinite     = "finite"     // no NaN or infinite values
+	checkSequence   = "sequence"   // no sequence number repeated for a sensor
+)
+
+var validateChecks = [...]string{checkSchema, checkTimestamps, checkRanges, checkFinite, checkSequence}
+
+// maxSequenceGap bounds the missing sequence numbers tracked per sensor;
+// a larger jump is counted as a gap without tracking the numbers in it.
+const maxSequenceGap = 1 << 16
+
+// validateMain implements "sensor-gen validate": it checks a JSONL, CSV
+// or Parquet file of readings against the documented record contract and
+// prints a summary report, exiting non-zero if any check fails.
+func validateMain(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	format := fs.String("format", "", "Input format: jsonl, csv or parquet (default: from the file extension)")
+	checks := fs.String("checks", strings.Join(validateChecks[:], ","), "Checks that must pass; the others are reported but ignored")
+	tolerance := fs.Float64("range-tolerance", 0.25, "How far values may stray beyond their type's range, as a fraction of the range or of the maximum if larger (generated anomalies reach 20% of the maximum)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sensor-gen validate [flags] FILE  (.jsonl, .csv, either gzipped, or .parquet; - reads JSONL from standard input)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		if *format = recordFormat(path); *format == "" {
+			fmt.Fprintf(os.Stderr, "Error: cannot tell the format of %s; set -format\n", path)
+			return 1
+		}
+	}
+	v := &validator{tolerance: *tolerance, enabled: make(map[string]bool), sensors: make(map[string]*sensorTrack)}
+	for _, c := range strings.Split(*checks, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		if !slices.Contains(validateChecks[:], c) {
+			fmt.Fprintf(os.Stderr, "Error: unknown check %q (want %s)\n", c, strings.Join(validateChecks[:], ", "))
+			return 1
+		}
+		v.enabled[c] = true
+	}
+	if *tolerance < 0 {
+		fmt.Fprintln(os.Stderr, "Error: -range-tolerance must not be negative")
+		return 1
+	}
+
+	err := readRecords(path, *format, func(where string, r *SensorReading, line []byte, err error) {
+		v.records++
+		if line != nil {
+			// The field check explains a bad record better than decoding.
+			if ferr := checkJSONFields(line); ferr != nil {
+				err = ferr
+			}
+		}
+		if err != nil {
+			v.fail(checkSchema, where, "%v", err)
+			return
+		}
+		v.check(where, r)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: validate %s: %v\n", path, err)
+		return 1
+	}
+	if !v.report(os.Stdout, path, *format) {
+		return 1
+	}
+	return 0
+}
+
+// validator accumulates check results over the records of a file.
+type validator struct {
+	tolerance float64
+	enabled   map[string]bool
+	results   [len(validateChecks)]checkResult
+	records   int64
+	sensors   map[string]*sensorTrack
+	first     time.Time
+	last      time.Time
+	repeated  int64 // readings with the same timestamp as their sensor's last
+	gaps      int64 // sequence numbers skipped and never seen
+}
+
+type checkResult struct {
+	violations int64
+	first      string // where and what the first violation was
+}
+
+// sensorTrack is what validation remembers about a sensor.
+type sensorTrack struct {
+	last    time.Time
+	maxSeq  uint64
+	missing map[uint64]bool // sequence numbers below maxSeq not yet seen
+}
+
+// fail records a violation of check at record where.
+func (v *validator) fail(check, where string, format string, args ...any) {
+	i := slices.Index(validateChecks[:], check)
+	res := &v.results[i]
+	if res.violations == 0 {
+		res.first = where + ": " + fmt.Sprintf(format, args...)
+	}
+	res.violations++
+}
+
+// recordFormat returns the format of the file at path from its
+// extension, or "" if the extension is not a known one.
+func recordFormat(path string) string {
+	switch filepath.Ext(strings.TrimSuffix(path, ".gz")) {
+	case ".jsonl", ".json", "":
+		return formatJSONL
+	case ".csv":
+		return formatCSV
+	case ".parquet":
+		return formatParquet
+	}
+	return ""
+}
+
+// readRecords reads the readings of a JSONL, CSV or Parquet file, calling
+// fn with where each record is ("line 12", "row 12") and its reading, or
+// the error that kept it from being read. For JSONL, fn also gets the
+// line the reading came from.
+func readRecords(path, format string, fn func(where string, r *SensorReading, line []byte, err error)) error {
+	switch format {
+	case formatJSONL:
+		in, err := openReadings(format, path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		sc := bufio.NewScanner(in)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for n := 1; sc.Scan(); n++ {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var r SensorReading
+			err := unmarshalReading(line, &r)
+			fn(fmt.Sprintf("line %d", n), &r, line, err)
+		}
+		return sc.Err()
+	case formatCSV:
+		in, err := openReadings(format, path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		n := 1 // the header is row 1
+		return readCSVTable(in, readingColumns, func(row []any, err error) error {
+			n++
+			var r *SensorReading
+			if err == nil {
+				r = rowReading(readingColumns, row)
+			}
+			fn(fmt.Sprintf("row %d", n), r, nil, err)
+			return nil
+		})
+	case formatParquet:
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		n := 0
+		return readParquetTable(f, fi.Size(), readingColumns, func(row []any) error {
+			n++
+			fn(fmt.Sprintf("row %d", n), rowReading(readingColumns, row), nil, nil)
+			return nil
+		})
+	}
+	return fmt.Errorf("unknown format %q (want jsonl, csv or parquet)", format)
+}
+
+// check runs the record checks on a reading.
+func (v *validator) check(where string, r *SensorReading) {
+	typ := sensorTypeIndex(r.Type)
+	switch {
+	case r.SensorID == "":
+		v.fail(checkSchema, where, "empty sensor_id")
+	case r.PipelineID == "":
+		v.fail(checkSchema, where, "empty pipeline_id")
+	case typ < 0:
+		v.fail(checkSchema, where, "unknown type %q", r.Type)
+	case !validUnit(typ, r.Unit):
+		v.fail(checkSchema, where, "unit %q for type %s, want %q", r.Unit, r.Type, sensorTypes[typ].Unit)
+	case !slices.Contains(statusNames, r.Status):
+		v.fail(checkSchema, where, "unknown status %q", r.Status)
+	case r.AlertLevel != "" && r.AlertLevel != alertWarning && r.AlertLevel != alertCritical:
+		v.fail(checkSchema, where, "unknown alert_level %q", r.AlertLevel)
+	case !(r.Quality >= 0 && r.Quality <= 1):
+		v.fail(checkSchema, where, "quality_score %v outside 0-1", r.Quality)
+	case math.Abs(r.Location.Lat) > 90 || math.Abs(r.Location.Lon) > 180:
+		v.fail(checkSchema, where, "location %v,%v is not a coordinate", r.Location.Lat, r.Location.Lon)
+	case r.Components != nil && r.Type != chromatographType:
+		v.fail(checkSchema, where, "components in a %s reading", r.Type)
+	case isTankType(typ) && (r.TankID == "" || r.TerminalID == ""):
+		v.fail(checkSchema, where, "%s reading without terminal_id and tank_id", r.Type)
+	case !isTankType(typ) && (r.TankID != "" || r.TerminalID != ""):
+		v.fail(checkSchema, where, "terminal_id or tank_id in a %s reading", r.Type)
+	case (typ >= mixedTypes) != (r.StationID != ""):
+		v.fail(checkSchema, where, "%s reading with station_id %q", r.Type, r.StationID)
+	case (r.GatewayID == "") != (r.TransmittedAt == ""):
+		v.fail(checkSchema, where, "gateway_id %q with transmitted_at %q", r.GatewayID, r.TransmittedAt)
+	}
+
+	ts, tsErr := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if tsErr != nil {
+		v.fail(checkSchema, where, "timestamp: %v", tsErr)
+	} else {
+		if v.first.IsZero() || ts.Before(v.first) {
+			v.first = ts
+		}
+		if ts.After(v.last) {
+			v.last = ts
+		}
+	}
+	if r.IngestedAt != "" {
+		if _, err := time.Parse(time.RFC3339Nano, r.IngestedAt); err != nil {
+			v.fail(checkSchema, where, "ingested_at: %v", err)
+		}
+	}
+	if r.TransmittedAt != "" {
+		if _, err := time.Parse(time.RFC3339Nano, r.TransmittedAt); err != nil {
+			v.fail(checkSchema, where, "transmitted_at: %v", err)
+		}
+	}
+
+	if !isFinite(r.Value) {
+		v.fail(checkFinite, where, "sensor %s value %v", r.SensorID, r.Value)
+	} else if lo, hi, ok := typeRange(r); ok {
+		// Anomalies reach past the maximum by a fraction of it, which for a
+		// narrow range such as a chromatograph's is more than the range.
+		slack := v.tolerance * max(hi-lo, math.Abs(hi))
+		if r.Value < lo-slack || r.Value > hi+slack {
+			v.fail(checkRanges, where, "sensor %s value %v outside %v-%v", r.SensorID, r.Value, lo, hi)
+		}
+	}
+	if r.Components != nil {
+		if mol := r.Components["methane"] + r.Components["ethane"] + r.Components["co2"]; mol > 100 {
+			v.fail(checkRanges, where, "sensor %s components add up to %v mol %%", r.SensorID, mol)
+		}
+		for _, name := range gasComponents {
+			if r.Components[name] < 0 {
+				v.fail(checkRanges, where, "sensor %s %s %v is negative", r.SensorID, name, r.Components[name])
+			}
+		}
+	}
+
+	if r.BatteryPct < 0 || r.BatteryPct > 100 {
+		v.fail(checkRanges, where, "sensor %s battery_pct %v outside 0-100", r.SensorID, r.BatteryPct)
+	}
+	if r.RSSI > 0 {
+		v.fail(checkRanges, where, "sensor %s rssi_dbm %v is positive", r.SensorID, r.RSSI)
+	}
+	if r.Uptime < 0 {
+		v.fail(checkRanges, where, "sensor %s uptime_s %v is negative", r.SensorID, r.Uptime)
+	}
+
+	s := v.sensors[r.SensorID]
+	if s == nil {
+		s = &sensorTrack{}
+		v.sensors[r.SensorID] = s
+	}
+	if tsErr == nil {
+		switch {
+		case s.last.IsZero() || ts.After(s.last):
+			s.last = ts
+		case ts.Equal(s.last):
+			v.repeated++
+		default:
+			v.fail(checkTimestamps, where, "sensor %s went back %v to %s", r.SensorID, s.last.Sub(ts), r.Timestamp)
+		}
+	}
+	if seq := r.Sequence; seq > 0 {
+		switch {
+		case seq > s.maxSeq:
+			if gap := seq - s.maxSeq - 1; gap > 0 {
+				v.gaps += int64(gap)
+				if gap <= maxSequenceGap {
+					if s.missing == nil {
+						s.missing = make(map[uint64]bool)
+					}
+					for n := s.maxSeq + 1; n < seq; n++ {
+						s.missing[n] = true
+					}
+				}
+			}
+			s.maxSeq = seq
+		case s.missing[seq]:
+			delete(s.missing, seq)
+			v.gaps--
+		default:
+			v.fail(checkSequence, where, "sensor %s repeats sequence %d", r.SensorID, seq)
+		}
+	}
+}
+
+// report prints the summary and returns whether every enabled check
+// passed.
+func (v *validator) report(w io.Writer, path, format string) bool {
+	fmt.Fprintf(w, "%s (%s): %d records from %d sensors", path, format, v.records, len(v.sensors))
+	if !v.first.IsZero() {
+		fmt.Fprintf(w, ", %s to %s", v.first.Format(time.RFC3339Nano), v.last.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Check\tResult\tViolations\tFirst violation")
+	ok := true
+	for i, name := range validateChecks {
+		res := v.results[i]
+		result := "pass"
+		switch {
+		case !v.enabled[name]:
+			result = "ignored"
+		case res.violations > 0:
+			result = "FAIL"
+			ok = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", name, result, res.violations, res.first)
+	}
+	tw.Flush()
+	if v.repeated > 0 {
+		fmt.Fprintf(w, "\n%d readings repeat their sensor's previous timestamp (retransmissions)\n", v.repeated)
+	}
+	if v.gaps > 0 {
+		fmt.Fprintf(w, "%d sequence numbers never seen (dropped readings)\n", v.gaps)
+	}
+	if ok {
+		fmt.Fprintln(w, "\nPASS")
+	} else {
+		fmt.Fprintln(w, "\nFAIL")
+	}
+	return ok
+}
+
+// readingFields maps the fields of a reading's JSON to their JSON types,
+// locationFields those of its location and componentsFields those of a
+// chromatograph's components.
+var (
+	readingFields = map[string]string{
+		"sensor_id":        "string",
+		"timestamp":        "string",
+		"type":             "string",
+		"value":            "number",
+		"unit":             "string",
+		"location":         "object",
+		"pipeline_id":      "string",
+		"status":           "string",
+		"quality_score":    "number",
+		"alert_level":      "string",
+		"pair_id":          "string",
+		"backfilled":       "boolean",
+		"cohort":           "string",
+		"ingested_at":      "string",
+		"sequence":         "number",
+		"components":       "object",
+		"terminal_id":      "string",
+		"tank_id":          "string",
+		"station_id":       "string",
+		"gateway_id":       "string",
+		"transmitted_at":   "string",
+		"battery_pct":      "number",
+		"rssi_dbm":         "number",
+		"uptime_s":         "number",
+		"firmware_version": "string",
+		"run_id":           "string",
+	}
+	locationFields   = map[string]string{"lat": "number", "lon": "number", "mile_post": "number"}
+	componentsFields = map[string]string{"methane": "number", "ethane": "number", "co2": "number", "h2s": "number"}
+)
+
+// optionalFields are the reading fields the JSON omits when empty.
+var optionalFields = []string{"alert_level", "pair_id", "backfilled", "cohort", "ingested_at", "sequence", "components", "terminal_id", "tank_id", "station_id", "gateway_id", "transmitted_at", "battery_pct", "rssi_dbm", "uptime_s", "firmware_version", "run_id"}
+
+// checkJSONFields checks that a JSON reading has exactly the documented
+// fields, each of the right JSON type. A value may be the string "NaN",
+// "Infinity" or "-Infinity".
+func checkJSONFields(line []byte) error {
+	var obj, loc, comp map[string]json.RawMessage
+	if err := json.Unmarshal(line, &obj); err != nil {
+		return err
+	}
+	if err := checkJSONObject("", obj, readingFields); err != nil {
+		return err
+	}
+	json.Unmarshal(obj["location"], &loc)
+	if err := checkJSONObject("location.", loc, locationFields); err != nil {
+		return err
+	}
+	if raw, ok := obj["components"]; ok {
+		json.Unmarshal(raw, &comp)
+		return checkJSONObject("components.", comp, componentsFields)
+	}
+	return nil
+}
+
+func checkJSONObject(prefix string, obj map[string]json.RawMessage, fields map[string]string) error {
+	for name, raw := range obj {
+		want, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unexpected field %s%s", prefix, name)
+		}
+		got := jsonType(raw)
+		if prefix+name == "value" && got == "string" {
+			switch string(raw) {
+			case `"NaN"`, `"Infinity"`, `"-Infinity"`:
+				got = "number"
+			}
+		}
+		if got != want {
+			return fmt.Errorf("field %s%s: %s, want %s", prefix, name, got, want)
+		}
+	}
+	for name := range fields {
+		if _, ok := obj[name]; !ok && !slices.Contains(optionalFields, prefix+name) {
+			return fmt.Errorf("missing field %s%s", prefix, name)
+		}
+	}
+	return nil
+}
+
+// jsonType names the JSON type of a raw value.
+func jsonType(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "nothing"
+	}
+	switch raw[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// rowReading builds a reading from a row of readingColumns values.
+func rowReading(cols []column, row []any) *SensorReading {
+	r := new(SensorReading)
+	for i, c := range cols {
+		val := row[i]
+		if val == nil {
+			continue
+		}
+		switch c.name {
+		case "sensor_id":
+			r.SensorID = val.(string)
+		case "timestamp":
+			r.Timestamp = val.(time.Time).UTC().Format(time.RFC3339Nano)
+		case "type":
+			r.Type = val.(string)
+		case "value":
+			r.Value = val.(float64)
+		case "unit":
+			r.Unit = val.(string)
+		case "lat":
+			r.Location.Lat = val.(float64)
+		case "lon":
+			r.Location.Lon = val.(float64)
+		case "mile_post":
+			r.Location.MilePost = val.(float64)
+		case "pipeline_id":
+			r.PipelineID = val.(string)
+		case "status":
+			r.Status = val.(string)
+		case "quality_score":
+			r.Quality = val.(float64)
+		case "alert_level":
+			r.AlertLevel = val.(string)
+		case "pair_id":
+			r.PairID = val.(string)
+		case "backfilled":
+			r.Backfilled = val.(bool)
+		case "cohort":
+			r.Cohort = val.(string)
+		case "ingested_at":
+			r.IngestedAt = val.(time.Time).UTC().Format(time.RFC3339Nano)
+		case "sequence":
+			r.Sequence = uint64(val.(int64))
+		case "terminal_id":
+			r.TerminalID = val.(string)
+		case "tank_id":
+			r.TankID = val.(string)
+		case "station_id":
+			r.StationID = val.(string)
+		case "gateway_id":
+			r.GatewayID = val.(string)
+		case "transmitted_at":
+			r.TransmittedAt = val.(time.Time).UTC().Format(time.RFC3339Nano)
+		case "battery_pct":
+			r.BatteryPct = val.(float64)
+		case "rssi_dbm":
+			r.RSSI = val.(float64)
+		case "uptime_s":
+			r.Uptime = val.(int64)
+		case "firmware_version":
+			r.Firmware = val.(string)
+		case "run_id":
+			r.RunID = val.(string)
+		default:
+			if slices.Contains(gasComponents, c.name) {
+				if r.Components == nil {
+					r.Components = make(map[string]float64, len(gasComponents))
+				}
+				r.Components[c.name] = val.(float64)
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchWriter decouples generation from output: batches are handed to a
+// background goroutine that writes them to the sink, so the next batch can
+// be generated and encoded while the previous one is being written.
+//
+// Two batch buffers circulate between the generator and the writer (double
+// buffering), which bounds memory and applies backpressure when the sink
+// is slower than generation. Batches the sink rejects are retried as
+// retry says, then dropped (counted in the error budget) or
+// dead-lettered, rather than stopping the writer.
+type batchWriter struct {
+	sink      Sink
+	name      string // for logs
+	class     string // error class for write failures
+	deadClass string // and for failures to dead-letter them
+	errs      *errorBudget
+	retry     sinkRetry
+	dead      *deadLetter // with onFailureDeadLetter
+	stats     deliveryStats
+	breaker   *breaker
+	bp        backpressure
+	buffers   atomic.Int64    // batch buffers in circulation
+	queued    atomic.Int64    // memory held by queued batches, with backpressureBuffer
+	ctx       context.Context // cancelled to abort in-flight writes
+	cancel    context.CancelFunc
+	free      chan []Record
+	full      chan []Record
+	done      chan struct{}
+}
+
+// newBatchWriter starts a writer for sink. A non-empty name qualifies the
+// error class its failures are counted under; label names it in logs.
+func newBatchWriter(sink Sink, name, label string, errs *errorBudget, retry sinkRetry, dead *deadLetter, bp backpressure) *batchWriter {
+	slots := 2
+	if bp.policy == backpressureBuffer {
+		slots = bufferBatches
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &batchWriter{
+		sink:      sink,
+		name:      label,
+		class:     sinkErrClass(errClassWrite, name),
+		deadClass: sinkErrClass(errClassDeadLetter, name),
+		errs:      errs,
+		retry:     retry,
+		dead:      dead,
+		breaker:   newBreaker(retry.breakerFailures, retry.breakerWindow, retry.breakerProbe),
+		bp:        bp,
+		ctx:       ctx,
+		cancel:    cancel,
+		free:      make(chan []Record, slots),
+		full:      make(chan []Record, slots-1),
+		done:      make(chan struct{}),
+	}
+	for range 2 {
+		w.free <- nil
+	}
+	w.buffers.Store(2)
+	go w.run()
+	return w
+}
+
+func (w *batchWriter) run() {
+	defer close(w.done)
+	for batch := range w.full {
+		if w.ctx.Err() == nil {
+			w.deliver(batch)
+		}
+		if w.bp.policy == backpressureBuffer {
+			w.queued.Add(-batchMemory(batch))
+			if len(w.free) >= 2 {
+				batch = nil // only two buffers keep their memory for reuse
+			}
+		}
+		w.free <- batch[:0]
+	}
+}
+
+// deliver writes batch to the sink, retrying with backoff while it fails
+// and has retries left (forever with onFailureBlock, until the writer is
+// aborted or the breaker opens), and settles a batch that still fails by
+// the failure policy. While the breaker is open batches are settled
+// without being attempted. A sink may have delivered part of a batch
+// before failing, so retries are at least once. Records the sink refused
+// one by one are dropped without a retry.
+func (w *batchWriter) deliver(batch []Record) {
+	ok, probe := w.breaker.allow(time.Now())
+	if !ok {
+		w.settle(batch, nil)
+		return
+	}
+	err := w.write(batch)
+	if w.rejected(err) {
+		return
+	}
+	backoff := w.retry.backoff
+	for attempt := 1; err != nil && !probe && w.breaker.closed() && (attempt <= w.retry.retries || w.retry.onFailure == onFailureBlock); attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+		}
+		if w.ctx.Err() != nil {
+			break
+		}
+		backoff = min(backoff*2, maxSinkBackoff)
+		w.stats.retries.Add(1)
+		if err = w.write(batch); err == nil || w.rejected(err) {
+			w.stats.recovered.Add(1)
+			return
+		}
+	}
+	if err != nil {
+		w.settle(batch, err)
+	}
+}
+
+// write writes batch to the sink once, keeping the breaker informed.
+// Records the sink refused one by one do not count against it.
+func (w *batchWriter) write(batch []Record) error {
+	err := w.sink.Write(w.ctx, batch)
+	failed := err
+	if errors.As(err, new(*rejectedError)) {
+		failed = nil
+	}
+	switch w.breaker.record(failed, time.Now()) {
+	case breakerFailing:
+		slog.Warn(fmt.Sprintf("Sink %s failing: %v", w.name, err), "sink", w.name, "error", err)
+	case breakerTripped:
+		slog.Warn(fmt.Sprintf("Sink %s: circuit breaker open after %d failures within %v, probing every %v: %v", w.name, w.breaker.threshold, w.breaker.window, w.breaker.probe, err),
+			"sink", w.name, "failures", w.breaker.threshold, "window", w.breaker.window.String(), "probe", w.breaker.probe.String(), "error", err)
+	case breakerRecovered:
+		slog.Info(fmt.Sprintf("Sink %s recovered", w.name), "sink", w.name)
+	}
+	return err
+}
+
+// settle deals with a batch that failed with err, or was not attempted
+// with the breaker open (err nil): it is dead-lettered or dropped, a
+// failed batch dropped counting as a write error.
+func (w *batchWriter) settle(batch []Record, err error) {
+	if w.dead != nil {
+		derr := w.dead.write(batch)
+		if derr == nil {
+			w.stats.deadLettered.Add(int64(len(batch)))
+			return
+		}
+		w.errs.Record(w.deadClass, derr)
+	}
+	w.stats.dropped.Add(int64(len(batch)))
+	if err != nil {
+		w.errs.Record(w.class, err)
+	}
+}
+
+// rejected settles a write that failed with a rejectedError: the records
+// the sink refused are dropped. It reports whether err was one.
+func (w *batchWriter) rejected(err error) bool {
+	var rej *rejectedError
+	if !errors.As(err, &rej) {
+		return false
+	}
+	w.stats.dropped.Add(int64(rej.records))
+	w.errs.Record(w.class, err)
+	return true
+}
+
+// Buffer returns an empty batch buffer, waiting for the writer to release
+// one if all are in use. With backpressureBuffer a buffer is added instead
+// while the queued batches are under the limit.
+func (w *batchWriter) Buffer(ctx context.Context) ([]Record, error) {
+	if w.bp.policy == backpressureBuffer {
+		if b, ok := w.TryBuffer(); ok {
+			return b, nil
+		}
+		if w.buffers.Load() < int64(cap(w.free)) && w.queued.Load() < w.bp.limit {
+			w.buffers.Add(1)
+			return nil, nil
+		}
+	}
+	return w.take(ctx)
+}
+
+// TryBuffer returns an empty batch buffer if one is free, without waiting.
+func (w *batchWriter) TryBuffer() ([]Record, bool) {
+	select {
+	case b := <-w.free:
+		return b, true
+	default:
+		return nil, false
+	}
+}
+
+// take waits for the writer to release a buffer.
+func (w *batchWriter) take(ctx context.Context) ([]Record, error) {
+	select {
+	case b := <-w.free:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Submit queues a filled buffer for writing.
+func (w *batchWriter) Submit(batch []Record) {
+	if w.bp.policy == backpressureBuffer {
+		w.queued.Add(batchMemory(batch))
+	}
+	w.full <- batch
+}
+
+// Flush waits until every batch submitted so far has been written. It
+// holds every buffer, which the writer only releases once done with them.
+func (w *batchWriter) Flush(ctx context.Context) error {
+	var held [][]Record
+	defer func() {
+		for _, b := range held {
+			w.free <- b
+		}
+	}()
+	for range w.buffers.Load() {
+		b, err := w.take(ctx)
+		if err != nil {
+			return err
+		}
+		held = append(held, b)
+	}
+	return nil
+}
+
+// Close waits for queued batches to be written. If ctx expires first,
+// in-flight writes are aborted, remaining batches are dropped and ctx's
+// error is returned. It does not close the sink.
+func (w *batchWriter) Close(ctx context.Context) error {
+	close(w.full)
+	defer w.cancel()
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+// fanOut writes every batch to several sinks. Each sink has its own
+// batchWriter, so sinks buffer and fail independently: a sink that rejects
+// a batch has the failure counted under its own name while the others carry
+// on. A sink slower than generation applies backpressure, by default
+// slowing generation rather than silently losing data.
+type fanOut struct {
+	sinks   []Sink
+	names   []string
+	writers []*batchWriter
+	errs    *errorBudget
+}
+
+// newFanOut starts a writer per sink, retrying and settling failed
+// batches as retry says and keeping up with slow sinks as bp says. names
+// label the sinks in error classes; with a single sink they are left out.
+func newFanOut(sinks []Sink, names []string, errs *errorBudget, retry sinkRetry, bp backpressure) *fanOut {
+	f := &fanOut{sinks: sinks, names: names, errs: errs}
+	if len(sinks) == 1 {
+		f.names = []string{""}
+	}
+	for i, sink := range sinks {
+		var dead *deadLetter
+		if retry.onFailure == onFailureDeadLetter {
+			dead = &deadLetter{path: retry.deadLetter}
+			if len(sinks) > 1 {
+				dead.path = shardPath(retry.deadLetter, i, len(sinks))
+			}
+		}
+		f.writers = append(f.writers, newBatchWriter(sink, f.names[i], names[i], errs, retry, dead, bp))
+	}
+	return f
+}
+
+// Write queues records for every sink, waiting for a free buffer on each,
+// or with backpressureDrop shedding them for a sink without one. The
+// records are copied, so the caller may reuse the slice.
+func (f *fanOut) Write(ctx context.Context, records []Record) error {
+	for _, w := range f.writers {
+		var batch []Record
+		if w.bp.policy == backpressureDrop {
+			var ok bool
+			if batch, ok = w.TryBuffer(); !ok {
+				w.stats.shed.Add(int64(len(records)))
+				continue
+			}
+		} else {
+			var err error
+			if batch, err = w.Buffer(ctx); err != nil {
+				return err
+			}
+		}
+		w.Submit(append(batch, records...))
+	}
+	return nil
+}
+
+// Flush waits until every sink has written the batches queued so far.
+func (f *fanOut) Flush(ctx context.Context) error {
+	for _, w := range f.writers {
+		if err := w.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliveries returns, per sink, the outcomes of its batches so far.
+func (f *fanOut) Deliveries() []deliveryCounts {
+	counts := make([]deliveryCounts, len(f.writers))
+	for i, w := range f.writers {
+		counts[i] = w.stats.counts()
+	}
+	return counts
+}
+
+// Health returns, per sink, the state of its circuit breaker.
+func (f *fanOut) Health() []sinkHealth {
+	health := make([]sinkHealth, len(f.writers))
+	for i, w := range f.writers {
+		health[i] = w.breaker.health()
+	}
+	return health
+}
+
+// Slots returns how many batch buffers each sink can queue.
+func (f *fanOut) Slots() int {
+	if len(f.writers) == 0 {
+		return 0
+	}
+	return cap(f.writers[0].free)
+}
+
+// Queued returns, per sink, how many batch buffers are queued or being
+// written: with both of its first two in use, the sink is behind.
+func (f *fanOut) Queued() []int {
+	queued := make([]int, len(f.writers))
+	for i, w := range f.writers {
+		queued[i] = int(w.buffers.Load()) - len(w.free)
+	}
+	return queued
+}
+
+// Close drains every writer and then closes every sink, all in parallel so
+// one stuck sink cannot use up the others' share of ctx. Failures are
+// counted in the error budget.
+func (f *fanOut) Close(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, w := range f.writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.Close(ctx); err != nil {
+				f.errs.Record(sinkErrClass(errClassWrite, f.names[i]), fmt.Errorf("queued batches dropped: %w", err))
+			}
+			if err := f.sinks[i].Close(ctx); err != nil {
+				f.errs.Record(sinkErrClass(errClassClose, f.names[i]), err)
+			}
+			if err := w.dead.close(); err != nil {
+				f.errs.Record(sinkErrClass(errClassDeadLetter, f.names[i]), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
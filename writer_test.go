@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink returns results in turn from its writes, then succeeds, and
+// records the batches it was given by their records' data. With gate set,
+// writes wait for it to be closed.
+type fakeSink struct {
+	results []error
+	gate    chan struct{}
+
+	mu      sync.Mutex
+	batches [][]string // every batch written, failed writes included
+	times   []time.Time
+}
+
+func (s *fakeSink) Write(ctx context.Context, batch []Record) error {
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, len(batch))
+	for i, rec := range batch {
+		ids[i] = string(rec.Data)
+	}
+	n := len(s.batches)
+	s.batches = append(s.batches, ids)
+	s.times = append(s.times, time.Now())
+	if n < len(s.results) {
+		return s.results[n]
+	}
+	return nil
+}
+
+func (s *fakeSink) Close(context.Context) error { return nil }
+
+func (s *fakeSink) written() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.batches)
+}
+
+// writeBatches submits each batch to w and closes it.
+func writeBatches(t *testing.T, w *batchWriter, batches ...[]string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, ids := range batches {
+		b, err := w.Buffer(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Submit(append(b, sinkRecords(ids...)...))
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.dead.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchWriterFailures(t *testing.T) {
+	errDown := errors.New("down")
+	rejected := &rejectedError{records: 1, err: errors.New("1 of 2 documents rejected")}
+	tests := []struct {
+		name    string
+		retry   sinkRetry
+		dead    string // dead-letter file name, "" for none
+		results []error
+		writes  int // sink writes, retries included
+		counts  deliveryCounts
+		errs    map[string]int64 // error budget counts by class
+		letters string           // dead-letter file contents
+	}{
+		{
+			name:   "written",
+			writes: 1,
+		},
+		{
+			name:    "recovered on a retry",
+			retry:   sinkRetry{retries: 2},
+			results: []error{errDown},
+			writes:  2,
+			counts:  deliveryCounts{Retries: 1, Recovered: 1},
+		},
+		{
+			name:    "dropped after its retries",
+			retry:   sinkRetry{retries: 2},
+			results: []error{errDown, errDown, errDown},
+			writes:  3,
+			counts:  deliveryCounts{Retries: 2, Dropped: 2},
+			errs:    map[string]int64{errClassWrite: 1},
+		},
+		{
+			name:    "blocked until written",
+			retry:   sinkRetry{onFailure: onFailureBlock},
+			results: []error{errDown, errDown, errDown},
+			writes:  4,
+			counts:  deliveryCounts{Retries: 3, Recovered: 1},
+		},
+		{
+			name:    "dead-lettered",
+			retry:   sinkRetry{retries: 1, onFailure: onFailureDeadLetter},
+			dead:    "dead.jsonl",
+			results: []error{errDown, errDown},
+			writes:  2,
+			counts:  deliveryCounts{Retries: 1, DeadLettered: 2},
+			letters: "a\nb\n",
+		},
+		{
+			name:    "dead letter fails",
+			retry:   sinkRetry{onFailure: onFailureDeadLetter},
+			dead:    "missing/dead.jsonl",
+			results: []error{errDown},
+			writes:  1,
+			counts:  deliveryCounts{Dropped: 2},
+			errs:    map[string]int64{errClassWrite: 1, errClassDeadLetter: 1},
+		},
+		{
+			name:    "rejected records are not retried",
+			retry:   sinkRetry{retries: 2},
+			results: []error{rejected},
+			writes:  1,
+			counts:  deliveryCounts{Dropped: 1},
+			errs:    map[string]int64{errClassWrite: 1},
+		},
+		{
+			name:    "rejected records on a retry",
+			retry:   sinkRetry{retries: 2},
+			results: []error{errDown, rejected},
+			writes:  2,
+			counts:  deliveryCounts{Retries: 1, Recovered: 1, Dropped: 1},
+			errs:    map[string]int64{errClassWrite: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.retry.backoff = time.Millisecond
+			var dead *deadLetter
+			if tt.dead != "" {
+				dead = &deadLetter{path: filepath.Join(t.TempDir(), tt.dead)}
+			}
+			sink := &fakeSink{results: tt.results}
+			errs := newErrorBudget(-1)
+			w := newBatchWriter(sink, "", "fake", errs, tt.retry, dead, backpressure{})
+			writeBatches(t, w, []string{"a", "b"})
+
+			if got := sink.written(); len(got) != tt.writes {
+				t.Errorf("%d writes, want %d", len(got), tt.writes)
+			}
+			if got := w.stats.counts(); got != tt.counts {
+				t.Errorf("counts %+v, want %+v", got, tt.counts)
+			}
+			if !maps.Equal(errs.counts, tt.errs) {
+				t.Errorf("errors %v, want %v", errs.counts, tt.errs)
+			}
+			if dead != nil {
+				data, _ := os.ReadFile(dead.path)
+				if string(data) != tt.letters {
+					t.Errorf("dead letters %q, want %q", data, tt.letters)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchWriterBackoff(t *testing.T) {
+	errDown := errors.New("down")
+	sink := &fakeSink{results: []error{errDown, errDown, errDown}}
+	backoff := 20 * time.Millisecond
+	w := newBatchWriter(sink, "", "fake", newErrorBudget(-1), sinkRetry{retries: 3, backoff: backoff}, nil, backpressure{})
+	writeBatches(t, w, []string{"a"})
+	if len(sink.times) != 4 {
+		t.Fatalf("%d writes, want 4", len(sink.times))
+	}
+	for i := 1; i < len(sink.times); i++ {
+		if gap := sink.times[i].Sub(sink.times[i-1]); gap < backoff {
+			t.Errorf("retry %d after %v, want at least %v", i, gap, backoff)
+		}
+		backoff *= 2
+	}
+}
+
+func TestBatchWriterCloseAborts(t *testing.T) {
+	// A sink that never answers: Close gives up once ctx expires and
+	// drops the batches still queued.
+	sink := &fakeSink{gate: make(chan struct{})}
+	w := newBatchWriter(sink, "s1", "fake", newErrorBudget(-1), sinkRetry{onFailure: onFailureBlock, backoff: time.Millisecond}, nil, backpressure{})
+	ctx := context.Background()
+	for range 2 {
+		b, err := w.Buffer(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Submit(append(b, sinkRecords("a")...))
+	}
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := w.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := sink.written(); len(got) != 0 {
+		t.Errorf("wrote %q after the writer was aborted", got)
+	}
+}
+
+func TestFanOutDeadLetterShards(t *testing.T) {
+	errDown := errors.New("down")
+	dir := t.TempDir()
+	sinks := []Sink{&fakeSink{results: []error{errDown}}, &fakeSink{}}
+	errs := newErrorBudget(-1)
+	retry := sinkRetry{backoff: time.Millisecond, onFailure: onFailureDeadLetter, deadLetter: filepath.Join(dir, "dead.jsonl")}
+	f := newFanOut(sinks, []string{"s0", "s1"}, errs, retry, backpressure{})
+	ctx := context.Background()
+	if err := f.Write(ctx, sinkRecords("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close(ctx)
+	want := []deliveryCounts{{DeadLettered: 2}, {}}
+	if got := f.Deliveries(); !slices.Equal(got, want) {
+		t.Errorf("deliveries %+v, want %+v", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dead-0.jsonl"))
+	if err != nil || string(data) != "a\nb\n" {
+		t.Errorf("dead-0.jsonl = %q, %v; want %q", data, err, "a\nb\n")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dead-1.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("dead-1.jsonl exists for a sink without failures")
+	}
+	if len(errs.counts) != 0 {
+		t.Errorf("errors %v, want none", errs.counts)
+	}
+}
+
+// fillWriter has w take a buffer and submit a one-record batch n times,
+// failing if a buffer is not available at once.
+func fillWriter(t *testing.T, w *batchWriter, n int) {
+	t.Helper()
+	for range n {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		b, err := w.Buffer(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Submit(append(b, sinkRecords("a")...))
+	}
+}
+
+// bufferWaits reports whether w.Buffer waits for the writer.
+func bufferWaits(w *batchWriter) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := w.Buffer(ctx)
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func TestBatchWriterBackpressure(t *testing.T) {
+	batch := batchMemory(sinkRecords("a"))
+	tests := []struct {
+		name    string
+		bp      backpressure
+		fill    int // batches taken without waiting before Buffer waits
+		buffers int64
+	}{
+		{name: "slow", bp: backpressure{policy: backpressureSlow}, fill: 2, buffers: 2},
+		{name: "buffer up to the limit", bp: backpressure{policy: backpressureBuffer, limit: 3*batch + 1}, fill: 4, buffers: 4},
+		{name: "buffer limit below two batches", bp: backpressure{policy: backpressureBuffer, limit: 1}, fill: 2, buffers: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{gate: make(chan struct{})}
+			w := newBatchWriter(sink, "", "fake", newErrorBudget(-1), sinkRetry{backoff: time.Millisecond}, nil, tt.bp)
+			fillWriter(t, w, tt.fill)
+			if !bufferWaits(w) {
+				t.Errorf("Buffer did not wait after %d batches", tt.fill)
+			}
+			if got := w.buffers.Load(); got != tt.buffers {
+				t.Errorf("%d buffers, want %d", got, tt.buffers)
+			}
+			if tt.bp.policy == backpressureBuffer {
+				if got, want := w.queued.Load(), int64(tt.fill)*batch; got != want {
+					t.Errorf("queued %d bytes, want %d", got, want)
+				}
+			}
+
+			close(sink.gate)
+			ctx := context.Background()
+			if err := w.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.queued.Load(); got != 0 {
+				t.Errorf("queued %d bytes once flushed, want 0", got)
+			}
+			if got := len(w.free); int64(got) != tt.buffers {
+				t.Errorf("%d free buffers once flushed, want %d", got, tt.buffers)
+			}
+			if err := w.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(sink.written()); got != tt.fill {
+				t.Errorf("%d batches written, want %d", got, tt.fill)
+			}
+		})
+	}
+}
+
+func TestFanOutShedsForSlowSink(t *testing.T) {
+	slow := &fakeSink{gate: make(chan struct{})}
+	fast := &fakeSink{}
+	f := newFanOut([]Sink{slow, fast}, []string{"slow", "fast"}, newErrorBudget(-1), sinkRetry{backoff: time.Millisecond}, backpressure{policy: backpressureDrop})
+	ctx := context.Background()
+	for range 5 {
+		if err := f.Write(ctx, sinkRecords("a", "b")); err != nil {
+			t.Fatal(err)
+		}
+		// The fast sink keeps up.
+		if err := f.writers[1].Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.Queued(); got[0] != 2 {
+		t.Errorf("slow sink has %d buffers queued, want 2", got[0])
+	}
+	close(slow.gate)
+	f.Close(ctx)
+	want := []deliveryCounts{{Shed: 6}, {}}
+	if got := f.Deliveries(); !slices.Equal(got, want) {
+		t.Errorf("deliveries %+v, want %+v", got, want)
+	}
+	if got := len(slow.written()); got != 2 {
+		t.Errorf("slow sink wrote %d batches, want 2", got)
+	}
+	if got := len(fast.written()); got != 5 {
+		t.Errorf("fast sink wrote %d batches, want 5", got)
+	}
+}
+
+func TestBatchWriterBreaker(t *testing.T) {
+	// The breaker opens on the first retry, which is not followed by
+	// another; later batches are dropped without being attempted.
+	errDown := errors.New("down")
+	sink := &fakeSink{results: []error{errDown, errDown}}
+	errs := newErrorBudget(-1)
+	retry := sinkRetry{retries: 5, backoff: time.Millisecond, breakerFailures: 2, breakerWindow: time.Minute, breakerProbe: time.Hour}
+	w := newBatchWriter(sink, "", "fake", errs, retry, nil, backpressure{})
+	writeBatches(t, w, []string{"a", "b"}, []string{"c"}, []string{"d"})
+	if got := len(sink.written()); got != 2 {
+		t.Errorf("%d writes, want 2", got)
+	}
+	if got, want := w.stats.counts(), (deliveryCounts{Retries: 1, Dropped: 4}); got != want {
+		t.Errorf("counts %+v, want %+v", got, want)
+	}
+	// Batches not attempted are not write errors.
+	if got := errs.counts[errClassWrite]; got != 1 {
+		t.Errorf("%d write errors, want 1", got)
+	}
+	h := w.breaker.health()
+	if h.State != sinkOpen || h.Trips != 1 || h.Failures != 2 || h.LastError != "down" {
+		t.Errorf("health %+v, want open after 1 trip and 2 failures", h)
+	}
+}
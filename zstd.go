@@ -0,0 +1,721 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// zstdWriter compresses to a Zstandard frame (RFC 8878), so that the
+// compress benchmark can report zstd while sensor-gen keeps to the
+// standard library. It is a fast-level encoder: greedy hash-table
+// matching like snappyEncode over a 1 MiB window, preferring repeat
+// offsets, then Huffman-coded literals and sequences coded with FSE
+// tables fitted to each block. Literals of more than 129 distinct byte
+// values, which would need their Huffman weights FSE-coded, stay raw.
+type zstdWriter struct {
+	w     io.Writer
+	buf   []byte // the window followed by the input not yet compressed
+	pos   int    // start of the input not yet compressed in buf
+	base  int    // stream offset of buf[0]
+	table []int  // stream offset+1 of the last prefix with each hash
+	lits  []byte
+	seqs  []zstdSeq
+	codes [][3]uint8 // each sequence's literals length, match length and offset codes
+	rep   [3]int     // the repeat offsets, most recent first
+	out   []byte
+	begun bool
+}
+
+const (
+	zstdWindowLog = 20
+	zstdBlockSize = 128 << 10
+	zstdHashLog   = 16
+)
+
+// zstdHash hashes the 8 bytes a match must start with; shorter matches,
+// which runs of digits are full of, cost more than they save.
+func zstdHash(prefix uint64) int {
+	return int((prefix * 0x9e3779b97f4a7c15) >> (64 - zstdHashLog))
+}
+
+// zstdSeq is a sequence: lit literals, then a match of match bytes. The
+// offset is coded as zstd's offset value: 1 to 3 for a repeat offset,
+// otherwise the distance back plus 3.
+type zstdSeq struct {
+	lit, match, offset int
+}
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, table: make([]int, 1<<zstdHashLog), rep: [3]int{1, 4, 8}}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	z.buf = append(z.buf, p...)
+	for len(z.buf)-z.pos >= zstdBlockSize {
+		if err := z.block(z.pos+zstdBlockSize, false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close compresses the rest of the input and ends the frame. It does not
+// close the underlying writer.
+func (z *zstdWriter) Close() error {
+	return z.block(len(z.buf), true)
+}
+
+// block compresses buf[pos:end] as a block, stored raw if that is smaller.
+func (z *zstdWriter) block(end int, last bool) error {
+	z.out = z.out[:0]
+	if !z.begun {
+		// No checksum, content size or dictionary; the window descriptor's
+		// exponent is the window log less 10.
+		z.out = append(z.out, 0x28, 0xb5, 0x2f, 0xfd, 0, (zstdWindowLog-10)<<3)
+		z.begun = true
+	}
+	src := z.buf[z.pos:end]
+	rep := z.rep
+	z.match(end)
+	hdr := len(z.out)
+	z.out = append(z.out, 0, 0, 0)
+	z.out = zstdLiterals(z.out, z.lits)
+	z.out = z.sequences(z.out)
+	typ, size := 2, len(z.out)-hdr-3
+	if size >= len(src) {
+		z.out = append(z.out[:hdr+3], src...)
+		typ, size = 0, len(src)
+		z.rep = rep // a raw block leaves the decoder's unchanged
+	}
+	h := uint32(size)<<3 | uint32(typ)<<1
+	if last {
+		h |= 1
+	}
+	z.out[hdr], z.out[hdr+1], z.out[hdr+2] = byte(h), byte(h>>8), byte(h>>16)
+	if _, err := z.w.Write(z.out); err != nil {
+		return err
+	}
+
+	z.pos = end
+	if z.pos >= 2<<zstdWindowLog { // drop what has left the window
+		drop := z.pos - 1<<zstdWindowLog
+		z.buf = z.buf[:copy(z.buf, z.buf[drop:])]
+		z.pos -= drop
+		z.base += drop
+	}
+	return nil
+}
+
+// match splits buf[pos:end] into sequences and trailing literals.
+func (z *zstdWriter) match(end int) {
+	z.lits, z.seqs = z.lits[:0], z.seqs[:0]
+	buf := z.buf
+	lit := z.pos
+	for i := z.pos; i+8 <= end; {
+		cur := binary.LittleEndian.Uint64(buf[i:])
+		h := zstdHash(cur)
+		cand := z.table[h] - 1 - z.base
+		z.table[h] = z.base + i + 1
+		n := 0
+		if cand >= 0 && i-cand <= 1<<zstdWindowLog && binary.LittleEndian.Uint64(buf[cand:]) == cur {
+			n = zstdMatchLen(buf[cand:], buf[i:end])
+		}
+		// A repeat offset is cheaper to code, so a shorter match there will
+		// do, and a longer one is better still.
+		if i > lit {
+			for _, r := range z.rep {
+				if r > i {
+					continue
+				}
+				if m := zstdMatchLen(buf[i-r:], buf[i:end]); m >= 4 && m+2 > n {
+					cand, n = i-r, m
+					break
+				}
+			}
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		for i > lit && cand > 0 && buf[i-1] == buf[cand-1] {
+			i, cand, n = i-1, cand-1, n+1
+		}
+		z.seqs = append(z.seqs, zstdSeq{lit: i - lit, match: n, offset: z.offsetValue(i-cand, i-lit)})
+		z.lits = append(z.lits, buf[lit:i]...)
+		i += n
+		lit = i
+		for j := i - n + 1; j < i && j+8 <= end; j++ { // later matches may start inside this one
+			z.table[zstdHash(binary.LittleEndian.Uint64(buf[j:]))] = z.base + j + 1
+		}
+	}
+	z.lits = append(z.lits, buf[lit:end]...)
+}
+
+// zstdMatchLen returns the length of the common prefix of a and b.
+func zstdMatchLen(a, b []byte) int {
+	n := 0
+	for n+8 <= len(a) && n+8 <= len(b) {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// offsetValue returns the offset value coding a match offset back after
+// lit literals, updating the repeat offsets as the decoder will. Without
+// literals, the values shift by one: the last offset is not repeated
+// straight away.
+func (z *zstdWriter) offsetValue(offset, lit int) int {
+	r := &z.rep
+	if lit > 0 {
+		switch offset {
+		case r[0]:
+			return 1
+		case r[1]:
+			r[0], r[1] = r[1], r[0]
+			return 2
+		case r[2]:
+			r[0], r[1], r[2] = r[2], r[0], r[1]
+			return 3
+		}
+	} else {
+		switch offset {
+		case r[1]:
+			r[0], r[1] = r[1], r[0]
+			return 1
+		case r[2]:
+			r[0], r[1], r[2] = r[2], r[0], r[1]
+			return 2
+		case r[0] - 1:
+			r[0], r[1], r[2] = offset, r[0], r[1]
+			return 3
+		}
+	}
+	r[0], r[1], r[2] = offset, r[0], r[1]
+	return offset + 3
+}
+
+// zstdLiterals appends the literals section: lits Huffman-coded when that
+// is possible and smaller, else run-length or raw.
+func zstdLiterals(dst, lits []byte) []byte {
+	var hist [256]int
+	maxSym, distinct := 0, 0
+	for _, b := range lits {
+		if hist[b] == 0 {
+			distinct++
+		}
+		hist[b]++
+		maxSym = max(maxSym, int(b))
+	}
+	switch {
+	case distinct == 1 && len(lits) > 1:
+		return append(zstdLiteralsHeader(dst, 1, len(lits)), lits[0])
+	case distinct < 2 || len(lits) < 64 || maxSym > 128:
+		// Weights of more than 128 symbols need FSE-coding.
+		return append(zstdLiteralsHeader(dst, 0, len(lits)), lits...)
+	}
+
+	nbits := huffmanLengths(hist[:maxSym+1], 11)
+	tableLog := uint8(0)
+	for _, n := range nbits {
+		tableLog = max(tableLog, n)
+	}
+	// The tree is the weights, tableLog+1 less the code lengths, of all
+	// but the last symbol, four bits each.
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+	tree := len(dst)
+	dst = append(dst, byte(127+maxSym))
+	for s := 0; s < maxSym; s += 2 {
+		b := zstdWeight(nbits[s], tableLog) << 4
+		if s+1 < maxSym {
+			b |= zstdWeight(nbits[s+1], tableLog)
+		}
+		dst = append(dst, b)
+	}
+	// Codes go to symbols by increasing weight, then symbol.
+	var next [12]uint32
+	var total uint32
+	for w := uint8(1); w <= tableLog; w++ {
+		next[w] = total
+		for _, n := range nbits {
+			if n > 0 && zstdWeight(n, tableLog) == w {
+				total += 1 << (w - 1)
+			}
+		}
+	}
+	codes := make([]uint32, len(nbits))
+	for s, n := range nbits {
+		if n > 0 {
+			w := zstdWeight(n, tableLog)
+			codes[s] = next[w] >> (w - 1)
+			next[w] += 1 << (w - 1)
+		}
+	}
+
+	sizeFormat := 0
+	if len(lits) <= 1023 {
+		dst = huffmanStream(dst, lits, codes, nbits)
+	} else {
+		// Four streams, after a jump table of the first three's sizes.
+		sizeFormat = 3
+		if len(lits) <= 16383 {
+			sizeFormat = 2
+		}
+		jump := len(dst)
+		dst = append(dst, 0, 0, 0, 0, 0, 0)
+		seg := (len(lits) + 3) / 4
+		for i := range 4 {
+			from := len(dst)
+			dst = huffmanStream(dst, lits[i*seg:min((i+1)*seg, len(lits))], codes, nbits)
+			if i < 3 {
+				binary.LittleEndian.PutUint16(dst[jump+2*i:], uint16(len(dst)-from))
+			}
+		}
+	}
+	size := len(dst) - tree
+	hdr := 3 + max(sizeFormat-1, 0)
+	if size+hdr >= len(lits)+3 || sizeFormat == 0 && size > 1023 {
+		return append(zstdLiteralsHeader(dst[:start], 0, len(lits)), lits...)
+	}
+	shift := []int{14, 14, 18, 22}[sizeFormat]
+	h := uint64(2) | uint64(sizeFormat)<<2 | uint64(len(lits))<<4 | uint64(size)<<shift
+	for i := range hdr {
+		dst[start+i] = byte(h >> (8 * i))
+	}
+	return append(dst[:start+hdr], dst[start+5:]...)
+}
+
+// zstdLiteralsHeader appends the header of raw (typ 0) or run-length
+// (typ 1) literals.
+func zstdLiteralsHeader(dst []byte, typ, n int) []byte {
+	switch {
+	case n < 32:
+		return append(dst, byte(typ|n<<3))
+	case n < 4096:
+		return append(dst, byte(typ|1<<2|n<<4), byte(n>>4))
+	default:
+		return append(dst, byte(typ|3<<2|n<<4), byte(n>>4), byte(n>>12))
+	}
+}
+
+func zstdWeight(nbits, tableLog uint8) uint8 {
+	if nbits == 0 {
+		return 0
+	}
+	return tableLog + 1 - nbits
+}
+
+// huffmanLengths returns the code length of each symbol of a Huffman code
+// for hist, 0 for the absent ones, halving the counts until no code is
+// longer than limit.
+func huffmanLengths(hist []int, limit uint8) []uint8 {
+	freq := make([]int, len(hist))
+	copy(freq, hist)
+	nbits := make([]uint8, len(hist))
+	for {
+		// Leaves by increasing count, then the internal nodes in the order
+		// made, which is by increasing count too.
+		var leaves []int
+		for s, f := range freq {
+			if f > 0 {
+				leaves = append(leaves, s)
+			}
+		}
+		slices.SortStableFunc(leaves, func(a, b int) int { return freq[a] - freq[b] })
+		k := len(leaves)
+		count := make([]int, 2*k-1)
+		parent := make([]int, 2*k-1)
+		for i, s := range leaves {
+			count[i] = freq[s]
+		}
+		i, j := 0, k
+		pick := func(next int) int {
+			if i < k && (j >= next || count[i] <= count[j]) {
+				i++
+				return i - 1
+			}
+			j++
+			return j - 1
+		}
+		for next := k; next < 2*k-1; next++ {
+			a, b := pick(next), pick(next)
+			count[next] = count[a] + count[b]
+			parent[a], parent[b] = next, next
+		}
+		depth := make([]uint8, 2*k-1)
+		longest := uint8(0)
+		for n := 2*k - 3; n >= 0; n-- {
+			depth[n] = depth[parent[n]] + 1
+			longest = max(longest, depth[n])
+		}
+		if longest <= limit {
+			for i, s := range leaves {
+				nbits[s] = depth[i]
+			}
+			return nbits
+		}
+		for s := range freq {
+			if freq[s] > 0 {
+				freq[s] = (freq[s] + 1) / 2
+			}
+		}
+	}
+}
+
+// huffmanStream appends lits Huffman-coded as a zstd bitstream, which is
+// read from its end, so the last literal goes in first.
+func huffmanStream(dst, lits []byte, codes []uint32, nbits []uint8) []byte {
+	bw := zstdBits{b: dst}
+	for i := len(lits) - 1; i >= 0; i-- {
+		bw.add(uint64(codes[lits[i]]), uint(nbits[lits[i]]))
+	}
+	return bw.close()
+}
+
+// sequences appends the sequences section. As with literals, the last
+// sequence goes in first.
+func (z *zstdWriter) sequences(dst []byte) []byte {
+	n := len(z.seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7f00:
+		dst = append(dst, byte(n>>8+128), byte(n))
+	default:
+		dst = append(dst, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if n == 0 {
+		return dst
+	}
+
+	z.codes = z.codes[:0]
+	var llHist [len(zstdLLBase)]int
+	var mlHist [len(zstdMLBase)]int
+	var ofHist [32]int
+	for _, s := range z.seqs {
+		c := [3]uint8{
+			uint8(zstdCode(zstdLLBase[:], s.lit)),
+			uint8(zstdCode(zstdMLBase[:], s.match)),
+			uint8(bits.Len(uint(s.offset)) - 1),
+		}
+		llHist[c[0]]++
+		mlHist[c[1]]++
+		ofHist[c[2]]++
+		z.codes = append(z.codes, c)
+	}
+	modes := len(dst)
+	dst = append(dst, 0)
+	var ll, of, ml *fseTable
+	var mode byte
+	dst, ll, mode = zstdSequenceTable(dst, llHist[:], n, zstdLLTable, 9)
+	dst[modes] |= mode << 6
+	dst, of, mode = zstdSequenceTable(dst, ofHist[:], n, zstdOFTable, 8)
+	dst[modes] |= mode << 4
+	dst, ml, mode = zstdSequenceTable(dst, mlHist[:], n, zstdMLTable, 9)
+	dst[modes] |= mode << 2
+
+	bw := zstdBits{b: dst}
+	var llState, ofState, mlState uint32
+	for i := n - 1; i >= 0; i-- {
+		s, c := z.seqs[i], z.codes[i]
+		llCode, mlCode, ofCode := int(c[0]), int(c[1]), int(c[2])
+		if i == n-1 {
+			mlState = ml.init(mlCode)
+			ofState = of.init(ofCode)
+			llState = ll.init(llCode)
+		} else {
+			of.encode(&bw, &ofState, ofCode)
+			ml.encode(&bw, &mlState, mlCode)
+			ll.encode(&bw, &llState, llCode)
+		}
+		bw.add(uint64(s.lit-int(zstdLLBase[llCode])), uint(zstdLLBits[llCode]))
+		bw.add(uint64(s.match-int(zstdMLBase[mlCode])), uint(zstdMLBits[mlCode]))
+		bw.add(uint64(s.offset), uint(ofCode))
+	}
+	bw.add(uint64(mlState), ml.log)
+	bw.add(uint64(ofState), of.log)
+	bw.add(uint64(llState), ll.log)
+	return bw.close()
+}
+
+// zstdSequenceTable picks the cheapest table for the n codes counted in
+// hist: a single repeated code (mode 1), the predefined table (mode 0) or
+// one fitted to hist (mode 2), whose description it appends.
+func zstdSequenceTable(dst []byte, hist []int, n int, predefined *fseTable, maxLog uint) ([]byte, *fseTable, byte) {
+	maxSym := 0
+	for s, c := range hist {
+		if c == n {
+			return append(dst, byte(s)), &fseTable{}, 1
+		}
+		if c > 0 {
+			maxSym = s
+		}
+	}
+	log := min(maxLog, max(5, uint(bits.Len(uint(maxSym)))+1, uint(bits.Len(uint(n)))-2))
+	norm := fseNormalize(hist[:maxSym+1], n, log)
+	desc := fseDescription(nil, norm, log)
+	if fseCost(hist, predefined.norm, predefined.log) <= fseCost(hist, norm, log)+float64(8*len(desc)) {
+		return dst, predefined, 0
+	}
+	return append(dst, desc...), newFSETable(log, norm), 2
+}
+
+// fseCost estimates the bits to code the symbols counted in hist with the
+// distribution norm, infinite if it lacks one of them.
+func fseCost(hist []int, norm []int16, log uint) float64 {
+	bitsUsed := 0.0
+	for s, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		bitsUsed += float64(c) * (float64(log) - math.Log2(math.Abs(float64(norm[s]))))
+	}
+	return bitsUsed
+}
+
+// fseNormalize scales the counts in hist, totalling n, to probabilities
+// totalling 1<<log, none of a present symbol below 1.
+func fseNormalize(hist []int, n int, log uint) []int16 {
+	size := 1 << log
+	norm := make([]int16, len(hist))
+	sum, largest := 0, 0
+	for s, c := range hist {
+		if c == 0 {
+			continue
+		}
+		p := max((c*size+n/2)/n, 1)
+		norm[s] = int16(p)
+		sum += p
+		if norm[s] > norm[largest] {
+			largest = s
+		}
+	}
+	if sum <= size {
+		norm[largest] += int16(size - sum)
+		return norm
+	}
+	for ; sum > size; sum-- { // take the excess from the most probable
+		for s := range norm {
+			if norm[s] > norm[largest] {
+				largest = s
+			}
+		}
+		norm[largest]--
+	}
+	return norm
+}
+
+// fseDescription appends the description of a distribution as zstd reads
+// it: the accuracy log, then each probability plus one in as few bits as
+// the probability still to be assigned allows, with runs of zero
+// probabilities coded in 2-bit repeat flags.
+func fseDescription(dst []byte, norm []int16, log uint) []byte {
+	bw := zstdBits{b: dst}
+	bw.add(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbits := log + 1
+	for s := 0; s < len(norm) && remaining > 1; {
+		if s > 0 && norm[s-1] == 0 {
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+			for ; s >= start+24; start += 24 {
+				bw.add(0xffff, 16)
+			}
+			for ; s >= start+3; start += 3 {
+				bw.add(3, 2)
+			}
+			bw.add(uint64(s-start), 2)
+		}
+		p := int(norm[s])
+		s++
+		limit := 2*threshold - 1 - remaining
+		remaining -= max(p, -p)
+		v := p + 1
+		if v >= threshold {
+			v += limit
+		}
+		if v < limit {
+			bw.add(uint64(v), nbits-1)
+		} else {
+			bw.add(uint64(v), nbits)
+		}
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if bw.n > 0 {
+		bw.b = append(bw.b, byte(bw.acc))
+	}
+	return bw.b
+}
+
+// zstdCode returns the code of v: the last whose baseline it reaches.
+func zstdCode(base []uint32, v int) int {
+	c := len(base) - 1
+	for int(base[c]) > v {
+		c--
+	}
+	return c
+}
+
+var (
+	zstdLLBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLLBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMLBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMLBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	// The predefined distributions; -1 is a probability below one.
+	zstdLLTable = newFSETable(6, []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	})
+	zstdMLTable = newFSETable(6, []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	})
+	zstdOFTable = newFSETable(5, []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	})
+)
+
+// fseTable encodes symbols with a finite state entropy table, as zstd's
+// reference encoder does.
+type fseTable struct {
+	log    uint // 0 for a single repeated symbol, which takes no bits
+	norm   []int16
+	states []uint32 // next state, by symbol then occurrence
+	// Per symbol: the bits to emit are (state+deltaBits)>>16, and the next
+	// state is states[state>>nbits+deltaState].
+	deltaBits  []uint32
+	deltaState []int
+}
+
+func newFSETable(log uint, norm []int16) *fseTable {
+	size := 1 << log
+	t := &fseTable{log: log, norm: norm, states: make([]uint32, size), deltaBits: make([]uint32, len(norm)), deltaState: make([]int, len(norm))}
+	// Spread the symbols over the table, those below one at the end.
+	symbols := make([]int, size)
+	cumul := make([]int, len(norm)+1)
+	high := size - 1
+	for s, p := range norm {
+		if p == -1 {
+			cumul[s+1] = cumul[s] + 1
+			symbols[high] = s
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(p)
+		}
+	}
+	step, pos := size>>1+size>>3+3, 0
+	for s, p := range norm {
+		for range max(p, 0) {
+			symbols[pos] = s
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	next := slices.Clone(cumul)
+	for u, s := range symbols {
+		t.states[next[s]] = uint32(size + u)
+		next[s]++
+	}
+	for s, p := range norm {
+		switch p {
+		case 0:
+		case -1, 1:
+			t.deltaBits[s] = uint32(log<<16 - uint(size))
+			t.deltaState[s] = cumul[s] - 1
+		default:
+			maxBits := log - uint(bits.Len(uint(p-1))-1)
+			t.deltaBits[s] = uint32(maxBits<<16) - uint32(int(p)<<maxBits)
+			t.deltaState[s] = cumul[s] - int(p)
+		}
+	}
+	return t
+}
+
+// init returns the state to start with when the first symbol encoded is s.
+func (t *fseTable) init(s int) uint32 {
+	if t.log == 0 {
+		return 0
+	}
+	n := (t.deltaBits[s] + 1<<15) >> 16
+	v := n<<16 - t.deltaBits[s]
+	return t.states[int(v>>n)+t.deltaState[s]]
+}
+
+// encode emits the bits taking state to one that decodes s.
+func (t *fseTable) encode(bw *zstdBits, state *uint32, s int) {
+	if t.log == 0 {
+		return
+	}
+	n := (*state + t.deltaBits[s]) >> 16
+	bw.add(uint64(*state), uint(n))
+	*state = t.states[int(*state>>n)+t.deltaState[s]]
+}
+
+// zstdBits writes a bitstream of the kind zstd reads backwards: bits
+// fill each byte from the least significant, and a final 1 bit marks the
+// end.
+type zstdBits struct {
+	b   []byte
+	acc uint64
+	n   uint
+}
+
+// add appends the low n bits of v.
+func (w *zstdBits) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.b = append(w.b, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *zstdBits) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.b = append(w.b, byte(w.acc))
+	}
+	return w.b
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+// TestZstdRoundTrip decompresses zstdWriter's frames with the zstd
+// command, skipping if it is not installed.
+func TestZstdRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	rng.Read(random)
+	var jsonl []byte
+	for _, r := range testReadings(t, 12000) { // past two windows, so the window slides
+		b, _ := json.Marshal(r)
+		jsonl = append(append(jsonl, b...), '\n')
+	}
+	digits := make([]byte, 200000)
+	for i := range digits {
+		digits[i] = '0' + byte(rng.Intn(10))
+	}
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"one byte repeated", bytes.Repeat([]byte{'x'}, 300000)},
+		{"repeated", bytes.Repeat([]byte("sensor-gen "), 30000)},
+		{"random", random},
+		{"digits", digits},
+		{"jsonl", jsonl},
+		{"mixed", append(append(bytes.Clone(jsonl[:200000]), random[:50000]...), jsonl[:100000]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var enc bytes.Buffer
+			zw := newZstdWriter(&enc)
+			for src := tt.src; len(src) > 0; { // in uneven writes
+				n := min(len(src), 70001)
+				if _, err := zw.Write(src[:n]); err != nil {
+					t.Fatal(err)
+				}
+				src = src[n:]
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("zstd", "-d", "-c")
+			cmd.Stdin = &enc
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d: %v: %s", err, &stderr)
+			}
+			if !bytes.Equal(got, tt.src) {
+				t.Fatalf("round trip differs: %d bytes in, %d out", len(tt.src), len(got))
+			}
+			if tt.name == "jsonl" && enc.Len() > len(tt.src)/5 {
+				t.Errorf("JSONL compressed to only %d of %d bytes", enc.Len(), len(tt.src))
+			}
+		})
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// Fibonacci counts make a Huffman code as deep as it can be.
+	fib := make([]int, 20)
+	fib[0], fib[1] = 1, 1
+	for i := 2; i < len(fib); i++ {
+		fib[i] = fib[i-1] + fib[i-2]
+	}
+	tests := []struct {
+		name string
+		hist []int
+	}{
+		{"two", []int{5, 0, 1}},
+		{"even", []int{3, 3, 3, 3, 3, 3, 3, 3}},
+		{"skewed", []int{1000, 1, 1, 1, 500, 0, 2}},
+		{"fibonacci", fib},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nbits := huffmanLengths(tt.hist, 11)
+			kraft := 0.0
+			for s, n := range nbits {
+				if (n == 0) != (tt.hist[s] == 0) || n > 11 {
+					t.Fatalf("symbol %d (count %d) has a %d-bit code", s, tt.hist[s], n)
+				}
+				if n > 0 {
+					kraft += 1 / float64(uint(1)<<n)
+				}
+			}
+			if kraft != 1 {
+				t.Errorf("code lengths %v are not a complete code", nbits)
+			}
+		})
+	}
+}